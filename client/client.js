@@ -4,17 +4,23 @@
  * Tunnel Client - WebSocket-based tunneling client
  *
  * Usage:
- *   node client.js [subdomain] [local-port]
+ *   node client.js [--json] [subdomain] [local-port]
  *
  * Examples:
  *   node client.js myapp 3000           # Custom subdomain
  *   node client.js - 3000                # Random subdomain
+ *   node client.js --json - 3000         # Print the tunnel as one JSON line on stdout
  *
  * Environment variables (or use .env file):
  *   TUNNEL_SERVER - Tunnel server URL (default: ws://localhost:8080/tunnel)
  *   SUBDOMAIN     - Default subdomain (can be overridden by CLI arg)
  *   LOCAL_PORT    - Default local port (can be overridden by CLI arg)
  *   LOCAL_HOST    - Local host (default: localhost)
+ *   OUTPUT        - Set to "json" for the same effect as --json
+ *
+ * With --json, the only thing written to stdout is a single line like
+ *   {"tunnel_id":"...","subdomain":"myapp","url":"https://myapp.example.com"}
+ * once the tunnel is registered. Human-readable output goes to stderr.
  */
 
 // Load environment variables from .env file
@@ -23,22 +29,28 @@ require('dotenv').config();
 const WebSocket = require('ws');
 const http = require('http');
 
+// Machine-readable output keeps stdout free for the registration result
+const jsonOutput = process.argv.includes('--json') || process.env.OUTPUT === 'json';
+const args = process.argv.slice(2).filter((arg) => arg !== '--json');
+const log = jsonOutput ? console.error : console.log;
+
 // Configuration - prioritize CLI args, then env vars, then defaults
 const TUNNEL_SERVER = process.env.TUNNEL_SERVER || 'ws://localhost:8080/tunnel';
-const subdomain = process.argv[2] === '-' ? '' : (process.argv[2] || process.env.SUBDOMAIN || '');
-const localPort = parseInt(process.argv[3] || process.env.LOCAL_PORT || '3000');
+const subdomain = args[0] === '-' ? '' : (args[0] || process.env.SUBDOMAIN || '');
+const localPort = parseInt(args[1] || process.env.LOCAL_PORT || '3000');
 const localHost = process.env.LOCAL_HOST || 'localhost';
+let registered = false;
 
-console.log('🚀 Starting tunnel client...');
-console.log(`📍 Server: ${TUNNEL_SERVER}`);
-console.log(`🏠 Local: http://${localHost}:${localPort}`);
-console.log(`🏷️  Subdomain: ${subdomain || '(random)'}\n`);
+log('🚀 Starting tunnel client...');
+log(`📍 Server: ${TUNNEL_SERVER}`);
+log(`🏠 Local: http://${localHost}:${localPort}`);
+log(`🏷️  Subdomain: ${subdomain || '(random)'}\n`);
 
 // Connect to tunnel server
 const ws = new WebSocket(TUNNEL_SERVER);
 
 ws.on('open', () => {
-  console.log('✅ Connected to tunnel server');
+  log('✅ Connected to tunnel server');
 
   // Register tunnel
   const registerMsg = {
@@ -52,7 +64,7 @@ ws.on('open', () => {
   };
 
   ws.send(JSON.stringify(registerMsg));
-  console.log('📤 Sent registration request...');
+  log('📤 Sent registration request...');
 });
 
 ws.on('message', (data, isBinary) => {
@@ -68,21 +80,29 @@ ws.on('message', (data, isBinary) => {
 
     if (msg.type === 'success') {
       const info = msg.data;
-      console.log('\n✨ Tunnel created successfully!');
-      console.log(`━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━`);
-      console.log(`🌐 Public URL: https://${info.full_domain}`);
-      console.log(`📌 Subdomain: ${info.subdomain}`);
-      console.log(`🔗 Forwarding to: ${info.local_addr}`);
-      console.log(`━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n`);
-      console.log('💡 Press Ctrl+C to stop the tunnel');
+      if (jsonOutput && !registered) {
+        process.stdout.write(JSON.stringify({
+          tunnel_id: info.tunnel_id,
+          subdomain: info.subdomain,
+          url: `https://${info.full_domain}`
+        }) + '\n');
+      }
+      registered = true;
+      log('\n✨ Tunnel created successfully!');
+      log(`━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━`);
+      log(`🌐 Public URL: https://${info.full_domain}`);
+      log(`📌 Subdomain: ${info.subdomain}`);
+      log(`🔗 Forwarding to: ${info.local_addr}`);
+      log(`━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n`);
+      log('💡 Press Ctrl+C to stop the tunnel');
     } else if (msg.type === 'error') {
       console.error(`❌ Error: ${msg.error}`);
       process.exit(1);
     } else if (msg.type === 'pong') {
       // Pong received - connection is alive
-      console.log('🏓 Pong received');
+      log('🏓 Pong received');
     } else {
-      console.log(`📨 Received message type: ${msg.type}`);
+      log(`📨 Received message type: ${msg.type}`);
     }
   } catch (err) {
     console.error(`❌ Failed to parse message: ${err.message}`);
@@ -94,13 +114,13 @@ ws.on('error', (err) => {
 });
 
 ws.on('close', () => {
-  console.log('👋 Disconnected from tunnel server');
+  log('👋 Disconnected from tunnel server');
   process.exit(0);
 });
 
 // Handle incoming HTTP traffic from tunnel
 function handleHttpTraffic(data) {
-  console.log(`📥 Received HTTP traffic (${data.length} bytes)`);
+  log(`📥 Received HTTP traffic (${data.length} bytes)`);
 
   try {
     // Forward the HTTP request to local server
@@ -129,7 +149,7 @@ function handleHttpTraffic(data) {
         const fullResponse = `${httpResponse}${headers}\r\n\r\n${responseData}`;
 
         // Send response back through tunnel
-        console.log(`📤 Sending response (${fullResponse.length} bytes)`);
+        log(`📤 Sending response (${fullResponse.length} bytes)`);
         ws.send(Buffer.from(fullResponse), { binary: true });
       });
     });
@@ -168,7 +188,7 @@ setInterval(() => {
 
 // Graceful shutdown
 process.on('SIGINT', () => {
-  console.log('\n\n🛑 Shutting down...');
+  log('\n\n🛑 Shutting down...');
   if (ws.readyState === WebSocket.OPEN) {
     ws.send(JSON.stringify({
       type: 'unregister',
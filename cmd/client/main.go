@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	tws "github.com/ahmadrosid/tunnel/internal/websocket"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Mux frames are a big-endian stream ID and payload length followed by
+	// the payload, see internal/proxy/mux.go
+	frameHeaderSize = 8
+	maxFramePayload = 64 * 1024
+
+	// With flow control a stream has at most streamWindow bytes in flight
+	// each way. A window update sets windowUpdateFlag in the length and
+	// grants the other bits' worth of bytes.
+	streamWindow     = 256 * 1024
+	windowUpdateFlag = 1 << 31
+
+	// Time allowed to write a message to the server
+	writeWait = 10 * time.Second
+
+	// The server pings every 54s; without a ping for this long the
+	// connection is considered dead
+	readWait = 2 * time.Minute
+
+	// Time allowed to connect to the local server
+	dialTimeout = 10 * time.Second
+
+	// Reconnect attempts back off up to this delay
+	maxBackoff = 30 * time.Second
+)
+
+// errRejected marks failures that reconnecting won't fix, such as a
+// refused token or a port the server doesn't allow
+var errRejected = errors.New("rejected by server")
+
+// client keeps one tunnel open, reconnecting when the connection drops
+type client struct {
+	serverURL string
+	token     string
+	localAddr string
+	localPort int
+	output    io.Writer // receives the registration as a JSON line; nil unless --json
+
+	// Updated after every registration so a reconnect reclaims the tunnel
+	subdomain      string
+	tunnelID       string
+	reconnectToken string
+	fullDomain     string
+}
+
+func main() {
+	server := flag.String("server", "ws://localhost:8080/tunnel", "Tunnel server URL")
+	port := flag.Int("port", 3000, "Local port to expose")
+	subdomain := flag.String("subdomain", "", "Subdomain to request; random when empty")
+	token := flag.String("token", os.Getenv("TUNNEL_TOKEN"), "Token sent as Authorization: Bearer, for servers with AUTH_TOKENS")
+	jsonOutput := flag.Bool("json", false, "Print the tunnel as one JSON line on stdout once registered; logs stay on stderr")
+	flag.Parse()
+
+	if *port < 1 || *port > 65535 {
+		log.Fatalf("Invalid port %d: must be between 1 and 65535", *port)
+	}
+	serverURL, err := tunnelURL(*server)
+	if err != nil {
+		log.Fatalf("Invalid server URL %q: %v", *server, err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := &client{
+		serverURL: serverURL,
+		token:     *token,
+		localAddr: fmt.Sprintf("localhost:%d", *port),
+		localPort: *port,
+		subdomain: *subdomain,
+	}
+	if *jsonOutput {
+		c.output = os.Stdout
+	}
+	if err := c.run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// tunnelURL turns the -server flag into a WebSocket URL, defaulting to wss
+// and the /tunnel path
+func tunnelURL(raw string) (string, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "wss://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", errors.New("missing host")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/tunnel"
+	}
+	return u.String(), nil
+}
+
+// run connects and serves the tunnel until ctx is done, reconnecting with
+// backoff after the connection drops
+func (c *client) run(ctx context.Context) error {
+	backoff := time.Second
+	for {
+		registered, err := c.session(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errRejected) {
+			return err
+		}
+		if registered {
+			backoff = time.Second
+		}
+
+		log.Printf("Disconnected: %v; reconnecting in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// session runs one connection to the server. It reports whether the
+// tunnel was registered, so run knows to reset its backoff.
+func (c *client) session(ctx context.Context) (bool, error) {
+	header := http.Header{}
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, c.serverURL, header)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return false, fmt.Errorf("%w: %s", errRejected, resp.Status)
+		}
+		return false, err
+	}
+
+	s := &session{
+		conn:      conn,
+		localAddr: c.localAddr,
+		streams:   make(map[uint32]*stream),
+	}
+	defer s.close()
+
+	conn.SetReadDeadline(time.Now().Add(readWait))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(readWait))
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+	})
+
+	// Unregister on interrupt so the subdomain is released right away
+	// instead of being reserved for a reconnect
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.writeControl(tws.MessageTypeUnregister, nil)
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := c.register(s); err != nil {
+		return false, err
+	}
+	return true, s.serve()
+}
+
+// register sends the register message, or reconnect to reclaim the
+// previous tunnel, and waits for the server's answer
+func (c *client) register(s *session) error {
+	req := tws.RegisterRequest{
+		Subdomain:    c.subdomain,
+		LocalAddr:    c.localAddr,
+		LocalPort:    c.localPort,
+		Capabilities: []string{tws.CapabilityMux, tws.CapabilityFlow, tws.CapabilityReconnect},
+	}
+	msgType := tws.MessageTypeRegister
+	if c.reconnectToken != "" {
+		msgType = tws.MessageTypeReconnect
+		req.TunnelID = c.tunnelID
+		req.ReconnectToken = c.reconnectToken
+	}
+	if err := s.writeControl(msgType, req); err != nil {
+		return err
+	}
+
+	msg, err := s.readControl()
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case tws.MessageTypeSuccess:
+	case tws.MessageTypeError:
+		switch {
+		case msg.Code == tws.ErrorCodeAtCapacity || msg.Code == tws.ErrorCodeMaintenance:
+			return fmt.Errorf("registration failed: %s", msg.Error)
+		case c.reconnectToken != "":
+			// The reservation expired; register from scratch next time
+			c.reconnectToken = ""
+			return fmt.Errorf("failed to reclaim %s: %s", c.subdomain, msg.Error)
+		default:
+			return fmt.Errorf("%w: %s", errRejected, msg.Error)
+		}
+	default:
+		return fmt.Errorf("unexpected %q message while registering", msg.Type)
+	}
+
+	var res tws.RegisterResponse
+	if err := json.Unmarshal(msg.Data, &res); err != nil {
+		return fmt.Errorf("invalid register response: %w", err)
+	}
+	if !slices.Contains(res.Capabilities, tws.CapabilityMux) {
+		return fmt.Errorf("%w: server does not support multiplexed streams", errRejected)
+	}
+	if !slices.Contains(res.Capabilities, tws.CapabilityFlow) {
+		return fmt.Errorf("%w: server does not support flow control", errRejected)
+	}
+
+	first := c.fullDomain == ""
+	restored := res.FullDomain == c.fullDomain
+	c.subdomain = res.Subdomain
+	c.tunnelID = res.TunnelID
+	c.reconnectToken = res.ReconnectToken
+	c.fullDomain = res.FullDomain
+
+	if restored {
+		log.Printf("Tunnel restored: %s", res.FullDomain)
+		return nil
+	}
+	log.Printf("Forwarding https://%s -> %s", res.FullDomain, c.localAddr)
+	if res.QRCode != "" {
+		fmt.Fprint(os.Stderr, res.QRCode)
+	}
+	if first && c.output != nil {
+		return writeRegistration(c.output, res)
+	}
+	return nil
+}
+
+// registration is the line printed with --json, the same as the Node
+// client's, so scripts can read the tunnel's URL from either
+type registration struct {
+	TunnelID  string `json:"tunnel_id"`
+	Subdomain string `json:"subdomain"`
+	URL       string `json:"url"`
+}
+
+// writeRegistration writes res to w as a single JSON line
+func writeRegistration(w io.Writer, res tws.RegisterResponse) error {
+	line, err := json.Marshal(registration{
+		TunnelID:  res.TunnelID,
+		Subdomain: res.Subdomain,
+		URL:       "https://" + res.FullDomain,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", line)
+	return err
+}
+
+// session is one connection to the server. The server opens a stream for
+// every proxied request; each stream is piped to a new connection to the
+// local server.
+type session struct {
+	conn      *websocket.Conn
+	localAddr string
+	writeMu   sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*stream
+	lastID  uint32 // highest stream ID seen; the server never reuses IDs
+}
+
+// stream is one proxied request. Payloads from the server queue up until
+// the local connection takes them; the server's window keeps the queue
+// bounded, so the session's reader never waits on a slow local server.
+type stream struct {
+	id uint32
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    [][]byte // payloads for the local connection
+	buffered int      // bytes queued or being written to the local connection
+	unacked  int      // bytes written locally since the last window update
+	window   int      // bytes the server still has room for
+	ended    bool     // the server closed the stream or the session ended
+}
+
+func newStream(id uint32) *stream {
+	st := &stream{id: id, window: streamWindow}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// push queues a payload from the server. It reports false if the server
+// sent more than the window allows.
+func (st *stream) push(payload []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.buffered+len(payload) > streamWindow {
+		return false
+	}
+	st.queue = append(st.queue, payload)
+	st.buffered += len(payload)
+	st.cond.Broadcast()
+	return true
+}
+
+// pop waits for the next payload. It reports false once the stream has
+// ended and everything queued was taken.
+func (st *stream) pop() ([]byte, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for len(st.queue) == 0 && !st.ended {
+		st.cond.Wait()
+	}
+	if len(st.queue) == 0 {
+		return nil, false
+	}
+	payload := st.queue[0]
+	st.queue = st.queue[1:]
+	return payload, true
+}
+
+// written records that n popped bytes reached the local server and
+// returns how much window to grant the server, once half of it is due
+func (st *stream) written(n int) int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.buffered -= n
+	st.unacked += n
+	if st.unacked < streamWindow/2 {
+		return 0
+	}
+	n, st.unacked = st.unacked, 0
+	return n
+}
+
+// reserve waits for the server to have room and takes up to n bytes of
+// the window. It reports false if the stream ended first.
+func (st *stream) reserve(n int) (int, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for st.window == 0 && !st.ended {
+		st.cond.Wait()
+	}
+	if st.ended {
+		return 0, false
+	}
+	n = min(n, st.window)
+	st.window -= n
+	return n, true
+}
+
+// grant adds a window update from the server
+func (st *stream) grant(n int) {
+	st.mu.Lock()
+	st.window += n
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+// end stops the stream; payloads already queued are still delivered
+func (st *stream) end() {
+	st.mu.Lock()
+	st.ended = true
+	st.mu.Unlock()
+	st.cond.Broadcast()
+}
+
+// writeControl sends a JSON control message
+func (s *session) writeControl(t tws.MessageType, data interface{}) error {
+	msg := tws.Message{Type: t, Timestamp: time.Now()}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		msg.Data = raw
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.conn.WriteJSON(msg)
+}
+
+// readControl reads the next JSON control message, skipping binary data
+func (s *session) readControl() (*tws.Message, error) {
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+
+		var msg tws.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("invalid control message: %w", err)
+		}
+		return &msg, nil
+	}
+}
+
+// serve reads from the server until the connection fails, handing frames
+// to their streams and logging control messages
+func (s *session) serve() error {
+	var pending []byte
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		if messageType == websocket.TextMessage {
+			var msg tws.Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				log.Printf("Ignoring invalid control message: %v", err)
+				continue
+			}
+			if msg.Type == tws.MessageTypeError {
+				log.Printf("Server error: %s", msg.Error)
+			}
+			continue
+		}
+
+		// Frames may share a binary message or span several
+		pending = append(pending, data...)
+		for len(pending) >= frameHeaderSize {
+			id := binary.BigEndian.Uint32(pending[:4])
+			length := binary.BigEndian.Uint32(pending[4:frameHeaderSize])
+			if length&windowUpdateFlag != 0 {
+				s.grant(id, int(length&^windowUpdateFlag))
+				pending = pending[frameHeaderSize:]
+				continue
+			}
+			if length > maxFramePayload {
+				return fmt.Errorf("frame of %d bytes for stream %d exceeds the limit", length, id)
+			}
+			if len(pending) < frameHeaderSize+int(length) {
+				break
+			}
+
+			payload := pending[frameHeaderSize : frameHeaderSize+int(length)]
+			s.handleFrame(id, slices.Clone(payload))
+			pending = pending[frameHeaderSize+int(length):]
+		}
+		pending = slices.Clone(pending)
+	}
+}
+
+// handleFrame passes a frame to its stream, opening the stream for a new
+// ID. It never waits for the local server.
+func (s *session) handleFrame(id uint32, payload []byte) {
+	s.mu.Lock()
+	st := s.streams[id]
+	switch {
+	case st == nil && (id <= s.lastID || len(payload) == 0):
+		// Frames for streams the local side already closed are dropped
+		s.mu.Unlock()
+		return
+	case st == nil:
+		st = newStream(id)
+		s.streams[id] = st
+		s.lastID = id
+		go s.pipe(st)
+	case len(payload) == 0:
+		delete(s.streams, id)
+		st.end()
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	if !st.push(payload) {
+		log.Printf("Closing stream %d: the server sent more than its window", id)
+		st.end()
+		s.endStream(id)
+	}
+}
+
+// grant passes a window update to its stream
+func (s *session) grant(id uint32, n int) {
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+
+	if st != nil {
+		st.grant(n)
+	}
+}
+
+// pipe connects a stream to the local server
+func (s *session) pipe(st *stream) {
+	local, err := net.DialTimeout("tcp", s.localAddr, dialTimeout)
+	if err != nil {
+		log.Printf("Failed to connect to %s: %v", s.localAddr, err)
+		st.end()
+		s.endStream(st.id)
+		return
+	}
+	defer local.Close()
+
+	go func() {
+		for {
+			payload, ok := st.pop()
+			if !ok {
+				break
+			}
+			if _, err := local.Write(payload); err != nil {
+				break
+			}
+			if n := st.written(len(payload)); n > 0 {
+				s.writeWindowUpdate(st.id, n)
+			}
+		}
+		local.Close()
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := local.Read(buf)
+		if n > 0 {
+			if err := s.send(st, buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	s.endStream(st.id)
+}
+
+// send writes p to the server as the server's window allows
+func (s *session) send(st *stream, p []byte) error {
+	for len(p) > 0 {
+		n, ok := st.reserve(len(p))
+		if !ok {
+			return io.ErrClosedPipe
+		}
+		if err := s.writeFrame(st.id, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// endStream tells the server the local side of a stream is done
+func (s *session) endStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+
+	s.writeFrame(id, nil)
+}
+
+// writeFrame sends one frame as its own binary message
+func (s *session) writeFrame(id uint32, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], id)
+	binary.BigEndian.PutUint32(frame[4:frameHeaderSize], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+	return s.writeBinary(frame)
+}
+
+// writeWindowUpdate lets the server send n more bytes on stream id
+func (s *session) writeWindowUpdate(id uint32, n int) error {
+	header := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(header[:4], id)
+	binary.BigEndian.PutUint32(header[4:], windowUpdateFlag|uint32(n))
+	return s.writeBinary(header)
+}
+
+// writeBinary sends data as one binary message
+func (s *session) writeBinary(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// close ends the connection and every open stream
+func (s *session) close() {
+	s.conn.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, st := range s.streams {
+		delete(s.streams, id)
+		st.end()
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/proxy"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	tws "github.com/ahmadrosid/tunnel/internal/websocket"
+)
+
+func TestWriteRegistration(t *testing.T) {
+	var out strings.Builder
+	err := writeRegistration(&out, tws.RegisterResponse{
+		TunnelID:   "3f2a",
+		Subdomain:  "myapp",
+		FullDomain: "myapp.example.com",
+		LocalAddr:  "localhost:3000",
+		Message:    "Tunnel created",
+	})
+	if err != nil {
+		t.Fatalf("writeRegistration: %v", err)
+	}
+
+	want := `{"tunnel_id":"3f2a","subdomain":"myapp","url":"https://myapp.example.com"}` + "\n"
+	if out.String() != want {
+		t.Fatalf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestTunnelURL(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"example.com", "wss://example.com/tunnel"},
+		{"ws://localhost:8080", "ws://localhost:8080/tunnel"},
+		{"http://localhost:8080/", "ws://localhost:8080/tunnel"},
+		{"https://example.com/custom", "wss://example.com/custom"},
+		{"ftp://example.com", ""},
+		{"wss://", ""},
+	} {
+		got, err := tunnelURL(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("tunnelURL(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("tunnelURL(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// lineWriter hands every write to a channel
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+// startClient runs a client for local behind a tunnel server until the
+// test ends. It returns the visitor proxy's URL and the registration the
+// client printed.
+func startClient(t *testing.T, local http.Handler) (string, registration) {
+	t.Helper()
+
+	cfg := testkit.Config()
+	registry := tunnel.NewRegistry(0)
+
+	control := httptest.NewServer(tws.NewServer(cfg, registry, nil).Handler())
+	t.Cleanup(control.Close)
+	visitors := httptest.NewServer(proxy.NewHandler(cfg, registry))
+	t.Cleanup(visitors.Close)
+	backend := httptest.NewServer(local)
+	t.Cleanup(backend.Close)
+
+	serverURL, err := tunnelURL(control.URL)
+	if err != nil {
+		t.Fatalf("tunnelURL: %v", err)
+	}
+	output := make(lineWriter, 1)
+	c := &client{
+		serverURL: serverURL,
+		localAddr: strings.TrimPrefix(backend.URL, "http://"),
+		subdomain: "myapp",
+		output:    output,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	var reg registration
+	select {
+	case line := <-output:
+		if err := json.Unmarshal([]byte(line), &reg); err != nil {
+			t.Fatalf("registration line %q: %v", line, err)
+		}
+	case <-time.After(testkit.Timeout):
+		t.Fatal("client never printed its registration")
+	}
+	return visitors.URL, reg
+}
+
+// visit sends req to the tunnel through the visitor proxy
+func visit(t *testing.T, visitors string, method, path string, body io.Reader) (*http.Response, error) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, visitors+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "myapp.tunnel.test"
+	client := &http.Client{Timeout: testkit.Timeout, Transport: &http.Transport{DisableKeepAlives: true}}
+	return client.Do(req)
+}
+
+// The client registers with mux, prints its registration and serves
+// concurrent requests to the local server
+func TestClientServesRequests(t *testing.T) {
+	visitors, reg := startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "local "+r.URL.Path)
+	}))
+	if reg.Subdomain != "myapp" || reg.URL != "https://myapp.tunnel.test" || reg.TunnelID == "" {
+		t.Fatalf("registration = %+v", reg)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := visit(t, visitors, http.MethodGet, fmt.Sprintf("/req/%d", i), nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if want := fmt.Sprintf("local /req/%d", i); resp.StatusCode != http.StatusOK || string(body) != want {
+				errs <- fmt.Errorf("request %d: %d %q, want 200 %q", i, resp.StatusCode, body, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// A stream stalled on a slow reader, in either direction, holds up neither
+// the client's reader nor the other requests on the tunnel
+func TestSlowStreamDoesNotStallOthers(t *testing.T) {
+	const size = 16 << 20
+	release := make(chan struct{})
+	visitors, _ := startClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/download":
+			w.Write(bytes.Repeat([]byte("d"), size))
+		case "/upload":
+			// The local server doesn't read the upload until released
+			<-release
+			n, _ := io.Copy(io.Discard, r.Body)
+			fmt.Fprint(w, n)
+		default:
+			io.WriteString(w, "fast")
+		}
+	}))
+
+	// The visitor stops reading the download after its headers
+	download, err := visit(t, visitors, http.MethodGet, "/download", nil)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	defer download.Body.Close()
+
+	upload := make(chan string, 1)
+	go func() {
+		resp, err := visit(t, visitors, http.MethodPost, "/upload", bytes.NewReader(bytes.Repeat([]byte("u"), size)))
+		if err != nil {
+			upload <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		upload <- string(body)
+	}()
+
+	for i := 0; i < 5; i++ {
+		resp, err := visit(t, visitors, http.MethodGet, "/fast", nil)
+		if err != nil {
+			t.Fatalf("fast request next to the stalled streams: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "fast" {
+			t.Fatalf("fast request = %q", body)
+		}
+	}
+
+	// Both stalled streams still complete in full
+	close(release)
+	select {
+	case got := <-upload:
+		if got != fmt.Sprint(size) {
+			t.Fatalf("upload = %q, want %d bytes received", got, size)
+		}
+	case <-time.After(testkit.Timeout):
+		t.Fatal("upload did not finish")
+	}
+	n, err := io.Copy(io.Discard, download.Body)
+	if err != nil || n != size {
+		t.Fatalf("download = %d bytes, %v; want %d", n, err, size)
+	}
+}
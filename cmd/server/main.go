@@ -3,31 +3,153 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/ahmadrosid/tunnel/internal/cert"
 	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/dnscheck"
+	"github.com/ahmadrosid/tunnel/internal/ipfilter"
+	"github.com/ahmadrosid/tunnel/internal/logging"
 	"github.com/ahmadrosid/tunnel/internal/proxy"
+	"github.com/ahmadrosid/tunnel/internal/statsd"
 	"github.com/ahmadrosid/tunnel/internal/tunnel"
 	"github.com/ahmadrosid/tunnel/internal/websocket"
 )
 
+// Build information, set with -ldflags "-X main.Version=... -X main.Commit=..."
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
 func main() {
-	log.Println("Starting tunnel server...")
+	log.Printf("Starting tunnel server %s (%s)...", Version, Commit)
+	websocket.Version = Version
 
 	// Load configuration
 	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	logging.Setup(cfg.LogFormat, cfg.LogLevel)
 	log.Printf("Configuration loaded: WebSocket Port=%d, Domain=%s, HTTP Port=%d, HTTPS Port=%d",
 		cfg.WebSocketPort, cfg.Domain, cfg.HTTPPort, cfg.HTTPSPort)
 
+	// Make sure DNS points here before clients start registering
+	if cfg.DNSCheck {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := dnscheck.Check(ctx, net.DefaultResolver, cfg.Domain, cfg.PublicIP)
+		cancel()
+		if err != nil && cfg.DNSCheckStrict {
+			log.Fatalf("DNS check failed: %v", err)
+		} else if err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+	}
+
+	proxy.SetCopyBufferSize(cfg.CopyBufferSize)
+
 	// Create tunnel registry
-	registry := tunnel.NewRegistry()
+	registry := tunnel.NewRegistry(cfg.MaxTunnels)
+
+	// Hold the subdomains of clients that were connected before a restart
+	var stateFile *tunnel.StateFile
+	if cfg.RegistryStatePath != "" {
+		reservations, err := tunnel.LoadState(cfg.RegistryStatePath, cfg.ReconnectGrace)
+		if err != nil {
+			log.Printf("Failed to load registry state: %v", err)
+		} else if len(reservations) > 0 {
+			imported, dropped := registry.Import(reservations)
+			log.Printf("Restored %d tunnel reservations from %s", imported, cfg.RegistryStatePath)
+			if dropped > 0 {
+				log.Printf("WARNING: dropped %d restored reservations, MAX_TUNNELS=%d is reached", dropped, cfg.MaxTunnels)
+			}
+		}
+		stateFile = tunnel.NewStateFile(registry, cfg.RegistryStatePath, cfg.ReconnectGrace)
+	}
+
+	// Take over subdomain reservations from the instance being replaced
+	if cfg.MigrateFrom != "" {
+		reservations, err := tunnel.FetchReservations(cfg.MigrateFrom, cfg.MigrateToken)
+		if err != nil {
+			log.Printf("Failed to migrate tunnels from %s: %v", cfg.MigrateFrom, err)
+		} else {
+			imported, dropped := registry.Import(reservations)
+			log.Printf("Migrated %d tunnel reservations from %s", imported, cfg.MigrateFrom)
+			if dropped > 0 {
+				log.Printf("WARNING: dropped %d migrated reservations, MAX_TUNNELS=%d is reached", dropped, cfg.MaxTunnels)
+			}
+		}
+	}
+
+	// SIGUSR2 toggles maintenance mode, e.g. to drain before a restart
+	maintenanceChan := make(chan os.Signal, 1)
+	signal.Notify(maintenanceChan, syscall.SIGUSR2)
+	go func() {
+		for range maintenanceChan {
+			enabled := !registry.InMaintenance()
+			registry.SetMaintenance(enabled)
+			log.Printf("Maintenance mode set to %t via SIGUSR2", enabled)
+		}
+	}()
+
+	// Close tunnels that stopped carrying traffic
+	registry.StartReaper(cfg.IdleTimeout, websocket.IdleEvictionHandler(cfg))
+
+	// Push per-tunnel metrics to StatsD
+	if cfg.StatsDAddr != "" {
+		exporter, err := statsd.NewExporter(cfg.StatsDAddr, cfg.StatsDPrefix, registry)
+		if err != nil {
+			log.Printf("StatsD export disabled: %v", err)
+		} else {
+			exporter.Start(cfg.StatsDInterval)
+		}
+	}
 
 	// Create certificate manager for TLS
-	certManager := cert.NewManager(cfg)
+	certManager := cert.NewManager(cfg, registry)
+	certManager.OnPersistentFailure(websocket.CertFailureHandler(cfg, registry))
+
+	// Tunnel clients from denied ranges are refused at the upgrade
+	var denylist *ipfilter.Denylist
+	if cfg.IPDenylistPath != "" {
+		var err error
+		if denylist, err = ipfilter.Load(cfg.IPDenylistPath); err != nil {
+			log.Fatalf("Failed to load IP denylist: %v", err)
+		}
+	}
+
+	// SIGHUP reloads certificates from files, e.g. after they were
+	// renewed, and the IP denylist
+	if cfg.TLSCertPath != "" || denylist != nil {
+		reloadChan := make(chan os.Signal, 1)
+		signal.Notify(reloadChan, syscall.SIGHUP)
+		go func() {
+			for range reloadChan {
+				if cfg.TLSCertPath != "" {
+					if err := certManager.Reload(); err != nil {
+						log.Printf("Certificate reload via SIGHUP failed, keeping the current one: %v", err)
+					}
+				}
+				if denylist != nil {
+					if err := denylist.Reload(); err != nil {
+						log.Printf("IP denylist reload via SIGHUP failed, keeping the current one: %v", err)
+					}
+				}
+			}
+		}()
+	}
+
+	// Obtain the base domain certificate up front; the challenge is served
+	// by the listeners started below
+	if cfg.EnableHTTPS && cfg.CertStartupTimeout > 0 {
+		certManager.WarmUp(cfg.CertStartupTimeout)
+	}
 
 	// Check if WebSocket and HTTPS are on the same port
 	if cfg.WebSocketPort == cfg.HTTPSPort && cfg.EnableHTTPS {
@@ -35,6 +157,7 @@ func main() {
 
 		// Create combined server that handles both WebSocket and proxy on same port
 		combinedServer := websocket.NewCombinedServer(cfg, registry, certManager)
+		combinedServer.SetDenylist(denylist)
 
 		// Handle graceful shutdown
 		sigChan := make(chan os.Signal, 1)
@@ -51,7 +174,7 @@ func main() {
 		<-sigChan
 		log.Println("\nShutting down server...")
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 		defer cancel()
 
 		if err := combinedServer.Shutdown(ctx); err != nil {
@@ -60,7 +183,13 @@ func main() {
 	} else {
 		// Run separate servers on different ports
 		wsServer := websocket.NewServer(cfg, registry, certManager)
-		proxyServer := proxy.NewServer(cfg, registry)
+		wsServer.SetDenylist(denylist)
+		proxyServer := proxy.NewServer(cfg, registry, certManager)
+
+		// Serve the control endpoints on reserved control subdomains
+		for _, name := range cfg.ControlHosts {
+			proxyServer.HandleReserved(name, wsServer.Handler())
+		}
 
 		// Handle graceful shutdown
 		sigChan := make(chan os.Signal, 1)
@@ -84,15 +213,34 @@ func main() {
 		<-sigChan
 		log.Println("\nShutting down server...")
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+		wsServer.BeginShutdown()
 
-		if err := proxyServer.Shutdown(ctx); err != nil {
-			log.Printf("Error during proxy shutdown: %v", err)
-		}
+		// Each server drains within its own budget, at the same time, so a
+		// slow proxy drain doesn't eat into the WebSocket server's
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownBudget(cfg.ProxyShutdown))
+			defer cancel()
+			if err := proxyServer.Shutdown(ctx); err != nil {
+				log.Printf("Error during proxy shutdown: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownBudget(cfg.WSShutdown))
+			defer cancel()
+			if err := wsServer.Shutdown(ctx); err != nil {
+				log.Printf("Error during WebSocket shutdown: %v", err)
+			}
+		}()
+		wg.Wait()
+	}
 
-		if err := wsServer.Shutdown(); err != nil {
-			log.Printf("Error during WebSocket shutdown: %v", err)
+	if stateFile != nil {
+		if err := stateFile.Save(); err != nil {
+			log.Printf("Failed to save registry state: %v", err)
 		}
 	}
 
@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry records a single action taken through the API
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`  // who performed the action, e.g. a remote address
+	Action string    `json:"action"` // what was done, e.g. "register"
+	Target string    `json:"target"` // what it was done to, e.g. a subdomain
+	Result string    `json:"result"` // "ok" or the error message
+}
+
+// Log is a fixed-size, thread-safe ring buffer of audit entries.
+// Once full, new entries overwrite the oldest ones.
+type Log struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+}
+
+// NewLog creates an audit log holding at most size entries
+func NewLog(size int) *Log {
+	if size < 1 {
+		size = 1
+	}
+	return &Log{
+		entries: make([]Entry, size),
+	}
+}
+
+// Record appends an entry for an action. A nil err is recorded as "ok".
+func (l *Log) Record(actor, action, target string, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[l.next] = Entry{
+		Time:   time.Now(),
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Result: result,
+	}
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Entries returns a copy of the recorded entries, oldest first
+func (l *Log) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.full {
+		return append([]Entry(nil), l.entries[:l.next]...)
+	}
+
+	entries := make([]Entry, 0, len(l.entries))
+	entries = append(entries, l.entries[l.next:]...)
+	entries = append(entries, l.entries[:l.next]...)
+	return entries
+}
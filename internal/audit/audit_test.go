@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestLogRecordsResults(t *testing.T) {
+	l := NewLog(10)
+	l.Record("1.2.3.4", "register", "myapp", nil)
+	l.Record("1.2.3.4", "rename", "myapp", errors.New("subdomain 'other' is already in use"))
+
+	entries := l.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.Actor != "1.2.3.4" || e.Action != "register" || e.Target != "myapp" || e.Result != "ok" || e.Time.IsZero() {
+		t.Fatalf("first entry = %+v", e)
+	}
+	if e := entries[1]; e.Result != "subdomain 'other' is already in use" {
+		t.Fatalf("failed action recorded as %q", e.Result)
+	}
+}
+
+func TestLogKeepsNewestEntries(t *testing.T) {
+	l := NewLog(3)
+	for i := 0; i < 5; i++ {
+		l.Record("admin", "action", fmt.Sprint(i), nil)
+	}
+
+	entries := l.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	for i, e := range entries {
+		if want := fmt.Sprint(i + 2); e.Target != want {
+			t.Fatalf("entry %d is for %s, want %s (oldest first)", i, e.Target, want)
+		}
+	}
+
+	// Entries returns a copy
+	entries[0].Target = "changed"
+	if l.Entries()[0].Target == "changed" {
+		t.Fatal("Entries exposes the log's storage")
+	}
+}
+
+func TestNewLogHoldsAtLeastOneEntry(t *testing.T) {
+	l := NewLog(0)
+	l.Record("admin", "action", "a", nil)
+	l.Record("admin", "action", "b", nil)
+	if entries := l.Entries(); len(entries) != 1 || entries[0].Target != "b" {
+		t.Fatalf("entries = %+v, want only the newest", entries)
+	}
+}
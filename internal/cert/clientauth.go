@@ -0,0 +1,41 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+
+	"golang.org/x/crypto/acme"
+)
+
+// LoadCertPool reads PEM-encoded CA certificates from path
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// requireClientCerts makes cfg reject clients without a certificate signed
+// by one of cas. ACME TLS-ALPN challenges are exempt, since the CA
+// validating a domain has no client certificate.
+func requireClientCerts(cfg *tls.Config, cas *x509.CertPool) {
+	challenge := cfg.Clone()
+
+	cfg.ClientCAs = cas
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return challenge, nil
+		}
+		return nil, nil
+	}
+}
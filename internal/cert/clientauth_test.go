@@ -0,0 +1,125 @@
+package cert
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"golang.org/x/crypto/acme"
+)
+
+// issueClient returns a client certificate signed by ca
+func (ca *testCA) issueClient(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serverHandshake connects to a TLS server using cfg, presenting certs,
+// and returns the server's handshake error
+func serverHandshake(t *testing.T, cfg *tls.Config, host string, roots *x509.CertPool, certs []tls.Certificate) error {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	result := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		result <- tls.Server(serverConn, cfg).Handshake()
+	}()
+
+	client := tls.Client(clientConn, &tls.Config{ServerName: host, RootCAs: roots, Certificates: certs})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client.HandshakeContext(ctx)
+	// With TLS 1.3 the server checks the certificate after the client has
+	// finished, so keep reading to take its alert or session tickets
+	go io.Copy(io.Discard, client)
+	return <-result
+}
+
+func TestClientCertificatesRequired(t *testing.T) {
+	const host = "tunnel.test"
+	serverCA := newTestCA(t)
+	clientCA := newTestCA(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, host), serverCA.issue(t, host), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	caPath := filepath.Join(dir, "clients.pem")
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCA.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Load()
+	cfg.Domain = host
+	cfg.CertCacheDir = dir
+	cfg.ClientCAPath = caPath
+	m := NewManager(cfg, tunnel.NewRegistry(0))
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+
+	for name, tlsConfig := range map[string]*tls.Config{
+		"GetTLSConfig":             m.GetTLSConfig(),
+		"GetTLSConfigForHijacking": m.GetTLSConfigForHijacking(),
+	} {
+		if err := serverHandshake(t, tlsConfig, host, roots, nil); err == nil {
+			t.Errorf("%s: handshake without a client certificate succeeded", name)
+		}
+		if err := serverHandshake(t, tlsConfig, host, roots, []tls.Certificate{serverCA.issueClient(t)}); err == nil {
+			t.Errorf("%s: handshake with a certificate from another CA succeeded", name)
+		}
+		if err := serverHandshake(t, tlsConfig, host, roots, []tls.Certificate{clientCA.issueClient(t)}); err != nil {
+			t.Errorf("%s: handshake with a trusted client certificate: %v", name, err)
+		}
+	}
+}
+
+// The CA validating a domain over TLS-ALPN has no client certificate
+func TestACMEChallengesSkipClientAuth(t *testing.T) {
+	cfg := &tls.Config{NextProtos: []string{"http/1.1", acme.ALPNProto}}
+	requireClientCerts(cfg, x509.NewCertPool())
+
+	challenge, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}})
+	if err != nil || challenge == nil {
+		t.Fatalf("GetConfigForClient(acme-tls/1) = %v, %v, want the challenge config", challenge, err)
+	}
+	if challenge.ClientAuth != tls.NoClientCert || !slices.Contains(challenge.NextProtos, acme.ALPNProto) {
+		t.Fatalf("challenge config has ClientAuth %v and protocols %v", challenge.ClientAuth, challenge.NextProtos)
+	}
+
+	if visitor, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{"http/1.1"}}); err != nil || visitor != nil {
+		t.Fatalf("GetConfigForClient(http/1.1) = %v, %v, want the client auth config", visitor, err)
+	}
+}
@@ -0,0 +1,160 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cloudflareAPI is the base URL of the Cloudflare v4 API
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareProvider manages DNS-01 records through the Cloudflare API.
+// The API token needs Zone:Read and DNS:Edit on the domain's zone.
+type cloudflareProvider struct {
+	api    string // base URL of the API, cloudflareAPI outside tests
+	token  string
+	client *http.Client
+
+	mu      sync.Mutex
+	zones   map[string]string // record name -> zone ID
+	records map[string]string // record name + value -> record ID
+}
+
+func newCloudflareProvider(token string) *cloudflareProvider {
+	return &cloudflareProvider{
+		api:     cloudflareAPI,
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		zones:   make(map[string]string),
+		records: make(map[string]string),
+	}
+}
+
+// cloudflareResponse is the envelope of every Cloudflare API response
+type cloudflareResponse struct {
+	Success bool            `json:"success"`
+	Errors  []cloudflareErr `json:"errors"`
+	Result  json.RawMessage `json:"result"`
+}
+
+type cloudflareErr struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Present implements DNSProvider
+func (p *cloudflareProvider) Present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]interface{}{
+		"type":    "TXT",
+		"name":    fqdn,
+		"content": value,
+		"ttl":     60,
+	}
+	var record struct {
+		ID string `json:"id"`
+	}
+	if err := p.do(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", body, &record); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.records[fqdn+" "+value] = record.ID
+	p.mu.Unlock()
+	return nil
+}
+
+// CleanUp implements DNSProvider
+func (p *cloudflareProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	p.mu.Lock()
+	recordID, ok := p.records[fqdn+" "+value]
+	delete(p.records, fqdn+" "+value)
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	zoneID, err := p.zoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	return p.do(ctx, http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+recordID, nil, nil)
+}
+
+// zoneID finds the zone holding fqdn by trying each parent domain in turn
+func (p *cloudflareProvider) zoneID(ctx context.Context, fqdn string) (string, error) {
+	p.mu.Lock()
+	id, ok := p.zones[fqdn]
+	p.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	for i := 1; i < len(labels)-1; i++ {
+		name := strings.Join(labels[i:], ".")
+
+		var zones []struct {
+			ID string `json:"id"`
+		}
+		if err := p.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(name), nil, &zones); err != nil {
+			return "", err
+		}
+		if len(zones) > 0 {
+			p.mu.Lock()
+			p.zones[fqdn] = zones[0].ID
+			p.mu.Unlock()
+			return zones[0].ID, nil
+		}
+	}
+	return "", fmt.Errorf("no Cloudflare zone found for %s", fqdn)
+}
+
+// do sends an API request and decodes the response's result into result
+func (p *cloudflareProvider) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.api+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare: %s %s: status %d", method, path, resp.StatusCode)
+	}
+	if !envelope.Success {
+		if len(envelope.Errors) > 0 {
+			return fmt.Errorf("cloudflare: %s (code %d)", envelope.Errors[0].Message, envelope.Errors[0].Code)
+		}
+		return fmt.Errorf("cloudflare: %s %s: status %d", method, path, resp.StatusCode)
+	}
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package cert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCloudflare serves the zone lookup and DNS record calls of the
+// Cloudflare API for a single zone, tunnel.test
+type fakeCloudflare struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	records map[string]string // record ID -> content
+}
+
+func newFakeCloudflare(t *testing.T) *fakeCloudflare {
+	t.Helper()
+
+	f := &fakeCloudflare{records: make(map[string]string)}
+	reply := func(w http.ResponseWriter, result interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "errors": []interface{}{}, "result": result})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /zones", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") != "tunnel.test" {
+			reply(w, []interface{}{})
+			return
+		}
+		reply(w, []map[string]string{{"id": "zone1"}})
+	})
+	mux.HandleFunc("POST /zones/zone1/dns_records", func(w http.ResponseWriter, r *http.Request) {
+		var record struct{ Type, Name, Content string }
+		json.NewDecoder(r.Body).Decode(&record)
+		if record.Type != "TXT" || record.Name != "_acme-challenge.tunnel.test" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []map[string]interface{}{{"code": 9000, "message": "unexpected record"}}})
+			return
+		}
+		f.mu.Lock()
+		id := record.Content + "-id"
+		f.records[id] = record.Content
+		f.mu.Unlock()
+		reply(w, map[string]string{"id": id})
+	})
+	mux.HandleFunc("DELETE /zones/zone1/dns_records/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		delete(f.records, r.PathValue("id"))
+		f.mu.Unlock()
+		reply(w, map[string]string{"id": r.PathValue("id")})
+	})
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "errors": []map[string]interface{}{{"code": 10000, "message": "Authentication error"}}})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeCloudflare) contents() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var contents []string
+	for _, content := range f.records {
+		contents = append(contents, content)
+	}
+	return contents
+}
+
+// A wildcard order needs two records with the same name; each is removed
+// on its own
+func TestCloudflarePresentAndCleanUp(t *testing.T) {
+	f := newFakeCloudflare(t)
+	p := newCloudflareProvider("secret")
+	p.api = f.URL
+	ctx := context.Background()
+
+	const fqdn = "_acme-challenge.tunnel.test"
+	for _, value := range []string{"first", "second"} {
+		if err := p.Present(ctx, fqdn, value); err != nil {
+			t.Fatalf("Present(%s): %v", value, err)
+		}
+	}
+	if contents := f.contents(); len(contents) != 2 {
+		t.Fatalf("records after Present = %q, want two", contents)
+	}
+
+	if err := p.CleanUp(ctx, fqdn, "first"); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if contents := f.contents(); len(contents) != 1 || contents[0] != "second" {
+		t.Fatalf("records after CleanUp = %q, want only second", contents)
+	}
+	// Records this provider didn't create are left alone
+	if err := p.CleanUp(ctx, fqdn, "unknown"); err != nil {
+		t.Fatalf("CleanUp of an unknown record: %v", err)
+	}
+}
+
+func TestCloudflareErrors(t *testing.T) {
+	f := newFakeCloudflare(t)
+	ctx := context.Background()
+
+	p := newCloudflareProvider("wrong")
+	p.api = f.URL
+	if err := p.Present(ctx, "_acme-challenge.tunnel.test", "value"); err == nil || !strings.Contains(err.Error(), "Authentication error") {
+		t.Fatalf("Present with a bad token = %v, want the API's error message", err)
+	}
+
+	p = newCloudflareProvider("secret")
+	p.api = f.URL
+	if err := p.Present(ctx, "_acme-challenge.other.example", "value"); err == nil || !strings.Contains(err.Error(), "no Cloudflare zone") {
+		t.Fatalf("Present outside any zone = %v, want a missing zone error", err)
+	}
+}
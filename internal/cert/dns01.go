@@ -0,0 +1,389 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DNSProvider publishes the TXT records that prove control of a domain
+// for ACME DNS-01 challenges
+type DNSProvider interface {
+	// Present creates a TXT record named fqdn holding value. Other TXT
+	// records with the same name must be kept: a wildcard order needs two.
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the record created by Present
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// NewDNSProvider returns the DNS provider named by cfg.DNSProvider
+func NewDNSProvider(cfg *config.Config) (DNSProvider, error) {
+	switch cfg.DNSProvider {
+	case config.DNSProviderCloudflare:
+		return newCloudflareProvider(cfg.CloudflareAPIToken), nil
+	default:
+		return nil, fmt.Errorf("unknown DNS provider %q", cfg.DNSProvider)
+	}
+}
+
+const (
+	// dnsPropagationDelay is how long records are given to reach the
+	// provider's nameservers before the CA is asked to check them
+	dnsPropagationDelay = 15 * time.Second
+
+	// wildcardRenewBefore is how long before expiry the certificate is renewed
+	wildcardRenewBefore = 30 * 24 * time.Hour
+
+	// wildcardIssueTimeout bounds a single issuance attempt
+	wildcardIssueTimeout = 5 * time.Minute
+
+	// wildcardRetryDelay spaces out attempts after a failure, keeping
+	// well under the CA's failed validation rate limit
+	wildcardRetryDelay = 15 * time.Minute
+)
+
+// Cache keys, distinct from the ones autocert uses in the same directory
+const (
+	wildcardAccountKey = "dns01_account.key"
+	wildcardCertSuffix = "+wildcard"
+)
+
+// wildcardIssuer obtains and renews a single certificate covering the
+// domain and *.domain through DNS-01 challenges, so every subdomain is
+// served without a certificate request of its own
+type wildcardIssuer struct {
+	domain    string
+	email     string
+	keyType   string
+	cache     autocert.Cache
+	provider  DNSProvider
+	directory string // ACME directory URL, Let's Encrypt outside tests
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	issuing  chan struct{} // closed when the running issuance finishes; nil when idle
+	issueErr error         // outcome of the last issuance
+	retryAt  time.Time     // no new issuance before this after a failure
+}
+
+// newWildcardIssuer creates an issuer for cfg.Domain. A certificate cached
+// by an earlier run is used until it needs renewing.
+func newWildcardIssuer(cfg *config.Config, provider DNSProvider) *wildcardIssuer {
+	w := &wildcardIssuer{
+		domain:    cfg.Domain,
+		email:     cfg.LetsEncryptEmail,
+		keyType:   cfg.CertKeyType,
+		cache:     autocert.DirCache(cfg.CertCacheDir),
+		provider:  provider,
+		directory: autocert.DefaultACMEDirectory,
+	}
+	if cert, err := w.loadCached(context.Background()); err == nil {
+		w.cert = cert
+		log.Printf("Loaded cached wildcard certificate for *.%s, valid until %s", w.domain, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return w
+}
+
+// certificate returns the wildcard certificate. The first call issues it
+// and waits; once one exists it is returned right away, and renewal runs
+// in the background when it is close to expiry.
+func (w *wildcardIssuer) certificate() (*tls.Certificate, error) {
+	w.mu.Lock()
+	cert := w.cert
+	if cert != nil && time.Until(cert.Leaf.NotAfter) > wildcardRenewBefore {
+		w.mu.Unlock()
+		return cert, nil
+	}
+	done := w.startIssue()
+	w.mu.Unlock()
+
+	// Keep serving the current certificate while it's renewed
+	if cert != nil && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	<-done
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cert == nil || !time.Now().Before(w.cert.Leaf.NotAfter) {
+		return nil, w.issueErr
+	}
+	return w.cert, nil
+}
+
+// startIssue starts an issuance unless one is running or the last one
+// failed too recently, and returns a channel closed when it finishes.
+// Callers hold w.mu.
+func (w *wildcardIssuer) startIssue() chan struct{} {
+	if w.issuing != nil {
+		return w.issuing
+	}
+	if time.Now().Before(w.retryAt) {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+
+	done := make(chan struct{})
+	w.issuing = done
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), wildcardIssueTimeout)
+		defer cancel()
+
+		cert, err := w.issue(ctx)
+		if err != nil {
+			log.Printf("Failed to obtain wildcard certificate for *.%s: %v", w.domain, err)
+		} else {
+			log.Printf("Obtained wildcard certificate for *.%s, valid until %s", w.domain, cert.Leaf.NotAfter.Format(time.RFC3339))
+		}
+
+		w.mu.Lock()
+		if err == nil {
+			w.cert = cert
+		} else {
+			w.retryAt = time.Now().Add(wildcardRetryDelay)
+		}
+		w.issueErr = err
+		w.issuing = nil
+		w.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// issue runs a full ACME order for the domain and its wildcard
+func (w *wildcardIssuer) issue(ctx context.Context) (*tls.Certificate, error) {
+	client, err := w.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(w.domain, "*."+w.domain))
+	if err != nil {
+		return nil, fmt.Errorf("creating order: %w", err)
+	}
+
+	if err := w.authorize(ctx, client, order.AuthzURLs); err != nil {
+		return nil, err
+	}
+
+	key, err := w.newKey()
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: w.domain},
+		DNSNames: []string{w.domain, "*." + w.domain},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, fmt.Errorf("waiting for order: %w", err)
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, fmt.Errorf("finalizing order: %w", err)
+	}
+
+	cert, err := newCertificate(der, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.saveCached(ctx, cert); err != nil {
+		log.Printf("Failed to cache wildcard certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// authorize completes the DNS-01 challenge of every pending authorization.
+// The domain and its wildcard share one record name, so all records are
+// published before the CA is asked to look.
+func (w *wildcardIssuer) authorize(ctx context.Context, client *acme.Client, authzURLs []string) error {
+	type pending struct {
+		authzURL  string
+		challenge *acme.Challenge
+		fqdn      string
+		value     string
+	}
+	var challenges []pending
+
+	defer func() {
+		for _, p := range challenges {
+			if err := w.provider.CleanUp(context.Background(), p.fqdn, p.value); err != nil {
+				log.Printf("Failed to remove DNS record %s: %v", p.fqdn, err)
+			}
+		}
+	}()
+
+	for _, authzURL := range authzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return fmt.Errorf("fetching authorization: %w", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var challenge *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "dns-01" {
+				challenge = c
+				break
+			}
+		}
+		if challenge == nil {
+			return fmt.Errorf("CA offered no dns-01 challenge for %s", authz.Identifier.Value)
+		}
+
+		value, err := client.DNS01ChallengeRecord(challenge.Token)
+		if err != nil {
+			return err
+		}
+		fqdn := "_acme-challenge." + w.domain
+		if err := w.provider.Present(ctx, fqdn, value); err != nil {
+			return fmt.Errorf("creating DNS record %s: %w", fqdn, err)
+		}
+		challenges = append(challenges, pending{authzURL, challenge, fqdn, value})
+	}
+
+	if len(challenges) == 0 {
+		return nil
+	}
+
+	select {
+	case <-time.After(dnsPropagationDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, p := range challenges {
+		if _, err := client.Accept(ctx, p.challenge); err != nil {
+			return fmt.Errorf("accepting challenge: %w", err)
+		}
+	}
+	for _, p := range challenges {
+		if _, err := client.WaitAuthorization(ctx, p.authzURL); err != nil {
+			return fmt.Errorf("authorization failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// client returns an ACME client with a registered account, creating the
+// account key on first use
+func (w *wildcardIssuer) client(ctx context.Context) (*acme.Client, error) {
+	key, err := w.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{Key: key, DirectoryURL: w.directory}
+	account := &acme.Account{}
+	if w.email != "" {
+		account.Contact = []string{"mailto:" + w.email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("registering ACME account: %w", err)
+	}
+	return client, nil
+}
+
+// accountKey loads the ACME account key from the cache or creates one
+func (w *wildcardIssuer) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := w.cache.Get(ctx, wildcardAccountKey)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid cached account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.cache.Put(ctx, wildcardAccountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newKey generates a certificate key of the configured type
+func (w *wildcardIssuer) newKey() (crypto.Signer, error) {
+	if w.keyType == config.CertKeyTypeRSA {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// loadCached reads a certificate stored by saveCached
+func (w *wildcardIssuer) loadCached(ctx context.Context) (*tls.Certificate, error) {
+	data, err := w.cache.Get(ctx, w.domain+wildcardCertSuffix)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// saveCached stores cert's key and chain as PEM in one cache entry
+func (w *wildcardIssuer) saveCached(ctx context.Context, cert *tls.Certificate) error {
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	for _, c := range cert.Certificate {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+	}
+	return w.cache.Put(ctx, w.domain+wildcardCertSuffix, buf.Bytes())
+}
+
+// newCertificate builds a tls.Certificate from an issued chain and its key
+func newCertificate(der [][]byte, key crypto.Signer) (*tls.Certificate, error) {
+	if len(der) == 0 {
+		return nil, fmt.Errorf("CA returned no certificate")
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
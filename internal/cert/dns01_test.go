@@ -0,0 +1,62 @@
+package cert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+)
+
+// newTestWildcardIssuer returns an issuer for tunnel.test ordering from acme
+func newTestWildcardIssuer(acme *stubACME, dir string) *wildcardIssuer {
+	cfg := config.Load()
+	cfg.Domain = "tunnel.test"
+	cfg.CertCacheDir = dir
+	// The stub CA authorizes orders up front, so no DNS records are needed
+	w := newWildcardIssuer(cfg, nil)
+	w.directory = acme.URL + "/directory"
+	return w
+}
+
+func TestWildcardCertificateCoversSubdomains(t *testing.T) {
+	acme := newStubACME(t)
+	dir := t.TempDir()
+	w := newTestWildcardIssuer(acme, dir)
+
+	cert, err := w.certificate()
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	for _, host := range []string{"tunnel.test", "myapp.tunnel.test", "other.tunnel.test"} {
+		if err := cert.Leaf.VerifyHostname(host); err != nil {
+			t.Errorf("wildcard certificate doesn't cover %s: %v", host, err)
+		}
+	}
+
+	// A restart serves the cached certificate rather than ordering again
+	next := newTestWildcardIssuer(acme, dir)
+	if next.cert == nil || !next.cert.Leaf.Equal(cert.Leaf) {
+		t.Fatal("the issued certificate was not loaded from the cache")
+	}
+}
+
+func TestWildcardIssuanceFailureIsRetriedLater(t *testing.T) {
+	acme := newStubACME(t)
+	w := newTestWildcardIssuer(acme, t.TempDir())
+	acme.Close()
+
+	if _, err := w.certificate(); err == nil {
+		t.Fatal("certificate succeeded with the CA down")
+	}
+	w.mu.Lock()
+	retryAt := w.retryAt
+	w.mu.Unlock()
+	if retryAt.Before(time.Now().Add(wildcardRetryDelay - time.Minute)) {
+		t.Fatalf("retry scheduled at %s, want about %s from now", retryAt, wildcardRetryDelay)
+	}
+
+	// Handshakes until then fail right away instead of waiting on the CA
+	if _, err := w.certificate(); err == nil {
+		t.Fatal("certificate succeeded during the retry delay")
+	}
+}
@@ -0,0 +1,33 @@
+package cert
+
+import (
+	"crypto/tls"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+)
+
+// rsaSignatureSchemes is offered to autocert in place of the client's
+// schemes when RSA certificates are forced
+var rsaSignatureSchemes = []tls.SignatureScheme{
+	tls.PSSWithSHA256,
+	tls.PSSWithSHA384,
+	tls.PSSWithSHA512,
+	tls.PKCS1WithSHA256,
+	tls.PKCS1WithSHA384,
+	tls.PKCS1WithSHA512,
+	tls.PKCS1WithSHA1,
+}
+
+// withKeyType adjusts a client hello so autocert picks the configured key
+// type. autocert has no key type option: it serves ECDSA certificates to
+// clients that support them and RSA to the rest. Hiding ECDSA support
+// makes it issue and serve RSA certificates to every client.
+func withKeyType(hello *tls.ClientHelloInfo, keyType string) *tls.ClientHelloInfo {
+	if keyType != config.CertKeyTypeRSA {
+		return hello
+	}
+
+	rsaOnly := *hello
+	rsaOnly.SignatureSchemes = rsaSignatureSchemes
+	return &rsaOnly
+}
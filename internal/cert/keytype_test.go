@@ -0,0 +1,81 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"golang.org/x/crypto/acme"
+)
+
+func TestIssuedCertificateKeyType(t *testing.T) {
+	const host = "tunnel.test"
+	for _, tt := range []struct {
+		keyType string
+		isRSA   bool
+	}{
+		{config.CertKeyTypeECDSA, false},
+		{config.CertKeyTypeRSA, true},
+	} {
+		t.Run(tt.keyType, func(t *testing.T) {
+			acmeServer := newStubACME(t)
+			cfg := config.Load()
+			cfg.Domain = host
+			cfg.CertCacheDir = t.TempDir()
+			cfg.CertKeyType = tt.keyType
+			m := NewManager(cfg, tunnel.NewRegistry(0))
+			m.autocertManager.Client = &acme.Client{DirectoryURL: acmeServer.URL + "/directory"}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(acmeServer.ca.cert)
+			// The client supports ECDSA, so only the configuration decides
+			state := handshake(t, m.GetTLSConfig(), host, roots)
+
+			acmeServer.mu.Lock()
+			issued := acmeServer.issued
+			acmeServer.mu.Unlock()
+			if len(issued) != 1 {
+				t.Fatalf("ACME server issued %d certificates, want 1", len(issued))
+			}
+			for name, key := range map[string]crypto.PublicKey{
+				"issued": issued[0],
+				"served": state.PeerCertificates[0].PublicKey,
+			} {
+				_, isRSA := key.(*rsa.PublicKey)
+				_, isECDSA := key.(*ecdsa.PublicKey)
+				if isRSA != tt.isRSA || isECDSA == tt.isRSA {
+					t.Errorf("%s certificate key is %T", name, key)
+				}
+			}
+		})
+	}
+}
+
+func TestWithKeyType(t *testing.T) {
+	hello := &tls.ClientHelloInfo{
+		ServerName:       "tunnel.test",
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+	}
+
+	if got := withKeyType(hello, config.CertKeyTypeECDSA); got != hello {
+		t.Fatal("ECDSA key type changed the client hello")
+	}
+
+	got := withKeyType(hello, config.CertKeyTypeRSA)
+	for _, scheme := range got.SignatureSchemes {
+		if scheme == tls.ECDSAWithP256AndSHA256 {
+			t.Fatal("RSA key type still offers ECDSA signatures")
+		}
+	}
+	if got.ServerName != hello.ServerName {
+		t.Fatalf("server name = %q, want %q", got.ServerName, hello.ServerName)
+	}
+	if len(hello.SignatureSchemes) != 2 {
+		t.Fatal("the original client hello was modified")
+	}
+}
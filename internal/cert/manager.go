@@ -3,25 +3,50 @@ package cert
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// errUnknownHost is returned for hosts that aren't a registered tunnel
+var errUnknownHost = errors.New("no tunnel for host")
+
 // Manager handles TLS certificate management
 type Manager struct {
 	autocertManager *autocert.Manager
+	stapler         *ocspStapler
+	clientCAs       *x509.CertPool                  // clients must present a certificate from these CAs; nil disables
+	devCert         *tls.Certificate                // self-signed certificate served instead of autocert in dev mode
+	staticCert      atomic.Pointer[tls.Certificate] // certificate loaded from files, replacing autocert; see Reload
+	wildcard        *wildcardIssuer                 // DNS-01 wildcard certificate replacing autocert; nil when not configured
 	config          *config.Config
+
+	mu        sync.Mutex
+	failures  map[string]*failureStreak // host -> consecutive certificate failures
+	onFailure func(host string, err error)
+	readyErr  error // why the initial certificate isn't available yet, nil once it is
 }
 
-// NewManager creates a new certificate manager
-func NewManager(cfg *config.Config) *Manager {
-	// Create registry reference for validation (will be set later)
+// NewManager creates a new certificate manager. Certificates are only
+// requested for the base domain, the control subdomains and subdomains
+// registry knows about.
+func NewManager(cfg *config.Config, registry *tunnel.Registry) *Manager {
 	manager := &Manager{
-		config: cfg,
+		config:   cfg,
+		stapler:  newOCSPStapler(),
+		failures: make(map[string]*failureStreak),
 	}
 
 	m := &autocert.Manager{
@@ -34,14 +59,20 @@ func NewManager(cfg *config.Config) *Manager {
 			}
 
 			// Allow the base domain
-			if host == cfg.Domain {
+			host = strings.ToLower(host)
+			domain := strings.ToLower(cfg.Domain)
+			if host == domain {
 				log.Printf("Certificate requested for base domain: %s", host)
 				return nil
 			}
 
-			// For subdomains, log the request
-			// Note: We allow all subdomains because we can't check tunnel registry here
-			// The proxy layer will return 404 if tunnel doesn't exist
+			// Only subdomains with a tunnel, a reservation or a tunnel that
+			// just left get certificates, so requests for random hosts
+			// can't use up the CA's rate limits
+			name, ok := strings.CutSuffix(host, "."+domain)
+			if !ok || !(slices.Contains(cfg.ControlHosts, name) || registry.Known(name)) {
+				return fmt.Errorf("%w: %s", errUnknownHost, host)
+			}
 			log.Printf("Certificate requested for: %s", host)
 			return nil
 		},
@@ -53,38 +84,246 @@ func NewManager(cfg *config.Config) *Manager {
 	}
 
 	manager.autocertManager = m
+
+	// Dev mode serves a self-signed certificate; browsers will warn about it
+	if cfg.DevMode {
+		devCert, err := selfSignedCertificate(cfg.Domain)
+		if err != nil {
+			log.Fatalf("Failed to create self-signed certificate: %v", err)
+		}
+		manager.devCert = devCert
+		log.Printf("WARNING: dev mode is on, serving a self-signed certificate for %s and *.%s", cfg.Domain, cfg.Domain)
+	}
+
+	// A wildcard certificate covers every subdomain, so autocert is bypassed
+	if cfg.DNSProvider != "" {
+		provider, err := NewDNSProvider(cfg)
+		if err != nil {
+			log.Fatalf("Failed to set up DNS-01: %v", err)
+		}
+		manager.wildcard = newWildcardIssuer(cfg, provider)
+	}
+
+	// Certificates from files bypass autocert entirely
+	if cfg.TLSCertPath != "" {
+		if err := manager.Reload(); err != nil {
+			log.Fatalf("Failed to load TLS_CERT_PATH: %v", err)
+		}
+	}
+
+	// Config.Validate has already checked the file, so failing here means
+	// it changed since; serving without client auth would fail open
+	if cfg.ClientCAPath != "" {
+		pool, err := LoadCertPool(cfg.ClientCAPath)
+		if err != nil {
+			log.Fatalf("Failed to load client CAs: %v", err)
+		}
+		manager.clientCAs = pool
+	}
+
 	return manager
 }
 
 // GetTLSConfig returns a TLS configuration for HTTPS server
+// Certificates are served with a stapled OCSP response when their issuer
+// runs an OCSP responder.
 func (m *Manager) GetTLSConfig() *tls.Config {
-	return m.autocertManager.TLSConfig()
+	cfg := m.autocertManager.TLSConfig()
+	cfg.GetCertificate = m.getStapledCertificate
+	if m.devCert != nil {
+		cfg.GetCertificate = m.GetCertificate
+	}
+	if m.clientCAs != nil {
+		requireClientCerts(cfg, m.clientCAs)
+	}
+	return cfg
 }
 
 // GetTLSConfigForHijacking returns a TLS configuration with HTTP/2 disabled
 // This is required for connection hijacking to work properly.
 // HTTP/2 doesn't support hijacking, so we force HTTP/1.1.
+// NextProtos must keep acme.ALPNProto for TLS-ALPN challenges; the stapling
+// GetCertificate is carried over by Clone.
 func (m *Manager) GetTLSConfigForHijacking() *tls.Config {
 	// Clone the config to avoid mutating the shared instance
-	cfg := m.autocertManager.TLSConfig().Clone()
+	cfg := m.GetTLSConfig().Clone()
 	// Disable HTTP/2 by only allowing HTTP/1.1
-	cfg.NextProtos = []string{"http/1.1"}
+	cfg.NextProtos = []string{"http/1.1", acme.ALPNProto}
 	return cfg
 }
 
-// HTTPHandler returns HTTP handler for ACME HTTP-01 challenge
+// getStapledCertificate returns the autocert certificate for the handshake
+// with an OCSP response attached when one is available
+func (m *Manager) getStapledCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := m.GetCertificate(hello)
+	if err != nil {
+		return nil, err
+	}
+	return m.stapler.staple(cert), nil
+}
+
+// HTTPHandler returns HTTP handler for ACME HTTP-01 challenge. With
+// certificates from files or DNS-01 there are no HTTP challenges, so next
+// is returned as is.
 func (m *Manager) HTTPHandler() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
+		if m.UsesStaticCertificate() || m.wildcard != nil {
+			return next
+		}
 		return m.autocertManager.HTTPHandler(next)
 	}
 }
 
 // GetCertificate returns a certificate for the given client hello
 func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	cert, err := m.autocertManager.GetCertificate(hello)
+	if m.devCert != nil {
+		return m.devCert, nil
+	}
+	if cert := m.staticCert.Load(); cert != nil {
+		return cert, nil
+	}
+
+	var cert *tls.Certificate
+	var err error
+	if m.wildcard != nil {
+		cert, err = m.wildcard.certificate()
+	} else {
+		cert, err = m.autocertManager.GetCertificate(withKeyType(hello, m.config.CertKeyType))
+	}
+	if errors.Is(err, errUnknownHost) {
+		// Not worth a log line: scanners send these all the time
+		return nil, err
+	}
 	if err != nil {
 		log.Printf("Failed to get certificate for %s: %v", hello.ServerName, err)
+		m.recordFailure(hello.ServerName, err)
 		return nil, fmt.Errorf("failed to get certificate: %w", err)
 	}
+	m.recordSuccess(hello.ServerName)
 	return cert, nil
 }
+
+// failureStreak is a run of certificate failures for one host
+type failureStreak struct {
+	count    int
+	first    time.Time
+	reported bool
+}
+
+// OnPersistentFailure registers a callback run once a host has failed to
+// get a certificate CertFailureLimit times in a row over at least
+// CertFailureWindow, e.g. because a CAA record blocks issuance. Requiring
+// the failures to span the window keeps a short ACME outage from closing
+// tunnels. The callback runs again only after a success resets the count.
+func (m *Manager) OnPersistentFailure(fn func(host string, err error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.onFailure = fn
+}
+
+// recordFailure counts a certificate failure for host
+func (m *Manager) recordFailure(host string, err error) {
+	if host == "" || m.config.CertFailureLimit <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	streak := m.failures[host]
+	if streak == nil {
+		streak = &failureStreak{first: time.Now()}
+		m.failures[host] = streak
+	}
+	streak.count++
+	persistent := !streak.reported && streak.count >= m.config.CertFailureLimit &&
+		time.Since(streak.first) >= m.config.CertFailureWindow
+	if persistent {
+		streak.reported = true
+	}
+	count, since := streak.count, streak.first
+	onFailure := m.onFailure
+	m.mu.Unlock()
+
+	if persistent && onFailure != nil {
+		log.Printf("Certificate for %s failed %d times in a row since %s", host, count, since.Format(time.RFC3339))
+		go onFailure(host, err)
+	}
+}
+
+// WarmUp obtains the certificate for the base domain in the background, so
+// an unreachable ACME CA shows up in the logs at startup rather than as a
+// hanging first handshake. Until the certificate is available, Ready
+// reports an error. If it takes longer than timeout a clear error is
+// logged, but the attempt keeps going. Dev mode and certificates from
+// files have nothing to obtain.
+func (m *Manager) WarmUp(timeout time.Duration) {
+	if m.devCert != nil || m.UsesStaticCertificate() {
+		return
+	}
+
+	m.setReady(fmt.Errorf("waiting for initial certificate for %s", m.config.Domain))
+
+	hello := &tls.ClientHelloInfo{
+		ServerName:       m.config.Domain,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.GetCertificate(hello)
+		done <- err
+	}()
+
+	go func() {
+		select {
+		case err := <-done:
+			m.finishWarmUp(err)
+		case <-time.After(timeout):
+			log.Printf("ERROR: no certificate for %s after %v; check that the ACME CA is reachable and that DNS for %s points to this server",
+				m.config.Domain, timeout, m.config.Domain)
+			m.setReady(fmt.Errorf("timed out after %v waiting for initial certificate for %s", timeout, m.config.Domain))
+			m.finishWarmUp(<-done)
+		}
+	}()
+}
+
+// finishWarmUp records the outcome of the initial certificate request
+func (m *Manager) finishWarmUp(err error) {
+	if err != nil {
+		m.setReady(fmt.Errorf("initial certificate for %s failed: %w", m.config.Domain, err))
+		return
+	}
+	log.Printf("Initial certificate for %s is ready", m.config.Domain)
+	m.setReady(nil)
+}
+
+// Ready returns nil once the initial certificate is available, or the
+// reason it isn't. Without a WarmUp it always returns nil.
+func (m *Manager) Ready() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.readyErr
+}
+
+// setReady updates the readiness state reported by Ready
+func (m *Manager) setReady(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.readyErr = err
+}
+
+// recordSuccess resets the failure count for host. A certificate for the
+// base domain also makes the server ready if the warm-up failed or timed out.
+func (m *Manager) recordSuccess(host string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.failures, host)
+	if m.readyErr != nil && strings.EqualFold(host, m.config.Domain) {
+		m.readyErr = nil
+	}
+}
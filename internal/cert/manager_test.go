@@ -0,0 +1,135 @@
+package cert
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// newFailureManager returns a manager that only tracks certificate
+// failures, reporting persistent ones on the returned channel
+func newFailureManager(limit int, window time.Duration) (*Manager, chan string) {
+	m := &Manager{
+		config:   &config.Config{CertFailureLimit: limit, CertFailureWindow: window},
+		failures: make(map[string]*failureStreak),
+	}
+	reported := make(chan string, 8)
+	m.OnPersistentFailure(func(host string, err error) { reported <- host })
+	return m, reported
+}
+
+// expectReport waits for a report for host, or checks none arrives when
+// host is empty
+func expectReport(t *testing.T, reported chan string, host string) {
+	t.Helper()
+
+	if host == "" {
+		select {
+		case got := <-reported:
+			t.Fatalf("unexpected persistent failure for %s", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+		return
+	}
+	select {
+	case got := <-reported:
+		if got != host {
+			t.Fatalf("persistent failure reported for %s, want %s", got, host)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no persistent failure reported for %s", host)
+	}
+}
+
+var errIssuance = errors.New("acme: CAA record forbids issuance")
+
+func TestCertFailuresOffByDefault(t *testing.T) {
+	if limit := config.Load().CertFailureLimit; limit != 0 {
+		t.Fatalf("CERT_FAILURE_LIMIT defaults to %d, want 0", limit)
+	}
+
+	m, reported := newFailureManager(0, 0)
+	for i := 0; i < 10; i++ {
+		m.recordFailure("myapp.example.com", errIssuance)
+	}
+	expectReport(t, reported, "")
+}
+
+func TestCertFailuresReportedAfterLimit(t *testing.T) {
+	m, reported := newFailureManager(3, 0)
+
+	m.recordFailure("myapp.example.com", errIssuance)
+	m.recordFailure("myapp.example.com", errIssuance)
+	m.recordFailure("other.example.com", errIssuance)
+	expectReport(t, reported, "")
+
+	m.recordFailure("myapp.example.com", errIssuance)
+	expectReport(t, reported, "myapp.example.com")
+
+	// Reported once per streak
+	m.recordFailure("myapp.example.com", errIssuance)
+	expectReport(t, reported, "")
+}
+
+func TestCertSuccessResetsFailures(t *testing.T) {
+	m, reported := newFailureManager(2, 0)
+
+	m.recordFailure("myapp.example.com", errIssuance)
+	m.recordSuccess("myapp.example.com")
+	m.recordFailure("myapp.example.com", errIssuance)
+	expectReport(t, reported, "")
+
+	m.recordFailure("myapp.example.com", errIssuance)
+	expectReport(t, reported, "myapp.example.com")
+}
+
+// A burst of failures during a short ACME outage isn't persistent
+func TestCertFailuresMustSpanWindow(t *testing.T) {
+	window := 100 * time.Millisecond
+	m, reported := newFailureManager(3, window)
+
+	for i := 0; i < 10; i++ {
+		m.recordFailure("myapp.example.com", errIssuance)
+	}
+	expectReport(t, reported, "")
+
+	time.Sleep(window)
+	m.recordFailure("myapp.example.com", errIssuance)
+	expectReport(t, reported, "myapp.example.com")
+}
+
+// Random hosts under the domain don't get a certificate request, so they
+// can't use up the CA's rate limits
+func TestHostPolicyOnlyAllowsKnownHosts(t *testing.T) {
+	cfg := config.Load()
+	cfg.Domain = "tunnel.test"
+	cfg.CertCacheDir = t.TempDir()
+	cfg.ControlHosts = []string{"admin"}
+	registry := tunnel.NewRegistry(0)
+	tun := &tunnel.Tunnel{ID: "myapp-id"}
+	tun.SetSubdomain("myapp")
+	if err := registry.Register(tun); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(cfg, registry)
+
+	for host, allowed := range map[string]bool{
+		"tunnel.test":        true,
+		"Tunnel.Test":        true,
+		"admin.tunnel.test":  true,
+		"myapp.tunnel.test":  true,
+		"MyApp.tunnel.test":  true,
+		"random.tunnel.test": false,
+		"myapp.example.org":  false,
+		"localhost":          false,
+	} {
+		err := m.autocertManager.HostPolicy(context.Background(), host)
+		if (err == nil) != allowed {
+			t.Errorf("HostPolicy(%q) = %v, want allowed %t", host, err, allowed)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// stapledResponse is a cached OCSP response for one certificate
+type stapledResponse struct {
+	raw       []byte
+	refreshAt time.Time
+}
+
+// ocspStapler staples OCSP responses to certificates whose issuer runs an
+// OCSP responder. Responses are fetched in the background so handshakes are
+// never blocked on the responder; until one is available, certificates are
+// served without a staple.
+type ocspStapler struct {
+	mu       sync.Mutex
+	cache    map[string]*stapledResponse // leaf serial -> response
+	fetching map[string]bool
+	client   *http.Client
+}
+
+// newOCSPStapler creates an empty stapler
+func newOCSPStapler() *ocspStapler {
+	return &ocspStapler{
+		cache:    make(map[string]*stapledResponse),
+		fetching: make(map[string]bool),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// staple returns cert with a cached OCSP response attached, starting a
+// background refresh when none is cached or it is due. The certificate is
+// copied rather than modified, since autocert shares it across handshakes.
+func (s *ocspStapler) staple(cert *tls.Certificate) *tls.Certificate {
+	if len(cert.Certificate) < 2 {
+		return cert
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return cert
+		}
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return cert
+	}
+
+	key := leaf.SerialNumber.String()
+
+	s.mu.Lock()
+	resp := s.cache[key]
+	if (resp == nil || time.Now().After(resp.refreshAt)) && !s.fetching[key] {
+		s.fetching[key] = true
+		go s.fetch(key, leaf, cert.Certificate[1])
+	}
+	s.mu.Unlock()
+
+	if resp == nil {
+		return cert
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = resp.raw
+	return &stapled
+}
+
+// fetch requests a fresh OCSP response for leaf and caches it if it is good
+func (s *ocspStapler) fetch(key string, leaf *x509.Certificate, issuerDER []byte) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.fetching, key)
+		s.mu.Unlock()
+	}()
+
+	raw, resp, err := s.request(leaf, issuerDER)
+	if err != nil {
+		log.Printf("Failed to fetch OCSP response for %v: %v", leaf.DNSNames, err)
+		return
+	}
+	if resp.Status != ocsp.Good {
+		log.Printf("OCSP status for %v is not good (%d), not stapling", leaf.DNSNames, resp.Status)
+		return
+	}
+
+	// Refresh halfway to the next update, or hourly if the responder gives none
+	refreshAt := time.Now().Add(time.Hour)
+	if !resp.NextUpdate.IsZero() {
+		refreshAt = resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	}
+
+	s.mu.Lock()
+	s.cache[key] = &stapledResponse{raw: raw, refreshAt: refreshAt}
+	s.mu.Unlock()
+}
+
+// request queries the certificate's OCSP responder
+func (s *ocspStapler) request(leaf *x509.Certificate, issuerDER []byte) ([]byte, *ocsp.Response, error) {
+	issuer, err := x509.ParseCertificate(issuerDER)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid issuer certificate: %w", err)
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	httpResp, err := s.client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder returned %s", httpResp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return raw, resp, nil
+}
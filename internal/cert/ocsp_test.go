@@ -0,0 +1,189 @@
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA issues certificates that point at its own OCSP responder
+type testCA struct {
+	cert      *x509.Certificate
+	key       *ecdsa.PrivateKey
+	responder *httptest.Server
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{key: key}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	// The responder vouches for every certificate it is asked about
+	ca.responder = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	t.Cleanup(ca.responder.Close)
+	return ca
+}
+
+// issue returns a certificate for host and its key in the PEM layout of an
+// autocert cache entry: the private key followed by the chain
+func (ca *testCA) issue(t *testing.T, host string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{ca.responder.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	pem.Encode(&out, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pem.Encode(&out, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&out, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	return out.Bytes()
+}
+
+// handshake connects to a TLS server using cfg and returns the state of
+// the verified connection
+func handshake(t *testing.T, cfg *tls.Config, host string, roots *x509.CertPool) tls.ConnectionState {
+	t.Helper()
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		tls.Server(serverConn, cfg).Handshake()
+	}()
+
+	client := tls.Client(clientConn, &tls.Config{ServerName: host, RootCAs: roots, NextProtos: []string{"http/1.1"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.HandshakeContext(ctx); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	return client.ConnectionState()
+}
+
+// Issued certificates are served with a stapled OCSP response by both TLS
+// configs, once the stapler has fetched one
+func TestIssuedCertificatesAreStapled(t *testing.T) {
+	const host = "tunnel.test"
+	ca := newTestCA(t)
+	cacheDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(cacheDir, host), ca.issue(t, host), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Load()
+	cfg.Domain = host
+	cfg.CertCacheDir = cacheDir
+	m := NewManager(cfg, tunnel.NewRegistry(0))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for name, tlsConfig := range map[string]*tls.Config{
+		"GetTLSConfig":             m.GetTLSConfig(),
+		"GetTLSConfigForHijacking": m.GetTLSConfigForHijacking(),
+	} {
+		var state tls.ConnectionState
+		testkit.WaitFor(t, name+" to staple an OCSP response", func() bool {
+			state = handshake(t, tlsConfig, host, roots)
+			return state.OCSPResponse != nil
+		})
+
+		resp, err := ocsp.ParseResponseForCert(state.OCSPResponse, state.PeerCertificates[0], ca.cert)
+		if err != nil {
+			t.Fatalf("%s: invalid stapled response: %v", name, err)
+		}
+		if resp.Status != ocsp.Good {
+			t.Fatalf("%s: stapled status = %d, want good", name, resp.Status)
+		}
+	}
+}
+
+// Certificates without an OCSP responder are served as they are
+func TestStaplerSkipsCertificatesWithoutResponder(t *testing.T) {
+	cert, err := selfSignedCertificate("tunnel.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newOCSPStapler()
+	if got := s.staple(cert); got != cert || got.OCSPStaple != nil {
+		t.Fatal("stapler changed a certificate without an OCSP responder")
+	}
+}
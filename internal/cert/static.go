@@ -0,0 +1,30 @@
+package cert
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+)
+
+// Reload reads the certificate and key from TLSCertPath and TLSKeyPath
+// again, e.g. after they were renewed. Handshakes already using the old
+// certificate are unaffected. On error the current certificate is kept.
+func (m *Manager) Reload() error {
+	if m.config.TLSCertPath == "" {
+		return fmt.Errorf("no certificate files configured")
+	}
+
+	cert, err := tls.LoadX509KeyPair(m.config.TLSCertPath, m.config.TLSKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	m.staticCert.Store(&cert)
+	log.Printf("Loaded certificate from %s", m.config.TLSCertPath)
+	return nil
+}
+
+// UsesStaticCertificate reports whether certificates come from files
+// rather than autocert
+func (m *Manager) UsesStaticCertificate() bool {
+	return m.staticCert.Load() != nil
+}
@@ -0,0 +1,73 @@
+package cert
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// Certificates from files are served instead of autocert's, and Reload
+// swaps them without a restart unless the new files are unusable
+func TestStaticCertificateReload(t *testing.T) {
+	const host = "tunnel.test"
+	ca := newTestCA(t)
+	// The autocert cache layout holds the key and the chain in one file,
+	// which serves as both TLS_CERT_PATH and TLS_KEY_PATH
+	path := filepath.Join(t.TempDir(), "tunnel.pem")
+	if err := os.WriteFile(path, ca.issue(t, host), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Load()
+	cfg.Domain = host
+	cfg.CertCacheDir = t.TempDir()
+	cfg.TLSCertPath = path
+	cfg.TLSKeyPath = path
+	m := NewManager(cfg, tunnel.NewRegistry(0))
+	if !m.UsesStaticCertificate() {
+		t.Fatal("UsesStaticCertificate() = false with TLS_CERT_PATH set")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	served := func() *x509.Certificate {
+		return handshake(t, m.GetTLSConfig(), host, roots).PeerCertificates[0]
+	}
+	first := served()
+
+	if err := os.WriteFile(path, ca.issue(t, host), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	renewed := served()
+	if renewed.Equal(first) {
+		t.Fatal("still serving the old certificate after Reload")
+	}
+
+	if err := os.WriteFile(path, []byte("truncated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err == nil {
+		t.Fatal("Reload accepted an invalid certificate file")
+	}
+	if !served().Equal(renewed) {
+		t.Fatal("a failed Reload replaced the certificate")
+	}
+}
+
+func TestReloadWithoutCertificateFiles(t *testing.T) {
+	cfg := config.Load()
+	cfg.CertCacheDir = t.TempDir()
+	m := NewManager(cfg, tunnel.NewRegistry(0))
+	if m.UsesStaticCertificate() {
+		t.Fatal("UsesStaticCertificate() = true without TLS_CERT_PATH")
+	}
+	if err := m.Reload(); err == nil {
+		t.Fatal("Reload succeeded without certificate files")
+	}
+}
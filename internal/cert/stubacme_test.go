@@ -0,0 +1,181 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubACME is an ACME server that authorizes every order up front and
+// signs whatever key the CSR carries with a test CA
+type stubACME struct {
+	*httptest.Server
+	ca *testCA
+
+	mu     sync.Mutex
+	host   string
+	issued []crypto.PublicKey // keys of the certificates issued so far
+	chain  []byte
+}
+
+func newStubACME(t *testing.T) *stubACME {
+	t.Helper()
+
+	s := &stubACME{ca: newTestCA(t)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order/new",
+			"revokeCert": s.URL + "/revoke",
+			"keyChange":  s.URL + "/key-change",
+		})
+	})
+	mux.HandleFunc("/nonce", s.nonce)
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		s.nonce(w, r)
+		w.Header().Set("Location", s.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	})
+	mux.HandleFunc("/order/new", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		s.decode(t, r, &req)
+		s.mu.Lock()
+		s.host = req.Identifiers[0].Value
+		s.mu.Unlock()
+
+		s.nonce(w, r)
+		w.Header().Set("Location", s.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		s.writeOrder(w, "pending")
+	})
+	mux.HandleFunc("/order/1", func(w http.ResponseWriter, r *http.Request) {
+		s.nonce(w, r)
+		s.mu.Lock()
+		status := "ready"
+		if s.chain != nil {
+			status = "valid"
+		}
+		s.mu.Unlock()
+		s.writeOrder(w, status)
+	})
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, r *http.Request) {
+		s.nonce(w, r)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     "valid",
+			"identifier": map[string]string{"type": "dns", "value": s.host},
+			"challenges": []interface{}{},
+		})
+	})
+	mux.HandleFunc("/finalize", func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ CSR string }
+		s.decode(t, r, &req)
+		der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+		if err != nil {
+			t.Errorf("finalize: %v", err)
+			return
+		}
+		s.issue(t, der)
+
+		s.nonce(w, r)
+		s.writeOrder(w, "valid")
+	})
+	mux.HandleFunc("/cert/1", func(w http.ResponseWriter, r *http.Request) {
+		s.nonce(w, r)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(s.chain)
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// nonce sets a fresh replay nonce, which every ACME response carries
+func (s *stubACME) nonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// decode reads the payload of a JWS request body into v without checking
+// the signature
+func (s *stubACME) decode(t *testing.T, r *http.Request, v interface{}) {
+	var jws struct{ Payload string }
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &jws); err != nil {
+		t.Errorf("%s: invalid JWS: %v", r.URL.Path, err)
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		t.Errorf("%s: invalid payload: %v", r.URL.Path, err)
+		return
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		t.Errorf("%s: invalid payload: %v", r.URL.Path, err)
+	}
+}
+
+// writeOrder writes the single order this server knows about
+func (s *stubACME) writeOrder(w http.ResponseWriter, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := map[string]interface{}{
+		"status":         status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": s.host}},
+		"authorizations": []string{s.URL + "/authz/1"},
+		"finalize":       s.URL + "/finalize",
+	}
+	if status == "valid" {
+		order["certificate"] = s.URL + "/cert/1"
+	}
+	json.NewEncoder(w).Encode(order)
+}
+
+// issue signs the key of a CSR with the test CA
+func (s *stubACME) issue(t *testing.T, csrDER []byte) {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Errorf("finalize: %v", err)
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca.cert, csr.PublicKey, s.ca.key)
+	if err != nil {
+		t.Errorf("finalize: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.issued = append(s.issued, csr.PublicKey)
+	s.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.cert.Raw})...)
+}
@@ -0,0 +1,172 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newWarmUpManager returns a manager for tunnel.test caching certificates
+// in dir
+func newWarmUpManager(dir string) *Manager {
+	cfg := config.Load()
+	cfg.Domain = "tunnel.test"
+	cfg.CertCacheDir = dir
+	return NewManager(cfg, tunnel.NewRegistry(0))
+}
+
+// waitForReady polls Ready until check accepts its result
+func waitForReady(t *testing.T, m *Manager, what string, check func(error) bool) {
+	t.Helper()
+
+	testkit.WaitFor(t, what, func() bool { return check(m.Ready()) })
+}
+
+func TestWarmUpTimesOutOnSlowACME(t *testing.T) {
+	// The ACME directory answers only once released, and then with an error
+	release := make(chan struct{})
+	acmeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		http.Error(w, "not an ACME server", http.StatusNotFound)
+	}))
+	defer acmeServer.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	m := newWarmUpManager(t.TempDir())
+	m.autocertManager.Client = &acme.Client{DirectoryURL: acmeServer.URL}
+
+	if err := m.Ready(); err != nil {
+		t.Fatalf("Ready() before WarmUp = %v, want nil", err)
+	}
+	m.WarmUp(50 * time.Millisecond)
+	if err := m.Ready(); err == nil || !strings.Contains(err.Error(), "waiting") {
+		t.Fatalf("Ready() during WarmUp = %v, want waiting", err)
+	}
+
+	waitForReady(t, m, "the timeout", func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "timed out")
+	})
+
+	// The attempt keeps going; its failure replaces the timeout
+	close(release)
+	waitForReady(t, m, "the failed attempt", func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "failed")
+	})
+}
+
+// A failed warm-up doesn't keep the server unready once a certificate for
+// the base domain is obtained after all
+func TestReadyAfterWarmUpFailure(t *testing.T) {
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+
+	m := newWarmUpManager(t.TempDir())
+	m.autocertManager.Client = &acme.Client{DirectoryURL: broken.URL}
+	m.WarmUp(time.Second)
+	waitForReady(t, m, "the failed attempt", func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "failed")
+	})
+
+	// autocert holds on to a failed order for a minute before trying
+	// again; a fresh manager with a working CA stands in for the retry
+	acmeServer := newStubACME(t)
+	failed := m.autocertManager
+	m.autocertManager = &autocert.Manager{
+		Prompt:     failed.Prompt,
+		Cache:      failed.Cache,
+		HostPolicy: failed.HostPolicy,
+		Client:     &acme.Client{DirectoryURL: acmeServer.URL + "/directory"},
+	}
+
+	// Other hosts don't make the server ready
+	if err := m.Ready(); err == nil {
+		t.Fatal("Ready() = nil before any certificate was issued")
+	}
+	m.recordSuccess("myapp.tunnel.test")
+	if err := m.Ready(); err == nil {
+		t.Fatal("Ready() = nil after a certificate for another host")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(acmeServer.ca.cert)
+	handshake(t, m.GetTLSConfig(), "tunnel.test", roots)
+	if err := m.Ready(); err != nil {
+		t.Fatalf("Ready() after the base domain certificate was issued = %v, want nil", err)
+	}
+}
+
+func TestWarmUpWithCachedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tunnel.test"), newTestCA(t).issue(t, "tunnel.test"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newWarmUpManager(dir)
+	m.WarmUp(time.Second)
+	waitForReady(t, m, "the cached certificate", func(err error) bool { return err == nil })
+}
+
+// Dev mode has no certificate to obtain, so it is ready at once
+func TestWarmUpInDevMode(t *testing.T) {
+	cfg := config.Load()
+	cfg.Domain = "tunnel.test"
+	cfg.DevMode = true
+	m := NewManager(cfg, tunnel.NewRegistry(0))
+	m.WarmUp(time.Second)
+	if err := m.Ready(); err != nil {
+		t.Fatalf("Ready() in dev mode = %v, want nil", err)
+	}
+}
+
+// Dev mode serves one self-signed certificate for the domain and all its
+// subdomains from both TLS configs, without asking a CA
+func TestDevModeServesSelfSignedCertificate(t *testing.T) {
+	cfg := config.Load()
+	cfg.Domain = "tunnel.test"
+	cfg.DevMode = true
+	// An unreachable CA would fail the handshakes if it were asked
+	cfg.CertCacheDir = t.TempDir()
+	m := NewManager(cfg, tunnel.NewRegistry(0))
+	m.autocertManager.Client = &acme.Client{DirectoryURL: "http://127.0.0.1:1/directory"}
+
+	leaf, err := x509.ParseCertificate(m.devCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	for name, tlsConfig := range map[string]*tls.Config{
+		"GetTLSConfig":             m.GetTLSConfig(),
+		"GetTLSConfigForHijacking": m.GetTLSConfigForHijacking(),
+	} {
+		for _, host := range []string{"tunnel.test", "myapp.tunnel.test"} {
+			state := handshake(t, tlsConfig, host, roots)
+			if !state.PeerCertificates[0].Equal(leaf) {
+				t.Errorf("%s: %s got a certificate other than the dev one", name, host)
+			}
+		}
+	}
+}
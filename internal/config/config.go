@@ -1,35 +1,412 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"html/template"
+	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/ipfilter"
+	"github.com/ahmadrosid/tunnel/internal/subdomain"
+	"golang.org/x/net/http/httpguts"
+)
+
+// Forwarding modes for proxied requests
+const (
+	// ForwardModeHijack pipes raw bytes over the hijacked client connection
+	ForwardModeHijack = "hijack"
+	// ForwardModeBuffered round-trips each request and writes the response
+	// through the ResponseWriter, so HTTP/2 can be served
+	ForwardModeBuffered = "buffered"
+)
+
+// Styles for randomly generated subdomains
+const (
+	SubdomainStyleHex      = "hex"      // e.g. 3f9a1c2b
+	SubdomainStyleReadable = "readable" // e.g. happy-otter-42
+)
+
+// Log output formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Log levels, from most to least verbose
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// Key types for issued certificates
+const (
+	CertKeyTypeECDSA = "ecdsa" // ECDSA, with RSA only for clients that lack ECDSA support
+	CertKeyTypeRSA   = "rsa"   // RSA for every client
+)
+
+// DNS providers for DNS-01 challenges
+const (
+	DNSProviderCloudflare = "cloudflare"
 )
 
 // Config holds the server configuration
 type Config struct {
-	WebSocketPort    int
-	Domain           string
-	HTTPPort         int
-	HTTPSPort        int
-	CertCacheDir     string
-	LetsEncryptEmail string
-	RequestTimeout   time.Duration
-	EnableHTTPS      bool
+	WebSocketPort       int
+	Domain              string
+	HTTPPort            int
+	HTTPSPort           int
+	CertCacheDir        string
+	CertKeyType         string // Key type of issued certificates: "ecdsa" or "rsa"
+	ClientCAPath        string // PEM CA bundle; when set, HTTPS clients must present a certificate it signed
+	DevMode             bool   // Serve a self-signed certificate instead of using Let's Encrypt
+	TLSCertPath         string // PEM certificate served instead of using Let's Encrypt; requires TLSKeyPath
+	TLSKeyPath          string // PEM private key for TLSCertPath
+	IPDenylistPath      string // File of CIDR ranges whose tunnel client connections are refused
+	DNSProvider         string // When set, one wildcard certificate is obtained through DNS-01 with this provider
+	CloudflareAPIToken  string // API token for DNSProviderCloudflare
+	LogFormat           string // LogFormatText or LogFormatJSON
+	LogLevel            string // LogLevelDebug, LogLevelInfo, LogLevelWarn or LogLevelError
+	LetsEncryptEmail    string
+	RequestTimeout      time.Duration
+	MaxTimeout          time.Duration // Upper bound for per-request timeout overrides; 0 disables them
+	EnableHTTPS         bool
+	InstanceID          string // Sent as X-Served-By when set
+	RegisterQRCode      bool   // Include a terminal QR code of the public URL in register responses
+	ReconnectGrace      time.Duration
+	RegistryStatePath   string   // File the registry's reclaimable subdomains are saved to; empty disables
+	ControlHosts        []string // Reserved subdomains that serve the control endpoints
+	AllowedOrigins      []string // Origin headers allowed to open tunnel connections; empty or "*" allows all
+	ForwardMode         string   // ForwardModeHijack or ForwardModeBuffered
+	PathRoutingPrefix   string   // On the base domain, "/t/" routes /t/<subdomain>/... to that tunnel; empty disables
+	AdminToken          string   // Bearer token for the admin API; empty disables it
+	AuditLogSize        int
+	MaxTunnels          int    // 0 means unlimited
+	MaxControlConns     int    // Open tunnel client connections; 0 means unlimited
+	MaxVisitorConns     int    // Open visitor connections to the proxy; 0 means unlimited
+	SoftConcurrency     int    // In-flight requests per tunnel above which a warning is logged; 0 disables
+	PausedMessage       string // Body of the 503 served while a tunnel is paused
+	ReconnectingMessage string // Body of the 503 response served while a tunnel's client is reconnecting
+	NotFoundPagePath    string // HTML template served when no tunnel matches the subdomain
+	TCPNoDelay          bool   // Disables Nagle's algorithm on forwarded client connections
+	AccessLog           bool   // Log one line per proxied request with its status, size and duration
+	DNSCheck            bool   // Verify at startup that Domain and *.Domain resolve
+	DNSCheckStrict      bool   // Refuse to start when the DNS check fails
+	PublicIP            string // Address the DNS records are expected to point to
+	BreakerThreshold    int    // Consecutive backend failures that open a tunnel's circuit; 0 disables
+	BreakerWindow       time.Duration
+	BreakerCooldown     time.Duration
+	MaxSubdomainLen     int               // Longest custom subdomain accepted, at most 63
+	CertFailureLimit    int               // Consecutive certificate failures after which a host's tunnel is closed; 0 disables
+	CertFailureWindow   time.Duration     // How long a host's certificate must keep failing before its tunnel is closed
+	WriteCoalesce       time.Duration     // Window for batching small tunnel writes into one frame; 0 disables
+	CertStartupTimeout  time.Duration     // How long to wait for the base domain certificate at startup before logging an error; 0 skips the startup request
+	CopyBufferSize      int               // Size of the pooled buffers used to copy proxied data
+	AuthTokens          map[string]string // Tokens accepted for tunnel registration, mapped to a label for logs; empty allows everyone
+	AllowedLocalPorts   []string          // Ports or ranges (e.g. "3000", "8000-8999") clients may expose; empty allows all
+	DenyPrivileged      bool              // Reject local ports below 1024
+	RequestsPerSecond   float64           // Per-tunnel request rate limit; 0 disables
+	BurstSize           int               // Requests a tunnel may make at once above the rate; 0 means one second's worth
+	IdleTimeout         time.Duration     // Tunnels without traffic for this long are closed; 0 disables
+	CloseDrainTimeout   time.Duration     // How long in-flight requests may finish when the server closes a tunnel; 0 closes at once
+	ShutdownTimeout     time.Duration     // How long each server may drain on shutdown
+	ProxyShutdown       time.Duration     // Drain budget of the standalone proxy; 0 uses ShutdownTimeout
+	WSShutdown          time.Duration     // Drain budget of the standalone WebSocket server; 0 uses ShutdownTimeout
+	StatsDAddr          string            // StatsD server to push metrics to over UDP; empty disables
+	StatsDPrefix        string            // Prefix of the metric names sent to StatsD
+	StatsDInterval      time.Duration     // How often metrics are pushed to StatsD
+	TrustedHops         int               // Proxies in front of this server whose X-Forwarded-For entries are trusted
+	SchemeHeaders       []string          // Headers telling backends the visitor's scheme: "Name" or "Name=value"
+	SubdomainStyle      string            // How random subdomains look: hex or readable
+	SubdomainLength     int               // Characters in random hex subdomains, clamped to 1-MaxSubdomainLen
+	SubdomainAttempts   int               // Random subdomains tried before registration gives up on collisions
+	ResponseBufferLimit int               // Largest response held in memory for tunnels that buffer responses
+	MigrateFrom         string            // Base URL of an instance to import reservations from at startup
+	MigrateToken        string            // Admin token of the MigrateFrom instance
 }
 
 // Load reads configuration from environment variables with defaults
 func Load() *Config {
-	return &Config{
-		WebSocketPort:    getEnvAsInt("WS_PORT", 8080),
-		Domain:           getEnv("DOMAIN", "easypod.cloud"),
-		HTTPPort:         getEnvAsInt("HTTP_PORT", 80),
-		HTTPSPort:        getEnvAsInt("HTTPS_PORT", 443),
-		CertCacheDir:     getEnv("CERT_CACHE_DIR", "./certs"),
-		LetsEncryptEmail: getEnv("LETSENCRYPT_EMAIL", ""),
-		RequestTimeout:   getEnvAsDuration("REQUEST_TIMEOUT", 30*time.Second),
-		EnableHTTPS:      getEnvAsBool("ENABLE_HTTPS", true),
+	cfg := &Config{
+		WebSocketPort:       getEnvAsInt("WS_PORT", 8080),
+		Domain:              getEnv("DOMAIN", "easypod.cloud"),
+		HTTPPort:            getEnvAsInt("HTTP_PORT", 80),
+		HTTPSPort:           getEnvAsInt("HTTPS_PORT", 443),
+		CertCacheDir:        getEnv("CERT_CACHE_DIR", "./certs"),
+		CertKeyType:         getEnv("CERT_KEY_TYPE", CertKeyTypeECDSA),
+		ClientCAPath:        getEnv("CLIENT_CA_PATH", ""),
+		DevMode:             getEnvAsBool("DEV_MODE", false),
+		TLSCertPath:         getEnv("TLS_CERT_PATH", ""),
+		TLSKeyPath:          getEnv("TLS_KEY_PATH", ""),
+		IPDenylistPath:      getEnv("IP_DENYLIST_PATH", ""),
+		DNSProvider:         strings.ToLower(getEnv("DNS_PROVIDER", "")),
+		CloudflareAPIToken:  getEnv("CLOUDFLARE_API_TOKEN", ""),
+		LogFormat:           getEnv("LOG_FORMAT", LogFormatText),
+		LogLevel:            strings.ToLower(getEnv("LOG_LEVEL", LogLevelInfo)),
+		LetsEncryptEmail:    getEnv("LETSENCRYPT_EMAIL", ""),
+		RequestTimeout:      getEnvAsDuration("REQUEST_TIMEOUT", 30*time.Second),
+		MaxTimeout:          getEnvAsDuration("MAX_REQUEST_TIMEOUT", 5*time.Minute),
+		EnableHTTPS:         getEnvAsBool("ENABLE_HTTPS", true),
+		RegisterQRCode:      getEnvAsBool("REGISTER_QR_CODE", false),
+		InstanceID:          getEnv("INSTANCE_ID", ""),
+		ReconnectGrace:      getEnvAsDuration("RECONNECT_GRACE", 30*time.Second),
+		RegistryStatePath:   getEnv("REGISTRY_STATE_PATH", ""),
+		ControlHosts:        getEnvAsList("CONTROL_SUBDOMAINS", []string{"admin", "api"}),
+		AllowedOrigins:      getEnvAsList("ALLOWED_ORIGINS", nil),
+		ForwardMode:         getEnv("FORWARD_MODE", ForwardModeHijack),
+		PathRoutingPrefix:   getEnv("PATH_ROUTING_PREFIX", ""),
+		AdminToken:          getEnv("ADMIN_TOKEN", ""),
+		AuditLogSize:        getEnvAsInt("AUDIT_LOG_SIZE", 100),
+		MaxTunnels:          getEnvAsInt("MAX_TUNNELS", 0),
+		MaxControlConns:     getEnvAsInt("MAX_CONTROL_CONNECTIONS", 0),
+		MaxVisitorConns:     getEnvAsInt("MAX_VISITOR_CONNECTIONS", 0),
+		SoftConcurrency:     getEnvAsInt("SOFT_CONCURRENCY_LIMIT", 0),
+		PausedMessage:       getEnv("PAUSED_MESSAGE", "This tunnel is paused for maintenance, please try again shortly"),
+		ReconnectingMessage: getEnv("RECONNECTING_MESSAGE", "This tunnel is reconnecting, please try again in a few seconds"),
+		NotFoundPagePath:    getEnv("NOT_FOUND_PAGE", ""),
+		TCPNoDelay:          getEnvAsBool("TCP_NODELAY", true),
+		AccessLog:           getEnvAsBool("ACCESS_LOG", false),
+		DNSCheck:            getEnvAsBool("DNS_CHECK", true),
+		DNSCheckStrict:      getEnvAsBool("DNS_CHECK_STRICT", false),
+		PublicIP:            getEnv("PUBLIC_IP", ""),
+		BreakerThreshold:    getEnvAsInt("BREAKER_THRESHOLD", 0),
+		BreakerWindow:       getEnvAsDuration("BREAKER_WINDOW", 30*time.Second),
+		BreakerCooldown:     getEnvAsDuration("BREAKER_COOLDOWN", 30*time.Second),
+		MaxSubdomainLen:     getEnvAsInt("MAX_SUBDOMAIN_LENGTH", 63),
+		CertFailureLimit:    getEnvAsInt("CERT_FAILURE_LIMIT", 0),
+		CertFailureWindow:   getEnvAsDuration("CERT_FAILURE_WINDOW", 10*time.Minute),
+		WriteCoalesce:       getEnvAsDuration("WRITE_COALESCE_WINDOW", 0),
+		CertStartupTimeout:  getEnvAsDuration("CERT_STARTUP_TIMEOUT", 2*time.Minute),
+		CopyBufferSize:      getEnvAsInt("COPY_BUFFER_SIZE", 32*1024),
+		AuthTokens:          getEnvAsTokens("AUTH_TOKENS"),
+		AllowedLocalPorts:   getEnvAsList("ALLOWED_LOCAL_PORTS", nil),
+		DenyPrivileged:      getEnvAsBool("DENY_PRIVILEGED_PORTS", false),
+		RequestsPerSecond:   getEnvAsFloat("RATE_LIMIT_RPS", 0),
+		BurstSize:           getEnvAsInt("RATE_LIMIT_BURST", 0),
+		IdleTimeout:         getEnvAsDuration("IDLE_TIMEOUT", 0),
+		CloseDrainTimeout:   getEnvAsDuration("CLOSE_DRAIN_TIMEOUT", 0),
+		ShutdownTimeout:     getEnvAsDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		ProxyShutdown:       getEnvAsDuration("PROXY_SHUTDOWN_TIMEOUT", 0),
+		WSShutdown:          getEnvAsDuration("WS_SHUTDOWN_TIMEOUT", 0),
+		StatsDAddr:          getEnv("STATSD_ADDR", ""),
+		StatsDPrefix:        getEnv("STATSD_PREFIX", "tunnel."),
+		StatsDInterval:      getEnvAsDuration("STATSD_INTERVAL", 10*time.Second),
+		TrustedHops:         getEnvAsInt("TRUSTED_PROXY_HOPS", 0),
+		SchemeHeaders:       getEnvAsList("FORWARDED_SCHEME_HEADERS", []string{"X-Forwarded-Proto"}),
+		SubdomainStyle:      getEnv("SUBDOMAIN_STYLE", SubdomainStyleHex),
+		SubdomainLength:     getEnvAsInt("SUBDOMAIN_LENGTH", subdomain.DefaultLength),
+		SubdomainAttempts:   getEnvAsInt("SUBDOMAIN_ATTEMPTS", 10),
+		ResponseBufferLimit: getEnvAsInt("RESPONSE_BUFFER_LIMIT", 10*1024*1024),
+		MigrateFrom:         getEnv("MIGRATE_FROM", ""),
+		MigrateToken:        getEnv("MIGRATE_TOKEN", ""),
+	}
+	cfg.clampSubdomainLength()
+	return cfg
+}
+
+// clampSubdomainLength keeps SubdomainLength between 1 and MaxSubdomainLen,
+// warning when the configured value had to change
+func (c *Config) clampSubdomainLength() {
+	limit := c.MaxSubdomainLen
+	if limit < 1 || limit > subdomain.MaxLength {
+		limit = subdomain.MaxLength
+	}
+	if length := min(max(c.SubdomainLength, 1), limit); length != c.SubdomainLength {
+		log.Printf("WARNING: SUBDOMAIN_LENGTH=%d is outside 1-%d, using %d", c.SubdomainLength, limit, length)
+		c.SubdomainLength = length
+	}
+}
+
+// ShutdownBudget returns how long a sub-server may drain: its own timeout
+// if set, otherwise ShutdownTimeout
+func (c *Config) ShutdownBudget(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return c.ShutdownTimeout
+}
+
+// Validate checks the configuration for settings the server can't run with,
+// such as two listeners bound to the same port
+func (c *Config) Validate() error {
+	type namedPort struct {
+		name string
+		port int
+	}
+
+	ports := []namedPort{
+		{"WS_PORT", c.WebSocketPort},
+		{"HTTP_PORT", c.HTTPPort},
+	}
+	if c.EnableHTTPS {
+		ports = append(ports, namedPort{"HTTPS_PORT", c.HTTPSPort})
+	}
+
+	for _, p := range ports {
+		if p.port < 1 || p.port > 65535 {
+			return fmt.Errorf("%s must be between 1 and 65535, got %d", p.name, p.port)
+		}
+	}
+
+	if c.WebSocketPort == c.HTTPPort {
+		return fmt.Errorf("WS_PORT and HTTP_PORT are both %d; the WebSocket server can only share a port with HTTPS (set WS_PORT=HTTPS_PORT with ENABLE_HTTPS=true)", c.HTTPPort)
+	}
+
+	if c.MaxSubdomainLen < 1 || c.MaxSubdomainLen > 63 {
+		return fmt.Errorf("MAX_SUBDOMAIN_LENGTH must be between 1 and 63, got %d", c.MaxSubdomainLen)
+	}
+
+	for _, entry := range c.AllowedLocalPorts {
+		if _, _, err := parsePortRange(entry); err != nil {
+			return fmt.Errorf("ALLOWED_LOCAL_PORTS: %w", err)
+		}
+	}
+
+	for _, entry := range c.SchemeHeaders {
+		name, _, _ := strings.Cut(entry, "=")
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("FORWARDED_SCHEME_HEADERS: invalid header name %q", name)
+		}
+	}
+
+	if c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		return fmt.Errorf("LOG_FORMAT must be %q or %q, got %q", LogFormatText, LogFormatJSON, c.LogFormat)
+	}
+
+	switch c.LogLevel {
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+	default:
+		return fmt.Errorf("LOG_LEVEL must be one of debug, info, warn or error, got %q", c.LogLevel)
+	}
+
+	if c.CertKeyType != CertKeyTypeECDSA && c.CertKeyType != CertKeyTypeRSA {
+		return fmt.Errorf("CERT_KEY_TYPE must be %q or %q, got %q", CertKeyTypeECDSA, CertKeyTypeRSA, c.CertKeyType)
+	}
+
+	if c.SubdomainStyle != SubdomainStyleHex && c.SubdomainStyle != SubdomainStyleReadable {
+		return fmt.Errorf("SUBDOMAIN_STYLE must be %q or %q, got %q", SubdomainStyleHex, SubdomainStyleReadable, c.SubdomainStyle)
+	}
+	if c.SubdomainStyle == SubdomainStyleReadable && c.MaxSubdomainLen < subdomain.ReadableMaxLength {
+		return fmt.Errorf("SUBDOMAIN_STYLE=%s generates names of up to %d characters, more than MAX_SUBDOMAIN_LENGTH (%d)",
+			SubdomainStyleReadable, subdomain.ReadableMaxLength, c.MaxSubdomainLen)
+	}
+
+	if c.StatsDAddr != "" && c.StatsDInterval <= 0 {
+		return fmt.Errorf("STATSD_INTERVAL must be positive, got %s", c.StatsDInterval)
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("SHUTDOWN_TIMEOUT must be positive, got %s", c.ShutdownTimeout)
+	}
+	if c.ProxyShutdown < 0 || c.WSShutdown < 0 {
+		return fmt.Errorf("PROXY_SHUTDOWN_TIMEOUT and WS_SHUTDOWN_TIMEOUT must not be negative")
+	}
+
+	if c.ResponseBufferLimit <= 0 {
+		return fmt.Errorf("RESPONSE_BUFFER_LIMIT must be positive, got %d", c.ResponseBufferLimit)
 	}
+
+	if c.PathRoutingPrefix != "" && (len(c.PathRoutingPrefix) < 3 ||
+		!strings.HasPrefix(c.PathRoutingPrefix, "/") || !strings.HasSuffix(c.PathRoutingPrefix, "/")) {
+		return fmt.Errorf("PATH_ROUTING_PREFIX must start and end with / and not be just /, got %q", c.PathRoutingPrefix)
+	}
+
+	if c.ClientCAPath != "" {
+		data, err := os.ReadFile(c.ClientCAPath)
+		if err != nil {
+			return fmt.Errorf("CLIENT_CA_PATH: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			return fmt.Errorf("CLIENT_CA_PATH: no PEM certificates found in %s", c.ClientCAPath)
+		}
+	}
+
+	if (c.TLSCertPath == "") != (c.TLSKeyPath == "") {
+		return fmt.Errorf("TLS_CERT_PATH and TLS_KEY_PATH must be set together")
+	}
+	if c.TLSCertPath != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLSCertPath, c.TLSKeyPath); err != nil {
+			return fmt.Errorf("TLS_CERT_PATH: %w", err)
+		}
+		if c.DevMode {
+			return fmt.Errorf("DEV_MODE and TLS_CERT_PATH can't be used together")
+		}
+	}
+
+	switch c.DNSProvider {
+	case "":
+	case DNSProviderCloudflare:
+		if c.CloudflareAPIToken == "" {
+			return fmt.Errorf("DNS_PROVIDER=%s requires CLOUDFLARE_API_TOKEN", c.DNSProvider)
+		}
+	default:
+		return fmt.Errorf("DNS_PROVIDER must be empty or %q, got %q", DNSProviderCloudflare, c.DNSProvider)
+	}
+	if c.DNSProvider != "" && (c.DevMode || c.TLSCertPath != "") {
+		return fmt.Errorf("DNS_PROVIDER can't be used with DEV_MODE or TLS_CERT_PATH")
+	}
+
+	if c.IPDenylistPath != "" {
+		if _, err := ipfilter.ParseFile(c.IPDenylistPath); err != nil {
+			return fmt.Errorf("IP_DENYLIST_PATH: %w", err)
+		}
+	}
+
+	if c.NotFoundPagePath != "" {
+		if _, err := template.ParseFiles(c.NotFoundPagePath); err != nil {
+			return fmt.Errorf("NOT_FOUND_PAGE: %w", err)
+		}
+	}
+
+	if c.EnableHTTPS && c.HTTPPort == c.HTTPSPort {
+		return fmt.Errorf("HTTP_PORT and HTTPS_PORT are both %d; they must differ when ENABLE_HTTPS=true", c.HTTPPort)
+	}
+
+	return nil
+}
+
+// LocalPortAllowed reports whether clients may expose a local port
+func (c *Config) LocalPortAllowed(port int) bool {
+	if c.DenyPrivileged && port < 1024 {
+		return false
+	}
+	if len(c.AllowedLocalPorts) == 0 {
+		return true
+	}
+
+	for _, entry := range c.AllowedLocalPorts {
+		if low, high, err := parsePortRange(entry); err == nil && port >= low && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePortRange parses a port ("3000") or inclusive range ("8000-8999")
+func parsePortRange(entry string) (int, int, error) {
+	lowText, highText, isRange := strings.Cut(entry, "-")
+	if !isRange {
+		highText = lowText
+	}
+
+	low, err := strconv.Atoi(strings.TrimSpace(lowText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", entry)
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(highText))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", entry)
+	}
+	if low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q", entry)
+	}
+	return low, high, nil
 }
 
 // getEnv reads an environment variable or returns a default value
@@ -50,6 +427,16 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvAsFloat reads an environment variable as float64 or returns a default value
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return defaultValue
+}
+
 // getEnvAsBool reads an environment variable as boolean or returns a default value
 func getEnvAsBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
@@ -69,3 +456,35 @@ func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
 	}
 	return defaultValue
 }
+
+// getEnvAsList reads a comma-separated environment variable or returns a default value
+func getEnvAsList(key string, defaultValue []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvAsTokens reads a comma-separated list of "label:token" entries.
+// Entries without a label are labelled by their position, e.g. "token2".
+func getEnvAsTokens(key string) map[string]string {
+	tokens := make(map[string]string)
+	for i, entry := range getEnvAsList(key, nil) {
+		label, token, found := strings.Cut(entry, ":")
+		if !found {
+			label, token = fmt.Sprintf("token%d", i+1), entry
+		}
+		if token != "" {
+			tokens[token] = label
+		}
+	}
+	return tokens
+}
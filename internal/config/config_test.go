@@ -0,0 +1,339 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/subdomain"
+)
+
+func TestSubdomainLengthIsClamped(t *testing.T) {
+	for _, tt := range []struct {
+		length, max string
+		want        int
+	}{
+		{"8", "63", 8},
+		{"1", "63", 1},
+		{"63", "63", 63},
+		{"0", "63", 1},
+		{"-4", "63", 1},
+		{"100", "63", 63},
+		{"13", "12", 12},
+		{"100", "0", 63}, // an invalid maximum is reported by Validate
+	} {
+		t.Setenv("SUBDOMAIN_LENGTH", tt.length)
+		t.Setenv("MAX_SUBDOMAIN_LENGTH", tt.max)
+		if got := Load().SubdomainLength; got != tt.want {
+			t.Errorf("SUBDOMAIN_LENGTH=%s MAX_SUBDOMAIN_LENGTH=%s: got %d, want %d", tt.length, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePorts(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		ws, http, https  int
+		httpsEnabled, ok bool
+	}{
+		{"separate ports", 8080, 80, 443, true, true},
+		{"websocket shares HTTPS", 443, 80, 443, true, true},
+		{"websocket shares HTTP", 80, 80, 443, true, false},
+		{"websocket shares HTTP without HTTPS", 80, 80, 443, false, false},
+		{"HTTP shares HTTPS", 8080, 443, 443, true, false},
+		{"all on one port", 443, 443, 443, true, false},
+		{"HTTPS port unused without HTTPS", 8080, 80, 80, false, true},
+		{"HTTPS port out of range unused", 8080, 80, 0, false, true},
+		{"websocket port out of range", 0, 80, 443, true, false},
+		{"HTTP port out of range", 8080, 65536, 443, true, false},
+		{"HTTPS port out of range", 8080, 80, -1, true, false},
+	} {
+		cfg := Load()
+		cfg.WebSocketPort, cfg.HTTPPort, cfg.HTTPSPort = tt.ws, tt.http, tt.https
+		cfg.EnableHTTPS = tt.httpsEnabled
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateReadableSubdomainLength(t *testing.T) {
+	for _, tt := range []struct {
+		style string
+		max   int
+		ok    bool
+	}{
+		{SubdomainStyleReadable, 63, true},
+		{SubdomainStyleReadable, subdomain.ReadableMaxLength, true},
+		{SubdomainStyleReadable, subdomain.ReadableMaxLength - 1, false},
+		{SubdomainStyleReadable, 8, false},
+		{SubdomainStyleHex, 8, true},
+	} {
+		cfg := Load()
+		cfg.SubdomainStyle = tt.style
+		cfg.MaxSubdomainLen = tt.max
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("SUBDOMAIN_STYLE=%s MAX_SUBDOMAIN_LENGTH=%d: Validate() = %v, want ok %t", tt.style, tt.max, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateCertKeyType(t *testing.T) {
+	for keyType, ok := range map[string]bool{
+		CertKeyTypeECDSA: true,
+		CertKeyTypeRSA:   true,
+		"RSA":            false,
+		"ed25519":        false,
+	} {
+		cfg := Load()
+		cfg.CertKeyType = keyType
+		if err := cfg.Validate(); (err == nil) != ok {
+			t.Errorf("CERT_KEY_TYPE=%s: Validate() = %v, want ok %t", keyType, err, ok)
+		}
+	}
+}
+
+func TestValidatePathRoutingPrefix(t *testing.T) {
+	for prefix, ok := range map[string]bool{
+		"":         true,
+		"/t/":      true,
+		"/tunnel/": true,
+		"/":        false,
+		"//":       false,
+		"t/":       false,
+		"/t":       false,
+	} {
+		cfg := Load()
+		cfg.PathRoutingPrefix = prefix
+		if err := cfg.Validate(); (err == nil) != ok {
+			t.Errorf("PATH_ROUTING_PREFIX=%q: Validate() = %v, want ok %t", prefix, err, ok)
+		}
+	}
+}
+
+func TestValidateLogFormat(t *testing.T) {
+	for format, ok := range map[string]bool{
+		LogFormatText: true,
+		LogFormatJSON: true,
+		"":            false,
+		"JSON":        false,
+		"logfmt":      false,
+	} {
+		cfg := Load()
+		cfg.LogFormat = format
+		if err := cfg.Validate(); (err == nil) != ok {
+			t.Errorf("LOG_FORMAT=%q: Validate() = %v, want ok %t", format, err, ok)
+		}
+	}
+}
+
+func TestValidateLogLevel(t *testing.T) {
+	for level, ok := range map[string]bool{
+		LogLevelDebug: true,
+		LogLevelInfo:  true,
+		LogLevelWarn:  true,
+		LogLevelError: true,
+		"":            false,
+		"trace":       false,
+	} {
+		cfg := Load()
+		cfg.LogLevel = level
+		if err := cfg.Validate(); (err == nil) != ok {
+			t.Errorf("LOG_LEVEL=%q: Validate() = %v, want ok %t", level, err, ok)
+		}
+	}
+}
+
+func TestLocalPortAllowed(t *testing.T) {
+	for _, tt := range []struct {
+		allowed        []string
+		denyPrivileged bool
+		port           int
+		ok             bool
+	}{
+		{nil, false, 80, true},
+		{nil, false, 3000, true},
+		{nil, true, 80, false},
+		{nil, true, 1023, false},
+		{nil, true, 1024, true},
+		{[]string{"3000", "8000-8999"}, false, 3000, true},
+		{[]string{"3000", "8000-8999"}, false, 8000, true},
+		{[]string{"3000", "8000-8999"}, false, 8999, true},
+		{[]string{"3000", "8000-8999"}, false, 9000, false},
+		{[]string{"3000", "8000-8999"}, false, 22, false},
+		{[]string{"80"}, true, 80, false},
+	} {
+		cfg := &Config{AllowedLocalPorts: tt.allowed, DenyPrivileged: tt.denyPrivileged}
+		if got := cfg.LocalPortAllowed(tt.port); got != tt.ok {
+			t.Errorf("allowed %v, deny privileged %t: LocalPortAllowed(%d) = %t, want %t",
+				tt.allowed, tt.denyPrivileged, tt.port, got, tt.ok)
+		}
+	}
+}
+
+func TestValidateAllowedLocalPorts(t *testing.T) {
+	for entry, ok := range map[string]bool{
+		"3000":      true,
+		"8000-8999": true,
+		"http":      false,
+		"9000-8000": false,
+		"0":         false,
+		"70000":     false,
+	} {
+		cfg := Load()
+		cfg.AllowedLocalPorts = []string{entry}
+		if err := cfg.Validate(); (err == nil) != ok {
+			t.Errorf("ALLOWED_LOCAL_PORTS=%s: Validate() = %v, want ok %t", entry, err, ok)
+		}
+	}
+}
+
+func TestValidateNotFoundPage(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.html")
+	broken := filepath.Join(dir, "broken.html")
+	os.WriteFile(valid, []byte("<p>No tunnel named {{.Subdomain}}</p>"), 0o644)
+	os.WriteFile(broken, []byte("<p>{{.Subdomain</p>"), 0o644)
+
+	for path, ok := range map[string]bool{
+		"":                                 true,
+		valid:                              true,
+		broken:                             false,
+		filepath.Join(dir, "missing.html"): false,
+	} {
+		cfg := Load()
+		cfg.NotFoundPagePath = path
+		if err := cfg.Validate(); (err == nil) != ok {
+			t.Errorf("NOT_FOUND_PAGE=%q: Validate() = %v, want ok %t", path, err, ok)
+		}
+	}
+}
+
+func TestValidateSchemeHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		headers []string
+		ok      bool
+	}{
+		{[]string{"X-Forwarded-Proto"}, true},
+		{[]string{"X-Forwarded-Proto", "X-Forwarded-Ssl=on"}, true},
+		{nil, true},
+		{[]string{"X Forwarded"}, false},
+		{[]string{"=on"}, false},
+	} {
+		cfg := Load()
+		cfg.SchemeHeaders = tt.headers
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("FORWARDED_SCHEME_HEADERS=%v: Validate() = %v, want ok %t", tt.headers, err, tt.ok)
+		}
+	}
+}
+
+// A valid bundle is covered by the client certificate tests in cert
+func TestValidateClientCAPath(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.txt")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o644)
+
+	for path, ok := range map[string]bool{
+		"":                                true,
+		notPEM:                            false,
+		filepath.Join(dir, "missing.pem"): false,
+	} {
+		cfg := Load()
+		cfg.ClientCAPath = path
+		if err := cfg.Validate(); (err == nil) != ok {
+			t.Errorf("CLIENT_CA_PATH=%q: Validate() = %v, want ok %t", path, err, ok)
+		}
+	}
+}
+
+func TestValidateResponseBufferLimit(t *testing.T) {
+	for limit, ok := range map[int]bool{
+		1:                true,
+		10 * 1024 * 1024: true,
+		0:                false,
+		-1:               false,
+	} {
+		cfg := Load()
+		cfg.ResponseBufferLimit = limit
+		if err := cfg.Validate(); (err == nil) != ok {
+			t.Errorf("RESPONSE_BUFFER_LIMIT=%d: Validate() = %v, want ok %t", limit, err, ok)
+		}
+	}
+}
+
+// A valid pair is covered by the certificate reload tests in cert
+func TestValidateTLSCertPaths(t *testing.T) {
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "tls.pem")
+	os.WriteFile(broken, []byte("not a certificate"), 0o644)
+
+	for _, tt := range []struct {
+		cert, key string
+		ok        bool
+	}{
+		{"", "", true},
+		{broken, "", false},
+		{"", broken, false},
+		{broken, broken, false},
+	} {
+		cfg := Load()
+		cfg.TLSCertPath = tt.cert
+		cfg.TLSKeyPath = tt.key
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("TLS_CERT_PATH=%q TLS_KEY_PATH=%q: Validate() = %v, want ok %t", tt.cert, tt.key, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateDNSProvider(t *testing.T) {
+	for _, tt := range []struct {
+		provider, token string
+		devMode         bool
+		ok              bool
+	}{
+		{"", "", false, true},
+		{DNSProviderCloudflare, "token", false, true},
+		{DNSProviderCloudflare, "", false, false},
+		{"route53", "token", false, false},
+		{DNSProviderCloudflare, "token", true, false},
+	} {
+		cfg := Load()
+		cfg.DNSProvider = tt.provider
+		cfg.CloudflareAPIToken = tt.token
+		cfg.DevMode = tt.devMode
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("DNS_PROVIDER=%q with token %q, dev mode %t: Validate() = %v, want ok %t", tt.provider, tt.token, tt.devMode, err, tt.ok)
+		}
+	}
+}
+
+func TestShutdownBudget(t *testing.T) {
+	cfg := Load()
+	cfg.ShutdownTimeout = 30 * time.Second
+	if got := cfg.ShutdownBudget(0); got != 30*time.Second {
+		t.Errorf("ShutdownBudget(0) = %s, want the shutdown timeout", got)
+	}
+	if got := cfg.ShutdownBudget(5 * time.Second); got != 5*time.Second {
+		t.Errorf("ShutdownBudget(5s) = %s, want 5s", got)
+	}
+
+	for _, tt := range []struct {
+		name                    string
+		timeout, proxy, control time.Duration
+		ok                      bool
+	}{
+		{"defaults", 10 * time.Second, 0, 0, true},
+		{"per-server budgets", 10 * time.Second, time.Minute, time.Second, true},
+		{"no shutdown timeout", 0, 0, 0, false},
+		{"negative proxy budget", 10 * time.Second, -time.Second, 0, false},
+		{"negative WebSocket budget", 10 * time.Second, 0, -time.Second, false},
+	} {
+		cfg := Load()
+		cfg.ShutdownTimeout, cfg.ProxyShutdown, cfg.WSShutdown = tt.timeout, tt.proxy, tt.control
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package dnscheck
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resolver looks up the addresses of a host. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Check verifies that the base domain and a random name under it (which
+// only resolves through a wildcard record) both resolve. If publicIP is
+// set, both must also resolve to it. Misconfigured DNS makes every tunnel
+// unreachable and certificate issuance fail, so this runs at startup.
+func Check(ctx context.Context, resolver Resolver, domain, publicIP string) error {
+	probe, err := randomLabel()
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, host := range []string{domain, probe + "." + domain} {
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s does not resolve: %v", host, err))
+			continue
+		}
+
+		if publicIP != "" && !containsIP(addrs, publicIP) {
+			problems = append(problems, fmt.Sprintf("%s resolves to %s, not %s",
+				host, strings.Join(addrs, ", "), publicIP))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("DNS for %s is not set up correctly (need A records for %s and *.%s): %s",
+			domain, domain, domain, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// containsIP reports whether addrs includes ip, comparing parsed addresses
+func containsIP(addrs []string, ip string) bool {
+	want := net.ParseIP(ip)
+	for _, addr := range addrs {
+		if got := net.ParseIP(addr); got != nil && got.Equal(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// randomLabel returns a label unlikely to have an explicit DNS record
+func randomLabel() (string, error) {
+	bytes := make([]byte, 6)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate probe name: %w", err)
+	}
+	return "dnscheck-" + hex.EncodeToString(bytes), nil
+}
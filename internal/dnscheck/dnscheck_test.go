@@ -0,0 +1,95 @@
+package dnscheck
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// fakeResolver answers from fixed records. The wildcard entry, if set,
+// answers any name under the domain without its own record.
+type fakeResolver struct {
+	records  map[string][]string
+	wildcard []string
+	lookups  []string
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups = append(r.lookups, host)
+	if addrs, ok := r.records[host]; ok {
+		return addrs, nil
+	}
+	if r.wildcard != nil && strings.HasSuffix(host, ".tunnel.example") {
+		return r.wildcard, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestCheck(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		resolver *fakeResolver
+		publicIP string
+		problem  string // part of the error, or empty if the check passes
+	}{
+		{
+			name:     "base and wildcard point here",
+			resolver: &fakeResolver{records: map[string][]string{"tunnel.example": {"203.0.113.7"}}, wildcard: []string{"203.0.113.7"}},
+			publicIP: "203.0.113.7",
+		},
+		{
+			name:     "public IP among several addresses",
+			resolver: &fakeResolver{records: map[string][]string{"tunnel.example": {"2001:db8::1", "203.0.113.7"}}, wildcard: []string{"203.0.113.7"}},
+			publicIP: "203.0.113.7",
+		},
+		{
+			name:     "any address without a public IP",
+			resolver: &fakeResolver{records: map[string][]string{"tunnel.example": {"198.51.100.1"}}, wildcard: []string{"198.51.100.2"}},
+		},
+		{
+			name:     "no wildcard record",
+			resolver: &fakeResolver{records: map[string][]string{"tunnel.example": {"203.0.113.7"}}},
+			publicIP: "203.0.113.7",
+			problem:  "does not resolve",
+		},
+		{
+			name:     "base domain missing",
+			resolver: &fakeResolver{wildcard: []string{"203.0.113.7"}},
+			problem:  "tunnel.example does not resolve",
+		},
+		{
+			name:     "wildcard points elsewhere",
+			resolver: &fakeResolver{records: map[string][]string{"tunnel.example": {"203.0.113.7"}}, wildcard: []string{"198.51.100.1"}},
+			publicIP: "203.0.113.7",
+			problem:  "resolves to 198.51.100.1, not 203.0.113.7",
+		},
+	} {
+		err := Check(context.Background(), tt.resolver, "tunnel.example", tt.publicIP)
+		if tt.problem == "" {
+			if err != nil {
+				t.Errorf("%s: Check() = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.problem) {
+			t.Errorf("%s: Check() = %v, want an error mentioning %q", tt.name, err, tt.problem)
+		}
+	}
+}
+
+// The wildcard is probed with a fresh random name each time, so an
+// explicit record can't pass for it
+func TestCheckProbesRandomSubdomain(t *testing.T) {
+	resolver := &fakeResolver{records: map[string][]string{"tunnel.example": {"203.0.113.7"}}, wildcard: []string{"203.0.113.7"}}
+	Check(context.Background(), resolver, "tunnel.example", "")
+	Check(context.Background(), resolver, "tunnel.example", "")
+
+	if len(resolver.lookups) != 4 {
+		t.Fatalf("lookups = %v, want 4", resolver.lookups)
+	}
+	first, second := resolver.lookups[1], resolver.lookups[3]
+	if !strings.HasSuffix(first, ".tunnel.example") || first == second {
+		t.Fatalf("wildcard probes = %s, %s; want distinct random names", first, second)
+	}
+}
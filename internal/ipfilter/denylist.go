@@ -0,0 +1,106 @@
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Denylist holds source IP ranges whose connections are refused. It is
+// loaded from a file with one CIDR range or bare IP address per line;
+// blank lines and lines starting with # are ignored. A nil Denylist
+// denies nothing.
+type Denylist struct {
+	path     string
+	prefixes atomic.Pointer[[]netip.Prefix]
+}
+
+// Load reads the denylist at path
+func Load(path string) (*Denylist, error) {
+	d := &Denylist{path: path}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reload reads the file again. On error the current ranges are kept.
+func (d *Denylist) Reload() error {
+	prefixes, err := ParseFile(d.path)
+	if err != nil {
+		return err
+	}
+	d.prefixes.Store(&prefixes)
+	log.Printf("Loaded %d denied IP ranges from %s", len(prefixes), d.path)
+	return nil
+}
+
+// Contains reports whether ip, an address without a port, is in a denied
+// range. Addresses that don't parse are not denied.
+func (d *Denylist) Contains(ip string) bool {
+	if d == nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range *d.prefixes.Load() {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFile reads the CIDR ranges listed in the file at path
+func ParseFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		prefix, err := ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+// ParsePrefix parses a CIDR range such as "203.0.113.0/24", or a single
+// address, which is treated as a range of one
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid IP address %q", s)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR range %q", s)
+	}
+	return prefix.Masked(), nil
+}
@@ -0,0 +1,108 @@
+package ipfilter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeList writes a denylist file and returns its path
+func writeList(t *testing.T, dir, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "denylist")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDenylistContains(t *testing.T) {
+	path := writeList(t, t.TempDir(), `
+# scanners
+203.0.113.0/24
+198.51.100.7
+2001:db8::/32
+`)
+	d, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, denied := range map[string]bool{
+		"203.0.113.1":        true,
+		"203.0.113.255":      true,
+		"203.0.114.1":        false,
+		"198.51.100.7":       true,
+		"198.51.100.8":       false,
+		"::ffff:203.0.113.9": true,
+		"2001:db8::1":        true,
+		"2001:db9::1":        false,
+		"127.0.0.1":          false,
+		"not an ip":          false,
+		"":                   false,
+	} {
+		if got := d.Contains(ip); got != denied {
+			t.Errorf("Contains(%q) = %t, want %t", ip, got, denied)
+		}
+	}
+}
+
+func TestNilDenylistDeniesNothing(t *testing.T) {
+	var d *Denylist
+	if d.Contains("203.0.113.1") {
+		t.Fatal("nil denylist denied an address")
+	}
+}
+
+func TestDenylistReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeList(t, dir, "203.0.113.0/24\n")
+	d, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeList(t, dir, "198.51.100.0/24\n")
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if d.Contains("203.0.113.1") || !d.Contains("198.51.100.1") {
+		t.Fatal("reload did not replace the ranges")
+	}
+
+	// A broken file keeps the ranges in use
+	writeList(t, dir, "198.51.100.0/24\nnonsense\n")
+	if err := d.Reload(); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Fatalf("Reload() of a broken file = %v, want an error naming line 2", err)
+	}
+	if !d.Contains("198.51.100.1") {
+		t.Fatal("failed reload dropped the ranges in use")
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"203.0.113.0/24", "203.0.113.0/24"},
+		{"203.0.113.9/24", "203.0.113.0/24"},
+		{"198.51.100.7", "198.51.100.7/32"},
+		{"::ffff:198.51.100.7", "198.51.100.7/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"203.0.113.0/33", ""},
+		{"example.org", ""},
+	} {
+		got, err := ParsePrefix(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ParsePrefix(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got.String() != tt.want {
+			t.Errorf("ParsePrefix(%q) = %v, %v; want %s", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package logging
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+)
+
+// levels maps LOG_LEVEL values to slog levels
+var levels = map[string]slog.Level{
+	config.LogLevelDebug: slog.LevelDebug,
+	config.LogLevelInfo:  slog.LevelInfo,
+	config.LogLevelWarn:  slog.LevelWarn,
+	config.LogLevelError: slog.LevelError,
+}
+
+// Setup configures the default slog logger for the given format and level.
+// Text writes key=value lines; JSON writes one object per line. log.Printf
+// calls go through the same handler and count as info.
+func Setup(format, level string) {
+	opts := &slog.HandlerOptions{Level: levels[level]}
+
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if format == config.LogFormatJSON {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"sync/atomic"
+
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProxyGoroutines tracks goroutines currently forwarding proxied traffic.
+// It should return to its baseline once all requests have completed;
+// steady growth points to a leak in the forwarding path.
+var ProxyGoroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "tunnel_proxy_goroutines",
+	Help: "Goroutines currently forwarding proxied traffic.",
+})
+
+// Counters fed from the proxy hot path. Each update is a single atomic add.
+var (
+	TunnelsCreated  = newCounter("tunnel_tunnels_created_total", "Tunnels registered or reclaimed.")
+	ProxiedRequests = newCounter("tunnel_requests_total", "Requests forwarded to tunnels.")
+	BytesIn         = newCounter("tunnel_bytes_in_total", "Bytes sent from visitors to backends.")
+	BytesOut        = newCounter("tunnel_bytes_out_total", "Bytes sent from backends to visitors.")
+	BadGateway      = newCounter("tunnel_bad_gateway_total", "502 responses sent because a backend could not be reached.")
+	ControlRejected = newCounter("tunnel_control_rejected_total", "Tunnel client connections refused by MAX_CONTROL_CONNECTIONS.")
+	VisitorRejected = newCounter("tunnel_visitor_rejected_total", "Visitor connections refused by MAX_VISITOR_CONNECTIONS.")
+	ControlDenied   = newCounter("tunnel_control_denied_total", "Tunnel client connections refused by IP_DENYLIST_PATH.")
+)
+
+// Open connections by class. Tunnel clients ("control") and visitors
+// ("data") scale very differently, so they are limited separately.
+var (
+	ControlConnections Limiter
+	VisitorConnections Limiter
+)
+
+func newCounter(name, help string) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+}
+
+// Limiter counts open connections and refuses new ones beyond a limit,
+// safe for concurrent use. Prometheus gauges can't do the check and the
+// increment in one step, so the count is exported with a GaugeFunc.
+type Limiter struct {
+	value atomic.Int64
+}
+
+// TryInc increments the count by one unless that would take it above
+// limit. A limit of 0 or less means no limit.
+func (l *Limiter) TryInc(limit int64) bool {
+	for {
+		current := l.value.Load()
+		if limit > 0 && current >= limit {
+			return false
+		}
+		if l.value.CompareAndSwap(current, current+1) {
+			return true
+		}
+	}
+}
+
+// Dec decrements the count by one
+func (l *Limiter) Dec() {
+	l.value.Add(-1)
+}
+
+// Value returns the current count
+func (l *Limiter) Value() int64 {
+	return l.value.Load()
+}
+
+// NewRegistry returns a Prometheus registry holding the server's metrics,
+// with the tunnel gauges read from registry at scrape time
+func NewRegistry(registry *tunnel.Registry) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		TunnelsCreated, ProxiedRequests, BytesIn, BytesOut, BadGateway,
+		ControlRejected, VisitorRejected, ControlDenied, ProxyGoroutines,
+		limiterGauge("tunnel_control_connections", "Open tunnel client connections.", &ControlConnections),
+		limiterGauge("tunnel_visitor_connections", "Open visitor connections to the proxy.", &VisitorConnections),
+		registryCollector{registry},
+	)
+	return reg
+}
+
+func limiterGauge(name, help string, l *Limiter) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, func() float64 {
+		return float64(l.Value())
+	})
+}
+
+var (
+	tunnelsActiveDesc = prometheus.NewDesc("tunnel_tunnels_active", "Tunnels currently registered.", nil, nil)
+	maintenanceDesc   = prometheus.NewDesc("tunnel_maintenance", "1 while new registrations are refused for maintenance.", nil, nil)
+)
+
+// registryCollector reports the state of a tunnel registry. The registry
+// keeps its own counts, so they are read on each scrape rather than
+// mirrored into gauges.
+type registryCollector struct {
+	registry *tunnel.Registry
+}
+
+func (c registryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tunnelsActiveDesc
+	ch <- maintenanceDesc
+}
+
+func (c registryCollector) Collect(ch chan<- prometheus.Metric) {
+	maintenance := 0.0
+	if c.registry.InMaintenance() {
+		maintenance = 1
+	}
+	ch <- prometheus.MustNewConstMetric(tunnelsActiveDesc, prometheus.GaugeValue, float64(c.registry.Count()))
+	ch <- prometheus.MustNewConstMetric(maintenanceDesc, prometheus.GaugeValue, maintenance)
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLimiterTryIncRespectsLimit(t *testing.T) {
+	var l Limiter
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if l.TryInc(10) {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 10 || l.Value() != 10 {
+		t.Fatalf("accepted %d, count %d; want 10 and 10", accepted, l.Value())
+	}
+	l.Dec()
+	if !l.TryInc(10) {
+		t.Fatal("TryInc failed below the limit")
+	}
+	if !l.TryInc(0) {
+		t.Fatal("TryInc failed without a limit")
+	}
+}
+
+func TestRegistryCollector(t *testing.T) {
+	registry := tunnel.NewRegistry(0)
+	testkit.AddTunnel(t, registry, "one", http.NotFoundHandler())
+	testkit.AddTunnel(t, registry, "two", http.NotFoundHandler())
+	registry.SetMaintenance(true)
+
+	want := `# HELP tunnel_maintenance 1 while new registrations are refused for maintenance.
+# TYPE tunnel_maintenance gauge
+tunnel_maintenance 1
+# HELP tunnel_tunnels_active Tunnels currently registered.
+# TYPE tunnel_tunnels_active gauge
+tunnel_tunnels_active 2
+`
+	if err := testutil.CollectAndCompare(registryCollector{registry}, strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every metric the README lists is exported
+	names, err := NewRegistry(registry).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 13 {
+		t.Fatalf("gathered %d metric families, want 13", len(names))
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// maxStatusLine bounds how much of a response is kept to find its status
+const maxStatusLine = 64
+
+// responseRecorder wraps a tunnel connection and records the status code
+// of the first response read from it and the number of bytes read. It
+// only observes; the bytes are passed through unchanged.
+type responseRecorder struct {
+	tunnel.Connection
+	line     []byte // start of the response until the status is known
+	status   int    // 0 until the status line has been read
+	bytes    int64
+	onStatus func(status int) // called once with the status, or 0 if the tunnel ended without one
+	closed   atomic.Bool      // Close was called, so read errors are our own doing
+}
+
+// Read implements io.Reader
+func (r *responseRecorder) Read(p []byte) (int, error) {
+	n, err := r.Connection.Read(p)
+	r.bytes += int64(n)
+	if r.line != nil {
+		r.line = append(r.line, p[:min(n, maxStatusLine-len(r.line))]...)
+		if i := bytes.IndexByte(r.line, '\n'); i >= 0 || len(r.line) == maxStatusLine {
+			r.status = parseStatus(r.line)
+			r.line = nil
+			r.onStatus(r.status)
+		} else if err != nil && !r.closed.Load() {
+			// The backend went away before answering
+			r.line = nil
+			r.onStatus(0)
+		}
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (r *responseRecorder) Close() error {
+	r.closed.Store(true)
+	return r.Connection.Close()
+}
+
+// newResponseRecorder starts recording responses read from conn. onStatus
+// may be nil.
+func newResponseRecorder(conn tunnel.Connection, onStatus func(status int)) *responseRecorder {
+	if onStatus == nil {
+		onStatus = func(int) {}
+	}
+	return &responseRecorder{Connection: conn, line: make([]byte, 0, maxStatusLine), onStatus: onStatus}
+}
+
+// parseStatus returns the code from a status line such as
+// "HTTP/1.1 200 OK", or 0 if it isn't one
+func parseStatus(line []byte) int {
+	fields := bytes.Fields(line)
+	if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+		return 0
+	}
+	status, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0
+	}
+	return status
+}
+
+// accessWriter records the status and body size written through a
+// ResponseWriter
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader implements http.ResponseWriter
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logAccess writes the access log line for a proxied request. A status of
+// 0 means no valid response came back.
+func (h *Handler) logAccess(tun *tunnel.Tunnel, r *http.Request, status int, bytes int64, start time.Time) {
+	tunnelLog(tun).Info("Request",
+		"event", "access",
+		"method", r.Method,
+		"host", r.Host,
+		"path", r.URL.Path,
+		"status", status,
+		"bytes", bytes,
+		"duration", time.Since(start))
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+)
+
+func TestResponseRecorderReportsStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     int
+	}{
+		{"ok", "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", 200},
+		{"bad gateway", "HTTP/1.1 502 Bad Gateway\r\n\r\n", 502},
+		{"switching protocols", "HTTP/1.1 101 Switching Protocols\r\n\r\n", 101},
+		{"not http", "garbage\r\n", 0},
+		{"no response", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnelEnd, backendEnd := net.Pipe()
+			go func() {
+				io.WriteString(backendEnd, tt.response)
+				backendEnd.Close()
+			}()
+
+			var reported []int
+			recorder := newResponseRecorder(tunnelEnd, func(status int) {
+				reported = append(reported, status)
+			})
+			io.Copy(io.Discard, recorder)
+
+			if len(reported) != 1 || reported[0] != tt.want {
+				t.Fatalf("reported statuses = %v, want [%d]", reported, tt.want)
+			}
+			if recorder.bytes != int64(len(tt.response)) {
+				t.Fatalf("bytes = %d, want %d", recorder.bytes, len(tt.response))
+			}
+		})
+	}
+}
+
+// Closing the tunnel ourselves, e.g. because the visitor left, says
+// nothing about the backend
+func TestResponseRecorderIgnoresOwnClose(t *testing.T) {
+	tunnelEnd, backendEnd := net.Pipe()
+	defer backendEnd.Close()
+
+	reported := false
+	recorder := newResponseRecorder(tunnelEnd, func(int) { reported = true })
+	recorder.Close()
+	io.Copy(io.Discard, recorder)
+
+	if reported {
+		t.Fatal("a status was reported after the recorder was closed")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "hello")
+	})
+
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		logs := testkit.CaptureLogs(t)
+		cfg := testkit.Config()
+		cfg.ForwardMode = mode
+		cfg.AccessLog = true
+		server, registry := newTestProxy(t, cfg)
+		testkit.AddTunnel(t, registry, "myapp", backend)
+
+		resp := visit(t, server, "myapp."+testkit.Domain, "/hello?name=x")
+		testkit.ReadBody(t, resp)
+
+		var access map[string]interface{}
+		testkit.WaitFor(t, mode+" access log line", func() bool {
+			for _, record := range logs.Records(t) {
+				if record["event"] == "access" {
+					access = record
+					return true
+				}
+			}
+			return false
+		})
+		if access["method"] != "GET" || access["host"] != "myapp."+testkit.Domain || access["path"] != "/hello" || access["subdomain"] != "myapp" {
+			t.Errorf("%s: access line %v doesn't describe the request", mode, access)
+		}
+		if access["status"] != float64(http.StatusCreated) {
+			t.Errorf("%s: logged status %v, want 201", mode, access["status"])
+		}
+		// Hijacked connections count the whole response, buffered ones the body
+		if bytes, _ := access["bytes"].(float64); bytes < float64(len("hello")) {
+			t.Errorf("%s: logged %v bytes, want at least the body", mode, access["bytes"])
+		}
+	}
+}
@@ -3,7 +3,10 @@ package proxy
 import (
 	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 
+	"github.com/ahmadrosid/tunnel/internal/metrics"
 	"github.com/ahmadrosid/tunnel/internal/tunnel"
 )
 
@@ -12,14 +15,107 @@ import (
 // The VirtualConnection can be safely closed without affecting the underlying WebSocket,
 // allowing multiple HTTP requests to be handled over the same persistent tunnel.
 func DialThroughTunnel(tun *tunnel.Tunnel) (tunnel.Connection, error) {
-	// Check if WebSocket connection is still alive
+	// WebSocket is the only transport; a tunnel without a connection is
+	// inconsistent state and must not be dialed
 	if tun.WSConn == nil {
-		return nil, fmt.Errorf("WebSocket connection is nil")
+		return nil, fmt.Errorf("tunnel %s has no transport connection", tun.Subdomain())
+	}
+
+	// Clients that multiplex get a stream of their own per request
+	if tun.Streams != nil {
+		stream, err := tun.Streams.Dial()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open stream on tunnel %s: %w", tun.Subdomain(), err)
+		}
+		return &countingConn{Connection: stream, tun: tun}, nil
 	}
 
 	// Return a virtual connection wrapper
 	// This allows the proxy to call Close() without killing the WebSocket
-	return NewVirtualConnection(tun.WSConn), nil
+	return &countingConn{Connection: NewVirtualConnection(tun.WSConn), tun: tun}, nil
+}
+
+// countingConn adds the bytes passing through a tunnel connection to the
+// tunnel's traffic counters and marks the tunnel active
+type countingConn struct {
+	tunnel.Connection
+	tun *tunnel.Tunnel
+}
+
+// Read implements io.Reader, counting bytes from the backend
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Connection.Read(p)
+	atomic.AddInt64(&c.tun.BytesOut, int64(n))
+	metrics.BytesOut.Add(float64(n))
+	if n > 0 {
+		c.tun.Touch()
+	}
+	return n, err
+}
+
+// Write implements io.Writer, counting bytes to the backend
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Connection.Write(p)
+	atomic.AddInt64(&c.tun.BytesIn, int64(n))
+	metrics.BytesIn.Add(float64(n))
+	if n > 0 {
+		c.tun.Touch()
+	}
+	return n, err
+}
+
+// DefaultCopyBufferSize matches the buffer io.Copy allocates on its own.
+// Larger buffers mean fewer, bigger writes per tunnel at the cost of
+// memory per active connection.
+const DefaultCopyBufferSize = 32 * 1024
+
+// bufferPool hands out fixed-size copy buffers so proxying doesn't
+// allocate one per request. It satisfies httputil.BufferPool.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newBufferPool creates a pool of buffers of the given size
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, p.size)
+		return &buf
+	}
+	return p
+}
+
+// Get returns a buffer from the pool
+func (p *bufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer to the pool. Buffers of another size are dropped.
+func (p *bufferPool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
+
+// copyBuffers is the pool used by the proxy copy paths
+var copyBuffers = newBufferPool(DefaultCopyBufferSize)
+
+// SetCopyBufferSize sets the size of the buffers used to copy proxied
+// data. It must be called before any traffic is served.
+func SetCopyBufferSize(size int) {
+	if size > 0 {
+		copyBuffers = newBufferPool(size)
+	}
+}
+
+// copyBuffered copies src to dst using a pooled buffer
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get()
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, buf)
 }
 
 // CopyBidirectional copies data bidirectionally between two connections
@@ -27,14 +123,18 @@ func CopyBidirectional(conn1, conn2 io.ReadWriteCloser) error {
 	errChan := make(chan error, 2)
 
 	// Copy from conn1 to conn2
+	metrics.ProxyGoroutines.Inc()
 	go func() {
-		_, err := io.Copy(conn2, conn1)
+		defer metrics.ProxyGoroutines.Dec()
+		_, err := copyBuffered(conn2, conn1)
 		errChan <- err
 	}()
 
 	// Copy from conn2 to conn1
+	metrics.ProxyGoroutines.Inc()
 	go func() {
-		_, err := io.Copy(conn1, conn2)
+		defer metrics.ProxyGoroutines.Dec()
+		_, err := copyBuffered(conn1, conn2)
 		errChan <- err
 	}()
 
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := newBufferPool(1024)
+	buf := p.Get()
+	if len(buf) != 1024 {
+		t.Fatalf("Get() returned %d bytes, want 1024", len(buf))
+	}
+	p.Put(buf[:10])
+	if got := p.Get(); len(got) != 1024 {
+		t.Fatalf("a buffer put back resliced came out with %d bytes", len(got))
+	}
+
+	// Buffers of another size never enter the pool
+	p.Put(make([]byte, 64))
+	for i := 0; i < 10; i++ {
+		if got := p.Get(); len(got) != 1024 {
+			t.Fatalf("Get() returned a %d byte buffer from another pool", len(got))
+		}
+	}
+}
+
+// chunkWriter records the size of every write
+type chunkWriter struct {
+	buf     bytes.Buffer
+	largest int
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.largest = max(w.largest, len(p))
+	return w.buf.Write(p)
+}
+
+// onlyReader hides any WriterTo so copies go through the buffer
+type onlyReader struct{ io.Reader }
+
+func TestCopyBufferedUsesConfiguredSize(t *testing.T) {
+	defer SetCopyBufferSize(DefaultCopyBufferSize)
+
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, size := range []int{1024, 8 * 1024, DefaultCopyBufferSize} {
+		SetCopyBufferSize(size)
+		var w chunkWriter
+		n, err := copyBuffered(&w, onlyReader{bytes.NewReader(data)})
+		if err != nil || n != int64(len(data)) {
+			t.Fatalf("copyBuffered = %d, %v; want %d bytes", n, err, len(data))
+		}
+		if !bytes.Equal(w.buf.Bytes(), data) {
+			t.Fatalf("size %d: copied data differs", size)
+		}
+		if w.largest != size {
+			t.Fatalf("size %d: largest write was %d bytes", size, w.largest)
+		}
+	}
+
+	// Sizes that make no sense keep the current pool
+	SetCopyBufferSize(0)
+	if len(copyBuffers.Get()) != DefaultCopyBufferSize {
+		t.Fatal("SetCopyBufferSize(0) changed the buffer size")
+	}
+}
+
+func TestCopyBidirectional(t *testing.T) {
+	client, proxyClient := net.Pipe()
+	proxyBackend, backend := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() { done <- CopyBidirectional(proxyClient, proxyBackend) }()
+
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := backend.Read(buf)
+		backend.Write(bytes.ToUpper(buf[:n]))
+		backend.Close()
+	}()
+
+	client.Write([]byte("ping"))
+	reply, _ := io.ReadAll(client)
+	if string(reply) != "PING" {
+		t.Fatalf("reply = %q, want %q", reply, "PING")
+	}
+	<-done
+}
+
+// BenchmarkCopyBuffered copies through a pipe with different buffer sizes.
+// Larger buffers mean fewer writes per tunnel but more memory per active
+// connection; COPY_BUFFER_SIZE defaults to io.Copy's own 32 KiB.
+func BenchmarkCopyBuffered(b *testing.B) {
+	defer SetCopyBufferSize(DefaultCopyBufferSize)
+
+	const payload = 4 << 20
+	for _, size := range []int{4 << 10, 16 << 10, 32 << 10, 64 << 10, 256 << 10} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			SetCopyBufferSize(size)
+			b.SetBytes(payload)
+			for i := 0; i < b.N; i++ {
+				r, w := net.Pipe()
+				go func() {
+					copyBuffered(w, onlyReader{io.LimitReader(zeroReader{}, payload)})
+					w.Close()
+				}()
+				copyBuffered(io.Discard, onlyReader{r})
+			}
+		})
+	}
+}
+
+// recordConn is a tunnel connection that keeps what is written to it
+type recordConn struct {
+	written bytes.Buffer
+	closed  bool
+}
+
+func (c *recordConn) Read([]byte) (int, error)    { return 0, io.EOF }
+func (c *recordConn) Write(p []byte) (int, error) { return c.written.Write(p) }
+func (c *recordConn) Close() error                { c.closed = true; return nil }
+
+// stubDialer hands out conn for every stream
+type stubDialer struct{ conn tunnel.Connection }
+
+func (d stubDialer) Dial() (tunnel.Connection, error) { return d.conn, nil }
+
+func TestDialThroughTunnelTransports(t *testing.T) {
+	newTunnel := func(ws tunnel.Connection, streams tunnel.StreamDialer) *tunnel.Tunnel {
+		tun := &tunnel.Tunnel{ID: "id", WSConn: ws, Streams: streams}
+		tun.SetSubdomain("myapp")
+		return tun
+	}
+
+	// Without a client connection there is nothing to dial, even if a
+	// stream dialer is left over
+	for _, streams := range []tunnel.StreamDialer{nil, stubDialer{&recordConn{}}} {
+		if _, err := DialThroughTunnel(newTunnel(nil, streams)); err == nil || !strings.Contains(err.Error(), "no transport") {
+			t.Fatalf("dial without a connection (streams %v) = %v, want a no transport error", streams, err)
+		}
+	}
+
+	// Without mux, requests share the client connection, which closing
+	// the dialed connection must leave open
+	ws := &recordConn{}
+	conn, err := DialThroughTunnel(newTunnel(ws, nil))
+	if err != nil {
+		t.Fatalf("dial over the client connection: %v", err)
+	}
+	conn.Write([]byte("request"))
+	conn.Close()
+	if ws.written.String() != "request" || ws.closed {
+		t.Fatalf("client connection got %q, closed %t", ws.written.String(), ws.closed)
+	}
+
+	// With mux, each dial opens a stream and the client connection is unused
+	ws, stream := &recordConn{}, &recordConn{}
+	conn, err = DialThroughTunnel(newTunnel(ws, stubDialer{stream}))
+	if err != nil {
+		t.Fatalf("dial a stream: %v", err)
+	}
+	conn.Write([]byte("request"))
+	conn.Close()
+	if stream.written.String() != "request" || !stream.closed || ws.written.Len() != 0 {
+		t.Fatalf("stream got %q (closed %t), client connection got %q", stream.written.String(), stream.closed, ws.written.String())
+	}
+}
+
+// A tunnel in inconsistent state answers 502 rather than taking the proxy down
+func TestTunnelWithoutTransport(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		cfg := testkit.Config()
+		cfg.ForwardMode = mode
+		server, registry := newTestProxy(t, cfg)
+		tun := &tunnel.Tunnel{ID: "broken-id", CreatedAt: time.Now()}
+		tun.SetSubdomain("broken")
+		registry.Register(tun)
+
+		if resp := visit(t, server, "broken."+testkit.Domain, "/"); resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("%s: status = %d, want 502", mode, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,823 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/metrics"
+	"github.com/ahmadrosid/tunnel/internal/subdomain"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/idna"
+)
+
+// TimeoutHeader lets a request override RequestTimeout, e.g. "X-Tunnel-Timeout: 120s".
+// The value is clamped to MaxTimeout and the header is not forwarded.
+const TimeoutHeader = "X-Tunnel-Timeout"
+
+// Handler forwards requests to tunnels based on the subdomain in the Host header.
+// It is shared by the standalone proxy server and the combined server.
+type Handler struct {
+	config   *config.Config
+	registry *tunnel.Registry
+	reserved map[string]http.Handler // reserved subdomain -> internal handler
+	notFound *template.Template      // HTML page for unknown subdomains, nil for plain text
+}
+
+// NewHandler creates a new proxy handler
+func NewHandler(cfg *config.Config, registry *tunnel.Registry) *Handler {
+	h := &Handler{
+		config:   cfg,
+		registry: registry,
+		reserved: make(map[string]http.Handler),
+	}
+
+	if cfg.NotFoundPagePath != "" {
+		page, err := template.ParseFiles(cfg.NotFoundPagePath)
+		if err != nil {
+			log.Printf("Failed to load not found page, using plain text: %v", err)
+		} else {
+			h.notFound = page
+		}
+	}
+
+	return h
+}
+
+// HandleReserved routes requests for a reserved subdomain to an internal
+// handler instead of looking up a tunnel. Names that are not reserved are
+// ignored, since they could otherwise shadow a registered tunnel.
+func (h *Handler) HandleReserved(name string, handler http.Handler) {
+	if !subdomain.IsReserved(name) {
+		log.Printf("Ignoring internal route for non-reserved subdomain: %s", name)
+		return
+	}
+	h.reserved[name] = handler
+}
+
+// ServeHTTP handles incoming HTTP/HTTPS requests
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Extract subdomain from Host header
+	host := r.Host
+	name := h.extractSubdomain(host)
+
+	// Without wildcard DNS, tunnels can be reached on the base domain
+	// under a path prefix instead
+	var pathPrefix string
+	if name == "" && h.config.PathRoutingPrefix != "" && h.isOwnHost(host) {
+		name, pathPrefix = h.routeByPath(r.URL)
+	}
+
+	if name == "" {
+		// Scanners send junk for hosts we don't serve; answer without
+		// details and drop the connection
+		if !h.isOwnHost(host) {
+			foreignHostLog.Info("Rejected request for foreign host", "event", "foreign_host", "host", host,
+				"remote_addr", RealClientIP(r, h.config.TrustedHops))
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		h.writeError(w, http.StatusNotFound, "Invalid hostname")
+		return
+	}
+
+	// Reserved subdomains may be served by the server itself
+	if handler, ok := h.reserved[name]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	// Look up tunnel by subdomain
+	tun, exists := h.registry.Get(name)
+	if !exists {
+		slog.Info("Subdomain not found", "event", "tunnel_not_found", "subdomain", name,
+			"remote_addr", RealClientIP(r, h.config.TrustedHops))
+		h.writeNotFound(w, name)
+		return
+	}
+
+	// The client's connection is going away; it will likely reconnect
+	if tun.IsClosing() {
+		h.writeReconnecting(w)
+		return
+	}
+
+	// The owner paused the tunnel while working on their backend
+	if tun.IsPaused() {
+		w.Header().Set("Retry-After", "30")
+		h.writeError(w, http.StatusServiceUnavailable, h.config.PausedMessage)
+		return
+	}
+
+	// Protect the backend from being hammered
+	if tun.Limiter != nil && !tun.Limiter.Allow() {
+		w.Header().Set("Retry-After", "1")
+		h.writeError(w, http.StatusTooManyRequests, "Too many requests, please slow down")
+		return
+	}
+
+	// Fail fast while the backend keeps failing
+	if tun.Breaker != nil && !tun.Breaker.Allow() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(tun.Breaker.Cooldown().Seconds())))
+		h.writeError(w, http.StatusServiceUnavailable, "Tunnel backend is failing, please try again later")
+		return
+	}
+
+	// CONNECT turns the connection into a raw TCP pipe to the backend, so
+	// none of the HTTP rewriting below applies
+	if r.Method == http.MethodConnect {
+		if h.extractSubdomain(r.URL.Host) != name {
+			h.writeError(w, http.StatusBadRequest, "CONNECT target does not match the tunnel host")
+			return
+		}
+		h.beginRequest(tun)
+		h.forwardConnect(w, tun)
+		return
+	}
+
+	// Upgrades (WebSocket, h2c) reach the backend as the visitor sent them,
+	// without the rewriting below, and are always hijacked since the
+	// connection carries another protocol after the handshake
+	if IsUpgradeRequest(r) {
+		h.beginRequest(tun)
+		h.forwardHijacked(w, r, tun)
+		return
+	}
+
+	if tun.NormalizePaths {
+		normalizePath(r.URL)
+	}
+
+	// Tell the backend who the visitor is and how they connected
+	h.setForwardedHeaders(r)
+
+	// Path-routed backends see paths without the prefix; this tells them
+	// where they are mounted
+	r.Header.Del(ForwardedPrefixHeader)
+	if pathPrefix != "" {
+		r.Header.Set(ForwardedPrefixHeader, pathPrefix)
+	}
+
+	// Virtual-hosted backends may only answer to their own name; the
+	// public host is still available to them in X-Forwarded-Host
+	if tun.HostHeader != "" {
+		r.Host = tun.HostHeader
+	}
+
+	if tun.ForwardTLSInfo {
+		setTLSHeaders(r)
+	}
+
+	// Track in-flight requests and warn when a backend falls behind
+	h.beginRequest(tun)
+
+	// Requests reach the backend re-serialized from net/http's parse, which
+	// already answers 400 to conflicting Content-Length headers and drops
+	// Content-Length when Transfer-Encoding is present, so the backend can't
+	// frame a request differently from the proxy. In hijack mode this only
+	// holds for the first request; later requests on the same connection are
+	// piped as is, which is why buffered mode is the one to use when backends
+	// need that guarantee.
+	//
+	// Path-routed requests are never hijacked, since later requests on the
+	// same connection may be for other tunnels and need routing too.
+	// Neither are requests for tunnels that buffer responses, which needs
+	// the response parsed.
+	buffered := h.config.ForwardMode == config.ForwardModeBuffered || pathPrefix != "" || tun.BufferResponse
+	if buffered {
+		h.forwardBuffered(w, r, tun)
+		return
+	}
+
+	h.forwardHijacked(w, r, tun)
+}
+
+// forwardHijacked hijacks the client connection and pipes raw bytes
+// between it and the tunnel
+func (h *Handler) forwardHijacked(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel) {
+	// HTTP/2 streams can't be hijacked. Regular requests still work as a
+	// round trip; upgrades need the raw connection.
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		if !IsUpgradeRequest(r) {
+			h.forwardBuffered(w, r, tun)
+			return
+		}
+		tun.EndRequest()
+		h.writeError(w, http.StatusHTTPVersionNotSupported, "Upgrades require HTTP/1.1")
+		return
+	}
+
+	start := time.Now()
+	timeout := h.requestTimeout(r)
+
+	// Upgraded connections (WebSocket, h2c) carry a different protocol after
+	// the handshake, so they are piped as raw bytes without any rewriting
+	upgrade := IsUpgradeRequest(r)
+
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		tun.EndRequest()
+		log.Printf("Failed to hijack connection: %v", err)
+		h.writeError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	setNoDelay(clientConn, h.config.TCPNoDelay)
+
+	// Forward the request to the tunnel
+	metrics.ProxyGoroutines.Inc()
+	go func() {
+		defer metrics.ProxyGoroutines.Dec()
+		defer tun.EndRequest()
+		defer clientConn.Close()
+
+		// Dial through the tunnel to the local server
+		tunnelConn, err := DialThroughTunnel(tun)
+		if err != nil {
+			tunnelLog(tun).Warn("Failed to dial through tunnel", "event", "dial_failed", "error", err)
+			if tun.IsClosing() {
+				clientConn.Write(h.rawReconnectingResponse())
+				return
+			}
+			recordFailure(tun)
+			// Write 502 Bad Gateway error
+			countBadGateway(tun)
+			response := "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain\r\nContent-Length: 13\r\n\r\nBad Gateway\r\n"
+			clientConn.Write([]byte(response))
+			if h.config.AccessLog {
+				h.logAccess(tun, r, http.StatusBadGateway, int64(len(response)), start)
+			}
+			return
+		}
+		defer tunnelConn.Close()
+
+		// Write the original HTTP request to the tunnel. The body is
+		// streamed in small chunks as it arrives, never held in memory
+		// as a whole, so uploads of any size are safe.
+		if err := r.Write(tunnelConn); err != nil {
+			tunnelLog(tun).Warn("Failed to write request to tunnel", "event", "write_failed", "error", err)
+			if tun.IsClosing() {
+				clientConn.Write(h.rawReconnectingResponse())
+				return
+			}
+			recordFailure(tun)
+			return
+		}
+
+		// The status is taken from the response as it streams past and
+		// decides the circuit breaker's outcome; with keep-alive only the
+		// connection's first request is counted and logged
+		recorder := newResponseRecorder(tunnelConn, func(status int) {
+			recordStatus(tun, status)
+		})
+		tunnelConn = recorder
+
+		// Add our own headers to the response coming back from the tunnel
+		if !upgrade {
+			tunnelConn = WithResponseHeaders(tunnelConn, ResponseHeaders(h.config.InstanceID))
+		}
+
+		// Set timeout on client connection only
+		// The tunnel connection doesn't support SetDeadline.
+		// Upgraded connections are long-lived and are not timed out.
+		if timeout > 0 && !upgrade {
+			clientConn.SetDeadline(time.Now().Add(timeout))
+		}
+
+		// Bidirectional copy
+		CopyBidirectional(clientConn, tunnelConn)
+
+		if h.config.AccessLog {
+			h.logAccess(tun, r, recorder.status, recorder.bytes, start)
+		}
+	}()
+}
+
+// forwardConnect answers a CONNECT request with 200 Connection Established
+// and pipes raw bytes between the client and the tunnel, letting non-HTTP
+// protocols such as database clients reach the backend
+func (h *Handler) forwardConnect(w http.ResponseWriter, tun *tunnel.Tunnel) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		// HTTP/2 streams can't be hijacked
+		tun.EndRequest()
+		h.writeError(w, http.StatusHTTPVersionNotSupported, "CONNECT tunnels require HTTP/1.1")
+		return
+	}
+
+	// Dial before answering, so a dead tunnel is reported as an HTTP error
+	tunnelConn, err := DialThroughTunnel(tun)
+	if err != nil {
+		tun.EndRequest()
+		tunnelLog(tun).Warn("Failed to dial through tunnel", "event", "dial_failed", "error", err)
+		if tun.IsClosing() {
+			h.writeReconnecting(w)
+			return
+		}
+		recordFailure(tun)
+		countBadGateway(tun)
+		h.writeError(w, http.StatusBadGateway, "Bad Gateway")
+		return
+	}
+
+	clientConn, buf, err := hijacker.Hijack()
+	if err != nil {
+		tun.EndRequest()
+		tunnelConn.Close()
+		log.Printf("Failed to hijack connection: %v", err)
+		h.writeError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	recordSuccess(tun)
+
+	setNoDelay(clientConn, h.config.TCPNoDelay)
+
+	metrics.ProxyGoroutines.Inc()
+	go func() {
+		defer metrics.ProxyGoroutines.Dec()
+		defer tun.EndRequest()
+
+		if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			clientConn.Close()
+			tunnelConn.Close()
+			return
+		}
+
+		// Clients may send their first bytes before reading our answer
+		if n := buf.Reader.Buffered(); n > 0 {
+			early, _ := buf.Reader.Peek(n)
+			if _, err := tunnelConn.Write(early); err != nil {
+				clientConn.Close()
+				tunnelConn.Close()
+				return
+			}
+		}
+
+		// CONNECT tunnels are long-lived and are not timed out
+		CopyBidirectional(clientConn, tunnelConn)
+	}()
+}
+
+// forwardBuffered sends the request through the tunnel as a regular round
+// trip and writes the response through the ResponseWriter. This works over
+// HTTP/2 and lets the server handle response framing. Request and response
+// bodies are streamed; only the response head is parsed. Trailers on chunked
+// responses are read by the transport and written after the body, so gRPC
+// style responses keep their trailing headers. Tunnels with BufferResponse
+// set get each response body read in full first, see bufferResponse.
+func (h *Handler) forwardBuffered(w http.ResponseWriter, r *http.Request, tun *tunnel.Tunnel) {
+	defer tun.EndRequest()
+
+	if h.config.AccessLog {
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		w = aw
+		defer func() {
+			h.logAccess(tun, r, aw.status, aw.bytes, start)
+		}()
+	}
+
+	responseHeaders := ResponseHeaders(h.config.InstanceID)
+
+	if timeout := h.requestTimeout(r); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		// Extend (or shorten) the server's write timeout to match
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+	}
+
+	rp := &httputil.ReverseProxy{
+		BufferPool: copyBuffers,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// Keep the request's Host header (the public host or the tunnel's
+			// override); the URL host only names the tunnel target
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = tun.LocalAddr
+			pr.Out.Host = pr.In.Host
+
+			// ReverseProxy drops X-Forwarded-* headers before Rewrite; keep
+			// the ones ServeHTTP already set
+			for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host"} {
+				if values, ok := pr.In.Header[name]; ok {
+					pr.Out.Header[name] = values
+				}
+			}
+		},
+		Transport: NewTransport(tun),
+		ModifyResponse: func(resp *http.Response) error {
+			recordStatus(tun, resp.StatusCode)
+
+			for key, values := range responseHeaders {
+				resp.Header[key] = values
+			}
+			if tun.BufferResponse {
+				return bufferResponse(resp, h.config.ResponseBufferLimit)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if tun.IsClosing() {
+				tunnelLog(tun).Info("Tunnel is reconnecting", "event", "reconnecting", "error", err)
+				h.writeReconnecting(w)
+				return
+			}
+			recordFailure(tun)
+			tunnelLog(tun).Warn("Failed to forward request through tunnel", "event", "forward_failed", "error", err)
+			countBadGateway(tun)
+			if errors.Is(err, ErrInvalidResponse) {
+				h.writeError(w, http.StatusBadGateway, "Backend returned invalid response")
+				return
+			}
+			h.writeError(w, http.StatusBadGateway, "Bad Gateway")
+		},
+	}
+
+	rp.ServeHTTP(w, r)
+}
+
+// recordStatus tells the tunnel's circuit breaker how the backend answered
+// a request. Gateway errors count as failures, since clients answer 502
+// when their local server is down; so does a status of 0, meaning no valid
+// response came back. Any other status, errors from the app included,
+// shows the backend is up.
+func recordStatus(tun *tunnel.Tunnel, status int) {
+	switch status {
+	case 0, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		recordFailure(tun)
+	default:
+		recordSuccess(tun)
+	}
+}
+
+// reconnectRetryAfter is the Retry-After, in seconds, sent while a
+// tunnel's client is reconnecting
+const reconnectRetryAfter = "5"
+
+// writeReconnecting answers a request for a tunnel whose connection is closing
+func (h *Handler) writeReconnecting(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", reconnectRetryAfter)
+	h.writeError(w, http.StatusServiceUnavailable, h.config.ReconnectingMessage)
+}
+
+// rawReconnectingResponse is the writeReconnecting response for a
+// hijacked connection
+func (h *Handler) rawReconnectingResponse() []byte {
+	body := fmt.Sprintf("%d %s\n%s\n", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable), h.config.ReconnectingMessage)
+	return []byte(fmt.Sprintf("HTTP/1.1 503 Service Unavailable\r\nContent-Type: text/plain\r\nRetry-After: %s\r\nContent-Length: %d\r\n\r\n%s",
+		reconnectRetryAfter, len(body), body))
+}
+
+// recordSuccess tells the tunnel's circuit breaker the backend handled a request
+func recordSuccess(tun *tunnel.Tunnel) {
+	if tun.Breaker != nil {
+		tun.Breaker.Success()
+	}
+}
+
+// recordFailure tells the tunnel's circuit breaker the backend failed a request
+func recordFailure(tun *tunnel.Tunnel) {
+	if tun.Breaker == nil {
+		return
+	}
+	tun.Breaker.Failure()
+	if tun.Breaker.State() == tunnel.BreakerOpen {
+		tunnelLog(tun).Warn("Circuit opened after repeated backend failures", "event", "circuit_open")
+	}
+}
+
+// tunnelLog returns a logger tagged with the tunnel's subdomain and connection
+func tunnelLog(tun *tunnel.Tunnel) *slog.Logger {
+	return slog.With("subdomain", tun.Subdomain(), "conn", tun.ConnID)
+}
+
+// countBadGateway counts a 502 sent because the tunnel's backend failed
+func countBadGateway(tun *tunnel.Tunnel) {
+	metrics.BadGateway.Inc()
+	atomic.AddInt64(&tun.Errors, 1)
+}
+
+// beginRequest counts a request against the tunnel's in-flight requests.
+// Crossing the soft concurrency limit only logs a warning; requests are
+// never rejected. The caller must call tun.EndRequest when done.
+func (h *Handler) beginRequest(tun *tunnel.Tunnel) {
+	metrics.ProxiedRequests.Inc()
+	atomic.AddInt64(&tun.Requests, 1)
+	inFlight := tun.BeginRequest()
+	if limit := int64(h.config.SoftConcurrency); limit > 0 && inFlight == limit+1 {
+		tunnelLog(tun).Warn("Tunnel exceeded soft concurrency limit", "event", "concurrency_exceeded",
+			"in_flight", inFlight, "limit", limit)
+	}
+}
+
+// requestTimeout returns the timeout for a request. A valid TimeoutHeader
+// overrides RequestTimeout, clamped to MaxTimeout; the header is removed so
+// it doesn't reach the backend.
+func (h *Handler) requestTimeout(r *http.Request) time.Duration {
+	value := r.Header.Get(TimeoutHeader)
+	if value == "" {
+		return h.config.RequestTimeout
+	}
+	r.Header.Del(TimeoutHeader)
+
+	if h.config.MaxTimeout <= 0 {
+		return h.config.RequestTimeout
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		log.Printf("Ignoring invalid %s header: %q", TimeoutHeader, value)
+		return h.config.RequestTimeout
+	}
+
+	if timeout > h.config.MaxTimeout {
+		timeout = h.config.MaxTimeout
+	}
+	return timeout
+}
+
+// extractSubdomain extracts the subdomain from a host header
+func (h *Handler) extractSubdomain(host string) string {
+	// Remove port if present
+	if colonIndex := strings.Index(host, ":"); colonIndex != -1 {
+		host = host[:colonIndex]
+	}
+
+	// Host names are case-insensitive, and internationalized names are
+	// compared in their punycode form
+	host = normalizeHost(host)
+
+	// Check if host ends with our domain; the bare domain has no subdomain
+	domain := "." + normalizeHost(h.config.Domain)
+	if !strings.HasSuffix(host, domain) {
+		return ""
+	}
+
+	// Extract subdomain
+	subdomain := strings.TrimSuffix(host, domain)
+	subdomain = strings.TrimSpace(subdomain)
+
+	return subdomain
+}
+
+// ForwardedPrefixHeader carries the path prefix stripped from path-routed requests
+const ForwardedPrefixHeader = "X-Forwarded-Prefix"
+
+// routeByPath selects a tunnel from the first path segment after
+// PathRoutingPrefix, e.g. "/t/myapp/page" selects "myapp". On a match it
+// strips the prefix and segment from u and returns the tunnel name and the
+// stripped prefix; otherwise u is left alone. Reserved names never match.
+func (h *Handler) routeByPath(u *url.URL) (string, string) {
+	prefix := h.config.PathRoutingPrefix
+	escaped := u.EscapedPath()
+	rest, found := strings.CutPrefix(escaped, prefix)
+	if !found {
+		return "", ""
+	}
+
+	segment, tail, _ := strings.Cut(rest, "/")
+	name := strings.ToLower(segment)
+	if name == "" {
+		return "", ""
+	}
+	if _, reserved := h.reserved[name]; reserved {
+		return "", ""
+	}
+
+	tail = "/" + tail
+	unescaped, err := url.PathUnescape(tail)
+	if err != nil {
+		return "", ""
+	}
+	u.Path = unescaped
+	u.RawPath = tail
+
+	return name, prefix + segment
+}
+
+// isOwnHost reports whether host is the configured domain or one of its
+// subdomains
+func (h *Handler) isOwnHost(host string) bool {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = normalizeHost(host)
+	domain := normalizeHost(h.config.Domain)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// normalizeHost lowercases a host name, drops a trailing dot and converts
+// internationalized labels to punycode. Hosts idna rejects are only lowercased.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return host
+}
+
+// writeError writes an HTTP error response
+func (h *Handler) writeError(w http.ResponseWriter, statusCode int, message string) {
+	for key, values := range ResponseHeaders(h.config.InstanceID) {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(statusCode)
+	fmt.Fprintf(w, "%d %s\n%s\n", statusCode, http.StatusText(statusCode), message)
+}
+
+// writeNotFound answers a request for a subdomain without a tunnel, using
+// the configured HTML page when there is one
+func (h *Handler) writeNotFound(w http.ResponseWriter, name string) {
+	message := fmt.Sprintf("Tunnel not found for subdomain: %s", name)
+	if h.notFound == nil {
+		h.writeError(w, http.StatusNotFound, message)
+		return
+	}
+
+	// Render first so a failing template can still fall back to plain text
+	var page bytes.Buffer
+	if err := h.notFound.Execute(&page, struct{ Subdomain string }{name}); err != nil {
+		log.Printf("Failed to render not found page: %v", err)
+		h.writeError(w, http.StatusNotFound, message)
+		return
+	}
+
+	for key, values := range ResponseHeaders(h.config.InstanceID) {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(page.Bytes())
+}
+
+// setNoDelay applies the TCP_NODELAY setting to a client connection,
+// looking through TLS to the underlying TCP connection
+func setNoDelay(conn net.Conn, noDelay bool) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetNoDelay(noDelay); err != nil {
+			log.Printf("Failed to set TCP_NODELAY: %v", err)
+		}
+	}
+}
+
+// IsTunnelHost reports whether a host names a tunnel subdomain, as opposed
+// to the base domain, a foreign host or a reserved internal subdomain
+func (h *Handler) IsTunnelHost(host string) bool {
+	name := h.extractSubdomain(host)
+	if name == "" {
+		return false
+	}
+	_, reserved := h.reserved[name]
+	return !reserved
+}
+
+// forwardedChain returns the X-Forwarded-For entries of r followed by the
+// address of the peer that sent it
+func forwardedChain(r *http.Request) []string {
+	var chain []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				chain = append(chain, entry)
+			}
+		}
+	}
+
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	return append(chain, peer)
+}
+
+// clientIndex returns the position of the visitor in chain when the last
+// trustedHops entries before the peer were added by trusted proxies
+func clientIndex(chain []string, trustedHops int) int {
+	return max(len(chain)-1-max(trustedHops, 0), 0)
+}
+
+// RealClientIP returns the visitor's IP address. The peer is trusted to
+// report the address it got the request from, and so is each of the
+// trustedHops proxies before it; anything further left could be spoofed.
+func RealClientIP(r *http.Request, trustedHops int) string {
+	chain := forwardedChain(r)
+	return chain[clientIndex(chain, trustedHops)]
+}
+
+// forwardedFor returns the X-Forwarded-For value to send to the backend:
+// the real client IP followed by the trusted proxies, with any entries
+// the client added itself stripped
+func forwardedFor(r *http.Request, trustedHops int) string {
+	chain := forwardedChain(r)
+	return strings.Join(chain[clientIndex(chain, trustedHops):], ", ")
+}
+
+// setForwardedHeaders sets X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host on r, replacing any existing values so repeated
+// proxying never duplicates them. Proto and Host from the visitor are
+// only kept when TrustedHops says a proxy in front of us set them.
+func (h *Handler) setForwardedHeaders(r *http.Request) {
+	r.Header.Set("X-Forwarded-For", forwardedFor(r, h.config.TrustedHops))
+
+	trusted := h.config.TrustedHops > 0
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if !trusted || proto == "" {
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	}
+	r.Header.Del("X-Forwarded-Proto")
+	h.setSchemeHeaders(r, proto)
+	if host := r.Header.Get("X-Forwarded-Host"); !trusted || host == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+}
+
+// setSchemeHeaders tells the backend the scheme the visitor used through
+// the configured SchemeHeaders. A plain header name gets the scheme; a
+// "Name=value" entry gets value on HTTPS requests only, as frameworks
+// expect for headers like X-Forwarded-Ssl: on.
+func (h *Handler) setSchemeHeaders(r *http.Request, proto string) {
+	for _, entry := range h.config.SchemeHeaders {
+		name, value, fixed := strings.Cut(entry, "=")
+		r.Header.Del(name)
+		switch {
+		case !fixed:
+			r.Header.Set(name, proto)
+		case proto == "https":
+			r.Header.Set(name, value)
+		}
+	}
+}
+
+// Headers describing the visitor's TLS connection, added for tunnels that
+// ask for them
+const (
+	TLSVersionHeader = "X-Tunnel-TLS-Version"
+	TLSCipherHeader  = "X-Tunnel-TLS-Cipher"
+)
+
+// setTLSHeaders replaces any visitor-supplied TLS headers with the details
+// of the visitor's handshake. Plain HTTP requests get none.
+func setTLSHeaders(r *http.Request) {
+	r.Header.Del(TLSVersionHeader)
+	r.Header.Del(TLSCipherHeader)
+	if r.TLS == nil {
+		return
+	}
+
+	r.Header.Set(TLSVersionHeader, tls.VersionName(r.TLS.Version))
+	r.Header.Set(TLSCipherHeader, tls.CipherSuiteName(r.TLS.CipherSuite))
+}
+
+// normalizePath collapses duplicate slashes and resolves "." and ".."
+// segments in u's path, keeping a trailing slash. The escaped form is
+// cleaned so encoded characters such as %2F survive unchanged.
+func normalizePath(u *url.URL) {
+	escaped := u.EscapedPath()
+	if escaped == "" {
+		return
+	}
+
+	cleaned := path.Clean(escaped)
+	if strings.HasSuffix(escaped, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	if unescaped, err := url.PathUnescape(cleaned); err == nil {
+		u.Path = unescaped
+		u.RawPath = cleaned
+	}
+}
+
+// IsUpgradeRequest reports whether the request asks to switch protocols
+// (e.g. WebSocket or h2c). Both the Upgrade header and the "upgrade" token
+// in Connection are required, matching how servers decide to switch.
+func IsUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade")
+}
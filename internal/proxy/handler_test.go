@@ -0,0 +1,1391 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/metrics"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestProxy serves the proxy for cfg on a test server
+func newTestProxy(t *testing.T, cfg *config.Config) (*httptest.Server, *tunnel.Registry) {
+	t.Helper()
+
+	registry := tunnel.NewRegistry(0)
+	server := httptest.NewServer(NewHandler(cfg, registry))
+	t.Cleanup(server.Close)
+	return server, registry
+}
+
+// visitor sends every request on a new connection, so each one goes
+// through the proxy's routing rather than being piped on a hijacked one
+var visitor = &http.Client{
+	Timeout:   testkit.Timeout,
+	Transport: &http.Transport{DisableKeepAlives: true},
+}
+
+// visit sends a GET for path with the given Host through the proxy
+func visit(t *testing.T, server *httptest.Server, host, path string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Host = host
+	resp, err := visitor.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s%s: %v", host, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// waitForGauge waits until the proxy goroutine gauge reads want
+func waitForGauge(t *testing.T, want float64) {
+	t.Helper()
+
+	deadline := time.Now().Add(testkit.Timeout)
+	for testutil.ToFloat64(metrics.ProxyGoroutines) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy goroutines = %v, want %v", testutil.ToFloat64(metrics.ProxyGoroutines), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxyGoroutinesReturnToBaseline(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		t.Run(mode, func(t *testing.T) {
+			// Goroutines from earlier tests finish once their visitors hang up
+			waitForGauge(t, 0)
+
+			cfg := testkit.Config()
+			cfg.ForwardMode = mode
+			server, registry := newTestProxy(t, cfg)
+			testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello")
+			}))
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+					req.Host = "myapp." + testkit.Domain
+					resp, err := visitor.Do(req)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}()
+			}
+			wg.Wait()
+
+			waitForGauge(t, 0)
+		})
+	}
+}
+
+func TestReservedSubdomainRouting(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.PathRoutingPrefix = "/t/"
+	server, registry := newTestProxy(t, cfg)
+	h := server.Config.Handler.(*Handler)
+	h.HandleReserved("admin", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "dashboard "+r.URL.Path)
+	}))
+	// Names that aren't reserved could shadow a tunnel, so they are ignored
+	h.HandleReserved("myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "shadow")
+	}))
+	testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunnel")
+	}))
+
+	for _, tt := range []struct {
+		host, path string
+		status     int
+		body       string
+	}{
+		{"admin." + testkit.Domain, "/tunnels", http.StatusOK, "dashboard /tunnels"},
+		{"ADMIN." + testkit.Domain, "/", http.StatusOK, "dashboard /"},
+		{"myapp." + testkit.Domain, "/", http.StatusOK, "tunnel"},
+		// Reserved names without a handler are looked up, and never registered
+		{"www." + testkit.Domain, "/", http.StatusNotFound, ""},
+		// Path routing never reaches reserved handlers
+		{testkit.Domain, "/t/admin/tunnels", http.StatusNotFound, ""},
+	} {
+		resp := visit(t, server, tt.host, tt.path)
+		body := testkit.ReadBody(t, resp)
+		if resp.StatusCode != tt.status || (tt.body != "" && body != tt.body) {
+			t.Errorf("%s%s = %d %q, want %d %q", tt.host, tt.path, resp.StatusCode, body, tt.status, tt.body)
+		}
+	}
+}
+
+func TestForwardModes(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testkit.Config()
+			cfg.ForwardMode = mode
+			server, registry := newTestProxy(t, cfg)
+			testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Backend", "echo")
+				w.WriteHeader(http.StatusCreated)
+				io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+r.Host)
+			}))
+
+			resp := visit(t, server, "myapp."+testkit.Domain, "/hello?x=1")
+			if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Backend") != "echo" {
+				t.Fatalf("response = %d with X-Backend %q, want the backend's 201", resp.StatusCode, resp.Header.Get("X-Backend"))
+			}
+			if got, want := testkit.ReadBody(t, resp), "GET /hello?x=1 myapp."+testkit.Domain; got != want {
+				t.Fatalf("body = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestExtractSubdomain(t *testing.T) {
+	for _, tt := range []struct {
+		domain, host, want string
+	}{
+		{"tunnel.test", "myapp.tunnel.test", "myapp"},
+		{"tunnel.test", "MyApp.Tunnel.TEST", "myapp"},
+		{"Tunnel.Test", "myapp.tunnel.test", "myapp"},
+		{"tunnel.test", "myapp.tunnel.test:8080", "myapp"},
+		{"tunnel.test", "myapp.tunnel.test.", "myapp"},
+		{"tunnel.test", "Bücher.tunnel.test", "xn--bcher-kva"},
+		{"tunnel.test", "xn--bcher-kva.tunnel.test", "xn--bcher-kva"},
+		{"bücher.example", "myapp.xn--bcher-kva.example", "myapp"},
+		{"xn--bcher-kva.example", "MyApp.BÜCHER.example", "myapp"},
+		{"tunnel.test", "tunnel.test", ""},
+		{"tunnel.test", "myapp.other.test", ""},
+		{"tunnel.test", "eviltunnel.test", ""},
+	} {
+		cfg := testkit.Config()
+		cfg.Domain = tt.domain
+		h := NewHandler(cfg, tunnel.NewRegistry(0))
+		if got := h.extractSubdomain(tt.host); got != tt.want {
+			t.Errorf("domain %s: extractSubdomain(%q) = %q, want %q", tt.domain, tt.host, got, tt.want)
+		}
+	}
+}
+
+// Visitors typing a mixed-case host reach the tunnel
+func TestMixedCaseHostReachesTunnel(t *testing.T) {
+	server, registry := newTestProxy(t, testkit.Config())
+	testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunnel")
+	}))
+
+	resp := visit(t, server, "MyApp.Tunnel.TEST", "/")
+	if body := testkit.ReadBody(t, resp); resp.StatusCode != http.StatusOK || body != "tunnel" {
+		t.Fatalf("response = %d %q, want 200 %q", resp.StatusCode, body, "tunnel")
+	}
+}
+
+func TestRequestTimeoutOverride(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.RequestTimeout = 30 * time.Second
+	cfg.MaxTimeout = 2 * time.Minute
+	h := NewHandler(cfg, tunnel.NewRegistry(0))
+
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 30 * time.Second},
+		{"90s", 90 * time.Second},
+		{"1s", time.Second},
+		{"10m", 2 * time.Minute},
+		{"soon", 30 * time.Second},
+		{"-5s", 30 * time.Second},
+		{"0s", 30 * time.Second},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set(TimeoutHeader, tt.header)
+		}
+		if got := h.requestTimeout(r); got != tt.want {
+			t.Errorf("requestTimeout(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+		if r.Header.Get(TimeoutHeader) != "" {
+			t.Errorf("%s header %q was not removed", TimeoutHeader, tt.header)
+		}
+	}
+
+	cfg.MaxTimeout = 0
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(TimeoutHeader, "90s")
+	if got := h.requestTimeout(r); got != cfg.RequestTimeout {
+		t.Errorf("requestTimeout with overrides disabled = %v, want %v", got, cfg.RequestTimeout)
+	}
+}
+
+func TestRequestTimeoutOverrideReachesForwarding(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.RequestTimeout = 50 * time.Millisecond
+	cfg.MaxTimeout = testkit.Timeout
+	server, registry := newTestProxy(t, cfg)
+
+	seen := make(chan string, 2)
+	testkit.AddTunnel(t, registry, "slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get(TimeoutHeader)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+
+	get := func(override string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Host = "slow." + testkit.Domain
+		if override != "" {
+			req.Header.Set(TimeoutHeader, override)
+		}
+		return visitor.Do(req)
+	}
+
+	if resp, err := get(""); err == nil {
+		resp.Body.Close()
+		t.Fatalf("slow request finished despite the %v timeout: %s", cfg.RequestTimeout, resp.Status)
+	}
+	<-seen
+
+	resp, err := get("2s")
+	if err != nil {
+		t.Fatalf("request with a longer timeout failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if body := testkit.ReadBody(t, resp); body != "done" {
+		t.Fatalf("body = %q, want %q", body, "done")
+	}
+	if header := <-seen; header != "" {
+		t.Fatalf("backend saw %s: %q", TimeoutHeader, header)
+	}
+}
+
+func TestSoftConcurrencyLimitWarns(t *testing.T) {
+	logs := testkit.CaptureLogs(t)
+	cfg := testkit.Config()
+	cfg.SoftConcurrency = 2
+	server, registry := newTestProxy(t, cfg)
+	release := make(chan struct{})
+	tun := testkit.AddTunnel(t, registry, "busy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	// warnings returns the concurrency warnings logged so far
+	warnings := func() []map[string]interface{} {
+		var found []map[string]interface{}
+		for _, record := range logs.Records(t) {
+			if record["event"] == "concurrency_exceeded" {
+				found = append(found, record)
+			}
+		}
+		return found
+	}
+
+	var wg sync.WaitGroup
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+				req.Host = "busy." + testkit.Domain
+				resp, err := visitor.Do(req)
+				if err != nil {
+					t.Errorf("request over the soft limit failed: %v", err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("request over the soft limit = %d, want 200", resp.StatusCode)
+				}
+			}()
+		}
+	}
+	inFlight := func(want int64) {
+		deadline := time.Now().Add(testkit.Timeout)
+		for tun.InFlight() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("in-flight requests = %d, want %d", tun.InFlight(), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	send(2)
+	inFlight(2)
+	if n := len(warnings()); n != 0 {
+		t.Fatalf("%d warnings at the soft limit, want none", n)
+	}
+
+	send(2)
+	inFlight(4)
+	found := warnings()
+	if len(found) != 1 {
+		t.Fatalf("%d warnings above the soft limit, want exactly 1", len(found))
+	}
+	if found[0]["subdomain"] != "busy" || found[0]["in_flight"] != float64(3) || found[0]["limit"] != float64(2) {
+		t.Fatalf("warning = %v", found[0])
+	}
+
+	close(release)
+	wg.Wait()
+	inFlight(0)
+}
+
+func TestInFlightReturnsToZero(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testkit.Config()
+			cfg.ForwardMode = mode
+			server, registry := newTestProxy(t, cfg)
+			tun := testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			}))
+
+			resp := visit(t, server, "myapp."+testkit.Domain, "/")
+			if body := testkit.ReadBody(t, resp); body != "ok" {
+				t.Fatalf("body = %q, want %q", body, "ok")
+			}
+			testkit.WaitFor(t, "in-flight requests to reach 0", func() bool { return tun.InFlight() == 0 })
+		})
+	}
+}
+
+func TestPausedTunnelAnswersUnavailable(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.PausedMessage = "back soon"
+	server, registry := newTestProxy(t, cfg)
+	tun := testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	tun.Pause()
+	resp := visit(t, server, "myapp."+testkit.Domain, "/")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("paused tunnel answered %d (Retry-After %q), want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if body := testkit.ReadBody(t, resp); !strings.Contains(body, "back soon") {
+		t.Fatalf("paused body = %q, want the paused message", body)
+	}
+
+	tun.Resume()
+	resp = visit(t, server, "myapp."+testkit.Domain, "/")
+	if body := testkit.ReadBody(t, resp); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("after resuming = %d %q, want 200 %q", resp.StatusCode, body, "ok")
+	}
+}
+
+func TestBreakerOpensOnBackendErrors(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		for _, tt := range []struct {
+			status int
+			opens  bool
+		}{
+			{http.StatusBadGateway, true},
+			{http.StatusGatewayTimeout, true},
+			{http.StatusInternalServerError, false},
+			{http.StatusOK, false},
+		} {
+			t.Run(mode+"/"+http.StatusText(tt.status), func(t *testing.T) {
+				cfg := testkit.Config()
+				cfg.ForwardMode = mode
+				server, registry := newTestProxy(t, cfg)
+
+				var mu sync.Mutex
+				var backendRequests int64
+				tun := testkit.AddTunnel(t, registry, "myapp", statusHandler(tt.status, &backendRequests, &mu))
+				tun.Breaker = tunnel.NewBreaker(2, time.Minute, time.Minute)
+
+				for i := 0; i < 2; i++ {
+					if resp := visit(t, server, "myapp."+testkit.Domain, "/"); resp.StatusCode != tt.status {
+						t.Fatalf("request %d: status %d, want %d", i, resp.StatusCode, tt.status)
+					}
+				}
+
+				// The outcome is recorded as the response streams past, so
+				// wait for the breaker to see it
+				deadline := time.Now().Add(testkit.Timeout)
+				for tt.opens && tun.Breaker.State() != tunnel.BreakerOpen && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+
+				resp := visit(t, server, "myapp."+testkit.Domain, "/")
+				if tt.opens {
+					if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+						t.Fatalf("status after failures = %d, want 503 with Retry-After", resp.StatusCode)
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					if backendRequests != 2 {
+						t.Fatalf("backend saw %d requests, want 2: the open breaker should fail fast", backendRequests)
+					}
+				} else if resp.StatusCode != tt.status {
+					t.Fatalf("status = %d, want %d: the breaker should stay closed", resp.StatusCode, tt.status)
+				}
+			})
+		}
+	}
+}
+
+func TestRateLimitedTunnel(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		cfg := testkit.Config()
+		cfg.ForwardMode = mode
+		server, registry := newTestProxy(t, cfg)
+
+		var mu sync.Mutex
+		var backendRequests int64
+		tun := testkit.AddTunnel(t, registry, "myapp", statusHandler(http.StatusOK, &backendRequests, &mu))
+		tun.Limiter = tunnel.NewRateLimiter(0.001, 1)
+
+		if resp := visit(t, server, "myapp."+testkit.Domain, "/"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: first request = %d, want 200", mode, resp.StatusCode)
+		}
+		resp := visit(t, server, "myapp."+testkit.Domain, "/")
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+			t.Fatalf("%s: request over the limit = %d, want 429 with Retry-After", mode, resp.StatusCode)
+		}
+		mu.Lock()
+		if backendRequests != 1 {
+			t.Errorf("%s: backend saw %d requests, want 1", mode, backendRequests)
+		}
+		mu.Unlock()
+	}
+}
+
+// A backend that drops the connection without answering, as the client
+// does when the local server refuses connections, counts as a failure
+func TestBreakerCountsMissingResponses(t *testing.T) {
+	server, registry := newTestProxy(t, testkit.Config())
+	tun := testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	tun.Breaker = tunnel.NewBreaker(1, time.Minute, time.Minute)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+	req.Host = "myapp." + testkit.Domain
+	if resp, err := visitor.Do(req); err == nil {
+		resp.Body.Close()
+	}
+
+	deadline := time.Now().Add(testkit.Timeout)
+	for tun.Breaker.State() != tunnel.BreakerOpen {
+		if time.Now().After(deadline) {
+			t.Fatalf("breaker state = %s, want %s", tun.Breaker.State(), tunnel.BreakerOpen)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// statusHandler answers every request with status and counts the requests
+func statusHandler(status int, count *int64, mu *sync.Mutex) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*count++
+		mu.Unlock()
+		w.WriteHeader(status)
+	})
+}
+
+func TestIsTunnelHost(t *testing.T) {
+	h := NewHandler(testkit.Config(), tunnel.NewRegistry(0))
+	h.HandleReserved("admin", http.NotFoundHandler())
+
+	for host, want := range map[string]bool{
+		"myapp." + testkit.Domain: true,
+		"MYAPP." + testkit.Domain: true,
+		"admin." + testkit.Domain: false,
+		testkit.Domain:            false,
+		"example.org":             false,
+	} {
+		if got := h.IsTunnelHost(host); got != want {
+			t.Errorf("IsTunnelHost(%q) = %t, want %t", host, got, want)
+		}
+	}
+}
+
+// seenRequest is what the backend received
+type seenRequest struct {
+	uri, host, forwardedFor string
+}
+
+// upgradeBackend records each request and answers upgrades by switching
+// protocols and echoing the raw bytes that follow
+func upgradeBackend(seen chan<- seenRequest) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- seenRequest{r.RequestURI, r.Host, r.Header.Get("X-Forwarded-For")}
+		if !IsUpgradeRequest(r) {
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	})
+}
+
+// Upgrade requests and their responses are passed through untouched, in
+// every forward mode
+func TestUpgradeRequestsAreNotRewritten(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testkit.Config()
+			cfg.ForwardMode = mode
+			cfg.InstanceID = "proxy-1"
+			server, registry := newTestProxy(t, cfg)
+			seen := make(chan seenRequest, 2)
+			tun := testkit.AddTunnel(t, registry, "myapp", upgradeBackend(seen))
+			tun.NormalizePaths = true
+			tun.HostHeader = "backend.internal"
+
+			// A plain request is rewritten
+			visit(t, server, "myapp."+testkit.Domain, "/a/../b")
+			if got := <-seen; got.uri != "/b" || got.host != "backend.internal" || got.forwardedFor == "" {
+				t.Fatalf("plain request reached the backend as %+v, want it rewritten", got)
+			}
+
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(testkit.Timeout))
+			io.WriteString(conn, "GET /a/../socket HTTP/1.1\r\nHost: myapp."+testkit.Domain+
+				"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("read upgrade response: %v", err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("upgrade status = %d, want 101", resp.StatusCode)
+			}
+			if got := resp.Header.Get("X-Served-By"); got != "" {
+				t.Fatalf("upgrade response has X-Served-By %q, want it untouched", got)
+			}
+			if got := <-seen; got.uri != "/a/../socket" || got.host != "myapp."+testkit.Domain || got.forwardedFor != "" {
+				t.Fatalf("upgrade reached the backend as %+v, want it untouched", got)
+			}
+
+			// Bytes after the handshake are piped as is
+			io.WriteString(conn, "raw frame")
+			echo := make([]byte, len("raw frame"))
+			if _, err := io.ReadFull(br, echo); err != nil || string(echo) != "raw frame" {
+				t.Fatalf("echo = %q, %v; want %q", echo, err, "raw frame")
+			}
+		})
+	}
+}
+
+// rawBackend answers every request with reply instead of an HTTP response
+func rawBackend(reply string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, reply)
+	})
+}
+
+func TestMalformedBackendResponse(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.ForwardMode = config.ForwardModeBuffered
+	server, registry := newTestProxy(t, cfg)
+	testkit.AddTunnel(t, registry, "garbage", rawBackend("SSH-2.0-OpenSSH_9.6\r\nnot http at all\r\n\r\n"))
+	testkit.AddTunnel(t, registry, "silent", rawBackend(""))
+
+	resp := visit(t, server, "garbage."+testkit.Domain, "/")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status for a non-HTTP reply = %d, want 502", resp.StatusCode)
+	}
+	if body := testkit.ReadBody(t, resp); !strings.Contains(body, "invalid response") {
+		t.Fatalf("body = %q, want it to name the invalid response", body)
+	}
+
+	// A backend that hangs up without answering is a plain bad gateway
+	resp = visit(t, server, "silent."+testkit.Domain, "/")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status for an empty reply = %d, want 502", resp.StatusCode)
+	}
+	if body := testkit.ReadBody(t, resp); strings.Contains(body, "invalid response") {
+		t.Fatalf("body for an empty reply = %q, want a plain bad gateway", body)
+	}
+}
+
+// zeroReader is an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// Uploads are streamed to the backend; the proxy never holds a whole body
+func TestLargeUploadIsStreamed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uploads a large body")
+	}
+	const size = 256 << 20
+
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		cfg := testkit.Config()
+		cfg.ForwardMode = mode
+		server, registry := newTestProxy(t, cfg)
+		testkit.AddTunnel(t, registry, "upload", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := io.Copy(io.Discard, r.Body)
+			fmt.Fprint(w, n)
+		}))
+
+		runtime.GC()
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		// Sample the heap while the upload runs
+		done := make(chan struct{})
+		peak := make(chan uint64)
+		go func() {
+			var max uint64
+			var m runtime.MemStats
+			for {
+				runtime.ReadMemStats(&m)
+				if m.HeapAlloc > max {
+					max = m.HeapAlloc
+				}
+				select {
+				case <-done:
+					peak <- max
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}()
+
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/", io.LimitReader(zeroReader{}, size))
+		req.Host = "upload." + testkit.Domain
+		req.ContentLength = size
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Do(req)
+		close(done)
+		growth := int64(<-peak) - int64(before.HeapAlloc)
+		if err != nil {
+			t.Fatalf("%s: upload: %v", mode, err)
+		}
+		body := testkit.ReadBody(t, resp)
+		resp.Body.Close()
+
+		if body != fmt.Sprint(size) {
+			t.Fatalf("%s: backend received %s bytes, want %d", mode, body, size)
+		}
+		if growth > 32<<20 {
+			t.Fatalf("%s: heap grew by %d MB during a %d MB upload", mode, growth>>20, size>>20)
+		}
+	}
+}
+
+// recordingDialer keeps a copy of every byte the proxy sends to the backend
+type recordingDialer struct {
+	tunnel.StreamDialer
+	mu   sync.Mutex
+	sent bytes.Buffer
+}
+
+func (d *recordingDialer) Dial() (tunnel.Connection, error) {
+	conn, err := d.StreamDialer.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Connection: conn, d: d}, nil
+}
+
+// String returns everything sent so far
+func (d *recordingDialer) String() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sent.String()
+}
+
+type recordingConn struct {
+	tunnel.Connection
+	d *recordingDialer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.d.mu.Lock()
+	c.d.sent.Write(p)
+	c.d.mu.Unlock()
+	return c.Connection.Write(p)
+}
+
+// sendRaw writes a raw request to server and returns the response
+func sendRaw(t *testing.T, server *httptest.Server, raw string) *http.Response {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", server.Listener.Addr().String(), testkit.Timeout)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(testkit.Timeout))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return resp
+}
+
+func TestRequestSmugglingPatterns(t *testing.T) {
+	host := "Host: app." + testkit.Domain + "\r\n"
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		cfg := testkit.Config()
+		cfg.ForwardMode = mode
+		server, registry := newTestProxy(t, cfg)
+		tun := testkit.AddTunnel(t, registry, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+		}))
+		recorder := &recordingDialer{StreamDialer: tun.Streams}
+		tun.Streams = recorder
+
+		// Conflicting Content-Length headers are refused outright
+		for _, raw := range []string{
+			"POST / HTTP/1.1\r\n" + host + "Content-Length: 5\r\nContent-Length: 40\r\n\r\nhello",
+			"POST / HTTP/1.1\r\n" + host + "Content-Length: 5, 40\r\n\r\nhello",
+		} {
+			if resp := sendRaw(t, server, raw); resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("%s: conflicting Content-Length = %d, want 400", mode, resp.StatusCode)
+			}
+		}
+		if sent := recorder.String(); sent != "" {
+			t.Fatalf("%s: rejected requests reached the backend:\n%s", mode, sent)
+		}
+
+		// With both headers the body is chunked; the backend must not see a
+		// Content-Length it could frame the request by instead
+		smuggled := "GET /admin HTTP/1.1\r\n" + host + "\r\n"
+		raw := "POST / HTTP/1.1\r\n" + host + "Content-Length: " + fmt.Sprint(5+len(smuggled)) +
+			"\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n" + smuggled
+		if resp := sendRaw(t, server, raw); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: Content-Length with Transfer-Encoding = %d, want 200", mode, resp.StatusCode)
+		}
+		sent := recorder.String()
+		head, _, _ := strings.Cut(sent, "\r\n\r\n")
+		if strings.Contains(strings.ToLower(head), "content-length") {
+			t.Fatalf("%s: backend received both framing headers:\n%s", mode, head)
+		}
+
+		// The backend frames the request exactly like the proxy did: an
+		// empty body, with anything after it a request of its own
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(sent)))
+		if err != nil {
+			t.Fatalf("%s: backend received an unparsable request: %v", mode, err)
+		}
+		if body, _ := io.ReadAll(req.Body); len(body) != 0 {
+			t.Fatalf("%s: smuggled bytes reached the backend inside the first request: %q", mode, body)
+		}
+	}
+}
+
+func TestResponseTrailersReachClient(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		cfg := testkit.Config()
+		cfg.ForwardMode = mode
+		server, registry := newTestProxy(t, cfg)
+		testkit.AddTunnel(t, registry, "grpc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, "payload")
+			w.(http.Flusher).Flush()
+			w.Header().Set("Grpc-Status", "0")
+			w.Header().Set("Grpc-Message", "all good")
+			// Trailers not announced up front use the TrailerPrefix
+			w.Header().Set(http.TrailerPrefix+"X-Checksum", "abc123")
+		}))
+
+		resp := visit(t, server, "grpc."+testkit.Domain, "/")
+		if body := testkit.ReadBody(t, resp); body != "payload" {
+			t.Fatalf("%s: body = %q, want %q", mode, body, "payload")
+		}
+		for name, want := range map[string]string{"Grpc-Status": "0", "Grpc-Message": "all good", "X-Checksum": "abc123"} {
+			if got := resp.Trailer.Get(name); got != want {
+				t.Errorf("%s: trailer %s = %q, want %q (trailers: %v)", mode, name, got, want, resp.Trailer)
+			}
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"/a//b", "/a/b"},
+		{"//a///b/", "/a/b/"},
+		{"/a/./b/../c", "/a/c"},
+		{"/../../etc/passwd", "/etc/passwd"},
+		{"/a/%2F/b", "/a/%2F/b"},
+		{"/files//my%20doc.txt", "/files/my%20doc.txt"},
+		{"/", "/"},
+		{"/.", "/"},
+	} {
+		// Parsed like a request target, so a leading // isn't a host
+		u, err := url.ParseRequestURI(tt.in)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.in, err)
+		}
+		normalizePath(u)
+		if got := u.EscapedPath(); got != tt.want {
+			t.Errorf("normalizePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPathNormalizationPerTunnel(t *testing.T) {
+	const path = "//static/./css/../img//logo%2Fbig.png?v=1"
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		cfg := testkit.Config()
+		cfg.ForwardMode = mode
+		server, registry := newTestProxy(t, cfg)
+		seen := make(chan string, 1)
+		record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen <- r.RequestURI
+		})
+		testkit.AddTunnel(t, registry, "verbatim", record)
+		testkit.AddTunnel(t, registry, "clean", record).NormalizePaths = true
+
+		for name, want := range map[string]string{
+			"verbatim": path,
+			"clean":    "/static/img/logo%2Fbig.png?v=1",
+		} {
+			resp := sendRaw(t, server, "GET "+path+" HTTP/1.1\r\nHost: "+name+"."+testkit.Domain+"\r\nConnection: close\r\n\r\n")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: %s tunnel answered %d", mode, name, resp.StatusCode)
+			}
+			if got := <-seen; got != want {
+				t.Errorf("%s: %s tunnel saw %q, want %q", mode, name, got, want)
+			}
+		}
+	}
+}
+
+func TestHostHeaderOverrideInEachMode(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		cfg := testkit.Config()
+		cfg.ForwardMode = mode
+		server, registry := newTestProxy(t, cfg)
+		testkit.AddTunnel(t, registry, "saas", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Host)
+		})).HostHeader = "backend.internal"
+
+		if host := testkit.ReadBody(t, visit(t, server, "saas."+testkit.Domain, "/")); host != "backend.internal" {
+			t.Errorf("%s: backend saw Host %q, want the override", mode, host)
+		}
+	}
+}
+
+func TestForwardTLSInfo(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		cfg := testkit.Config()
+		cfg.ForwardMode = mode
+		registry := tunnel.NewRegistry(0)
+		server := httptest.NewTLSServer(NewHandler(cfg, registry))
+		t.Cleanup(server.Close)
+
+		report := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Header.Get(TLSVersionHeader)+"|"+r.Header.Get(TLSCipherHeader))
+		})
+		testkit.AddTunnel(t, registry, "fraud", report).ForwardTLSInfo = true
+		testkit.AddTunnel(t, registry, "plain", report)
+
+		for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+			transport := server.Client().Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.MinVersion = version
+			transport.TLSClientConfig.MaxVersion = version
+			transport.DisableKeepAlives = true
+			client := &http.Client{Transport: transport, Timeout: testkit.Timeout}
+
+			get := func(name string) (string, *tls.ConnectionState) {
+				req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+				req.Host = name + "." + testkit.Domain
+				// Visitors can't supply these themselves
+				req.Header.Set(TLSVersionHeader, "spoofed")
+				req.Header.Set(TLSCipherHeader, "spoofed")
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatalf("%s: GET %s: %v", mode, name, err)
+				}
+				defer resp.Body.Close()
+				return testkit.ReadBody(t, resp), resp.TLS
+			}
+
+			body, state := get("fraud")
+			if want := tls.VersionName(version) + "|" + tls.CipherSuiteName(state.CipherSuite); body != want {
+				t.Errorf("%s: backend saw %q, want %q", mode, body, want)
+			}
+			if body, _ := get("plain"); body != "spoofed|spoofed" {
+				t.Errorf("%s: tunnel without the flag saw %q, want the visitor's headers untouched", mode, body)
+			}
+		}
+
+		// Plain HTTP visitors have no TLS details, and can't fake them
+		plain := httptest.NewServer(NewHandler(cfg, registry))
+		t.Cleanup(plain.Close)
+		req, _ := http.NewRequest(http.MethodGet, plain.URL+"/", nil)
+		req.Host = "fraud." + testkit.Domain
+		req.Header.Set(TLSVersionHeader, "TLS 1.3")
+		resp, err := visitor.Do(req)
+		if err != nil {
+			t.Fatalf("%s: plain GET: %v", mode, err)
+		}
+		if body := testkit.ReadBody(t, resp); body != "|" {
+			t.Errorf("%s: backend saw %q over plain HTTP, want no TLS headers", mode, body)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestRealClientIP(t *testing.T) {
+	for _, tt := range []struct {
+		xff         []string
+		hops        int
+		client, fwd string
+	}{
+		// No trusted proxies: only the peer counts, spoofed entries go
+		{nil, 0, "203.0.113.9", "203.0.113.9"},
+		{[]string{"1.1.1.1"}, 0, "203.0.113.9", "203.0.113.9"},
+		// One trusted proxy (the peer) reports the client
+		{[]string{"198.51.100.7"}, 1, "198.51.100.7", "198.51.100.7, 203.0.113.9"},
+		{[]string{"1.1.1.1, 198.51.100.7"}, 1, "198.51.100.7", "198.51.100.7, 203.0.113.9"},
+		// Two hops, split across repeated headers
+		{[]string{"1.1.1.1, 198.51.100.7", "10.0.0.2"}, 2, "198.51.100.7", "198.51.100.7, 10.0.0.2, 203.0.113.9"},
+		// More trusted hops than entries: the leftmost is the best guess
+		{[]string{"198.51.100.7"}, 5, "198.51.100.7", "198.51.100.7, 203.0.113.9"},
+		// Empty entries are ignored
+		{[]string{" , 198.51.100.7 ,"}, 1, "198.51.100.7", "198.51.100.7, 203.0.113.9"},
+		{nil, -1, "203.0.113.9", "203.0.113.9"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "203.0.113.9:51234"
+		for _, value := range tt.xff {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := RealClientIP(r, tt.hops); got != tt.client {
+			t.Errorf("RealClientIP(%q, %d) = %s, want %s", tt.xff, tt.hops, got, tt.client)
+		}
+		if got := forwardedFor(r, tt.hops); got != tt.fwd {
+			t.Errorf("forwardedFor(%q, %d) = %q, want %q", tt.xff, tt.hops, got, tt.fwd)
+		}
+	}
+}
+
+func TestForwardedForReachesBackend(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		cfg := testkit.Config()
+		cfg.ForwardMode = mode
+		cfg.TrustedHops = 1
+		server, registry := newTestProxy(t, cfg)
+		testkit.AddTunnel(t, registry, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, strings.Join(r.Header.Values("X-Forwarded-For"), "|"))
+		}))
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+		req.Host = "app." + testkit.Domain
+		req.Header.Set("X-Forwarded-For", "6.6.6.6, 198.51.100.7")
+		resp, err := visitor.Do(req)
+		if err != nil {
+			t.Fatalf("%s: GET: %v", mode, err)
+		}
+		if body := testkit.ReadBody(t, resp); body != "198.51.100.7, 127.0.0.1" {
+			t.Errorf("%s: backend saw X-Forwarded-For %q", mode, body)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestForwardedProtoAndHost(t *testing.T) {
+	sent := http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"public.example.com"}}
+	for _, tt := range []struct {
+		hops   int
+		header http.Header
+		want   string // %s is the tunnel's public host
+	}{
+		{0, nil, "http|%s"},
+		// Without trusted proxies the visitor's values are replaced
+		{0, sent, "http|%s"},
+		// A trusted proxy's values are kept
+		{1, sent, "https|public.example.com"},
+		{1, nil, "http|%s"},
+	} {
+		for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+			cfg := testkit.Config()
+			cfg.ForwardMode = mode
+			cfg.TrustedHops = tt.hops
+			server, registry := newTestProxy(t, cfg)
+			testkit.AddTunnel(t, registry, "app", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.Header.Get("X-Forwarded-Proto")+"|"+r.Header.Get("X-Forwarded-Host"))
+			}))
+
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+			req.Host = "app." + testkit.Domain
+			for key, values := range tt.header {
+				req.Header[key] = values
+			}
+			resp, err := visitor.Do(req)
+			if err != nil {
+				t.Fatalf("%s: GET: %v", mode, err)
+			}
+			want := strings.ReplaceAll(tt.want, "%s", req.Host)
+			if body := testkit.ReadBody(t, resp); body != want {
+				t.Errorf("%s, %d hops, headers %v: backend saw %q, want %q", mode, tt.hops, tt.header, body, want)
+			}
+			resp.Body.Close()
+		}
+	}
+}
+
+// dyingDialer fails every dial, marking its tunnel closing first when set,
+// as happens when the client connection drops while a request is dialed
+type dyingDialer struct {
+	tunnel.StreamDialer
+	tun     *tunnel.Tunnel
+	closing bool
+}
+
+func (d *dyingDialer) Dial() (tunnel.Connection, error) {
+	if d.closing {
+		d.tun.MarkClosing()
+	}
+	return nil, net.ErrClosed
+}
+
+func TestClosingTunnelAnswersReconnecting(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		for _, tt := range []struct {
+			name    string
+			prepare func(tun *tunnel.Tunnel)
+			status  int
+		}{
+			// Marked closing before the request is routed
+			{"closed", func(tun *tunnel.Tunnel) { tun.MarkClosing() }, http.StatusServiceUnavailable},
+			// The connection dies while the request is dialed
+			{"race", func(tun *tunnel.Tunnel) {
+				tun.Streams = &dyingDialer{StreamDialer: tun.Streams, tun: tun, closing: true}
+			}, http.StatusServiceUnavailable},
+			// A dial failure on a live connection is still a bad gateway
+			{"failed", func(tun *tunnel.Tunnel) {
+				tun.Streams = &dyingDialer{StreamDialer: tun.Streams, tun: tun}
+			}, http.StatusBadGateway},
+		} {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				cfg := testkit.Config()
+				cfg.ForwardMode = mode
+				cfg.ReconnectingMessage = "back in a moment"
+				server, registry := newTestProxy(t, cfg)
+				tt.prepare(testkit.AddTunnel(t, registry, "myapp", http.NotFoundHandler()))
+
+				resp := visit(t, server, "myapp."+testkit.Domain, "/")
+				body := testkit.ReadBody(t, resp)
+				if resp.StatusCode != tt.status {
+					t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+				}
+				if tt.status != http.StatusServiceUnavailable {
+					return
+				}
+				if resp.Header.Get("Retry-After") == "" {
+					t.Fatal("503 for a closing tunnel has no Retry-After")
+				}
+				if !strings.Contains(body, cfg.ReconnectingMessage) {
+					t.Fatalf("body = %q, want the reconnecting message", body)
+				}
+			})
+		}
+	}
+}
+
+func TestConnectPipesRawBytes(t *testing.T) {
+	server, registry := newTestProxy(t, testkit.Config())
+
+	// The backend echoes each line in upper case, like a non-HTTP protocol
+	proxyEnd, backendEnd := net.Pipe()
+	t.Cleanup(func() { backendEnd.Close() })
+	go func() {
+		lines := bufio.NewScanner(backendEnd)
+		for lines.Scan() {
+			fmt.Fprintf(backendEnd, "%s\n", strings.ToUpper(lines.Text()))
+		}
+	}()
+	tun := &tunnel.Tunnel{ID: "db-id", WSConn: proxyEnd, LocalAddr: "localhost:5432", CreatedAt: time.Now()}
+	tun.SetSubdomain("db")
+	if err := registry.Register(tun); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialTimeout("tcp", server.Listener.Addr().String(), testkit.Timeout)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testkit.Timeout))
+
+	// The first line is sent before the answer is read
+	target := "db." + testkit.Domain + ":5432"
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nhello\n", target, target)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+
+	if line, err := br.ReadString('\n'); err != nil || line != "HELLO\n" {
+		t.Fatalf("early bytes came back as %q, %v; want %q", line, err, "HELLO\n")
+	}
+	io.WriteString(conn, "world\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "WORLD\n" {
+		t.Fatalf("read %q, %v; want %q", line, err, "WORLD\n")
+	}
+}
+
+func TestConnectToDeadTunnel(t *testing.T) {
+	server, registry := newTestProxy(t, testkit.Config())
+	tun := testkit.AddTunnel(t, registry, "db", http.NotFoundHandler())
+	tun.WSConn = nil
+
+	target := "db." + testkit.Domain + ":5432"
+	resp := sendRaw(t, server, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("CONNECT to a tunnel without a connection = %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestNotFoundPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "404.html")
+	os.WriteFile(path, []byte("<h1>No tunnel named {{.Subdomain}}</h1>"), 0o644)
+
+	plain, _ := newTestProxy(t, testkit.Config())
+	resp := visit(t, plain, "missing."+testkit.Domain, "/")
+	if body := testkit.ReadBody(t, resp); resp.StatusCode != http.StatusNotFound || !strings.Contains(body, "Tunnel not found for subdomain: missing") {
+		t.Fatalf("without NOT_FOUND_PAGE = %d %q, want the plain text error", resp.StatusCode, body)
+	}
+
+	cfg := testkit.Config()
+	cfg.NotFoundPagePath = path
+	server, _ := newTestProxy(t, cfg)
+	resp = visit(t, server, "missing."+testkit.Domain, "/")
+	body := testkit.ReadBody(t, resp)
+	if resp.StatusCode != http.StatusNotFound || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("with NOT_FOUND_PAGE = %d %s, want 404 text/html", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if body != "<h1>No tunnel named missing</h1>" {
+		t.Fatalf("body = %q, want the rendered page", body)
+	}
+}
+
+func TestForeignHostsAreRejectedEarly(t *testing.T) {
+	server, registry := newTestProxy(t, testkit.Config())
+	var reached atomic.Int64
+	testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+	}))
+
+	// Start a fresh throttling interval so the first rejection is logged
+	foreignHostLog.mu.Lock()
+	foreignHostLog.last = time.Time{}
+	foreignHostLog.mu.Unlock()
+	logs := testkit.CaptureLogs(t)
+
+	foreign := []string{
+		"example.org",
+		"myapp.example.org",
+		"myapp.tunnel.test.example.org",
+		"eviltunnel.test",
+		"203.0.113.7",
+		"example.org:8080",
+	}
+	for _, host := range foreign {
+		resp := sendRaw(t, server, "GET /wp-login.php HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		body := testkit.ReadBody(t, resp)
+		if resp.StatusCode != http.StatusMisdirectedRequest {
+			t.Errorf("%s: status = %d, want 421", host, resp.StatusCode)
+		}
+		if !resp.Close {
+			t.Errorf("%s: connection kept open", host)
+		}
+		if body != "" {
+			t.Errorf("%s: body = %q, want none", host, body)
+		}
+	}
+	if n := reached.Load(); n != 0 {
+		t.Fatalf("%d foreign requests reached a tunnel", n)
+	}
+
+	var logged int
+	for _, record := range logs.Records(t) {
+		if record["event"] == "foreign_host" {
+			logged++
+		}
+	}
+	if logged != 1 {
+		t.Fatalf("logged %d foreign host rejections, want 1 for %d requests", logged, len(foreign))
+	}
+
+	// Our own domain still gets the regular answers
+	for host, status := range map[string]int{
+		testkit.Domain:              http.StatusNotFound,
+		"TUNNEL.TEST.":              http.StatusNotFound,
+		"missing." + testkit.Domain: http.StatusNotFound,
+		"myapp." + testkit.Domain:   http.StatusOK,
+		"myapp.tunnel.test:8080":    http.StatusOK,
+	} {
+		if resp := visit(t, server, host, "/"); resp.StatusCode != status {
+			t.Errorf("%s: status = %d, want %d", host, resp.StatusCode, status)
+		}
+	}
+}
+
+func TestRouteByPath(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.PathRoutingPrefix = "/t/"
+	h := NewHandler(cfg, tunnel.NewRegistry(0))
+	h.HandleReserved("api", http.NotFoundHandler())
+
+	for _, tt := range []struct {
+		target   string
+		name     string
+		prefix   string
+		rewrites string
+	}{
+		{"/t/myapp/page?x=1", "myapp", "/t/myapp", "/page?x=1"},
+		{"/t/myapp", "myapp", "/t/myapp", "/"},
+		{"/t/MyApp/", "myapp", "/t/MyApp", "/"},
+		{"/t/myapp/a%2Fb", "myapp", "/t/myapp", "/a%2Fb"},
+		{"/t/", "", "", "/t/"},
+		{"/t/api/x", "", "", "/t/api/x"},
+		{"/tx/myapp/page", "", "", "/tx/myapp/page"},
+		{"/page", "", "", "/page"},
+	} {
+		u, err := url.ParseRequestURI(tt.target)
+		if err != nil {
+			t.Fatalf("parse %q: %v", tt.target, err)
+		}
+		name, prefix := h.routeByPath(u)
+		if name != tt.name || prefix != tt.prefix || u.RequestURI() != tt.rewrites {
+			t.Errorf("routeByPath(%q) = %q, %q, rewritten to %q; want %q, %q, %q",
+				tt.target, name, prefix, u.RequestURI(), tt.name, tt.prefix, tt.rewrites)
+		}
+	}
+}
+
+func TestPathRoutedRequestReachesTunnel(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := testkit.Config()
+			cfg.PathRoutingPrefix = "/t/"
+			cfg.ForwardMode = mode
+			server, registry := newTestProxy(t, cfg)
+			testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.URL.RequestURI()+" "+r.Header.Get(ForwardedPrefixHeader))
+			}))
+
+			resp := visit(t, server, testkit.Domain, "/t/myapp/page?x=1")
+			if got, want := testkit.ReadBody(t, resp), "/page?x=1 /t/myapp"; resp.StatusCode != http.StatusOK || got != want {
+				t.Fatalf("response = %d %q, want 200 %q", resp.StatusCode, got, want)
+			}
+		})
+	}
+}
+
+func TestSchemeHeaders(t *testing.T) {
+	report := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-Proto")+"|"+r.Header.Get("X-Forwarded-Ssl")+"|"+r.Header.Get("X-Scheme"))
+	})
+
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		for _, tt := range []struct {
+			headers     []string
+			http, https string
+		}{
+			{[]string{"X-Forwarded-Proto"}, "http||", "https||"},
+			{[]string{"X-Forwarded-Proto", "X-Forwarded-Ssl=on"}, "http||", "https|on|"},
+			{[]string{"X-Scheme"}, "||http", "||https"},
+		} {
+			cfg := testkit.Config()
+			cfg.ForwardMode = mode
+			cfg.SchemeHeaders = tt.headers
+			registry := tunnel.NewRegistry(0)
+			testkit.AddTunnel(t, registry, "app", report)
+			plain := httptest.NewServer(NewHandler(cfg, registry))
+			t.Cleanup(plain.Close)
+			secure := httptest.NewTLSServer(NewHandler(cfg, registry))
+			t.Cleanup(secure.Close)
+			transport := secure.Client().Transport.(*http.Transport).Clone()
+			transport.DisableKeepAlives = true
+
+			for _, visit := range []struct {
+				server *httptest.Server
+				client *http.Client
+				want   string
+			}{
+				{plain, visitor, tt.http},
+				{secure, &http.Client{Transport: transport, Timeout: testkit.Timeout}, tt.https},
+			} {
+				req, _ := http.NewRequest(http.MethodGet, visit.server.URL+"/", nil)
+				req.Host = "app." + testkit.Domain
+				// Visitors can't claim a scheme they didn't use
+				req.Header.Set("X-Forwarded-Proto", "https")
+				if tt.headers[len(tt.headers)-1] == "X-Forwarded-Ssl=on" {
+					req.Header.Set("X-Forwarded-Ssl", "on")
+				}
+				resp, err := visit.client.Do(req)
+				if err != nil {
+					t.Fatalf("%s %v: GET %s: %v", mode, tt.headers, visit.server.URL, err)
+				}
+				if body := testkit.ReadBody(t, resp); body != visit.want {
+					t.Errorf("%s %v: backend behind %s saw %q, want %q", mode, tt.headers, visit.server.URL, body, visit.want)
+				}
+				resp.Body.Close()
+			}
+		}
+	}
+}
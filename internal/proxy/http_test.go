@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/ahmadrosid/tunnel/internal/cert"
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// The standalone HTTPS proxy only offers HTTP/2 when it doesn't hijack, so
+// a client that prefers HTTP/2 still reaches the tunnel in every mode
+func TestHTTPSProxyProtocols(t *testing.T) {
+	for _, tt := range []struct {
+		mode  string
+		proto string
+	}{
+		{config.ForwardModeHijack, "HTTP/1.1"},
+		{config.ForwardModeBuffered, "HTTP/2.0"},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := testkit.Config()
+			cfg.EnableHTTPS = true
+			cfg.DevMode = true
+			cfg.CertCacheDir = t.TempDir()
+			cfg.ForwardMode = tt.mode
+			registry := tunnel.NewRegistry(0)
+			s := NewServer(cfg, registry, cert.NewManager(cfg, registry))
+
+			offersH2 := slices.Contains(s.httpsServer.TLSConfig.NextProtos, "h2")
+			if tt.mode == config.ForwardModeHijack && (offersH2 || !slices.Contains(s.httpsServer.TLSConfig.NextProtos, "http/1.1")) {
+				t.Fatalf("hijacking proxy offers %q, want http/1.1 only", s.httpsServer.TLSConfig.NextProtos)
+			}
+
+			testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello"))
+			}))
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.httpsServer.ServeTLS(l, "", "")
+			t.Cleanup(func() { s.httpsServer.Close() })
+
+			client := &http.Client{
+				Timeout: testkit.Timeout,
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						ServerName:         "myapp." + testkit.Domain,
+						InsecureSkipVerify: true, // the dev certificate is self-signed
+					},
+					ForceAttemptHTTP2: true,
+				},
+			}
+			req, err := http.NewRequest(http.MethodGet, "https://"+l.Addr().String()+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "myapp." + testkit.Domain
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("GET: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.Proto != tt.proto {
+				t.Errorf("served over %s, want %s", resp.Proto, tt.proto)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			if body := testkit.ReadBody(t, resp); body != "hello" {
+				t.Fatalf("body = %q, want the backend's response", body)
+			}
+		})
+	}
+}
+
+// A response writer that can't be hijacked, as under HTTP/2, still serves
+// plain requests; only upgrades are refused
+func TestUnhijackableWriter(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.ForwardMode = config.ForwardModeHijack
+	registry := tunnel.NewRegistry(0)
+	handler := NewHandler(cfg, registry)
+	testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://myapp."+testkit.Domain+"/", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("plain request got %d %q, want the backend's response", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://myapp."+testkit.Domain+"/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusHTTPVersionNotSupported {
+		t.Fatalf("upgrade got %d, want %d", rec.Code, http.StatusHTTPVersionNotSupported)
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/ahmadrosid/tunnel/internal/metrics"
+)
+
+// LimitListener caps the number of open visitor connections accepted from
+// l. Connections over the limit are closed right after accept. A limit of
+// 0 only counts connections.
+func LimitListener(l net.Listener, limit int) net.Listener {
+	return &limitListener{Listener: l, limit: int64(limit)}
+}
+
+// limitListener implements LimitListener
+type limitListener struct {
+	net.Listener
+	limit int64
+}
+
+// Accept waits for the next connection within the limit
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !metrics.VisitorConnections.TryInc(l.limit) {
+			metrics.VisitorRejected.Inc()
+			conn.Close()
+			continue
+		}
+
+		return &visitorConn{Conn: conn}, nil
+	}
+}
+
+// visitorConn releases its slot in VisitorConnections when closed or
+// reclassified, whichever comes first
+type visitorConn struct {
+	net.Conn
+	once sync.Once
+}
+
+// release gives back the connection's visitor slot
+func (c *visitorConn) release() {
+	c.once.Do(metrics.VisitorConnections.Dec)
+}
+
+// Close closes the connection and releases its slot
+func (c *visitorConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// ReleaseVisitorSlot stops counting conn as a visitor connection. Servers
+// that share a listener between visitors and tunnel clients call it once a
+// connection turns out to be a tunnel client.
+func ReleaseVisitorSlot(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if vc, ok := conn.(*visitorConn); ok {
+		vc.release()
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/metrics"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// acceptAll accepts connections from l until it is closed, closing them
+// all when the test ends
+func acceptAll(t *testing.T, l net.Listener) <-chan net.Conn {
+	t.Helper()
+
+	accepted := make(chan net.Conn, 16)
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			accepted <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return accepted
+}
+
+// dialVisitor connects to l as a visitor would
+func dialVisitor(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), testkit.Timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// closedByServer reports whether the server end of conn has been closed
+func closedByServer(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := LimitListener(inner, 2)
+	t.Cleanup(func() { l.Close() })
+	accepted := acceptAll(t, l)
+	before := metrics.VisitorConnections.Value()
+	rejected := testutil.ToFloat64(metrics.VisitorRejected)
+
+	first, second := dialVisitor(t, l), dialVisitor(t, l)
+	serverFirst := <-accepted
+	<-accepted
+	if got := metrics.VisitorConnections.Value() - before; got != 2 {
+		t.Fatalf("visitor gauge grew by %d, want 2", got)
+	}
+
+	// Over the limit: closed right after accept, never handed out
+	over := dialVisitor(t, l)
+	if !closedByServer(over) {
+		t.Fatal("connection over the limit was not closed")
+	}
+	if got := testutil.ToFloat64(metrics.VisitorRejected) - rejected; got != 1 {
+		t.Fatalf("rejected counter grew by %v, want 1", got)
+	}
+	if closedByServer(first) || closedByServer(second) {
+		t.Fatal("connection within the limit was closed")
+	}
+
+	// Closing a connection frees its slot, once
+	serverFirst.Close()
+	serverFirst.Close()
+	if got := metrics.VisitorConnections.Value() - before; got != 1 {
+		t.Fatalf("visitor gauge after close = +%d, want +1", got)
+	}
+	dialVisitor(t, l)
+	select {
+	case <-accepted:
+	case <-time.After(testkit.Timeout):
+		t.Fatal("connection not accepted after a slot was freed")
+	}
+}
+
+// Connections that turn out to be tunnel clients stop counting as visitors
+func TestReleaseVisitorSlot(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := LimitListener(inner, 1)
+	t.Cleanup(func() { l.Close() })
+	accepted := acceptAll(t, l)
+	before := metrics.VisitorConnections.Value()
+
+	dialVisitor(t, l)
+	client := <-accepted
+	ReleaseVisitorSlot(client)
+	if got := metrics.VisitorConnections.Value(); got != before {
+		t.Fatalf("visitor gauge = %d after release, want %d", got, before)
+	}
+
+	// The released slot is free for a visitor, and closing the tunnel
+	// client later does not release it a second time
+	visitor := dialVisitor(t, l)
+	<-accepted
+	client.Close()
+	if got := metrics.VisitorConnections.Value() - before; got != 1 {
+		t.Fatalf("visitor gauge = +%d, want +1", got)
+	}
+	if closedByServer(visitor) {
+		t.Fatal("visitor was rejected although the tunnel client released its slot")
+	}
+}
+
+// Without a limit connections are only counted
+func TestLimitListenerWithoutLimit(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := LimitListener(inner, 0)
+	t.Cleanup(func() { l.Close() })
+	accepted := acceptAll(t, l)
+	before := metrics.VisitorConnections.Value()
+
+	for i := 0; i < 5; i++ {
+		dialVisitor(t, l)
+		<-accepted
+	}
+	if got := metrics.VisitorConnections.Value() - before; got != 5 {
+		t.Fatalf("visitor gauge grew by %d, want 5", got)
+	}
+}
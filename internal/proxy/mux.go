@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// Frames carry one stream's data over a shared tunnel connection. Each
+// frame starts with a header holding the stream ID and the payload length,
+// both big-endian uint32. A frame with an empty payload closes the stream
+// in the sender's direction. Frames may share a binary message, e.g. when
+// writes are coalesced, or span several.
+const frameHeaderSize = 8
+
+// maxFramePayload bounds a single frame so one stream can't hold the
+// connection for long
+const maxFramePayload = 64 * 1024
+
+// With flow control, neither side may have more than streamWindow bytes of
+// a stream sent but not yet consumed by the other. A window update is a
+// frame header with windowUpdateFlag set in the length field; the other
+// bits give how many more bytes the receiver will take. It has no payload.
+const (
+	streamWindow     = 256 * 1024
+	windowUpdateFlag = 1 << 31
+)
+
+// maxUnflowedBuffer bounds what a stream buffers for a client without flow
+// control. Past it the client is sending faster than the visitor reads, and
+// the stream is reset rather than growing without bound.
+const maxUnflowedBuffer = 4 * 1024 * 1024
+
+var (
+	// errMuxClosed is returned once the tunnel connection under a mux has failed
+	errMuxClosed = errors.New("tunnel connection closed")
+	// errStreamOverrun ends a stream the client sent more than it may buffer
+	errStreamOverrun = errors.New("stream exceeded its receive window")
+)
+
+// streamMux multiplexes concurrent streams, one per proxied request, over a
+// single tunnel connection. Without it, concurrent requests would
+// interleave their bytes on the connection.
+type streamMux struct {
+	conn tunnel.Connection
+	flow bool // window updates bound each stream's unread data
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error // set once reading from conn failed
+}
+
+// NewStreamMux starts demultiplexing conn and returns a dialer that opens
+// streams over it. It reads conn until conn fails. With flow, both sides
+// exchange window updates so a slow reader holds up only its own stream.
+func NewStreamMux(conn tunnel.Connection, flow bool) tunnel.StreamDialer {
+	m := &streamMux{
+		conn:    conn,
+		flow:    flow,
+		streams: make(map[uint32]*muxStream),
+	}
+	go m.readLoop()
+	return m
+}
+
+// Dial opens a new stream
+func (m *streamMux) Dial() (tunnel.Connection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	m.nextID++
+	s := &muxStream{id: m.nextID, mux: m, window: streamWindow}
+	s.cond = sync.NewCond(&s.mu)
+	m.streams[s.id] = s
+	return s, nil
+}
+
+// readLoop hands incoming frames to their streams until conn fails
+func (m *streamMux) readLoop() {
+	header := make([]byte, frameHeaderSize)
+	for {
+		if _, err := io.ReadFull(m.conn, header); err != nil {
+			m.fail(err)
+			return
+		}
+		id := binary.BigEndian.Uint32(header[:4])
+		length := binary.BigEndian.Uint32(header[4:])
+
+		if m.flow && length&windowUpdateFlag != 0 {
+			if s := m.stream(id); s != nil {
+				s.grant(int(length &^ windowUpdateFlag))
+			}
+			continue
+		}
+		if length > maxFramePayload {
+			log.Printf("Closing stream mux: frame of %d bytes for stream %d exceeds the limit", length, id)
+			m.fail(errMuxClosed)
+			m.conn.Close()
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(m.conn, payload); err != nil {
+			m.fail(err)
+			return
+		}
+
+		// Frames for streams we already closed are dropped
+		s := m.stream(id)
+		if s == nil {
+			continue
+		}
+		if length == 0 {
+			s.closeRead(io.EOF)
+		} else if !s.push(payload) {
+			log.Printf("Resetting stream %d: %v", id, errStreamOverrun)
+			s.reset(errStreamOverrun)
+		}
+	}
+}
+
+// stream returns the open stream with id, or nil
+func (m *streamMux) stream(id uint32) *muxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+// receiveLimit is how many unread bytes a stream may hold
+func (m *streamMux) receiveLimit() int {
+	if m.flow {
+		return streamWindow
+	}
+	return maxUnflowedBuffer
+}
+
+// fail ends every open stream after conn failed
+func (m *streamMux) fail(err error) {
+	if err != io.EOF {
+		log.Printf("Stream mux stopped: %v", err)
+	}
+
+	m.mu.Lock()
+	m.err = errMuxClosed
+	streams := m.streams
+	m.streams = make(map[uint32]*muxStream)
+	m.mu.Unlock()
+
+	for _, s := range streams {
+		s.closeRead(errMuxClosed)
+	}
+}
+
+// writeFrame sends one frame. The header and payload go out in a single
+// Write so frames from different streams never interleave.
+func (m *streamMux) writeFrame(id uint32, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], id)
+	binary.BigEndian.PutUint32(frame[4:frameHeaderSize], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	_, err := m.conn.Write(frame)
+	return err
+}
+
+// writeWindowUpdate lets the client send n more bytes on stream id
+func (m *streamMux) writeWindowUpdate(id uint32, n int) error {
+	header := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(header[:4], id)
+	binary.BigEndian.PutUint32(header[4:], windowUpdateFlag|uint32(n))
+
+	_, err := m.conn.Write(header)
+	return err
+}
+
+// remove forgets a closed stream
+func (m *streamMux) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+// muxStream is one stream of a streamMux. Like VirtualConnection, closing
+// it leaves the tunnel connection open.
+type muxStream struct {
+	id  uint32
+	mux *streamMux
+
+	mu       sync.Mutex
+	cond     *sync.Cond // signals Read and Write alike
+	queue    [][]byte   // received payloads not read yet
+	buffered int        // bytes in queue
+	consumed int        // bytes read since the last window update
+	window   int        // bytes the client still has room for, with flow control
+	readErr  error      // returned once queue is drained
+	closed   bool
+}
+
+// push queues a received payload for Read. It reports false if the client
+// sent more than the stream may buffer; the readLoop never waits on a
+// slow reader.
+func (s *muxStream) push(payload []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buffered+len(payload) > s.mux.receiveLimit() {
+		return false
+	}
+	s.queue = append(s.queue, payload)
+	s.buffered += len(payload)
+	s.cond.Broadcast()
+	return true
+}
+
+// grant adds a window update from the client to the stream's send window
+func (s *muxStream) grant(n int) {
+	s.mu.Lock()
+	s.window += n
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// reset ends a stream that broke its window. Its unread data is dropped
+// and the client is told the stream is closed.
+func (s *muxStream) reset(err error) {
+	s.mu.Lock()
+	s.queue = nil
+	s.buffered = 0
+	s.readErr = err
+	s.mu.Unlock()
+	s.cond.Broadcast()
+
+	s.mux.remove(s.id)
+	s.mux.writeFrame(s.id, nil)
+}
+
+// closeRead ends the stream's incoming data with err
+func (s *muxStream) closeRead(err error) {
+	s.mu.Lock()
+	if s.readErr == nil {
+		s.readErr = err
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// Read implements io.Reader. With flow control, the client is granted
+// more window once half of it has been read.
+func (s *muxStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.queue) == 0 && s.readErr == nil && !s.closed {
+		s.cond.Wait()
+	}
+
+	if s.closed {
+		s.mu.Unlock()
+		return 0, io.EOF
+	}
+	if len(s.queue) == 0 {
+		err := s.readErr
+		s.mu.Unlock()
+		return 0, err
+	}
+
+	n := copy(p, s.queue[0])
+	if n < len(s.queue[0]) {
+		s.queue[0] = s.queue[0][n:]
+	} else {
+		s.queue = s.queue[1:]
+	}
+	s.buffered -= n
+
+	update := 0
+	if s.mux.flow {
+		s.consumed += n
+		if s.consumed >= streamWindow/2 {
+			update, s.consumed = s.consumed, 0
+		}
+	}
+	s.mu.Unlock()
+
+	if update > 0 {
+		s.mux.writeWindowUpdate(s.id, update)
+	}
+	return n, nil
+}
+
+// reserve waits until the client has room on the stream and takes up to n
+// bytes of its window. Once the client has closed its side it stops
+// granting window, so a write that would wait fails instead.
+func (s *muxStream) reserve(n int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.window == 0 && s.readErr == nil && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed || s.window == 0 {
+		return 0, io.ErrClosedPipe
+	}
+
+	n = min(n, s.window)
+	s.window -= n
+	return n, nil
+}
+
+// Write implements io.Writer, splitting p into frames. With flow control
+// it blocks while the client has no room for more of the stream.
+func (s *muxStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	written := 0
+	for written < len(p) {
+		size := min(maxFramePayload, len(p)-written)
+		if s.mux.flow {
+			var err error
+			if size, err = s.reserve(size); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := p[written : written+size]
+		if err := s.mux.writeFrame(s.id, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Close tells the client the stream is done and releases it. The tunnel
+// connection stays open for other streams.
+func (s *muxStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	s.cond.Broadcast()
+
+	s.mux.remove(s.id)
+	return s.mux.writeFrame(s.id, nil)
+}
@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// frame encodes one mux frame
+func frame(id uint32, payload string) []byte {
+	f := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(f[:4], id)
+	binary.BigEndian.PutUint32(f[4:frameHeaderSize], uint32(len(payload)))
+	copy(f[frameHeaderSize:], payload)
+	return f
+}
+
+// readFrame reads one mux frame from conn
+func readFrame(t *testing.T, conn net.Conn) (uint32, string) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(testkit.Timeout))
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("read frame header: %v", err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatalf("read frame payload: %v", err)
+	}
+	return binary.BigEndian.Uint32(header[:4]), string(payload)
+}
+
+// readStream reads n bytes from a stream
+func readStream(t *testing.T, s tunnel.Connection, n int) string {
+	t.Helper()
+
+	buf := make([]byte, n)
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(s, buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+	case <-time.After(testkit.Timeout):
+		t.Fatal("stream read did not return")
+	}
+	return string(buf)
+}
+
+func TestStreamMuxRoutesFramesToStreams(t *testing.T) {
+	muxEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	mux := NewStreamMux(muxEnd, false)
+
+	first, err := mux.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	second, err := mux.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	// Frames written to a stream carry its ID
+	go first.Write([]byte("request"))
+	if id, payload := readFrame(t, clientEnd); id != 1 || payload != "request" {
+		t.Fatalf("frame = %d %q, want 1 %q", id, payload, "request")
+	}
+
+	// Frames from the client reach the right stream, in any order
+	go func() {
+		clientEnd.Write(frame(2, "to second"))
+		clientEnd.Write(frame(1, "to first"))
+	}()
+	if got := readStream(t, second, len("to second")); got != "to second" {
+		t.Fatalf("second stream read %q", got)
+	}
+	if got := readStream(t, first, len("to first")); got != "to first" {
+		t.Fatalf("first stream read %q", got)
+	}
+
+	// An empty frame ends the stream's incoming data
+	go clientEnd.Write(frame(1, ""))
+	if n, err := first.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+		t.Fatalf("Read after close frame = %d, %v; want 0, EOF", n, err)
+	}
+
+	// Closing a stream sends an empty frame
+	go second.Close()
+	if id, payload := readFrame(t, clientEnd); id != 2 || payload != "" {
+		t.Fatalf("close frame = %d %q, want 2 %q", id, payload, "")
+	}
+}
+
+func TestStreamMuxFailsStreamsWhenConnectionCloses(t *testing.T) {
+	muxEnd, clientEnd := net.Pipe()
+	mux := NewStreamMux(muxEnd, false)
+
+	s, err := mux.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	clientEnd.Close()
+
+	if _, err := s.Read(make([]byte, 8)); err != errMuxClosed {
+		t.Fatalf("Read after connection closed = %v, want %v", err, errMuxClosed)
+	}
+	if _, err := mux.Dial(); err != errMuxClosed {
+		t.Fatalf("Dial after connection closed = %v, want %v", err, errMuxClosed)
+	}
+}
+
+func TestStreamMuxRejectsOversizedFrames(t *testing.T) {
+	muxEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	mux := NewStreamMux(muxEnd, false)
+
+	s, err := mux.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	header := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(header[:4], 1)
+	binary.BigEndian.PutUint32(header[4:], maxFramePayload+1)
+	go clientEnd.Write(header)
+
+	if _, err := s.Read(make([]byte, 8)); err != errMuxClosed {
+		t.Fatalf("Read after oversized frame = %v, want %v", err, errMuxClosed)
+	}
+}
+
+// muxFrame is a frame read from the client end of a mux
+type muxFrame struct {
+	id      uint32
+	payload string
+	update  int // window granted by a window update
+}
+
+// readFrames decodes frames from conn until it closes. Nothing written to
+// a net.Pipe goes through until it is read, so this must keep running.
+func readFrames(conn net.Conn) <-chan muxFrame {
+	frames := make(chan muxFrame, 1024)
+	go func() {
+		defer close(frames)
+		header := make([]byte, frameHeaderSize)
+		for {
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			f := muxFrame{id: binary.BigEndian.Uint32(header[:4])}
+			length := binary.BigEndian.Uint32(header[4:])
+			if length&windowUpdateFlag != 0 {
+				f.update = int(length &^ windowUpdateFlag)
+			} else {
+				payload := make([]byte, length)
+				if _, err := io.ReadFull(conn, payload); err != nil {
+					return
+				}
+				f.payload = string(payload)
+			}
+			frames <- f
+		}
+	}()
+	return frames
+}
+
+// nextFrame waits for the next frame on stream id, skipping other streams
+func nextFrame(t *testing.T, frames <-chan muxFrame, id uint32) muxFrame {
+	t.Helper()
+
+	timeout := time.After(testkit.Timeout)
+	for {
+		select {
+		case f, ok := <-frames:
+			if !ok {
+				t.Fatal("connection closed")
+			}
+			if f.id == id {
+				return f
+			}
+		case <-timeout:
+			t.Fatalf("no frame for stream %d", id)
+		}
+	}
+}
+
+// windowUpdate encodes a window update granting n bytes on stream id
+func windowUpdate(id uint32, n int) []byte {
+	f := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(f[:4], id)
+	binary.BigEndian.PutUint32(f[4:], windowUpdateFlag|uint32(n))
+	return f
+}
+
+// A stream nobody reads fills up to its limit and is reset past it, while
+// the stream next to it keeps working
+func TestStreamMuxSlowReaderDoesNotStallOthers(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		flow  bool
+		limit int
+	}{
+		{"flow", true, streamWindow},
+		{"no flow", false, maxUnflowedBuffer},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			muxEnd, clientEnd := net.Pipe()
+			defer clientEnd.Close()
+			mux := NewStreamMux(muxEnd, tt.flow)
+			frames := readFrames(clientEnd)
+
+			slow, _ := mux.Dial()
+			fast, _ := mux.Dial()
+
+			chunk := strings.Repeat("x", maxFramePayload)
+			for sent := 0; sent < tt.limit; sent += len(chunk) {
+				if _, err := clientEnd.Write(frame(1, chunk)); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+			clientEnd.Write(frame(2, "fast"))
+			if got := readStream(t, fast, len("fast")); got != "fast" {
+				t.Fatalf("fast stream read %q", got)
+			}
+
+			// One byte over the limit resets the slow stream only
+			clientEnd.Write(frame(1, "x"))
+			if f := nextFrame(t, frames, 1); f.payload != "" || f.update != 0 {
+				t.Fatalf("slow stream got %+v, want a close frame", f)
+			}
+			if _, err := slow.Read(make([]byte, 8)); err != errStreamOverrun {
+				t.Fatalf("slow stream Read = %v, want %v", err, errStreamOverrun)
+			}
+			clientEnd.Write(frame(2, "still"))
+			if got := readStream(t, fast, len("still")); got != "still" {
+				t.Fatalf("fast stream read %q after the reset", got)
+			}
+		})
+	}
+}
+
+// Writes wait for window on their own stream only, and reads grant window
+// back to the client
+func TestStreamMuxFlowControl(t *testing.T) {
+	muxEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	mux := NewStreamMux(muxEnd, true)
+	frames := readFrames(clientEnd)
+
+	slow, _ := mux.Dial()
+	fast, _ := mux.Dial()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := slow.Write([]byte(strings.Repeat("x", 2*streamWindow)))
+		written <- err
+	}()
+	received := 0
+	for received < streamWindow {
+		received += len(nextFrame(t, frames, 1).payload)
+	}
+	if received != streamWindow {
+		t.Fatalf("slow stream sent %d bytes before a window update, want %d", received, streamWindow)
+	}
+
+	// The slow stream is out of window; the fast one isn't held up
+	go fast.Write([]byte("fast"))
+	if f := nextFrame(t, frames, 2); f.payload != "fast" {
+		t.Fatalf("fast stream frame = %+v", f)
+	}
+	select {
+	case err := <-written:
+		t.Fatalf("Write returned (%v) without window for the rest", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go clientEnd.Write(windowUpdate(1, streamWindow))
+	for received < 2*streamWindow {
+		received += len(nextFrame(t, frames, 1).payload)
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	case <-time.After(testkit.Timeout):
+		t.Fatal("Write did not finish after the window update")
+	}
+
+	// Reading half the window grants it back
+	go func() {
+		for sent := 0; sent < streamWindow/2; sent += maxFramePayload {
+			clientEnd.Write(frame(2, strings.Repeat("y", maxFramePayload)))
+		}
+	}()
+	readStream(t, fast, streamWindow/2)
+	if f := nextFrame(t, frames, 2); f.update != streamWindow/2 {
+		t.Fatalf("frame after reading half the window = %+v, want a window update of %d", f, streamWindow/2)
+	}
+
+	// A client that closed its side grants no more window, so writes fail
+	// instead of waiting for it
+	go clientEnd.Write(frame(1, ""))
+	if _, err := slow.Read(make([]byte, 8)); err != io.EOF {
+		t.Fatalf("Read after the client closed = %v, want EOF", err)
+	}
+	waitClosed := make(chan error, 1)
+	go func() {
+		_, err := slow.Write([]byte(strings.Repeat("z", 2*streamWindow)))
+		waitClosed <- err
+	}()
+	select {
+	case err := <-waitClosed:
+		if err != io.ErrClosedPipe {
+			t.Fatalf("Write after the client closed = %v, want %v", err, io.ErrClosedPipe)
+		}
+	case <-time.After(testkit.Timeout):
+		t.Fatal("Write after the client closed is still waiting")
+	}
+}
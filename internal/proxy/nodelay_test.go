@@ -0,0 +1,95 @@
+//go:build unix
+
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (client, server *net.TCPConn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	return conn.(*net.TCPConn), peer.(*net.TCPConn)
+}
+
+// noDelay reads TCP_NODELAY from the socket
+func noDelay(t *testing.T, conn *net.TCPConn) bool {
+	t.Helper()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatalf("getsockopt TCP_NODELAY: %v", sockErr)
+	}
+	return value != 0
+}
+
+func TestSetNoDelay(t *testing.T) {
+	_, conn := tcpPair(t)
+
+	// Go enables TCP_NODELAY by default, so turning it off shows the
+	// setting is applied
+	setNoDelay(conn, false)
+	if noDelay(t, conn) {
+		t.Fatal("TCP_NODELAY still set after disabling it")
+	}
+	setNoDelay(conn, true)
+	if !noDelay(t, conn) {
+		t.Fatal("TCP_NODELAY not set after enabling it")
+	}
+}
+
+// HTTPS client connections are hijacked as *tls.Conn; the setting must
+// reach the TCP connection underneath
+func TestSetNoDelayThroughTLS(t *testing.T) {
+	_, conn := tcpPair(t)
+
+	setNoDelay(tls.Server(conn, &tls.Config{}), false)
+	if noDelay(t, conn) {
+		t.Fatal("TCP_NODELAY was not applied beneath the TLS connection")
+	}
+}
+
+// Connections that aren't TCP, such as in-memory pipes, are left alone
+func TestSetNoDelayIgnoresOtherConns(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	setNoDelay(a, false)
+}
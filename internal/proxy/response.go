@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// ServedByHeader is the response header carrying the serving instance ID
+const ServedByHeader = "X-Served-By"
+
+// ResponseHeaders returns the headers the proxy adds to every response it serves
+func ResponseHeaders(instanceID string) http.Header {
+	headers := http.Header{}
+	if instanceID != "" {
+		headers.Set(ServedByHeader, instanceID)
+	}
+	return headers
+}
+
+// bufferResponse reads resp's body into memory so it can be sent to the
+// visitor in one go with a Content-Length. Bodies larger than limit are
+// streamed once limit bytes have been read, so a large download can't
+// exhaust memory. Responses with trailers keep chunked framing.
+func bufferResponse(resp *http.Response, limit int) error {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+
+	if len(body) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+
+	// Reading to EOF has filled in any trailers
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if len(resp.Trailer) == 0 {
+		resp.ContentLength = int64(len(body))
+		resp.TransferEncoding = nil
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return nil
+}
+
+// headerInjector wraps a tunnel connection and adds headers to the first
+// HTTP response read from it. Everything after the response head is passed
+// through untouched, so bodies and upgraded streams keep their raw bytes.
+type headerInjector struct {
+	tunnel.Connection
+	reader  *bufio.Reader
+	headers http.Header
+	pending []byte
+	once    sync.Once
+}
+
+// WithResponseHeaders wraps conn so that the given headers are added to the
+// first response read from it. If headers is empty, conn is returned as is.
+func WithResponseHeaders(conn tunnel.Connection, headers http.Header) tunnel.Connection {
+	if len(headers) == 0 {
+		return conn
+	}
+	return &headerInjector{
+		Connection: conn,
+		reader:     bufio.NewReader(conn),
+		headers:    headers,
+	}
+}
+
+// Read implements io.Reader
+func (h *headerInjector) Read(p []byte) (int, error) {
+	var err error
+	h.once.Do(func() {
+		h.pending, err = h.readHead()
+	})
+
+	if len(h.pending) > 0 {
+		n := copy(p, h.pending)
+		h.pending = h.pending[n:]
+		return n, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return h.reader.Read(p)
+}
+
+// readHead reads the status line and header block of the first response and
+// returns it with the extra headers inserted before the terminating blank line.
+// On a read error, whatever was read so far is returned unmodified.
+func (h *headerInjector) readHead() ([]byte, error) {
+	var head bytes.Buffer
+	for {
+		line, err := h.reader.ReadBytes('\n')
+		if err != nil {
+			head.Write(line)
+			return head.Bytes(), err
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			h.headers.Write(&head)
+			head.Write(line)
+			return head.Bytes(), nil
+		}
+		head.Write(line)
+	}
+}
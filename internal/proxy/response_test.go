@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+)
+
+func TestServedByHeader(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		for _, instanceID := range []string{"", "edge-1"} {
+			t.Run(mode+"/"+instanceID, func(t *testing.T) {
+				cfg := testkit.Config()
+				cfg.ForwardMode = mode
+				cfg.InstanceID = instanceID
+				server, registry := newTestProxy(t, cfg)
+				testkit.AddTunnel(t, registry, "myapp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					io.WriteString(w, "hello")
+				}))
+
+				// Proxied responses and the proxy's own error pages
+				for _, host := range []string{"myapp." + testkit.Domain, "missing." + testkit.Domain} {
+					resp := visit(t, server, host, "/")
+					values := resp.Header.Values(ServedByHeader)
+					switch {
+					case instanceID == "" && len(values) != 0:
+						t.Errorf("%s: %s = %q without INSTANCE_ID", host, ServedByHeader, values)
+					case instanceID != "" && (len(values) != 1 || values[0] != instanceID):
+						t.Errorf("%s: %s = %q, want [%s]", host, ServedByHeader, values, instanceID)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestWithResponseHeadersInjectsIntoFirstHead(t *testing.T) {
+	backend, proxyEnd := net.Pipe()
+	go func() {
+		defer backend.Close()
+		// The head arrives in pieces; the body must come through as is
+		io.WriteString(backend, "HTTP/1.1 200 OK\r\nContent-")
+		io.WriteString(backend, "Length: 26\r\n\r\nHTTP/1.1 body\r\n\r\nuntouched")
+	}()
+
+	conn := WithResponseHeaders(proxyEnd, ResponseHeaders("edge-1"))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	want := "HTTP/1.1 200 OK\r\nContent-Length: 26\r\nX-Served-By: edge-1\r\n\r\nHTTP/1.1 body\r\n\r\nuntouched"
+	if string(got) != want {
+		t.Fatalf("response = %q, want %q", got, want)
+	}
+}
+
+func TestWithResponseHeadersWithoutHeaders(t *testing.T) {
+	_, proxyEnd := net.Pipe()
+	if conn := WithResponseHeaders(proxyEnd, ResponseHeaders("")); conn != proxyEnd {
+		t.Fatal("connection was wrapped although there are no headers to add")
+	}
+}
+
+// trickleBackend writes "first", flushes it, then writes "second" once
+// release is closed
+func trickleBackend(flushed chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		close(flushed)
+		<-release
+		io.WriteString(w, "second")
+	})
+}
+
+func TestBufferedVersusStreamedResponses(t *testing.T) {
+	for _, mode := range []string{config.ForwardModeHijack, config.ForwardModeBuffered} {
+		for _, buffer := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/buffer=%t", mode, buffer), func(t *testing.T) {
+				cfg := testkit.Config()
+				cfg.ForwardMode = mode
+				server, registry := newTestProxy(t, cfg)
+				flushed, release := make(chan struct{}), make(chan struct{})
+				testkit.AddTunnel(t, registry, "myapp", trickleBackend(flushed, release)).BufferResponse = buffer
+
+				responses := make(chan *http.Response, 1)
+				go func() {
+					req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+					req.Host = "myapp." + testkit.Domain
+					resp, err := visitor.Do(req)
+					if err != nil {
+						t.Errorf("GET: %v", err)
+						close(responses)
+						return
+					}
+					responses <- resp
+				}()
+				<-flushed
+
+				var resp *http.Response
+				if buffer {
+					// Nothing reaches the visitor until the backend is done
+					select {
+					case resp = <-responses:
+						t.Fatal("buffered response was sent before the backend finished")
+					case <-time.After(100 * time.Millisecond):
+					}
+					close(release)
+					resp = <-responses
+				} else {
+					// The flushed part arrives while the backend still works
+					resp = <-responses
+					first := make([]byte, len("first"))
+					if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "first" {
+						t.Fatalf("streamed start = %q, %v", first, err)
+					}
+					close(release)
+				}
+				if resp == nil {
+					t.FailNow()
+				}
+				defer resp.Body.Close()
+
+				body := testkit.ReadBody(t, resp)
+				if buffer && (body != "firstsecond" || resp.ContentLength != int64(len(body))) {
+					t.Fatalf("buffered body = %q with Content-Length %d", body, resp.ContentLength)
+				}
+				if !buffer && (body != "second" || resp.ContentLength != -1) {
+					t.Fatalf("streamed rest = %q with Content-Length %d, want chunked", body, resp.ContentLength)
+				}
+			})
+		}
+	}
+}
+
+// newBackendResponse returns a response as read from a backend, with
+// body as its chunked body
+func newBackendResponse(method string, status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:       status,
+		Header:           http.Header{},
+		Body:             io.NopCloser(strings.NewReader(body)),
+		ContentLength:    -1,
+		TransferEncoding: []string{"chunked"},
+		Request:          &http.Request{Method: method},
+	}
+}
+
+func TestBufferResponse(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		resp     *http.Response
+		limit    int
+		buffered bool
+	}{
+		{"within limit", newBackendResponse(http.MethodGet, http.StatusOK, "hello"), 10, true},
+		{"at limit", newBackendResponse(http.MethodGet, http.StatusOK, "hello"), 5, true},
+		{"over limit", newBackendResponse(http.MethodGet, http.StatusOK, "hello world"), 5, false},
+		{"HEAD", newBackendResponse(http.MethodHead, http.StatusOK, ""), 10, false},
+		{"no content", newBackendResponse(http.MethodGet, http.StatusNoContent, ""), 10, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			want, _ := io.ReadAll(tt.resp.Body)
+			tt.resp.Body = io.NopCloser(bytes.NewReader(want))
+
+			if err := bufferResponse(tt.resp, tt.limit); err != nil {
+				t.Fatal(err)
+			}
+			if buffered := tt.resp.ContentLength >= 0; buffered != tt.buffered {
+				t.Fatalf("Content-Length = %d, want buffered %t", tt.resp.ContentLength, tt.buffered)
+			}
+			if tt.buffered && (tt.resp.TransferEncoding != nil || tt.resp.Header.Get("Content-Length") != strconv.Itoa(len(want))) {
+				t.Fatalf("buffered response keeps chunked framing: %v, Content-Length %q",
+					tt.resp.TransferEncoding, tt.resp.Header.Get("Content-Length"))
+			}
+			// Nothing is lost either way
+			if got, _ := io.ReadAll(tt.resp.Body); string(got) != string(want) {
+				t.Fatalf("body = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// Responses with trailers are read in full but keep chunked framing, which
+// is the only way to send the trailers
+func TestBufferResponseKeepsTrailers(t *testing.T) {
+	resp := newBackendResponse(http.MethodGet, http.StatusOK, "hello")
+	resp.Trailer = http.Header{"X-Checksum": {"abc"}}
+	if err := bufferResponse(resp, 10); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != -1 || resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Fatalf("Content-Length %d, trailers %v; want chunked with trailers", resp.ContentLength, resp.Trailer)
+	}
+}
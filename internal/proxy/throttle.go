@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// foreignHostLog logs requests for hosts outside the configured domain.
+// Scanners produce a lot of them, so at most one line is written a minute.
+var foreignHostLog = &throttledLog{interval: time.Minute}
+
+// throttledLog writes at most one log line per interval and reports how
+// many lines it dropped in between
+type throttledLog struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// Info logs like slog.Info unless a line was written within the interval
+func (t *throttledLog) Info(msg string, args ...any) {
+	t.mu.Lock()
+	now := time.Now()
+	if now.Sub(t.last) < t.interval {
+		t.suppressed++
+		t.mu.Unlock()
+		return
+	}
+	suppressed := t.suppressed
+	t.last = now
+	t.suppressed = 0
+	t.mu.Unlock()
+
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	slog.Info(msg, args...)
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThrottledLogReportsSuppressedLines(t *testing.T) {
+	var out bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+	defer slog.SetDefault(prev)
+
+	l := &throttledLog{interval: time.Hour}
+	for i := 0; i < 3; i++ {
+		l.Info("Rejected request for foreign host", "host", "example.org")
+	}
+	l.mu.Lock()
+	l.last = time.Now().Add(-time.Hour)
+	l.mu.Unlock()
+	l.Info("Rejected request for foreign host", "host", "example.net")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2:\n%s", len(lines), out.String())
+	}
+	var first, second map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[1]), &second)
+	if first["host"] != "example.org" || first["suppressed"] != nil {
+		t.Fatalf("first line = %v", first)
+	}
+	if second["host"] != "example.net" || second["suppressed"] != float64(2) {
+		t.Fatalf("second line = %v, want 2 suppressed", second)
+	}
+}
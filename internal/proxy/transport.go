@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// ErrInvalidResponse is returned when the backend answers with bytes that
+// do not parse as an HTTP response
+var ErrInvalidResponse = errors.New("backend returned invalid response")
+
+// Transport is an http.RoundTripper that sends each request through a tunnel.
+// Every round trip gets its own virtual connection, which is released once
+// the response body has been read or closed.
+type Transport struct {
+	tun *tunnel.Tunnel
+}
+
+// NewTransport creates a round tripper for the given tunnel
+func NewTransport(tun *tunnel.Tunnel) *Transport {
+	return &Transport{tun: tun}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, err := DialThroughTunnel(t.tun)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to write request to tunnel: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		if isMalformedResponse(err) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+		}
+		return nil, fmt.Errorf("failed to read response from tunnel: %w", err)
+	}
+
+	// resp.Trailer is filled in as the body reaches its end, so the
+	// wrapper must hand reads straight through to the original body
+	resp.Body = &connBody{ReadCloser: resp.Body, conn: conn}
+	return resp, nil
+}
+
+// connBody releases the tunnel connection when the response body is closed
+type connBody struct {
+	io.ReadCloser
+	conn tunnel.Connection
+}
+
+// Close closes the body and the tunnel connection
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// isMalformedResponse reports whether a ReadResponse error came from parsing
+// the response rather than from the connection closing or timing out
+func isMalformedResponse(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false
+	}
+	var netErr net.Error
+	return !errors.As(err, &netErr)
+}
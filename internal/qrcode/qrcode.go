@@ -0,0 +1,468 @@
+// Package qrcode encodes short text, such as a tunnel URL, as a QR code
+// that can be printed in a terminal. It supports byte mode at error
+// correction level L in versions 1 to 10, which holds up to 271 bytes.
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// versions describes each supported version at error correction level L
+var versions = []struct {
+	codewords    int   // total codewords in the symbol
+	ecPerBlock   int   // error correction codewords per block
+	blocks       int   // number of blocks the codewords are split into
+	alignCenters []int // row and column centers of the alignment patterns
+}{
+	{26, 7, 1, nil},
+	{44, 10, 1, []int{6, 18}},
+	{70, 15, 1, []int{6, 22}},
+	{100, 20, 1, []int{6, 26}},
+	{134, 26, 1, []int{6, 30}},
+	{172, 18, 2, []int{6, 34}},
+	{196, 20, 2, []int{6, 22, 38}},
+	{242, 24, 2, []int{6, 24, 42}},
+	{292, 30, 2, []int{6, 26, 46}},
+	{346, 18, 4, []int{6, 28, 50}},
+}
+
+// Code is an encoded QR code
+type Code struct {
+	size     int
+	modules  [][]bool // true is dark
+	function [][]bool // finder, timing, alignment and format modules
+}
+
+// Encode returns the smallest QR code holding text
+func Encode(text string) (*Code, error) {
+	data := []byte(text)
+	for i, v := range versions {
+		version := i + 1
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		capacity := v.codewords - v.ecPerBlock*v.blocks
+		if 4+countBits+8*len(data) > 8*capacity {
+			continue
+		}
+
+		c := newCode(version)
+		c.placeData(addErrorCorrection(encodeData(data, countBits, capacity), v.ecPerBlock, v.blocks))
+		c.applyBestMask()
+		return c, nil
+	}
+	return nil, fmt.Errorf("text of %d bytes is too long for a QR code", len(data))
+}
+
+// Size returns the width and height in modules, without a quiet zone
+func (c *Code) Size() int {
+	return c.size
+}
+
+// Dark reports whether the module at row y and column x is dark
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// Terminal renders the code with Unicode half blocks, two rows of modules
+// per line, surrounded by a quiet zone. Light modules are drawn as blocks,
+// so it reads correctly on terminals with a dark background.
+func (c *Code) Terminal() string {
+	const quiet = 2
+	light := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		if x < 0 || y < 0 || x >= c.size || y >= c.size {
+			return true
+		}
+		return !c.modules[y][x]
+	}
+
+	var sb strings.Builder
+	total := c.size + 2*quiet
+	for y := 0; y < total; y += 2 {
+		for x := 0; x < total; x++ {
+			top, bottom := light(x, y), y+1 < total && light(x, y+1)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// encodeData builds the data codewords: byte mode indicator, character
+// count, the bytes, a terminator and padding up to capacity codewords
+func encodeData(data []byte, countBits, capacity int) []byte {
+	var bits bitBuffer
+	bits.append(0b0100, 4)
+	bits.append(len(data), countBits)
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	bits.append(0, min(4, 8*capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+
+	codewords := bits.bytes()
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+	return codewords
+}
+
+// addErrorCorrection splits data into blocks, computes each block's error
+// correction codewords and interleaves the result. When the data doesn't
+// divide evenly, the later blocks are one codeword longer.
+func addErrorCorrection(data []byte, ecLen, blocks int) []byte {
+	divisor := rsDivisor(ecLen)
+	short := len(data) / blocks
+	longFrom := blocks - len(data)%blocks
+
+	dataBlocks := make([][]byte, blocks)
+	ecBlocks := make([][]byte, blocks)
+	offset := 0
+	for i := range dataBlocks {
+		n := short
+		if i >= longFrom {
+			n++
+		}
+		dataBlocks[i] = data[offset : offset+n]
+		ecBlocks[i] = rsRemainder(dataBlocks[i], divisor)
+		offset += n
+	}
+
+	var result []byte
+	for i := 0; i <= short; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < ecLen; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// newCode creates a code of the given version with its function patterns
+// drawn and the format area reserved
+func newCode(version int) *Code {
+	size := 17 + 4*version
+	c := &Code{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range c.modules {
+		c.modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+
+	for i := 0; i < size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+
+	centers := versions[version-1].alignCenters
+	last := len(centers) - 1
+	for i, cy := range centers {
+		for j, cx := range centers {
+			// Skip the three corners taken by finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			c.drawAlignment(cx, cy)
+		}
+	}
+
+	// Reserve the format area; the real bits are drawn with the mask
+	c.drawFormat(0)
+	c.drawVersion(version)
+	return c
+}
+
+// set sets a function module at column x, row y
+func (c *Code) set(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+// drawFinder draws a finder pattern and its separator centered on x, y
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.size || yy >= c.size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.set(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern centered on x, y
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information for error
+// correction level L and mask, plus the dark module
+func (c *Code) drawFormat(mask int) {
+	data := 0b01<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.set(c.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.size-15+i, bit(i))
+	}
+	c.set(8, c.size-8, true)
+}
+
+// drawVersion draws both copies of the version information, which only
+// versions 7 and up carry
+func (c *Code) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 != 0
+		a, b := c.size-11+i%3, i/3
+		c.set(a, b, dark)
+		c.set(b, a, dark)
+	}
+}
+
+// placeData fills the non-function modules with codewords in the zigzag
+// order of the spec: two-column strips from the right, alternating up and
+// down, skipping the vertical timing pattern
+func (c *Code) placeData(codewords []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.size; vert++ {
+			y := vert
+			if upward {
+				y = c.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y][x] = codewords[i>>3]>>(7-i&7)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// masks are the eight data mask conditions; a module is flipped when its
+// condition holds
+var masks = []func(x, y int) bool{
+	func(x, y int) bool { return (x+y)%2 == 0 },
+	func(x, y int) bool { return y%2 == 0 },
+	func(x, y int) bool { return x%3 == 0 },
+	func(x, y int) bool { return (x+y)%3 == 0 },
+	func(x, y int) bool { return (x/3+y/2)%2 == 0 },
+	func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+	func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+	func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+}
+
+// applyMask flips the data modules selected by mask; applying it twice
+// undoes it
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if !c.function[y][x] && masks[mask](x, y) {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask applies the mask with the lowest penalty score, which
+// makes the code easiest to scan
+func (c *Code) applyBestMask() {
+	best, bestPenalty := 0, -1
+	for mask := range masks {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if penalty := c.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+}
+
+// penalty scores the code by the four rules of the spec: runs of one
+// color, 2x2 blocks, finder-like patterns and dark/light imbalance
+func (c *Code) penalty() int {
+	penalty := 0
+	finderLike := []string{"10111010000", "00001011101"}
+
+	for _, transpose := range []bool{false, true} {
+		for i := 0; i < c.size; i++ {
+			line := make([]byte, c.size)
+			for j := 0; j < c.size; j++ {
+				dark := c.modules[i][j]
+				if transpose {
+					dark = c.modules[j][i]
+				}
+				line[j] = '0'
+				if dark {
+					line[j] = '1'
+				}
+			}
+
+			run := 1
+			for j := 1; j <= c.size; j++ {
+				if j < c.size && line[j] == line[j-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+
+			for _, pattern := range finderLike {
+				penalty += 40 * strings.Count(string(line), pattern)
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < c.size && y+1 < c.size {
+				m := c.modules[y][x]
+				if c.modules[y][x+1] == m && c.modules[y+1][x] == m && c.modules[y+1][x+1] == m {
+					penalty += 3
+				}
+			}
+		}
+	}
+
+	total := c.size * c.size
+	deviation := abs(dark*20 - total*10)
+	penalty += 10 * ((deviation + total - 1) / total)
+	return penalty - 10
+}
+
+// bitBuffer collects bits most significant first
+type bitBuffer []byte
+
+// append adds the low n bits of value
+func (b *bitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, byte(value>>i&1))
+	}
+}
+
+// bytes packs the bits, whose count must be a multiple of 8
+func (b bitBuffer) bytes() []byte {
+	result := make([]byte, len(b)/8)
+	for i, bit := range b {
+		result[i/8] |= bit << (7 - i%8)
+	}
+	return result
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given
+// degree, highest coefficient (always 1) omitted
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords for data
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,303 @@
+package qrcode
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// formatL are the 15-bit format strings for error correction level L with
+// masks 0 to 7, as listed in the QR code specification
+var formatL = []int{
+	0b111011111000100,
+	0b111001011110011,
+	0b111110110101010,
+	0b111100010011101,
+	0b110011000101111,
+	0b110001100011000,
+	0b110110001000001,
+	0b110100101110110,
+}
+
+// specMasks are the data mask conditions of the specification for the
+// module in row i, column j
+var specMasks = []func(i, j int) bool{
+	func(i, j int) bool { return (i+j)%2 == 0 },
+	func(i, j int) bool { return i%2 == 0 },
+	func(i, j int) bool { return j%3 == 0 },
+	func(i, j int) bool { return (i+j)%3 == 0 },
+	func(i, j int) bool { return (i/2+j/3)%2 == 0 },
+	func(i, j int) bool { return i*j%2+i*j%3 == 0 },
+	func(i, j int) bool { return (i*j%2+i*j%3)%2 == 0 },
+	func(i, j int) bool { return ((i+j)%2+i*j%3)%2 == 0 },
+}
+
+// gfExp and gfLog are exponent and logarithm tables of GF(2^8) with the
+// QR code polynomial
+var gfExp, gfLog = func() ([512]byte, [256]int) {
+	var exp [512]byte
+	var log [256]int
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+// syndromesZero reports whether block, data followed by ecLen error
+// correction codewords, is a valid Reed-Solomon codeword
+func syndromesZero(block []byte, ecLen int) bool {
+	for k := 0; k < ecLen; k++ {
+		var s byte
+		for _, b := range block {
+			// s = s*α^k + b
+			if s != 0 {
+				s = gfExp[gfLog[s]+k]
+			}
+			s ^= b
+		}
+		if s != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// decode reads c back the way a scanner would and returns its text
+func decode(t *testing.T, c *Code) string {
+	t.Helper()
+
+	size := c.Size()
+	version := (size - 17) / 4
+	if version < 1 || version > len(versions) || 17+4*version != size {
+		t.Fatalf("size %d is not a supported version", size)
+	}
+
+	// Both copies of the format information must name the same mask
+	var first, second int
+	for i := 0; i <= 5; i++ {
+		first |= bit(c.Dark(8, i)) << i
+	}
+	first |= bit(c.Dark(8, 7))<<6 | bit(c.Dark(8, 8))<<7 | bit(c.Dark(7, 8))<<8
+	for i := 9; i < 15; i++ {
+		first |= bit(c.Dark(14-i, 8)) << i
+	}
+	for i := 0; i < 8; i++ {
+		second |= bit(c.Dark(size-1-i, 8)) << i
+	}
+	for i := 8; i < 15; i++ {
+		second |= bit(c.Dark(8, size-15+i)) << i
+	}
+	if first != second {
+		t.Fatalf("format copies differ: %015b and %015b", first, second)
+	}
+	mask := -1
+	for m, format := range formatL {
+		if format == first {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("format %015b is not level L with a valid mask", first)
+	}
+	if !c.Dark(8, size-8) {
+		t.Fatal("dark module is missing")
+	}
+
+	// Read the codewords in zigzag order, unmasking as we go
+	var codewords []byte
+	var current, n int
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < size; vert++ {
+			y := vert
+			if upward {
+				y = size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.function[y][x] {
+					continue
+				}
+				dark := c.Dark(x, y) != specMasks[mask](y, x)
+				current = current<<1 | bit(dark)
+				if n++; n%8 == 0 {
+					codewords = append(codewords, byte(current))
+					current = 0
+				}
+			}
+		}
+	}
+	v := versions[version-1]
+	if len(codewords) != v.codewords {
+		t.Fatalf("read %d codewords, version %d has %d", len(codewords), version, v.codewords)
+	}
+
+	// Undo the interleaving and check each block
+	dataLen := v.codewords - v.ecPerBlock*v.blocks
+	short := dataLen / v.blocks
+	longFrom := v.blocks - dataLen%v.blocks
+	blocks := make([][]byte, v.blocks)
+	pos := 0
+	for i := 0; i <= short; i++ {
+		for b := range blocks {
+			if i < short || b >= longFrom {
+				blocks[b] = append(blocks[b], codewords[pos])
+				pos++
+			}
+		}
+	}
+	var data []byte
+	for b := range blocks {
+		data = append(data, blocks[b]...)
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[pos])
+			pos++
+		}
+	}
+	for b, block := range blocks {
+		if !syndromesZero(block, v.ecPerBlock) {
+			t.Fatalf("block %d fails its error correction check", b)
+		}
+	}
+
+	// Byte mode: indicator, count, then the bytes
+	read := func(offset, n int) int {
+		value := 0
+		for i := offset; i < offset+n; i++ {
+			value = value<<1 | int(data[i/8]>>(7-i%8)&1)
+		}
+		return value
+	}
+	if mode := read(0, 4); mode != 0b0100 {
+		t.Fatalf("mode indicator %04b, want byte mode", mode)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	count := read(4, countBits)
+	text := make([]byte, count)
+	for i := range text {
+		text[i] = byte(read(4+countBits+8*i, 8))
+	}
+	return string(text)
+}
+
+func bit(dark bool) int {
+	if dark {
+		return 1
+	}
+	return 0
+}
+
+func TestEncodeDecodes(t *testing.T) {
+	for _, tt := range []struct {
+		length, version int
+	}{
+		{17, 1},
+		{18, 2},
+		{60, 4},
+		{100, 5},
+		{107, 6},
+		{154, 7},
+		{155, 8},
+		{200, 9},
+		{231, 10},
+		{271, 10},
+	} {
+		text := "https://" + strings.Repeat("a", tt.length-len("https://"))
+		c, err := Encode(text)
+		if err != nil {
+			t.Fatalf("Encode of %d bytes: %v", tt.length, err)
+		}
+		if got := (c.Size() - 17) / 4; got != tt.version {
+			t.Errorf("%d bytes encoded as version %d, want %d", tt.length, got, tt.version)
+		}
+		if got := decode(t, c); got != text {
+			t.Errorf("%d bytes decoded as %q", tt.length, got)
+		}
+	}
+}
+
+func TestEncodeTunnelURL(t *testing.T) {
+	const url = "https://myapp.easypod.cloud"
+	c, err := Encode(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decode(t, c); got != url {
+		t.Fatalf("decoded %q, want %q", got, url)
+	}
+
+	// Finder patterns sit in three corners
+	for _, corner := range [][2]int{{0, 0}, {c.Size() - 7, 0}, {0, c.Size() - 7}} {
+		for dy := 0; dy < 7; dy++ {
+			for dx := 0; dx < 7; dx++ {
+				ring := max(abs(dx-3), abs(dy-3))
+				if want := ring != 2; c.Dark(corner[0]+dx, corner[1]+dy) != want {
+					t.Fatalf("finder at %v wrong at %d,%d", corner, dx, dy)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	if _, err := Encode(strings.Repeat("a", 272)); err == nil {
+		t.Fatal("Encode of 272 bytes succeeded, want an error")
+	}
+}
+
+// The terminal rendering draws two module rows per line with a quiet zone
+// of light modules; light is drawn as a block
+func TestTerminal(t *testing.T) {
+	c, err := Encode("https://myapp.easypod.cloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const quiet = 2
+	total := c.Size() + 2*quiet
+	lines := strings.Split(strings.TrimSuffix(c.Terminal(), "\n"), "\n")
+	if len(lines) != (total+1)/2 {
+		t.Fatalf("got %d lines, want %d", len(lines), (total+1)/2)
+	}
+	if lines[0] != strings.Repeat("█", total) {
+		t.Fatalf("first line %q is not all quiet zone", lines[0])
+	}
+
+	halves := map[rune][2]bool{'█': {true, true}, '▀': {true, false}, '▄': {false, true}, ' ': {false, false}}
+	for row, line := range lines {
+		if n := utf8.RuneCountInString(line); n != total {
+			t.Fatalf("line %d has %d columns, want %d", row, n, total)
+		}
+		for col, r := range []rune(line) {
+			light, ok := halves[r]
+			if !ok {
+				t.Fatalf("line %d has unexpected rune %q", row, r)
+			}
+			for half := 0; half < 2; half++ {
+				x, y := col-quiet, 2*row+half-quiet
+				if x < 0 || y < 0 || x >= c.Size() || y >= c.Size() {
+					continue
+				}
+				if light[half] == c.Dark(x, y) {
+					t.Fatalf("module %d,%d drawn wrong", x, y)
+				}
+			}
+		}
+	}
+}
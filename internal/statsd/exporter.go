@@ -0,0 +1,126 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// maxPacketSize keeps each datagram within a typical Ethernet MTU
+const maxPacketSize = 1432
+
+// snapshot holds a tunnel's counters as of the previous flush
+type snapshot struct {
+	requests, bytesIn, bytesOut, errors int64
+}
+
+// Exporter pushes per-tunnel counters and the active tunnel gauge to a
+// StatsD server over UDP. StatsD counters are deltas, so each flush sends
+// what changed since the previous one.
+type Exporter struct {
+	conn     net.Conn
+	prefix   string
+	registry *tunnel.Registry
+	last     map[string]snapshot // tunnel ID -> counters at the last flush
+}
+
+// NewExporter creates an exporter sending to addr, e.g. "127.0.0.1:8125".
+// Metric names start with prefix.
+func NewExporter(addr, prefix string, registry *tunnel.Registry) (*Exporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial statsd at %s: %w", addr, err)
+	}
+
+	return &Exporter{
+		conn:     conn,
+		prefix:   prefix,
+		registry: registry,
+		last:     make(map[string]snapshot),
+	}, nil
+}
+
+// Start flushes metrics every interval in the background
+func (e *Exporter) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			e.Flush()
+		}
+	}()
+}
+
+// Flush sends the current metrics. It is not safe for concurrent use.
+func (e *Exporter) Flush() {
+	tunnels := e.registry.List()
+	current := make(map[string]snapshot, len(tunnels))
+
+	var lines []string
+	lines = append(lines, fmt.Sprintf("%stunnels.active:%d|g", e.prefix, len(tunnels)))
+
+	for _, tun := range tunnels {
+		now := snapshot{
+			requests: atomic.LoadInt64(&tun.Requests),
+			bytesIn:  atomic.LoadInt64(&tun.BytesIn),
+			bytesOut: atomic.LoadInt64(&tun.BytesOut),
+			errors:   atomic.LoadInt64(&tun.Errors),
+		}
+		current[tun.ID] = now
+
+		// A reclaimed tunnel keeps its ID but starts counting from zero
+		prev := e.last[tun.ID]
+		if now.requests < prev.requests || now.bytesIn < prev.bytesIn ||
+			now.bytesOut < prev.bytesOut || now.errors < prev.errors {
+			prev = snapshot{}
+		}
+
+		name := e.prefix + "tunnel." + tun.Subdomain()
+		lines = appendCounter(lines, name+".requests", now.requests-prev.requests)
+		lines = appendCounter(lines, name+".bytes_in", now.bytesIn-prev.bytesIn)
+		lines = appendCounter(lines, name+".bytes_out", now.bytesOut-prev.bytesOut)
+		lines = appendCounter(lines, name+".errors", now.errors-prev.errors)
+	}
+	e.last = current
+
+	e.send(lines)
+}
+
+// appendCounter adds a counter line, skipping counters that didn't change
+func appendCounter(lines []string, name string, delta int64) []string {
+	if delta == 0 {
+		return lines
+	}
+	return append(lines, fmt.Sprintf("%s:%d|c", name, delta))
+}
+
+// send writes lines in as few packets as fit within maxPacketSize
+func (e *Exporter) send(lines []string) {
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			e.write(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		e.write(packet.Bytes())
+	}
+}
+
+// write sends a single packet. UDP is fire-and-forget, so errors are only logged.
+func (e *Exporter) write(packet []byte) {
+	if _, err := e.conn.Write(packet); err != nil {
+		log.Printf("Failed to send metrics to statsd: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// listen starts a fake StatsD server and returns its address and a
+// function that reads the lines of everything sent so far
+func listen(t *testing.T) (string, func() []string) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	read := func() []string {
+		t.Helper()
+
+		var lines []string
+		buf := make([]byte, 64*1024)
+		for {
+			// The first packet may still be in flight, later ones are
+			// already queued once it arrived
+			wait := 10 * time.Millisecond
+			if lines == nil {
+				wait = 5 * time.Second
+			}
+			conn.SetReadDeadline(time.Now().Add(wait))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if n > maxPacketSize {
+				t.Errorf("packet of %d bytes exceeds %d", n, maxPacketSize)
+			}
+			lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+		}
+		sort.Strings(lines)
+		return lines
+	}
+	return conn.LocalAddr().String(), read
+}
+
+// addTunnel registers a tunnel named subdomain
+func addTunnel(t *testing.T, registry *tunnel.Registry, subdomain string) *tunnel.Tunnel {
+	t.Helper()
+
+	tun := &tunnel.Tunnel{ID: subdomain + "-id", CreatedAt: time.Now()}
+	tun.SetSubdomain(subdomain)
+	if err := registry.Register(tun); err != nil {
+		t.Fatal(err)
+	}
+	return tun
+}
+
+func TestFlushSendsDeltas(t *testing.T) {
+	addr, read := listen(t)
+	registry := tunnel.NewRegistry(0)
+	e, err := NewExporter(addr, "test.", registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun := addTunnel(t, registry, "myapp")
+	atomic.StoreInt64(&tun.Requests, 3)
+	atomic.StoreInt64(&tun.BytesIn, 100)
+	atomic.StoreInt64(&tun.BytesOut, 2000)
+	atomic.StoreInt64(&tun.Errors, 1)
+
+	e.Flush()
+	want := []string{
+		"test.tunnel.myapp.bytes_in:100|c",
+		"test.tunnel.myapp.bytes_out:2000|c",
+		"test.tunnel.myapp.errors:1|c",
+		"test.tunnel.myapp.requests:3|c",
+		"test.tunnels.active:1|g",
+	}
+	if got := read(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("first flush sent %q, want %q", got, want)
+	}
+
+	// Only what changed since the previous flush is sent
+	atomic.AddInt64(&tun.Requests, 2)
+	atomic.AddInt64(&tun.BytesOut, 500)
+	e.Flush()
+	want = []string{
+		"test.tunnel.myapp.bytes_out:500|c",
+		"test.tunnel.myapp.requests:2|c",
+		"test.tunnels.active:1|g",
+	}
+	if got := read(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("second flush sent %q, want %q", got, want)
+	}
+
+	// Removed tunnels drop out of the gauge
+	registry.Unregister("myapp")
+	e.Flush()
+	if got := read(); len(got) != 1 || got[0] != "test.tunnels.active:0|g" {
+		t.Fatalf("flush after unregister sent %q", got)
+	}
+}
+
+// A reclaimed tunnel keeps its ID but counts from zero again; its totals
+// are sent as they are rather than as negative deltas
+func TestFlushAfterCountersReset(t *testing.T) {
+	addr, read := listen(t)
+	registry := tunnel.NewRegistry(0)
+	e, err := NewExporter(addr, "", registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun := addTunnel(t, registry, "myapp")
+	atomic.StoreInt64(&tun.Requests, 10)
+	e.Flush()
+	read()
+
+	registry.Unregister("myapp")
+	tun = addTunnel(t, registry, "myapp")
+	atomic.StoreInt64(&tun.Requests, 4)
+	e.Flush()
+	want := []string{"tunnel.myapp.requests:4|c", "tunnels.active:1|g"}
+	if got := read(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("flush after reset sent %q, want %q", got, want)
+	}
+}
+
+func TestFlushSplitsLargeBatches(t *testing.T) {
+	addr, read := listen(t)
+	registry := tunnel.NewRegistry(0)
+	e, err := NewExporter(addr, "test.", registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const tunnels = 100
+	for i := 0; i < tunnels; i++ {
+		tun := addTunnel(t, registry, fmt.Sprintf("app%03d", i))
+		atomic.StoreInt64(&tun.Requests, 1)
+	}
+
+	e.Flush()
+	got := read()
+	if len(got) != tunnels+1 {
+		t.Fatalf("got %d lines, want %d", len(got), tunnels+1)
+	}
+	for i := 0; i < tunnels; i++ {
+		if want := fmt.Sprintf("test.tunnel.app%03d.requests:1|c", i); got[i] != want {
+			t.Fatalf("line %d = %q, want %q", i, got[i], want)
+		}
+	}
+}
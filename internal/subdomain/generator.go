@@ -4,40 +4,105 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"math/big"
 	"regexp"
 	"strings"
 )
 
 var validSubdomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9\-]{0,61}[a-z0-9])?$`)
 
-// Generate creates a random 8-character subdomain
-func Generate() (string, error) {
-	bytes := make([]byte, 4) // 4 bytes = 8 hex characters
+var reserved = []string{"www", "api", "admin", "mail", "ftp", "localhost"}
+
+// DefaultLength is the length of random hex subdomains unless configured
+const DefaultLength = 8
+
+// Generate creates a random subdomain of length hex characters. The length
+// is clamped to 1-MaxLength.
+func Generate(length int) (string, error) {
+	length = min(max(length, 1), MaxLength)
+
+	bytes := make([]byte, (length+1)/2) // 2 hex characters per byte
 	if _, err := rand.Read(bytes); err != nil {
 		return "", fmt.Errorf("failed to generate random subdomain: %w", err)
 	}
-	return hex.EncodeToString(bytes), nil
+	return hex.EncodeToString(bytes)[:length], nil
+}
+
+// GenerateReadable creates a memorable subdomain such as "happy-otter-42"
+// from an adjective, a noun and a number below 100
+func GenerateReadable() (string, error) {
+	adjective, err := pick(adjectives)
+	if err != nil {
+		return "", err
+	}
+	noun, err := pick(nouns)
+	if err != nil {
+		return "", err
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(100))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random subdomain: %w", err)
+	}
+	return fmt.Sprintf("%s-%s-%d", adjective, noun, n.Int64()), nil
 }
 
-func Validate(subdomain string) error {
+// ReadableMaxLength is the length of the longest name GenerateReadable
+// can return
+var ReadableMaxLength = longest(adjectives) + len("-") + longest(nouns) + len("-99")
+
+// longest returns the length of the longest of words
+func longest(words []string) int {
+	n := 0
+	for _, word := range words {
+		n = max(n, len(word))
+	}
+	return n
+}
+
+// pick returns a random element of words
+func pick(words []string) (string, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random subdomain: %w", err)
+	}
+	return words[i.Int64()], nil
+}
+
+// MaxLength is the longest subdomain DNS allows in a single label
+const MaxLength = 63
+
+// Validate checks that a subdomain is a usable DNS label of at most
+// maxLength characters. maxLength is capped at MaxLength; 0 means MaxLength.
+func Validate(subdomain string, maxLength int) error {
 	subdomain = strings.ToLower(subdomain)
 
-	if len(subdomain) < 1 || len(subdomain) > 63 {
-		return fmt.Errorf("subdomain must be between 1 and 63 characters")
+	if maxLength <= 0 || maxLength > MaxLength {
+		maxLength = MaxLength
+	}
+
+	if len(subdomain) < 1 || len(subdomain) > maxLength {
+		return fmt.Errorf("subdomain must be between 1 and %d characters", maxLength)
 	}
 
 	if !validSubdomainPattern.MatchString(subdomain) {
 		return fmt.Errorf("subdomain must contain only lowercase letters, numbers, and hyphens")
 	}
 
-	reserved := []string{"www", "api", "admin", "mail", "ftp", "localhost"}
+	if IsReserved(subdomain) {
+		return fmt.Errorf("subdomain '%s' is reserved", subdomain)
+	}
+
+	return nil
+}
+
+// IsReserved reports whether a subdomain is kept back from tunnel registration
+func IsReserved(subdomain string) bool {
 	for _, r := range reserved {
 		if subdomain == r {
-			return fmt.Errorf("subdomain '%s' is reserved", subdomain)
+			return true
 		}
 	}
-
-	return nil
+	return false
 }
 
 func Normalize(subdomain string) string {
@@ -0,0 +1,78 @@
+package subdomain
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	for _, tt := range []struct {
+		length int
+		want   int
+	}{
+		{0, 1},
+		{1, 1},
+		{7, 7},
+		{8, 8},
+		{64, MaxLength},
+	} {
+		name, err := Generate(tt.length)
+		if err != nil {
+			t.Fatalf("Generate(%d): %v", tt.length, err)
+		}
+		if len(name) != tt.want {
+			t.Errorf("Generate(%d) = %q, want %d characters", tt.length, name, tt.want)
+		}
+		// Odd lengths are cut from the hex of one more byte
+		padded := name
+		if len(padded)%2 == 1 {
+			padded += "0"
+		}
+		if _, err := hex.DecodeString(padded); err != nil {
+			t.Errorf("Generate(%d) = %q, want hex", tt.length, name)
+		}
+		if err := Validate(name, 0); err != nil && !IsReserved(name) {
+			t.Errorf("Generate(%d) = %q, which is not a valid subdomain: %v", tt.length, name, err)
+		}
+	}
+}
+
+func TestValidateMaxLength(t *testing.T) {
+	for _, tt := range []struct {
+		length, max int
+		ok          bool
+	}{
+		{11, 12, true},
+		{12, 12, true},
+		{13, 12, false},
+		{63, 0, true},
+		{64, 0, false},
+		{63, 100, true},
+		{64, 100, false},
+		{0, 12, false},
+	} {
+		name := strings.Repeat("a", tt.length)
+		if err := Validate(name, tt.max); (err == nil) != tt.ok {
+			t.Errorf("Validate(%d characters, max %d) = %v, want ok %t", tt.length, tt.max, err, tt.ok)
+		}
+	}
+}
+
+func TestGenerateReadableLength(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		name, err := GenerateReadable()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(name) > ReadableMaxLength {
+			t.Fatalf("GenerateReadable() = %q, longer than ReadableMaxLength (%d)", name, ReadableMaxLength)
+		}
+		if err := Validate(name, ReadableMaxLength); err != nil {
+			t.Fatalf("GenerateReadable() = %q: %v", name, err)
+		}
+	}
+	if want := len("sleepy-glacier-42"); ReadableMaxLength != want {
+		t.Fatalf("ReadableMaxLength = %d, want %d", ReadableMaxLength, want)
+	}
+}
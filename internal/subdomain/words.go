@@ -0,0 +1,22 @@
+package subdomain
+
+// Word lists for readable subdomains. Words are short, lowercase and
+// unambiguous when read aloud.
+
+var adjectives = []string{
+	"amber", "bold", "brave", "bright", "calm", "clever", "cosy", "crisp",
+	"curly", "daring", "eager", "fancy", "fast", "fluffy", "fresh", "gentle",
+	"giant", "glad", "golden", "happy", "humble", "jolly", "keen", "kind",
+	"lively", "lucky", "mellow", "merry", "mighty", "misty", "noble", "proud",
+	"quick", "quiet", "rapid", "rosy", "rusty", "shiny", "silent", "silver",
+	"sleepy", "smooth", "snowy", "sunny", "swift", "tidy", "tiny", "witty",
+}
+
+var nouns = []string{
+	"badger", "beaver", "bison", "canyon", "cedar", "comet", "coral", "crane",
+	"delta", "eagle", "falcon", "fern", "finch", "forest", "fox", "glacier",
+	"harbor", "hawk", "heron", "island", "koala", "lagoon", "lemur", "lynx",
+	"maple", "meadow", "moose", "nebula", "orbit", "otter", "owl", "panda",
+	"pebble", "pine", "planet", "prairie", "quokka", "raven", "reef", "river",
+	"robin", "salmon", "summit", "tiger", "tulip", "valley", "walrus", "willow",
+}
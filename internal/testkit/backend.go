@@ -0,0 +1,86 @@
+package testkit
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// Backend serves a tunnel's backend in memory. Every stream the proxy
+// dials is one end of a net.Pipe whose other end is accepted by an
+// http.Server running the backend handler.
+type Backend struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial implements tunnel.StreamDialer
+func (b *Backend) Dial() (tunnel.Connection, error) {
+	proxyEnd, backendEnd := net.Pipe()
+	select {
+	case b.conns <- backendEnd:
+		return proxyEnd, nil
+	case <-b.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Accept implements net.Listener
+func (b *Backend) Accept() (net.Conn, error) {
+	select {
+	case conn := <-b.conns:
+		return conn, nil
+	case <-b.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener
+func (b *Backend) Close() error {
+	b.closeOnce.Do(func() { close(b.done) })
+	return nil
+}
+
+// Addr implements net.Listener
+func (b *Backend) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3000}
+}
+
+// nopConn stands in for the tunnel's client connection, which the proxy
+// never touches once the tunnel has streams
+type nopConn struct{}
+
+func (nopConn) Read([]byte) (int, error)    { return 0, io.EOF }
+func (nopConn) Write(p []byte) (int, error) { return len(p), nil }
+func (nopConn) Close() error                { return nil }
+
+// AddTunnel registers a tunnel on name whose backend is handler, served
+// until the test ends
+func AddTunnel(t testing.TB, registry *tunnel.Registry, name string, handler http.Handler) *tunnel.Tunnel {
+	t.Helper()
+
+	backend := &Backend{conns: make(chan net.Conn), done: make(chan struct{})}
+	server := &http.Server{Handler: handler}
+	go server.Serve(backend)
+	t.Cleanup(func() { server.Close() })
+
+	tun := &tunnel.Tunnel{
+		ID:        name + "-id",
+		WSConn:    nopConn{},
+		Streams:   backend,
+		LocalAddr: "localhost:3000",
+		CreatedAt: time.Now(),
+		ConnID:    "test",
+	}
+	tun.SetSubdomain(name)
+	if err := registry.Register(tun); err != nil {
+		t.Fatalf("register %s: %v", name, err)
+	}
+	return tun
+}
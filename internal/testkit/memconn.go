@@ -0,0 +1,212 @@
+package testkit
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// memBuffer is one direction of a memConn: an unbounded byte buffer whose
+// reads block until data arrives, the writer closes or the deadline passes.
+// Unlike net.Pipe, writes never wait for the reader, as with a socket's
+// send buffer.
+type memBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	data     []byte
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newMemBuffer() *memBuffer {
+	b := &memBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *memBuffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.data) == 0 && !b.closed {
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+	if len(b.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func (b *memBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	b.data = append(b.data, p...)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+func (b *memBuffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), b.cond.Broadcast)
+	}
+	b.cond.Broadcast()
+}
+
+func (b *memBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// memConn is an in-memory net.Conn, one end of a pair made by memPipe
+type memConn struct {
+	in, out *memBuffer
+}
+
+// memPipe returns two connected in-memory connections
+func memPipe() (net.Conn, net.Conn) {
+	a, b := newMemBuffer(), newMemBuffer()
+	return &memConn{in: a, out: b}, &memConn{in: b, out: a}
+}
+
+func (c *memConn) Read(p []byte) (int, error)  { return c.in.read(p) }
+func (c *memConn) Write(p []byte) (int, error) { return c.out.write(p) }
+func (c *memConn) LocalAddr() net.Addr         { return memAddr{} }
+func (c *memConn) RemoteAddr() net.Addr        { return memAddr{} }
+
+func (c *memConn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn; writes never block, so it does nothing
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// memAddr is the address of both ends of a memConn
+type memAddr struct{}
+
+func (memAddr) Network() string { return "mem" }
+func (memAddr) String() string  { return "127.0.0.1:40000" }
+
+// MemListener is an in-memory net.Listener. DialContext hands one end of
+// a memPipe to Accept, so HTTP and WebSocket traffic never touches a socket.
+type MemListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemListener returns a listener that accepts in-memory connections
+func NewMemListener() *MemListener {
+	return &MemListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept implements net.Listener
+func (l *MemListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener
+func (l *MemListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr implements net.Listener
+func (l *MemListener) Addr() net.Addr {
+	return memAddr{}
+}
+
+// DialContext connects to the listener, ignoring the address
+func (l *MemListener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := memPipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ServeInMemory serves handler on a MemListener until the test ends
+func ServeInMemory(t testing.TB, handler http.Handler) *MemListener {
+	t.Helper()
+
+	l := NewMemListener()
+	server := &http.Server{Handler: handler}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return l
+}
+
+// DialWebSocket opens a WebSocket connection to path on l, returning the
+// handshake response so rejections can be checked
+func DialWebSocket(l *MemListener, path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{NetDialContext: l.DialContext, HandshakeTimeout: Timeout}
+	return dialer.Dial("ws://"+Domain+path, header)
+}
+
+// DialInMemory opens a WebSocket connection to path on l
+func DialInMemory(t testing.TB, l *MemListener, path string, header http.Header) *websocket.Conn {
+	t.Helper()
+
+	conn, resp, err := DialWebSocket(l, path, header)
+	if err != nil {
+		if resp != nil {
+			t.Fatalf("dial %s: %v (status %s)", path, err, resp.Status)
+		}
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
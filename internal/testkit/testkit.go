@@ -0,0 +1,53 @@
+// Package testkit holds helpers shared by the tests of the other packages:
+// a base configuration, test servers for HTTP and WebSocket traffic,
+// in-memory tunnel backends and small utilities. It is only imported from
+// _test.go files.
+package testkit
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+)
+
+// Timeout bounds every wait in tests, so a deadlock fails the test instead
+// of hanging it
+const Timeout = 5 * time.Second
+
+// Domain is the base domain tunnels are served under in tests
+const Domain = "tunnel.test"
+
+// Config returns the default configuration for a plain HTTP server on Domain
+func Config() *config.Config {
+	cfg := config.Load()
+	cfg.Domain = Domain
+	cfg.EnableHTTPS = false
+	return cfg
+}
+
+// ReadBody reads a response body as a string
+func ReadBody(t testing.TB, resp *http.Response) string {
+	t.Helper()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return string(body)
+}
+
+// WaitFor polls cond until it holds, failing the test after Timeout
+func WaitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(Timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,118 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"    // requests flow normally
+	BreakerOpen     = "open"      // requests fail fast until the cooldown ends
+	BreakerHalfOpen = "half-open" // one probe request decides whether to close
+)
+
+// Breaker is a circuit breaker for a tunnel's backend. After threshold
+// consecutive failures within window it opens and rejects requests for
+// cooldown, then lets a single probe through: success closes it again,
+// failure re-opens it.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	state        string
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probeAt      time.Time
+}
+
+// NewBreaker creates a closed circuit breaker
+func NewBreaker(threshold int, window, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+	}
+}
+
+// Allow reports whether a request may be sent to the backend.
+// Every allowed request should be followed by Success or Failure.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probeAt = now
+		return true
+	case BreakerHalfOpen:
+		// Allow another probe if the previous one never reported back
+		if now.Sub(b.probeAt) < b.cooldown {
+			return false
+		}
+		b.probeAt = now
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a request the backend handled
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+}
+
+// Failure records a request the backend failed to handle
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == BreakerHalfOpen {
+		b.open(now)
+		return
+	}
+
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+
+	if b.failures >= b.threshold {
+		b.open(now)
+	}
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// Cooldown returns how long the breaker stays open
+func (b *Breaker) Cooldown() time.Duration {
+	return b.cooldown
+}
+
+// open trips the breaker. b.mu must be held.
+func (b *Breaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.failures = 0
+}
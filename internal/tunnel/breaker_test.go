@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := NewBreaker(3, time.Minute, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("request %d rejected before the threshold", i)
+		}
+		b.Failure()
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("state after 2 failures = %s, want %s", got, BreakerClosed)
+	}
+
+	b.Failure()
+	if got := b.State(); got != BreakerOpen {
+		t.Fatalf("state after 3 failures = %s, want %s", got, BreakerOpen)
+	}
+	if b.Allow() {
+		t.Fatal("open breaker allowed a request during the cooldown")
+	}
+}
+
+func TestBreakerSuccessResetsFailures(t *testing.T) {
+	b := NewBreaker(2, time.Minute, time.Hour)
+
+	b.Failure()
+	b.Success()
+	b.Failure()
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("state = %s, want %s: a success in between should reset the count", got, BreakerClosed)
+	}
+}
+
+func TestBreakerFailuresOutsideWindowDontCount(t *testing.T) {
+	b := NewBreaker(2, 20*time.Millisecond, time.Hour)
+
+	b.Failure()
+	time.Sleep(40 * time.Millisecond)
+	b.Failure()
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("state = %s, want %s: the first failure fell out of the window", got, BreakerClosed)
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		succeed bool
+		want    string
+	}{
+		{"probe succeeds", true, BreakerClosed},
+		{"probe fails", false, BreakerOpen},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cooldown := 20 * time.Millisecond
+			b := NewBreaker(1, time.Minute, cooldown)
+			b.Failure()
+
+			time.Sleep(2 * cooldown)
+			if !b.Allow() {
+				t.Fatal("no probe allowed after the cooldown")
+			}
+			if got := b.State(); got != BreakerHalfOpen {
+				t.Fatalf("state during probe = %s, want %s", got, BreakerHalfOpen)
+			}
+			if b.Allow() {
+				t.Fatal("second request allowed while the probe is outstanding")
+			}
+
+			if tt.succeed {
+				b.Success()
+			} else {
+				b.Failure()
+			}
+			if got := b.State(); got != tt.want {
+				t.Fatalf("state after probe = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
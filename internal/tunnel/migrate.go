@@ -0,0 +1,40 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ExportPath is the admin API path serving Registry.Export
+const ExportPath = "/api/registry/export"
+
+// FetchReservations downloads the reservations exported by another instance
+// at baseURL, authenticating with its admin token
+func FetchReservations(baseURL, adminToken string) ([]Reservation, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(baseURL, "/")+ExportPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid migration source: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch reservations: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch reservations: %s", resp.Status)
+	}
+
+	var reservations []Reservation
+	if err := json.NewDecoder(resp.Body).Decode(&reservations); err != nil {
+		return nil, fmt.Errorf("invalid reservations response: %w", err)
+	}
+
+	return reservations, nil
+}
@@ -0,0 +1,59 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsBurst(t *testing.T) {
+	l := NewRateLimiter(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Fatalf("request %d rejected within the burst", i)
+		}
+	}
+	if l.Allow() {
+		t.Fatal("request allowed after the burst was used up")
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := NewRateLimiter(2, 2)
+	l.Allow()
+	l.Allow()
+
+	// Half a second at 2 per second earns one token, never more than burst
+	l.last = l.last.Add(-500 * time.Millisecond)
+	if !l.Allow() {
+		t.Fatal("request rejected after the bucket refilled")
+	}
+	if l.Allow() {
+		t.Fatal("bucket refilled more than one token in half a second")
+	}
+
+	l.last = l.last.Add(-time.Hour)
+	for i := 0; i < 2; i++ {
+		if !l.Allow() {
+			t.Fatalf("request %d rejected after a long pause", i)
+		}
+	}
+	if l.Allow() {
+		t.Fatal("bucket refilled beyond its burst")
+	}
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	for _, tt := range []struct {
+		rate float64
+		want float64
+	}{
+		{5, 5},
+		{2.5, 3},
+		{0.1, 1},
+	} {
+		if got := NewRateLimiter(tt.rate, 0).burst; got != tt.want {
+			t.Errorf("NewRateLimiter(%v, 0) burst = %v, want %v", tt.rate, got, tt.want)
+		}
+	}
+}
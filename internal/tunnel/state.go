@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateWriteDelay is how long a state file write waits for further
+// registry changes, so bursts of registrations cause a single write
+const stateWriteDelay = time.Second
+
+// StateFile keeps a snapshot of the registry's reclaimable subdomains on
+// disk, so a restarted server can hold them for reconnecting clients
+type StateFile struct {
+	registry *Registry
+	path     string
+	grace    time.Duration
+
+	mu      sync.Mutex
+	pending *time.Timer
+}
+
+// NewStateFile writes the registry's reservations to path whenever the
+// registry changes, at most once per stateWriteDelay. Live tunnels are
+// saved as reservations lasting grace.
+func NewStateFile(registry *Registry, path string, grace time.Duration) *StateFile {
+	f := &StateFile{
+		registry: registry,
+		path:     path,
+		grace:    grace,
+	}
+	registry.OnChange(f.schedule)
+	return f
+}
+
+// schedule queues a write unless one is already pending
+func (f *StateFile) schedule() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.pending == nil {
+		f.pending = time.AfterFunc(stateWriteDelay, func() {
+			if err := f.Save(); err != nil {
+				log.Printf("Failed to save registry state: %v", err)
+			}
+		})
+	}
+}
+
+// Save writes the current snapshot right away, replacing the file
+// atomically so a crash never leaves it half written
+func (f *StateFile) Save() error {
+	f.mu.Lock()
+	if f.pending != nil {
+		f.pending.Stop()
+		f.pending = nil
+	}
+	f.mu.Unlock()
+
+	data, err := json.Marshal(f.registry.Export(f.grace))
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// LoadState reads reservations saved by a StateFile. Each one is held for
+// grace from now, since clients can only reconnect once the server is back.
+// A missing file yields no reservations.
+func LoadState(path string, grace time.Duration) ([]Reservation, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var reservations []Reservation
+	if err := json.Unmarshal(data, &reservations); err != nil {
+		return nil, fmt.Errorf("invalid registry state in %s: %w", path, err)
+	}
+
+	expiresAt := time.Now().Add(grace)
+	for i := range reservations {
+		reservations[i].ExpiresAt = expiresAt
+	}
+	return reservations, nil
+}
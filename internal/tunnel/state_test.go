@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	old := NewRegistry(0)
+	if err := old.Register(newReclaimableTunnel("myapp", "token")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := NewStateFile(old, path, time.Minute).Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// Reservations are held for the grace period from the restart, not
+	// from when they were saved
+	loaded, err := LoadState(path, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].Subdomain != "myapp" || time.Until(loaded[0].ExpiresAt) < 59*time.Minute {
+		t.Fatalf("loaded reservations = %+v, want myapp held for an hour", loaded)
+	}
+
+	next := NewRegistry(0)
+	next.Import(loaded)
+	back := newTestTunnel("myapp")
+	back.ID = ""
+	if _, err := next.Reclaim(back, "token"); err != nil {
+		t.Fatalf("Reclaim after restart: %v", err)
+	}
+}
+
+func TestStateFileSavesOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	r := NewRegistry(0)
+	NewStateFile(r, path, time.Minute)
+	if err := r.Register(newReclaimableTunnel("myapp", "token")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	deadline := time.Now().Add(stateWriteDelay + 5*time.Second)
+	for {
+		loaded, err := LoadState(path, time.Minute)
+		if err != nil {
+			t.Fatalf("LoadState: %v", err)
+		}
+		if len(loaded) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("registry change was not saved")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	dir := t.TempDir()
+	if loaded, err := LoadState(filepath.Join(dir, "missing.json"), time.Minute); err != nil || loaded != nil {
+		t.Fatalf("LoadState of a missing file = %v, %v, want nothing", loaded, err)
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadState(invalid, time.Minute); err == nil {
+		t.Fatal("LoadState accepted an invalid file")
+	}
+}
@@ -1,8 +1,14 @@
 package tunnel
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,64 +19,732 @@ type Connection interface {
 	Close() error
 }
 
+// StreamDialer opens independent streams over a shared tunnel connection
+type StreamDialer interface {
+	Dial() (Connection, error)
+}
+
 type Tunnel struct {
 	ID         string
-	Subdomain  string
-	WSConn     Connection // WebSocket connection
-	LocalAddr  string     // e.g., "localhost:3000"
-	RemotePort int        // e.g., 80 or 443
+	WSConn     Connection   // WebSocket connection
+	Streams    StreamDialer // Multiplexes requests over WSConn; nil when the client didn't negotiate it
+	LocalAddr  string       // e.g., "localhost:3000"
+	RemotePort int          // e.g., 80 or 443
 	CreatedAt  time.Time
+	TokenHash  string       // Hash of the reconnect token issued to the client
+	Caps       []string     // Capabilities negotiated with the client
+	Breaker    *Breaker     // Fails requests fast while the backend is down; nil disables
+	Limiter    *RateLimiter // Limits the tunnel's request rate; nil disables
+	ConnID     string       // Correlation ID of the client connection, for logs
+
+	// NormalizePaths cleans request paths (collapsing "//", resolving "."
+	// and "..") before forwarding; by default paths are passed verbatim
+	NormalizePaths bool
+
+	// HostHeader replaces the Host header of forwarded requests when set
+	HostHeader string
+
+	// ForwardTLSInfo adds the visitor's TLS version and cipher to forwarded requests
+	ForwardTLSInfo bool
+
+	// BufferResponse reads each response in full, up to a size limit, before
+	// sending it to the visitor, so a backend that trickles its output
+	// can't keep visitors waiting on a half-sent response
+	BufferResponse bool
+
+	// Traffic through the tunnel, updated with atomic.AddInt64. Each
+	// registration gets a new Tunnel, so the totals start at zero.
+	BytesIn  int64 // bytes sent from visitors to the backend
+	BytesOut int64 // bytes sent from the backend to visitors
+	Requests int64 // requests forwarded to the backend
+	Errors   int64 // requests answered with 502 because the backend failed
+
+	subdomain    atomic.Pointer[string] // changed by Registry.Rename while requests read it
+	inFlight     int64                  // requests currently being proxied, updated atomically
+	lastActivity atomic.Int64           // unix nanoseconds of the last proxied bytes; 0 means none yet
+	paused       atomic.Bool            // traffic is refused while the owner works on the backend
+	closing      atomic.Bool            // the client connection is going away; the client may reconnect
+
+	idleMu sync.Mutex
+	idle   chan struct{} // closed when inFlight drops to zero; nil while nobody waits
+}
+
+// Subdomain returns the name the tunnel is registered under
+func (t *Tunnel) Subdomain() string {
+	if name := t.subdomain.Load(); name != nil {
+		return *name
+	}
+	return ""
+}
+
+// SetSubdomain sets the name the tunnel registers under. Once registered,
+// only Registry.Rename changes it.
+func (t *Tunnel) SetSubdomain(name string) {
+	t.subdomain.Store(&name)
+}
+
+// HasCapability reports whether the client negotiated the given capability
+func (t *Tunnel) HasCapability(capability string) bool {
+	for _, c := range t.Caps {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Pause stops traffic to the tunnel while keeping it registered
+func (t *Tunnel) Pause() {
+	t.paused.Store(true)
+}
+
+// Resume restores traffic to a paused tunnel
+func (t *Tunnel) Resume() {
+	t.paused.Store(false)
+}
+
+// IsPaused reports whether the tunnel is paused
+func (t *Tunnel) IsPaused() bool {
+	return t.paused.Load()
+}
+
+// BeginRequest marks a proxied request as started and returns the number
+// of requests now in flight on this tunnel
+func (t *Tunnel) BeginRequest() int64 {
+	return atomic.AddInt64(&t.inFlight, 1)
+}
+
+// EndRequest marks a proxied request as finished
+func (t *Tunnel) EndRequest() {
+	if atomic.AddInt64(&t.inFlight, -1) == 0 {
+		t.idleMu.Lock()
+		if t.idle != nil {
+			close(t.idle)
+			t.idle = nil
+		}
+		t.idleMu.Unlock()
+	}
+}
+
+// Idle returns a channel that is closed once no requests are in flight
+func (t *Tunnel) Idle() <-chan struct{} {
+	t.idleMu.Lock()
+	defer t.idleMu.Unlock()
+
+	if t.InFlight() == 0 {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	return t.idle
+}
+
+// MarkClosing flags the tunnel's connection as going away. Requests that
+// still reach the tunnel are told to retry rather than that it failed.
+func (t *Tunnel) MarkClosing() {
+	t.closing.Store(true)
+}
+
+// IsClosing reports whether the tunnel's connection is going away
+func (t *Tunnel) IsClosing() bool {
+	return t.closing.Load()
+}
+
+// Touch records that traffic just flowed through the tunnel
+func (t *Tunnel) Touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// LastActivity returns when traffic last flowed through the tunnel, or
+// when it was created if it has carried none
+func (t *Tunnel) LastActivity() time.Time {
+	if nanos := t.lastActivity.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return t.CreatedAt
+}
+
+// InFlight returns the number of requests currently being proxied
+func (t *Tunnel) InFlight() int64 {
+	return atomic.LoadInt64(&t.inFlight)
+}
+
+// ErrMaintenance is returned for new registrations while the server is in
+// maintenance mode. The message is shown to clients as is.
+var ErrMaintenance = errors.New("server is in maintenance mode and not accepting new tunnels, please try again later")
+
+// ErrAtCapacity is returned when the registry already holds its maximum
+// number of tunnels. The message is shown to clients as is.
+var ErrAtCapacity = errors.New("server is at capacity, please try again in a few minutes")
+
+// Reservation holds a subdomain for a disconnected client so it can
+// reclaim it with its reconnect token before ExpiresAt
+type Reservation struct {
+	Subdomain string    `json:"subdomain"`
+	TunnelID  string    `json:"tunnel_id"`
+	TokenHash string    `json:"token_hash"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Capacity describes how full the registry is. Reservations held for
+// reconnecting clients count as used slots.
+type Capacity struct {
+	Max       int `json:"max"`       // 0 means unlimited
+	Used      int `json:"used"`      // tunnels plus reservations
+	Remaining int `json:"remaining"` // -1 when unlimited
+}
+
+// registryShards is the number of independently locked maps the registry
+// is split into, so lookups for different subdomains rarely contend
+const registryShards = 32
+
+// departedWindow is how long a subdomain still counts as known after its
+// tunnel is removed without a reservation, see Known
+const departedWindow = 5 * time.Minute
+
+// registryShard holds the tunnels and reservations for a subset of subdomains
+type registryShard struct {
+	mu           sync.RWMutex
+	tunnels      map[string]*Tunnel      // subdomain -> tunnel
+	reservations map[string]*Reservation // subdomain -> reservation
+	departed     map[string]time.Time    // subdomain -> when its tunnel was removed
+}
+
+// depart records that the tunnel on subdomain was removed and forgets
+// departures older than departedWindow. s.mu must be held.
+func (s *registryShard) depart(subdomain string) {
+	now := time.Now()
+	for name, at := range s.departed {
+		if now.Sub(at) > departedWindow {
+			delete(s.departed, name)
+		}
+	}
+	s.departed[subdomain] = now
 }
 
 type Registry struct {
-	mu      sync.RWMutex
-	tunnels map[string]*Tunnel // subdomain -> tunnel
+	shards      [registryShards]*registryShard
+	maintenance atomic.Bool  // new registrations are refused while set
+	tunnels     atomic.Int64 // live tunnels across all shards
+	entries     atomic.Int64 // live tunnels plus reservations across all shards
+	maxTunnels  int64        // 0 means unlimited
+	onChange    func()       // called after tunnels or reservations change; set before use
 }
 
-func NewRegistry() *Registry {
-	return &Registry{
-		tunnels: make(map[string]*Tunnel),
+// NewRegistry creates a registry holding at most maxTunnels tunnels and
+// reservations combined. A maxTunnels of 0 means no limit.
+func NewRegistry(maxTunnels int) *Registry {
+	r := &Registry{maxTunnels: int64(maxTunnels)}
+	for i := range r.shards {
+		r.shards[i] = &registryShard{
+			tunnels:      make(map[string]*Tunnel),
+			reservations: make(map[string]*Reservation),
+			departed:     make(map[string]time.Time),
+		}
 	}
+	return r
+}
+
+// OnChange registers fn to be called after tunnels or reservations are
+// added or removed. It must be called before the registry is used, and fn
+// must not call back into the registry synchronously.
+func (r *Registry) OnChange(fn func()) {
+	r.onChange = fn
+}
+
+// changed runs the OnChange callback, if any
+func (r *Registry) changed() {
+	if r.onChange != nil {
+		r.onChange()
+	}
+}
+
+// shard returns the shard responsible for a subdomain
+func (r *Registry) shard(subdomain string) *registryShard {
+	return r.shards[r.shardIndex(subdomain)]
+}
+
+// shardIndex returns the index of the shard responsible for a subdomain
+func (r *Registry) shardIndex(subdomain string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(subdomain))
+	return h.Sum32() % registryShards
+}
+
+// HashToken returns the hash under which a reconnect token is stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetMaintenance turns maintenance mode on or off. While it is on, Register
+// refuses new tunnels; existing tunnels keep serving and reconnecting
+// clients can still reclaim their reservations, so traffic drains naturally.
+func (r *Registry) SetMaintenance(enabled bool) {
+	r.maintenance.Store(enabled)
+}
+
+// InMaintenance reports whether maintenance mode is on
+func (r *Registry) InMaintenance() bool {
+	return r.maintenance.Load()
 }
 
 func (r *Registry) Register(tunnel *Tunnel) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	if r.InMaintenance() {
+		return ErrMaintenance
+	}
+
+	// Expired reservations are only dropped lazily, so clear them out
+	// before concluding the registry is full
+	if r.atCapacity() {
+		r.expireReservations()
+	}
+
+	subdomain := tunnel.Subdomain()
+	s := r.shard(subdomain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !r.isAvailableLocked(s, subdomain) {
+		return fmt.Errorf("subdomain '%s' is already in use", subdomain)
+	}
+
+	if !r.acquire() {
+		return ErrAtCapacity
+	}
+
+	s.tunnels[subdomain] = tunnel
+	r.tunnels.Add(1)
+	r.changed()
+	return nil
+}
+
+// atCapacity reports whether no more tunnels can be registered.
+// Reservations count toward the limit so a reconnecting client always
+// gets its slot back.
+func (r *Registry) atCapacity() bool {
+	return r.maxTunnels > 0 && r.entries.Load() >= r.maxTunnels
+}
+
+// acquire takes a slot for a new entry, failing if the registry is full
+func (r *Registry) acquire() bool {
+	for {
+		n := r.entries.Load()
+		if r.maxTunnels > 0 && n >= r.maxTunnels {
+			return false
+		}
+		if r.entries.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
 
-	if _, exists := r.tunnels[tunnel.Subdomain]; exists {
-		return fmt.Errorf("subdomain '%s' is already in use", tunnel.Subdomain)
+// expireReservations drops expired reservations from every shard
+func (r *Registry) expireReservations() {
+	now := time.Now()
+	for _, s := range r.shards {
+		s.mu.Lock()
+		for subdomain, res := range s.reservations {
+			if now.After(res.ExpiresAt) {
+				delete(s.reservations, subdomain)
+				r.entries.Add(-1)
+			}
+		}
+		s.mu.Unlock()
 	}
+}
+
+// Reclaim registers a tunnel on a subdomain reserved for a reconnecting client.
+// The token must match the reservation and the grace period must not have
+// expired. On success the tunnel takes over the reserved tunnel ID; if
+// tunnel.ID is already set it must match.
+//
+// A client may reconnect before the server notices its old connection
+// dropped. A live tunnel issued the same token is then replaced and
+// returned, so the caller can close its connection.
+func (r *Registry) Reclaim(tunnel *Tunnel, token string) (*Tunnel, error) {
+	subdomain := tunnel.Subdomain()
+	s := r.shard(subdomain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokenHash := []byte(HashToken(token))
+
+	if old, live := s.tunnels[subdomain]; live {
+		if old.TokenHash == "" || subtle.ConstantTimeCompare([]byte(old.TokenHash), tokenHash) != 1 {
+			return nil, fmt.Errorf("subdomain '%s' is already in use", subdomain)
+		}
+		if tunnel.ID != "" && tunnel.ID != old.ID {
+			return nil, fmt.Errorf("tunnel ID does not match the tunnel on subdomain '%s'", subdomain)
+		}
+
+		tunnel.ID = old.ID
+		s.tunnels[subdomain] = tunnel
+		r.changed()
+		return old, nil
+	}
+
+	res, exists := s.reservations[subdomain]
+	if !exists || time.Now().After(res.ExpiresAt) {
+		if exists {
+			delete(s.reservations, subdomain)
+			r.entries.Add(-1)
+		}
+		return nil, fmt.Errorf("no reservation for subdomain '%s' (expired or never reserved)", subdomain)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(res.TokenHash), tokenHash) != 1 {
+		return nil, fmt.Errorf("invalid reconnect token for subdomain '%s'", subdomain)
+	}
+	if tunnel.ID != "" && tunnel.ID != res.TunnelID {
+		return nil, fmt.Errorf("tunnel ID does not match the reservation for subdomain '%s'", subdomain)
+	}
+
+	// The reservation's slot passes to the tunnel, so entries is unchanged
+	delete(s.reservations, subdomain)
+	tunnel.ID = res.TunnelID
+	s.tunnels[subdomain] = tunnel
+	r.tunnels.Add(1)
+	r.changed()
+	return nil, nil
+}
+
+// Release unregisters a tunnel whose connection dropped. If the tunnel was
+// issued a reconnect token and grace is positive, its subdomain stays
+// reserved for that long so the client can reclaim it. Nothing happens if
+// the subdomain has since been taken over by another tunnel.
+func (r *Registry) Release(tunnel *Tunnel, grace time.Duration) {
+	// A concurrent Rename may move the tunnel between reading its name and
+	// locking the shard. The name can't change while its shard is held.
+	subdomain := tunnel.Subdomain()
+	s := r.shard(subdomain)
+	s.mu.Lock()
+	for name := tunnel.Subdomain(); name != subdomain; name = tunnel.Subdomain() {
+		s.mu.Unlock()
+		subdomain = name
+		s = r.shard(subdomain)
+		s.mu.Lock()
+	}
+	defer s.mu.Unlock()
+
+	if s.tunnels[subdomain] != tunnel {
+		return
+	}
+	delete(s.tunnels, subdomain)
+	r.tunnels.Add(-1)
+	defer r.changed()
+
+	if tunnel.TokenHash == "" || grace <= 0 {
+		r.entries.Add(-1)
+		s.depart(subdomain)
+		return
+	}
+
+	s.reservations[subdomain] = &Reservation{
+		Subdomain: subdomain,
+		TunnelID:  tunnel.ID,
+		TokenHash: tunnel.TokenHash,
+		ExpiresAt: time.Now().Add(grace),
+	}
+}
+
+// Export returns a reservation for every live tunnel that can be reclaimed
+// and every pending reservation, so another instance can hold the subdomains
+// for clients reconnecting to it. Live tunnels are given the grace period.
+func (r *Registry) Export(grace time.Duration) []Reservation {
+	now := time.Now()
+	reservations := make([]Reservation, 0, r.entries.Load())
+	for _, s := range r.shards {
+		s.mu.RLock()
+		for _, tunnel := range s.tunnels {
+			if tunnel.TokenHash == "" {
+				continue
+			}
+			reservations = append(reservations, Reservation{
+				Subdomain: tunnel.Subdomain(),
+				TunnelID:  tunnel.ID,
+				TokenHash: tunnel.TokenHash,
+				ExpiresAt: now.Add(grace),
+			})
+		}
+		for _, res := range s.reservations {
+			if now.Before(res.ExpiresAt) {
+				reservations = append(reservations, *res)
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	return reservations
+}
+
+// Import adds reservations exported by another instance. Expired entries
+// and subdomains already in use here are skipped. Reservations count
+// toward MAX_TUNNELS, so once the registry is full the rest are dropped.
+// It returns the number of reservations added and dropped.
+func (r *Registry) Import(reservations []Reservation) (imported, dropped int) {
+	if r.atCapacity() {
+		r.expireReservations()
+	}
+
+	for _, res := range reservations {
+		if res.Subdomain == "" || res.TokenHash == "" || !time.Now().Before(res.ExpiresAt) {
+			continue
+		}
+
+		s := r.shard(res.Subdomain)
+		s.mu.Lock()
+		if r.isAvailableLocked(s, res.Subdomain) {
+			if r.acquire() {
+				res := res
+				s.reservations[res.Subdomain] = &res
+				imported++
+			} else {
+				dropped++
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	if imported > 0 {
+		r.changed()
+	}
+	return imported, dropped
+}
+
+// Unregister removes the tunnel on subdomain. It reports whether a tunnel
+// was removed, so callers only clean up after tunnels they actually closed.
+func (r *Registry) Unregister(subdomain string) bool {
+	_, removed := r.Kill(subdomain)
+	return removed
+}
+
+// Kill unregisters the tunnel on subdomain and returns it, so the caller
+// can close its connection. No reservation is kept for its client.
+func (r *Registry) Kill(subdomain string) (*Tunnel, bool) {
+	s := r.shard(subdomain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tunnel, exists := s.tunnels[subdomain]
+	if !exists {
+		return nil, false
+	}
+
+	delete(s.tunnels, subdomain)
+	r.tunnels.Add(-1)
+	r.entries.Add(-1)
+	s.depart(subdomain)
+	r.changed()
+	return tunnel, true
+}
+
+// Reserve holds res.Subdomain until res.ExpiresAt for whoever presents the
+// reconnect token hashed in res.TokenHash. The subdomain must be free, and
+// the reservation takes a slot like a tunnel does.
+func (r *Registry) Reserve(res Reservation) error {
+	if r.atCapacity() {
+		r.expireReservations()
+	}
+
+	s := r.shard(res.Subdomain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	r.tunnels[tunnel.Subdomain] = tunnel
+	if !r.isAvailableLocked(s, res.Subdomain) {
+		return fmt.Errorf("subdomain '%s' is already in use", res.Subdomain)
+	}
+	if !r.acquire() {
+		return ErrAtCapacity
+	}
+
+	s.reservations[res.Subdomain] = &res
+	r.changed()
 	return nil
 }
 
-func (r *Registry) Unregister(subdomain string) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// DeleteReservation drops the reservation for subdomain. It reports
+// whether there was one; live tunnels are not affected.
+func (r *Registry) DeleteReservation(subdomain string) bool {
+	s := r.shard(subdomain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.reservations[subdomain]; !exists {
+		return false
+	}
+
+	delete(s.reservations, subdomain)
+	r.entries.Add(-1)
+	r.changed()
+	return true
+}
+
+// ReapIdle unregisters tunnels that have carried no traffic for longer
+// than timeout and returns them so their connections can be closed
+func (r *Registry) ReapIdle(timeout time.Duration) []*Tunnel {
+	var reaped []*Tunnel
+	cutoff := time.Now().Add(-timeout)
+	for _, s := range r.shards {
+		s.mu.Lock()
+		for subdomain, tunnel := range s.tunnels {
+			// Requests still in flight count as activity
+			if tunnel.InFlight() > 0 || tunnel.LastActivity().After(cutoff) {
+				continue
+			}
+			delete(s.tunnels, subdomain)
+			r.tunnels.Add(-1)
+			r.entries.Add(-1)
+			s.depart(subdomain)
+			reaped = append(reaped, tunnel)
+		}
+		s.mu.Unlock()
+	}
+	if len(reaped) > 0 {
+		r.changed()
+	}
+	return reaped
+}
+
+// StartReaper checks for idle tunnels in the background and passes each
+// one it unregisters to onEvict. A timeout of 0 disables the reaper.
+func (r *Registry) StartReaper(timeout time.Duration, onEvict func(*Tunnel)) {
+	if timeout <= 0 {
+		return
+	}
+
+	interval := min(max(timeout/2, time.Second), time.Minute)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			for _, tunnel := range r.ReapIdle(timeout) {
+				onEvict(tunnel)
+			}
+		}
+	}()
+}
+
+// Rename moves a registered tunnel from one subdomain to another in a
+// single step, so requests never see it missing from both. The new
+// subdomain must be neither in use nor reserved.
+func (r *Registry) Rename(oldSubdomain, newSubdomain string) error {
+	oldShard, newShard := r.shard(oldSubdomain), r.shard(newSubdomain)
+
+	// Lock both shards in a fixed order so concurrent renames can't deadlock
+	first, second := oldShard, newShard
+	if r.shardIndex(newSubdomain) < r.shardIndex(oldSubdomain) {
+		first, second = newShard, oldShard
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	if second != first {
+		second.mu.Lock()
+		defer second.mu.Unlock()
+	}
+
+	tunnel, exists := oldShard.tunnels[oldSubdomain]
+	if !exists {
+		return fmt.Errorf("tunnel not found: %s", oldSubdomain)
+	}
+
+	if !r.isAvailableLocked(newShard, newSubdomain) {
+		return fmt.Errorf("subdomain '%s' is already in use", newSubdomain)
+	}
 
-	delete(r.tunnels, subdomain)
+	delete(oldShard.tunnels, oldSubdomain)
+	oldShard.depart(oldSubdomain)
+	tunnel.SetSubdomain(newSubdomain)
+	newShard.tunnels[newSubdomain] = tunnel
+	r.changed()
+	return nil
 }
 
 func (r *Registry) Get(subdomain string) (*Tunnel, bool) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	s := r.shard(subdomain)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	tunnel, exists := r.tunnels[subdomain]
+	tunnel, exists := s.tunnels[subdomain]
 	return tunnel, exists
 }
 
-func (r *Registry) Count() int {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// Known reports whether subdomain has a tunnel or an unexpired
+// reservation, or had a tunnel removed within the last few minutes. It is
+// cheaper than Get for callers that only need to know a subdomain is real.
+func (r *Registry) Known(subdomain string) bool {
+	s := r.shard(subdomain)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, exists := s.tunnels[subdomain]; exists {
+		return true
+	}
+	if res, exists := s.reservations[subdomain]; exists && time.Now().Before(res.ExpiresAt) {
+		return true
+	}
+	at, exists := s.departed[subdomain]
+	return exists && time.Since(at) <= departedWindow
+}
+
+// List returns a snapshot of the registered tunnels. The slice is a copy,
+// so callers may reorder or truncate it without affecting the registry.
+// Shards are read one at a time, so the snapshot is not atomic across them.
+func (r *Registry) List() []*Tunnel {
+	tunnels := make([]*Tunnel, 0, r.tunnels.Load())
+	for _, s := range r.shards {
+		s.mu.RLock()
+		for _, tunnel := range s.tunnels {
+			tunnels = append(tunnels, tunnel)
+		}
+		s.mu.RUnlock()
+	}
+	return tunnels
+}
 
-	return len(r.tunnels)
+// Capacity returns the configured limit and how much of it is in use
+func (r *Registry) Capacity() Capacity {
+	c := Capacity{
+		Max:       int(r.maxTunnels),
+		Used:      int(r.entries.Load()),
+		Remaining: -1,
+	}
+	if c.Max > 0 {
+		c.Remaining = max(c.Max-c.Used, 0)
+	}
+	return c
+}
+
+func (r *Registry) Count() int {
+	return int(r.tunnels.Load())
 }
 
 func (r *Registry) IsSubdomainAvailable(subdomain string) bool {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	s := r.shard(subdomain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return r.isAvailableLocked(s, subdomain)
+}
+
+// isAvailableLocked reports whether a subdomain is neither in use nor
+// reserved, dropping the reservation if it has expired. s.mu must be held.
+func (r *Registry) isAvailableLocked(s *registryShard, subdomain string) bool {
+	if _, exists := s.tunnels[subdomain]; exists {
+		return false
+	}
+
+	if res, exists := s.reservations[subdomain]; exists {
+		if time.Now().Before(res.ExpiresAt) {
+			return false
+		}
+		delete(s.reservations, subdomain)
+		r.entries.Add(-1)
+	}
 
-	_, exists := r.tunnels[subdomain]
-	return !exists
+	return true
 }
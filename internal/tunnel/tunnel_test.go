@@ -0,0 +1,680 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestTunnel returns an unregistered tunnel named subdomain
+func newTestTunnel(subdomain string) *Tunnel {
+	t := &Tunnel{ID: subdomain + "-id", CreatedAt: time.Now()}
+	t.SetSubdomain(subdomain)
+	return t
+}
+
+// newReclaimableTunnel returns an unregistered tunnel issued token
+func newReclaimableTunnel(subdomain, token string) *Tunnel {
+	t := newTestTunnel(subdomain)
+	t.TokenHash = HashToken(token)
+	return t
+}
+
+func TestReclaimReservation(t *testing.T) {
+	r := NewRegistry(0)
+	if err := r.Register(newReclaimableTunnel("myapp", "token")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	tun, _ := r.Get("myapp")
+	r.Release(tun, time.Minute)
+
+	if _, ok := r.Get("myapp"); ok {
+		t.Fatal("released tunnel is still live")
+	}
+	if err := r.Register(newTestTunnel("myapp")); err == nil {
+		t.Fatal("another client registered a reserved subdomain")
+	}
+
+	wrong := newTestTunnel("myapp")
+	wrong.ID = ""
+	if _, err := r.Reclaim(wrong, "other-token"); err == nil {
+		t.Fatal("Reclaim succeeded with the wrong token")
+	}
+	otherID := newTestTunnel("myapp")
+	otherID.ID = "other-id"
+	if _, err := r.Reclaim(otherID, "token"); err == nil {
+		t.Fatal("Reclaim succeeded with another tunnel's ID")
+	}
+
+	back := newTestTunnel("myapp")
+	back.ID = ""
+	replaced, err := r.Reclaim(back, "token")
+	if err != nil || replaced != nil {
+		t.Fatalf("Reclaim = %v, %v; want nil, nil", replaced, err)
+	}
+	if back.ID != "myapp-id" {
+		t.Fatalf("reclaimed tunnel ID = %q, want the reserved %q", back.ID, "myapp-id")
+	}
+	if got, ok := r.Get("myapp"); !ok || got != back {
+		t.Fatal("reclaimed tunnel is not registered")
+	}
+	if r.Count() != 1 {
+		t.Fatalf("Count() = %d, want 1", r.Count())
+	}
+}
+
+func TestReclaimExpiredReservation(t *testing.T) {
+	r := NewRegistry(0)
+	if err := r.Register(newReclaimableTunnel("myapp", "token")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	tun, _ := r.Get("myapp")
+	r.Release(tun, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := r.Reclaim(newTestTunnel("myapp"), "token"); err == nil {
+		t.Fatal("Reclaim succeeded after the grace period")
+	}
+	if err := r.Register(newTestTunnel("myapp")); err != nil {
+		t.Fatalf("subdomain is still reserved after the grace period: %v", err)
+	}
+}
+
+func TestReleaseWithoutTokenFreesSubdomain(t *testing.T) {
+	r := NewRegistry(0)
+	tun := newTestTunnel("myapp")
+	if err := r.Register(tun); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	r.Release(tun, time.Minute)
+	if err := r.Register(newTestTunnel("myapp")); err != nil {
+		t.Fatalf("subdomain was reserved for a tunnel without a reconnect token: %v", err)
+	}
+}
+
+func TestKillReturnsTunnel(t *testing.T) {
+	r := NewRegistry(1)
+	tun := newTestTunnel("myapp")
+	r.Register(tun)
+
+	if _, killed := r.Kill("missing"); killed {
+		t.Fatal("Kill of an unknown subdomain reported a removal")
+	}
+	got, killed := r.Kill("myapp")
+	if !killed || got != tun {
+		t.Fatalf("Kill = %v, %v; want the registered tunnel", got, killed)
+	}
+	if _, ok := r.Get("myapp"); ok || r.Capacity().Used != 0 {
+		t.Fatal("killed tunnel still holds its subdomain or slot")
+	}
+	if _, killed := r.Kill("myapp"); killed {
+		t.Fatal("second Kill reported a removal")
+	}
+}
+
+func TestReserveAndDelete(t *testing.T) {
+	r := NewRegistry(2)
+	r.Register(newTestTunnel("live"))
+	res := Reservation{Subdomain: "held", TunnelID: "held-id", TokenHash: HashToken("token"), ExpiresAt: time.Now().Add(time.Minute)}
+
+	if err := r.Reserve(Reservation{Subdomain: "live", ExpiresAt: res.ExpiresAt}); err == nil {
+		t.Fatal("reserved a subdomain with a live tunnel")
+	}
+	if err := r.Reserve(res); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := r.Reserve(res); err == nil {
+		t.Fatal("reserved the same subdomain twice")
+	}
+	if err := r.Reserve(Reservation{Subdomain: "more", ExpiresAt: res.ExpiresAt}); !errors.Is(err, ErrAtCapacity) {
+		t.Fatalf("Reserve at capacity = %v, want ErrAtCapacity", err)
+	}
+	if err := r.Register(newTestTunnel("held")); err == nil {
+		t.Fatal("another client registered a reserved subdomain")
+	}
+
+	if r.DeleteReservation("live") {
+		t.Fatal("DeleteReservation removed a live tunnel")
+	}
+	if !r.DeleteReservation("held") {
+		t.Fatal("DeleteReservation did not find the reservation")
+	}
+	if r.DeleteReservation("held") {
+		t.Fatal("second DeleteReservation reported a removal")
+	}
+	if err := r.Register(newTestTunnel("held")); err != nil {
+		t.Fatalf("Register after the reservation was deleted: %v", err)
+	}
+}
+
+// Subdomains stay known for a while after their tunnel leaves, so a
+// visitor's next handshake still gets a certificate
+func TestKnownSubdomains(t *testing.T) {
+	r := NewRegistry(0)
+	r.Register(newTestTunnel("live"))
+	r.Register(newTestTunnel("leaving"))
+	r.Register(newTestTunnel("old"))
+	r.Reserve(Reservation{Subdomain: "held", ExpiresAt: time.Now().Add(time.Minute)})
+	r.Reserve(Reservation{Subdomain: "expired", ExpiresAt: time.Now().Add(-time.Minute)})
+	r.Unregister("leaving")
+	r.Rename("old", "new")
+
+	for subdomain, known := range map[string]bool{
+		"live":    true,
+		"held":    true,
+		"leaving": true,
+		"old":     true,
+		"new":     true,
+		"expired": false,
+		"random":  false,
+	} {
+		if got := r.Known(subdomain); got != known {
+			t.Errorf("Known(%q) = %t, want %t", subdomain, got, known)
+		}
+	}
+}
+
+func TestRegisterAtCapacity(t *testing.T) {
+	r := NewRegistry(2)
+	for _, name := range []string{"one", "two"} {
+		if err := r.Register(newTestTunnel(name)); err != nil {
+			t.Fatalf("Register(%s) below capacity: %v", name, err)
+		}
+	}
+	if err := r.Register(newTestTunnel("three")); !errors.Is(err, ErrAtCapacity) {
+		t.Fatalf("Register at capacity = %v, want ErrAtCapacity", err)
+	}
+	if c := r.Capacity(); c.Max != 2 || c.Used != 2 || c.Remaining != 0 {
+		t.Fatalf("Capacity() = %+v", c)
+	}
+
+	// Unregistering frees the slot
+	r.Unregister("one")
+	if err := r.Register(newTestTunnel("three")); err != nil {
+		t.Fatalf("Register after a slot was freed: %v", err)
+	}
+}
+
+func TestReservationsCountTowardCapacity(t *testing.T) {
+	r := NewRegistry(1)
+	tun := newReclaimableTunnel("myapp", "token")
+	if err := r.Register(tun); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	r.Release(tun, 20*time.Millisecond)
+
+	if err := r.Register(newTestTunnel("other")); !errors.Is(err, ErrAtCapacity) {
+		t.Fatalf("Register while a reservation holds the last slot = %v, want ErrAtCapacity", err)
+	}
+	if _, err := r.Reclaim(newTestTunnel("myapp"), "token"); err != nil {
+		t.Fatalf("reconnecting client could not reclaim its slot: %v", err)
+	}
+	r.Unregister("myapp")
+
+	// An expired reservation gives its slot up
+	tun = newReclaimableTunnel("myapp", "token")
+	if err := r.Register(tun); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	r.Release(tun, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if err := r.Register(newTestTunnel("other")); err != nil {
+		t.Fatalf("expired reservation still holds its slot: %v", err)
+	}
+}
+
+func TestRegisterWithoutLimit(t *testing.T) {
+	r := NewRegistry(0)
+	for i := 0; i < 100; i++ {
+		if err := r.Register(newTestTunnel(fmt.Sprintf("app%d", i))); err != nil {
+			t.Fatalf("Register without a limit: %v", err)
+		}
+	}
+	if c := r.Capacity(); c.Max != 0 || c.Remaining != -1 {
+		t.Fatalf("Capacity() without a limit = %+v", c)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	old := NewRegistry(0)
+	if err := old.Register(newReclaimableTunnel("live", "live-token")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	released := newReclaimableTunnel("released", "released-token")
+	if err := old.Register(released); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	old.Release(released, time.Minute)
+	if err := old.Register(newTestTunnel("anonymous")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	exported := old.Export(time.Minute)
+	if len(exported) != 2 {
+		t.Fatalf("exported %d reservations, want 2 (tunnels without a token can't be reclaimed)", len(exported))
+	}
+
+	next := NewRegistry(0)
+	if n, dropped := next.Import(exported); n != 2 || dropped != 0 {
+		t.Fatalf("Import = %d, %d dropped, want 2, none dropped", n, dropped)
+	}
+	for _, c := range []struct{ subdomain, token string }{{"live", "live-token"}, {"released", "released-token"}} {
+		if err := next.Register(newTestTunnel(c.subdomain)); err == nil {
+			t.Fatalf("imported reservation for %s did not hold the subdomain", c.subdomain)
+		}
+		back := newTestTunnel(c.subdomain)
+		back.ID = ""
+		if _, err := next.Reclaim(back, c.token); err != nil {
+			t.Fatalf("Reclaim(%s) after import: %v", c.subdomain, err)
+		}
+		if back.ID != c.subdomain+"-id" {
+			t.Fatalf("reclaimed tunnel ID = %q, want %q", back.ID, c.subdomain+"-id")
+		}
+	}
+}
+
+func TestImportSkipsExpiredAndTaken(t *testing.T) {
+	r := NewRegistry(0)
+	if err := r.Register(newTestTunnel("taken")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	n, dropped := r.Import([]Reservation{
+		{Subdomain: "expired", TunnelID: "a", TokenHash: HashToken("a"), ExpiresAt: time.Now().Add(-time.Second)},
+		{Subdomain: "taken", TunnelID: "b", TokenHash: HashToken("b"), ExpiresAt: time.Now().Add(time.Minute)},
+		{Subdomain: "notoken", TunnelID: "c", ExpiresAt: time.Now().Add(time.Minute)},
+		{Subdomain: "fresh", TunnelID: "d", TokenHash: HashToken("d"), ExpiresAt: time.Now().Add(time.Minute)},
+	})
+	if n != 1 || dropped != 0 {
+		t.Fatalf("Import = %d, %d dropped, want 1, none dropped", n, dropped)
+	}
+	if !r.IsSubdomainAvailable("expired") || r.IsSubdomainAvailable("fresh") {
+		t.Fatal("Import kept the wrong reservations")
+	}
+}
+
+// Imported reservations take slots like tunnels do, so an import can't
+// push the registry past MAX_TUNNELS
+func TestImportRespectsMaxTunnels(t *testing.T) {
+	r := NewRegistry(3)
+	if err := r.Register(newTestTunnel("live")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	var reservations []Reservation
+	for _, name := range []string{"a", "b", "c", "d"} {
+		reservations = append(reservations, Reservation{
+			Subdomain: name, TunnelID: name, TokenHash: HashToken(name), ExpiresAt: time.Now().Add(time.Minute),
+		})
+	}
+	imported, dropped := r.Import(reservations)
+	if imported != 2 || dropped != 2 {
+		t.Fatalf("Import = %d, %d dropped, want 2, 2 dropped", imported, dropped)
+	}
+	if r.IsSubdomainAvailable("a") || r.IsSubdomainAvailable("b") || !r.IsSubdomainAvailable("c") {
+		t.Fatal("Import kept the wrong reservations")
+	}
+	if err := r.Register(newTestTunnel("other")); !errors.Is(err, ErrAtCapacity) {
+		t.Fatalf("Register after a full import = %v, want %v", err, ErrAtCapacity)
+	}
+
+	// Expired reservations make room for an import
+	r = NewRegistry(1)
+	if n, _ := r.Import([]Reservation{{Subdomain: "old", TunnelID: "old", TokenHash: HashToken("old"), ExpiresAt: time.Now().Add(10 * time.Millisecond)}}); n != 1 {
+		t.Fatalf("Import = %d, want 1", n)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if imported, dropped := r.Import(reservations[:1]); imported != 1 || dropped != 0 {
+		t.Fatalf("Import over an expired reservation = %d, %d dropped, want 1, none dropped", imported, dropped)
+	}
+}
+
+func TestListAndCountAcrossShards(t *testing.T) {
+	r := NewRegistry(0)
+	const n = 1000
+	used := make(map[uint32]bool)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("app%d", i)
+		used[r.shardIndex(name)] = true
+		if err := r.Register(newTestTunnel(name)); err != nil {
+			t.Fatalf("Register(%s): %v", name, err)
+		}
+	}
+	if len(used) != registryShards {
+		t.Fatalf("%d names landed in %d of %d shards", n, len(used), registryShards)
+	}
+
+	if r.Count() != n {
+		t.Fatalf("Count() = %d, want %d", r.Count(), n)
+	}
+	seen := make(map[string]bool)
+	for _, tun := range r.List() {
+		seen[tun.Subdomain()] = true
+	}
+	if len(seen) != n {
+		t.Fatalf("List() returned %d distinct tunnels, want %d", len(seen), n)
+	}
+
+	for i := 0; i < n; i += 2 {
+		r.Unregister(fmt.Sprintf("app%d", i))
+	}
+	if r.Count() != n/2 || len(r.List()) != n/2 {
+		t.Fatalf("after unregistering half: Count() = %d, len(List()) = %d, want %d", r.Count(), len(r.List()), n/2)
+	}
+}
+
+func TestConcurrentRegistryUse(t *testing.T) {
+	r := NewRegistry(0)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				name := fmt.Sprintf("w%d-app%d", w, i)
+				if err := r.Register(newTestTunnel(name)); err != nil {
+					t.Errorf("Register(%s): %v", name, err)
+					return
+				}
+				if _, ok := r.Get(name); !ok {
+					t.Errorf("Get(%s) missed a registered tunnel", name)
+				}
+				r.List()
+				if i%2 == 0 {
+					r.Unregister(name)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if want := 8 * 100; r.Count() != want || len(r.List()) != want {
+		t.Fatalf("Count() = %d, len(List()) = %d, want %d", r.Count(), len(r.List()), want)
+	}
+}
+
+// BenchmarkRegistryGet measures concurrent lookups in a large registry
+func BenchmarkRegistryGet(b *testing.B) {
+	r := NewRegistry(0)
+	const n = 50000
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("app%d", i)
+		r.Register(newTestTunnel(names[i]))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			r.Get(names[i%n])
+			i++
+		}
+	})
+}
+
+func TestRenameMovesTunnel(t *testing.T) {
+	r := NewRegistry(0)
+	tun := newTestTunnel("old")
+	if err := r.Register(tun); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := r.Register(newTestTunnel("taken")); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	if err := r.Rename("old", "taken"); err == nil {
+		t.Fatal("Rename onto a live tunnel succeeded")
+	}
+	if err := r.Rename("missing", "other"); err == nil {
+		t.Fatal("Rename of a missing tunnel succeeded")
+	}
+
+	if err := r.Rename("old", "new"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if tun.Subdomain() != "new" {
+		t.Fatalf("Subdomain() = %q, want %q", tun.Subdomain(), "new")
+	}
+	if got, ok := r.Get("new"); !ok || got != tun {
+		t.Fatal("tunnel is not registered under its new name")
+	}
+	if _, ok := r.Get("old"); ok {
+		t.Fatal("tunnel is still registered under its old name")
+	}
+	if r.Count() != 2 {
+		t.Fatalf("Count() = %d, want 2", r.Count())
+	}
+}
+
+// Requests read a tunnel's name while its owner renames it; run with -race
+func TestRenameWhileReadingSubdomain(t *testing.T) {
+	r := NewRegistry(0)
+	tun := newTestTunnel("name0")
+	if err := r.Register(tun); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					if tun.Subdomain() == "" {
+						t.Error("Subdomain() is empty during a rename")
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	names := []string{"name0", "name1"}
+	for i := 0; i < 200; i++ {
+		if err := r.Rename(names[i%2], names[(i+1)%2]); err != nil {
+			t.Fatalf("Rename: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestCapacityTracksRegistrations(t *testing.T) {
+	r := NewRegistry(3)
+	check := func(used, remaining int) {
+		t.Helper()
+		if c := r.Capacity(); c != (Capacity{Max: 3, Used: used, Remaining: remaining}) {
+			t.Fatalf("Capacity() = %+v, want %d used and %d remaining of 3", c, used, remaining)
+		}
+	}
+
+	check(0, 3)
+	r.Register(newTestTunnel("one"))
+	tun := newReclaimableTunnel("two", "token")
+	r.Register(tun)
+	check(2, 1)
+
+	// A reservation keeps its slot until the tunnel is reclaimed
+	r.Release(tun, time.Minute)
+	check(2, 1)
+	r.Reclaim(newTestTunnel("two"), "token")
+	check(2, 1)
+
+	r.Unregister("one")
+	r.Unregister("two")
+	check(0, 3)
+}
+
+func TestUnregisterReportsRemoval(t *testing.T) {
+	r := NewRegistry(0)
+	changes := 0
+	r.OnChange(func() { changes++ })
+	r.Register(newTestTunnel("myapp"))
+	changes = 0
+
+	if r.Unregister("missing") {
+		t.Fatal("Unregister of an unknown subdomain reported a removal")
+	}
+	if changes != 0 || r.Count() != 1 || r.Capacity().Used != 1 {
+		t.Fatalf("Unregister of an unknown subdomain changed the registry: %d changes, count %d", changes, r.Count())
+	}
+
+	if !r.Unregister("myapp") {
+		t.Fatal("Unregister of a live tunnel reported no removal")
+	}
+	if changes != 1 || r.Count() != 0 || r.Capacity().Used != 0 {
+		t.Fatalf("after Unregister: %d changes, count %d, used %d", changes, r.Count(), r.Capacity().Used)
+	}
+
+	if r.Unregister("myapp") {
+		t.Fatal("second Unregister reported a removal")
+	}
+	if changes != 1 || r.Capacity().Used != 0 {
+		t.Fatalf("second Unregister changed the registry: %d changes, used %d", changes, r.Capacity().Used)
+	}
+}
+
+func TestReapIdle(t *testing.T) {
+	r := NewRegistry(0)
+	idle := newTestTunnel("idle")
+	idle.CreatedAt = time.Now().Add(-time.Hour)
+	active := newTestTunnel("active")
+	active.CreatedAt = time.Now().Add(-time.Hour)
+	active.Touch()
+	busy := newTestTunnel("busy")
+	busy.CreatedAt = time.Now().Add(-time.Hour)
+	busy.BeginRequest()
+	fresh := newTestTunnel("fresh")
+	for _, tun := range []*Tunnel{idle, active, busy, fresh} {
+		if err := r.Register(tun); err != nil {
+			t.Fatalf("Register(%s): %v", tun.Subdomain(), err)
+		}
+	}
+
+	reaped := r.ReapIdle(time.Minute)
+	if len(reaped) != 1 || reaped[0] != idle {
+		t.Fatalf("ReapIdle reaped %d tunnels, want only the idle one", len(reaped))
+	}
+	if _, ok := r.Get("idle"); ok {
+		t.Fatal("reaped tunnel is still registered")
+	}
+	if r.Count() != 3 {
+		t.Fatalf("Count() = %d, want 3", r.Count())
+	}
+
+	// Once its request ends, the busy tunnel is idle too
+	busy.EndRequest()
+	if reaped := r.ReapIdle(time.Minute); len(reaped) != 1 || reaped[0] != busy {
+		t.Fatalf("ReapIdle reaped %d tunnels, want the finished busy one", len(reaped))
+	}
+}
+
+func TestRegisterInMaintenance(t *testing.T) {
+	r := NewRegistry(0)
+	if err := r.Register(newTestTunnel("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	r.SetMaintenance(true)
+	if !r.InMaintenance() {
+		t.Fatal("maintenance mode not reported after SetMaintenance(true)")
+	}
+	if err := r.Register(newTestTunnel("during")); !errors.Is(err, ErrMaintenance) {
+		t.Fatalf("Register in maintenance = %v, want ErrMaintenance", err)
+	}
+	if _, ok := r.Get("before"); !ok {
+		t.Fatal("existing tunnel dropped by maintenance mode")
+	}
+
+	r.SetMaintenance(false)
+	if err := r.Register(newTestTunnel("during")); err != nil {
+		t.Fatalf("Register after maintenance = %v", err)
+	}
+}
+
+func TestIdleWaitsForInFlightRequests(t *testing.T) {
+	tun := newTestTunnel("myapp")
+	select {
+	case <-tun.Idle():
+	default:
+		t.Fatal("Idle is not closed with no requests in flight")
+	}
+
+	tun.BeginRequest()
+	tun.BeginRequest()
+	idle := tun.Idle()
+	tun.EndRequest()
+	select {
+	case <-idle:
+		t.Fatal("Idle closed with a request still in flight")
+	default:
+	}
+	tun.EndRequest()
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatal("Idle did not close after the last request ended")
+	}
+}
+
+// Release must find a tunnel renamed concurrently, or it stays
+// registered after its connection is gone
+func TestReleaseDuringRename(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		r := NewRegistry(0)
+		tun := newTestTunnel("old")
+		if err := r.Register(tun); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Rename("old", "new")
+		}()
+		r.Release(tun, 0)
+		wg.Wait()
+
+		if r.Count() != 0 {
+			t.Fatalf("%s is still registered after Release", tun.Subdomain())
+		}
+	}
+}
+
+// A client may reconnect before the server notices its old connection
+// dropped; the live tunnel is handed over
+func TestReclaimLiveTunnel(t *testing.T) {
+	r := NewRegistry(0)
+	old := newReclaimableTunnel("myapp", "token")
+	if err := r.Register(old); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	if _, err := r.Reclaim(newTestTunnel("myapp"), "wrong"); err == nil {
+		t.Fatal("Reclaim of a live tunnel succeeded with the wrong token")
+	}
+
+	back := newTestTunnel("myapp")
+	replaced, err := r.Reclaim(back, "token")
+	if err != nil || replaced != old {
+		t.Fatalf("Reclaim = %v, %v; want the old tunnel", replaced, err)
+	}
+	if got, _ := r.Get("myapp"); got != back {
+		t.Fatal("the new tunnel did not take over the subdomain")
+	}
+
+	// The old connection's Release must not drop the new tunnel
+	r.Release(old, time.Minute)
+	if got, _ := r.Get("myapp"); got != back {
+		t.Fatal("releasing the replaced tunnel unregistered its successor")
+	}
+}
@@ -0,0 +1,372 @@
+package websocket
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/proxy"
+	"github.com/ahmadrosid/tunnel/internal/subdomain"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"github.com/google/uuid"
+)
+
+// requireAdmin wraps a handler so it only runs for requests carrying the
+// configured admin token. The admin API is disabled when no token is set.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.AdminToken == "" {
+			http.Error(w, "Admin API is disabled", http.StatusForbidden)
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// adminActor identifies the caller of an admin request in audit entries:
+// the operator named in X-Admin-User, or "admin", and the source address
+func (s *Server) adminActor(r *http.Request) string {
+	user := r.Header.Get("X-Admin-User")
+	if user == "" {
+		user = "admin"
+	}
+	return fmt.Sprintf("%s (%s)", user, proxy.RealClientIP(r, s.config.TrustedHops))
+}
+
+// handleAudit returns the audit log of API actions, oldest first
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, s.audit.Entries())
+}
+
+// handleCapacity returns how many tunnel slots are used and remaining
+func (s *Server) handleCapacity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, s.registry.Capacity())
+}
+
+// handleRegistryExport returns reservations for all tunnels so another
+// instance can import them during a migration
+func (s *Server) handleRegistryExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reservations := s.registry.Export(s.config.ReconnectGrace)
+	s.audit.Record(s.adminActor(r), "export", "registry", nil)
+	writeJSON(w, reservations)
+}
+
+// handleRegistryImport adds reservations exported by another instance
+func (s *Server) handleRegistryImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reservations []tunnel.Reservation
+	if err := json.NewDecoder(r.Body).Decode(&reservations); err != nil {
+		s.audit.Record(s.adminActor(r), "import", "registry", err)
+		http.Error(w, "Invalid reservations: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	imported, dropped := s.registry.Import(reservations)
+	s.audit.Record(s.adminActor(r), "import", "registry", nil)
+	log.Printf("Imported %d of %d tunnel reservations, %d dropped at MAX_TUNNELS", imported, len(reservations), dropped)
+	writeJSON(w, map[string]int{"imported": imported, "dropped": dropped})
+}
+
+// handleKill closes the tunnel on the subdomain in the path. Its client is
+// told why, and requests in flight get CLOSE_DRAIN_TIMEOUT to complete.
+func (s *Server) handleKill(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := subdomain.Normalize(r.PathValue("subdomain"))
+	tun, exists := s.registry.Kill(name)
+	if !exists {
+		s.audit.Record(s.adminActor(r), "kill", name, errTunnelNotFound)
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+
+	s.audit.Record(s.adminActor(r), "kill", name, nil)
+	closeTunnel(tun, s.config.CloseDrainTimeout, ErrorCodeKilled, "tunnel closed by an administrator")
+	writeJSON(w, map[string]string{"killed": name})
+}
+
+// defaultReservationTTL is how long an admin reservation lasts unless the
+// request says otherwise
+const defaultReservationTTL = time.Hour
+
+// reservationResponse is returned for a new admin reservation. The client
+// claims the subdomain by registering with the reconnect token.
+type reservationResponse struct {
+	Subdomain      string    `json:"subdomain"`
+	TunnelID       string    `json:"tunnel_id"`
+	ReconnectToken string    `json:"reconnect_token"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// handleReserve holds a subdomain for a client that hasn't connected yet,
+// with a body of {"subdomain": "myapp", "ttl": "24h"}
+func (s *Server) handleReserve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Subdomain string `json:"subdomain"`
+		TTL       string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid reservation: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := subdomain.Normalize(req.Subdomain)
+	ttl := defaultReservationTTL
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			http.Error(w, "Invalid reservation: ttl must be a positive duration such as \"24h\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := subdomain.Validate(name, s.config.MaxSubdomainLen); err != nil {
+		s.audit.Record(s.adminActor(r), "reserve", name, err)
+		http.Error(w, "Invalid reservation: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := generateReconnectToken()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	res := tunnel.Reservation{
+		Subdomain: name,
+		TunnelID:  uuid.New().String(),
+		TokenHash: tunnel.HashToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := s.registry.Reserve(res); err != nil {
+		s.audit.Record(s.adminActor(r), "reserve", name, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	s.audit.Record(s.adminActor(r), "reserve", name, nil)
+	log.Printf("Reserved %s until %s via admin API", name, res.ExpiresAt.Format(time.RFC3339))
+	writeJSON(w, reservationResponse{
+		Subdomain:      name,
+		TunnelID:       res.TunnelID,
+		ReconnectToken: token,
+		ExpiresAt:      res.ExpiresAt,
+	})
+}
+
+// handleDeleteReservation frees the reserved subdomain in the path
+func (s *Server) handleDeleteReservation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := subdomain.Normalize(r.PathValue("subdomain"))
+	if !s.registry.DeleteReservation(name) {
+		s.audit.Record(s.adminActor(r), "delete", name, errReservationNotFound)
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+
+	s.audit.Record(s.adminActor(r), "delete", name, nil)
+	writeJSON(w, map[string]string{"deleted": name})
+}
+
+// Results of admin actions on subdomains that have nothing to act on
+var (
+	errTunnelNotFound      = errors.New("no tunnel on this subdomain")
+	errReservationNotFound = errors.New("no reservation for this subdomain")
+)
+
+// tunnelInfo describes a live tunnel in the admin API
+type tunnelInfo struct {
+	TunnelID     string    `json:"tunnel_id"`
+	Subdomain    string    `json:"subdomain"`
+	LocalAddr    string    `json:"local_addr"`
+	CreatedAt    time.Time `json:"created_at"`
+	InFlight     int64     `json:"in_flight"`
+	Paused       bool      `json:"paused"`
+	Capabilities []string  `json:"capabilities"`
+	Breaker      string    `json:"breaker,omitempty"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+}
+
+// sortTunnels orders a registry snapshot by key: "created" (oldest first,
+// the default) or "subdomain". Ties are broken by subdomain so the order
+// is stable across calls.
+func sortTunnels(tunnels []*tunnel.Tunnel, key string) error {
+	switch key {
+	case "", "created":
+		sort.Slice(tunnels, func(i, j int) bool {
+			if !tunnels[i].CreatedAt.Equal(tunnels[j].CreatedAt) {
+				return tunnels[i].CreatedAt.Before(tunnels[j].CreatedAt)
+			}
+			return tunnels[i].Subdomain() < tunnels[j].Subdomain()
+		})
+	case "subdomain":
+		sort.Slice(tunnels, func(i, j int) bool {
+			return tunnels[i].Subdomain() < tunnels[j].Subdomain()
+		})
+	default:
+		return fmt.Errorf("invalid sort key %q, expected created or subdomain", key)
+	}
+	return nil
+}
+
+// handleTunnels lists the live tunnels, ordered by the sort query parameter
+func (s *Server) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snapshot := s.registry.List()
+	if err := sortTunnels(snapshot, r.URL.Query().Get("sort")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tunnels := make([]tunnelInfo, 0, len(snapshot))
+	for _, tun := range snapshot {
+		info := tunnelInfo{
+			TunnelID:     tun.ID,
+			Subdomain:    tun.Subdomain(),
+			LocalAddr:    tun.LocalAddr,
+			CreatedAt:    tun.CreatedAt,
+			InFlight:     tun.InFlight(),
+			Paused:       tun.IsPaused(),
+			Capabilities: tun.Caps,
+			BytesIn:      atomic.LoadInt64(&tun.BytesIn),
+			BytesOut:     atomic.LoadInt64(&tun.BytesOut),
+		}
+		if tun.Breaker != nil {
+			info.Breaker = tun.Breaker.State()
+		}
+		tunnels = append(tunnels, info)
+	}
+
+	writeJSON(w, tunnels)
+}
+
+// sdTargetGroup is a target group in Prometheus http_sd format
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// handleServiceDiscovery lists the public address of every tunnel as a
+// Prometheus http_sd target so the services behind them can be scraped
+func (s *Server) handleServiceDiscovery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scheme, port, defaultPort := "http", s.config.HTTPPort, 80
+	if s.config.EnableHTTPS {
+		scheme, port, defaultPort = "https", s.config.HTTPSPort, 443
+	}
+
+	groups := make([]sdTargetGroup, 0)
+	for _, tun := range s.registry.List() {
+		target := tun.Subdomain() + "." + s.config.Domain
+		if port != defaultPort {
+			target = fmt.Sprintf("%s:%d", target, port)
+		}
+
+		groups = append(groups, sdTargetGroup{
+			Targets: []string{target},
+			Labels: map[string]string{
+				"__scheme__": scheme,
+				"subdomain":  tun.Subdomain(),
+				"tunnel_id":  tun.ID,
+			},
+		})
+	}
+
+	writeJSON(w, groups)
+}
+
+// handleMaintenance reports maintenance mode on GET and changes it on POST
+// with a body of {"enabled": true|false}
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			http.Error(w, `Expected {"enabled": true|false}`, http.StatusBadRequest)
+			return
+		}
+
+		s.registry.SetMaintenance(*req.Enabled)
+		s.audit.Record(s.adminActor(r), "maintenance", strconv.FormatBool(*req.Enabled), nil)
+		log.Printf("Maintenance mode set to %t via admin API", *req.Enabled)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, map[string]bool{"enabled": s.registry.InMaintenance()})
+}
+
+// handleMetrics exports server metrics in the Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.metrics.ServeHTTP(w, r)
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
@@ -0,0 +1,581 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/audit"
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// adminConfig returns a test configuration with the admin API enabled
+func adminConfig() *config.Config {
+	cfg := testkit.Config()
+	cfg.AdminToken = testAdminToken
+	return cfg
+}
+
+func TestAdminAPIRequiresToken(t *testing.T) {
+	disabled := newHarness(t, testkit.Config())
+	if status := disabled.admin(http.MethodGet, "/api/audit", nil, nil); status != http.StatusForbidden {
+		t.Fatalf("status without ADMIN_TOKEN = %d, want 403", status)
+	}
+
+	h := newHarness(t, adminConfig())
+	if status := h.adminAs("wrong", http.MethodGet, "/api/audit", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("status with a wrong token = %d, want 401", status)
+	}
+	if status := h.admin(http.MethodGet, "/api/audit", nil, nil); status != http.StatusOK {
+		t.Fatalf("status with the token = %d, want 200", status)
+	}
+
+	// The token only counts with the Bearer scheme
+	req, err := http.NewRequest(http.MethodGet, "http://"+testkit.Domain+"/api/audit", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", testAdminToken)
+	if status := h.adminDo(req, nil); status != http.StatusUnauthorized {
+		t.Fatalf("status with a bare token = %d, want 401", status)
+	}
+}
+
+func TestAuditLogRecordsClientActions(t *testing.T) {
+	h := newHarness(t, adminConfig())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{CapabilityPause}})
+	other := h.connect(nil)
+	other.send(MessageTypeRegister, RegisterRequest{Subdomain: "myapp", LocalPort: 3000})
+	other.expectError()
+	client.send(MessageTypePause, nil)
+	client.expect(MessageTypeSuccess)
+	client.send(MessageTypeUnregister, nil)
+	client.expect(MessageTypeSuccess)
+
+	var entries []audit.Entry
+	if status := h.admin(http.MethodGet, "/api/audit", nil, &entries); status != http.StatusOK {
+		t.Fatalf("GET /api/audit = %d", status)
+	}
+
+	want := []struct{ action, target, result string }{
+		{"register", "myapp", "ok"},
+		{"register", "", ""},
+		{"pause", "myapp", "ok"},
+		{"unregister", "myapp", "ok"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d audit entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Action != w.action || e.Target != w.target || e.Actor == "" {
+			t.Errorf("entry %d = %+v, want %s of %s", i, e, w.action, w.target)
+		}
+		if w.result != "" && e.Result != w.result {
+			t.Errorf("entry %d result = %q, want %q", i, e.Result, w.result)
+		}
+		if w.result == "" && e.Result == "ok" {
+			t.Errorf("entry %d: failed %s recorded as ok", i, e.Action)
+		}
+	}
+}
+
+// adminAsUser sends an admin request naming the operator in X-Admin-User
+func (h *harness) adminAsUser(user, method, path string, body io.Reader, out interface{}) int {
+	h.t.Helper()
+
+	req, err := http.NewRequest(method, "http://"+testkit.Domain+path, body)
+	if err != nil {
+		h.t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("X-Admin-User", user)
+	return h.adminDo(req, out)
+}
+
+func TestAuditLogRecordsAdminActions(t *testing.T) {
+	h := newHarness(t, adminConfig())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+
+	for _, step := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/api/reservations", `{"subdomain": "held", "ttl": "24h"}`, http.StatusOK},
+		{http.MethodPost, "/api/reservations", `{"subdomain": "myapp"}`, http.StatusConflict},
+		{http.MethodDelete, "/api/tunnels/myapp", "", http.StatusOK},
+		{http.MethodDelete, "/api/tunnels/missing", "", http.StatusNotFound},
+		{http.MethodDelete, "/api/reservations/held", "", http.StatusOK},
+		{http.MethodDelete, "/api/reservations/held", "", http.StatusNotFound},
+		{http.MethodPost, "/api/maintenance", `{"enabled": false}`, http.StatusOK},
+		{http.MethodGet, tunnel.ExportPath, "", http.StatusOK},
+		{http.MethodPost, "/api/registry/import", `[]`, http.StatusOK},
+	} {
+		if status := h.adminAsUser("alice", step.method, step.path, strings.NewReader(step.body), nil); status != step.status {
+			t.Fatalf("%s %s = %d, want %d", step.method, step.path, status, step.status)
+		}
+	}
+	h.admin(http.MethodPost, "/api/reservations", strings.NewReader(`{"subdomain": "anonymous"}`), nil)
+
+	var entries []audit.Entry
+	if status := h.admin(http.MethodGet, "/api/audit", nil, &entries); status != http.StatusOK {
+		t.Fatalf("GET /api/audit = %d", status)
+	}
+
+	want := []struct{ actor, action, target, result string }{
+		{"", "register", "myapp", "ok"},
+		{"alice (127.0.0.1)", "reserve", "held", "ok"},
+		{"alice (127.0.0.1)", "reserve", "myapp", ""},
+		{"alice (127.0.0.1)", "kill", "myapp", "ok"},
+		{"alice (127.0.0.1)", "kill", "missing", ""},
+		{"alice (127.0.0.1)", "delete", "held", "ok"},
+		{"alice (127.0.0.1)", "delete", "held", ""},
+		{"alice (127.0.0.1)", "maintenance", "false", "ok"},
+		{"alice (127.0.0.1)", "export", "registry", "ok"},
+		{"alice (127.0.0.1)", "import", "registry", "ok"},
+		{"admin (127.0.0.1)", "reserve", "anonymous", "ok"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d audit entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Action != w.action || e.Target != w.target || (w.actor != "" && e.Actor != w.actor) {
+			t.Errorf("entry %d = %+v, want %s of %s by %s", i, e, w.action, w.target, w.actor)
+		}
+		if w.result != "" && e.Result != w.result {
+			t.Errorf("entry %d result = %q, want %q", i, e.Result, w.result)
+		}
+		if w.result == "" && e.Result == "ok" {
+			t.Errorf("entry %d: failed %s recorded as ok", i, e.Action)
+		}
+	}
+
+	// The killed tunnel's client is told why
+	if msg := client.expectError(); msg.Code != ErrorCodeKilled {
+		t.Fatalf("killed client got code %q (%s), want %q", msg.Code, msg.Error, ErrorCodeKilled)
+	}
+	if _, exists := h.registry.Get("myapp"); exists {
+		t.Fatal("killed tunnel is still registered")
+	}
+}
+
+func TestReservationIsClaimedWithItsToken(t *testing.T) {
+	h := newHarness(t, adminConfig())
+
+	var res reservationResponse
+	if status := h.admin(http.MethodPost, "/api/reservations", strings.NewReader(`{"subdomain": "MyApp"}`), &res); status != http.StatusOK {
+		t.Fatalf("POST /api/reservations = %d", status)
+	}
+	if res.Subdomain != "myapp" || res.ReconnectToken == "" || res.TunnelID == "" {
+		t.Fatalf("reservation = %+v", res)
+	}
+	if until := time.Until(res.ExpiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Fatalf("reservation expires in %v, want the default of an hour", until)
+	}
+
+	other := h.connect(nil)
+	other.send(MessageTypeRegister, RegisterRequest{Subdomain: "myapp", LocalPort: 3000})
+	other.expectError()
+
+	owner := h.connect(nil)
+	got := owner.register(RegisterRequest{Subdomain: "myapp", ReconnectToken: res.ReconnectToken})
+	if got.TunnelID != res.TunnelID {
+		t.Fatalf("claimed tunnel ID = %s, want %s", got.TunnelID, res.TunnelID)
+	}
+
+	for _, body := range []string{`{"subdomain": "www"}`, `{"subdomain": "x", "ttl": "soon"}`, `{"subdomain": "x", "ttl": "-1h"}`, `nope`} {
+		if status := h.admin(http.MethodPost, "/api/reservations", strings.NewReader(body), nil); status != http.StatusBadRequest {
+			t.Errorf("POST /api/reservations %s = %d, want 400", body, status)
+		}
+	}
+}
+
+func TestRegistryMigration(t *testing.T) {
+	old := newHarness(t, adminConfig())
+	client := old.connect(nil)
+	prev := client.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{CapabilityReconnect}})
+
+	var reservations []tunnel.Reservation
+	if status := old.admin(http.MethodGet, tunnel.ExportPath, nil, &reservations); status != http.StatusOK {
+		t.Fatalf("GET %s = %d", tunnel.ExportPath, status)
+	}
+	body, err := json.Marshal(reservations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := newHarness(t, adminConfig())
+	var result struct{ Imported int }
+	if status := next.admin(http.MethodPost, "/api/registry/import", bytes.NewReader(body), &result); status != http.StatusOK {
+		t.Fatalf("POST /api/registry/import = %d", status)
+	}
+	if result.Imported != 1 {
+		t.Fatalf("imported %d reservations, want 1", result.Imported)
+	}
+
+	// The subdomain is held for its owner on the new instance
+	other := next.connect(nil)
+	other.send(MessageTypeRegister, RegisterRequest{Subdomain: "myapp", LocalPort: 3000})
+	other.expectError()
+
+	moved := next.connect(nil)
+	msg := moved.reconnect(prev)
+	if msg.Type != MessageTypeSuccess {
+		t.Fatalf("reconnect to the new instance = %s (%s), want success", msg.Type, msg.Error)
+	}
+	if res := moved.decodeResponse(msg); res.TunnelID != prev.TunnelID {
+		t.Fatalf("tunnel ID after migration = %s, want %s", res.TunnelID, prev.TunnelID)
+	}
+}
+
+func TestRegistryImportReportsDropped(t *testing.T) {
+	cfg := adminConfig()
+	cfg.MaxTunnels = 1
+	h := newHarness(t, cfg)
+
+	expires := time.Now().Add(time.Minute)
+	body, err := json.Marshal([]tunnel.Reservation{
+		{Subdomain: "first", TunnelID: "a", TokenHash: tunnel.HashToken("a"), ExpiresAt: expires},
+		{Subdomain: "second", TunnelID: "b", TokenHash: tunnel.HashToken("b"), ExpiresAt: expires},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct{ Imported, Dropped int }
+	if status := h.admin(http.MethodPost, "/api/registry/import", bytes.NewReader(body), &result); status != http.StatusOK {
+		t.Fatalf("POST /api/registry/import = %d", status)
+	}
+	if result.Imported != 1 || result.Dropped != 1 {
+		t.Fatalf("imported %d and dropped %d reservations, want 1 and 1", result.Imported, result.Dropped)
+	}
+}
+
+func TestRegistryImportRejectsInvalidBody(t *testing.T) {
+	h := newHarness(t, adminConfig())
+	if status := h.admin(http.MethodPost, "/api/registry/import", strings.NewReader("not json"), nil); status != http.StatusBadRequest {
+		t.Fatalf("import of an invalid body = %d, want 400", status)
+	}
+}
+
+func TestServiceDiscoveryTargets(t *testing.T) {
+	cfg := adminConfig()
+	cfg.HTTPPort = 8000
+	h := newHarness(t, cfg)
+
+	// An empty registry is an empty list, not null
+	var raw json.RawMessage
+	if status := h.admin(http.MethodGet, "/api/sd", nil, &raw); status != http.StatusOK {
+		t.Fatalf("GET /api/sd = %d", status)
+	}
+	if string(raw) != "[]" {
+		t.Fatalf("targets without tunnels = %s, want []", raw)
+	}
+
+	res := h.connect(nil).register(RegisterRequest{Subdomain: "myapp"})
+
+	var groups []map[string]interface{}
+	h.admin(http.MethodGet, "/api/sd", nil, &groups)
+	if len(groups) != 1 {
+		t.Fatalf("got %d target groups, want 1", len(groups))
+	}
+	if len(groups[0]) != 2 {
+		t.Fatalf("target group has keys %v, want only targets and labels", groups[0])
+	}
+	targets, ok := groups[0]["targets"].([]interface{})
+	if !ok || len(targets) != 1 || targets[0] != "myapp."+testkit.Domain+":8000" {
+		t.Fatalf("targets = %v", groups[0]["targets"])
+	}
+	labels, ok := groups[0]["labels"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("labels = %v", groups[0]["labels"])
+	}
+	want := map[string]string{"__scheme__": "http", "subdomain": "myapp", "tunnel_id": res.TunnelID}
+	if len(labels) != len(want) {
+		t.Fatalf("labels = %v, want %v", labels, want)
+	}
+	for k, v := range want {
+		if labels[k] != v {
+			t.Fatalf("label %s = %v, want %s", k, labels[k], v)
+		}
+	}
+}
+
+func TestCapacityReporting(t *testing.T) {
+	cfg := adminConfig()
+	cfg.MaxTunnels = 5
+	h := newHarness(t, cfg)
+
+	first := h.connect(nil).register(RegisterRequest{Subdomain: "one"})
+	if c := first.Capacity; c == nil || *c != (tunnel.Capacity{Max: 5, Used: 1, Remaining: 4}) {
+		t.Fatalf("capacity in the first registration = %+v", c)
+	}
+	second := h.connect(nil).register(RegisterRequest{Subdomain: "two"})
+	if c := second.Capacity; c == nil || c.Used != 2 || c.Remaining != 3 {
+		t.Fatalf("capacity in the second registration = %+v", c)
+	}
+
+	var capacity tunnel.Capacity
+	if status := h.admin(http.MethodGet, "/api/capacity", nil, &capacity); status != http.StatusOK {
+		t.Fatalf("GET /api/capacity = %d", status)
+	}
+	if capacity != (tunnel.Capacity{Max: 5, Used: 2, Remaining: 3}) {
+		t.Fatalf("GET /api/capacity = %+v", capacity)
+	}
+}
+
+func TestTunnelListing(t *testing.T) {
+	h := newHarness(t, adminConfig())
+	res := h.connect(nil).register(RegisterRequest{Subdomain: "one", LocalAddr: "localhost:8080"})
+	paused := h.connect(nil)
+	paused.register(RegisterRequest{Subdomain: "two", Capabilities: []string{CapabilityPause}})
+	paused.send(MessageTypePause, nil)
+	paused.expect(MessageTypeSuccess)
+
+	if status := h.adminAs("wrong", http.MethodGet, "/admin/tunnels", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("GET /admin/tunnels with a wrong token = %d, want 401", status)
+	}
+
+	var tunnels []tunnelInfo
+	if status := h.admin(http.MethodGet, "/admin/tunnels", nil, &tunnels); status != http.StatusOK {
+		t.Fatalf("GET /admin/tunnels = %d", status)
+	}
+	listed := make(map[string]tunnelInfo)
+	for _, info := range tunnels {
+		listed[info.Subdomain] = info
+	}
+	if len(tunnels) != 2 || len(listed) != 2 {
+		t.Fatalf("listed %+v, want one and two", tunnels)
+	}
+	if one := listed["one"]; one.TunnelID != res.TunnelID || one.LocalAddr != "localhost:8080" || one.Paused || one.CreatedAt.IsZero() {
+		t.Fatalf("one = %+v", one)
+	}
+	if two := listed["two"]; !two.Paused || len(two.Capabilities) != 1 || two.Capabilities[0] != CapabilityPause {
+		t.Fatalf("two = %+v, want it paused with the pause capability", two)
+	}
+}
+
+func TestSortTunnels(t *testing.T) {
+	base := time.Now()
+	newTunnel := func(name string, age time.Duration) *tunnel.Tunnel {
+		tun := &tunnel.Tunnel{ID: name, CreatedAt: base.Add(-age)}
+		tun.SetSubdomain(name)
+		return tun
+	}
+	names := func(tunnels []*tunnel.Tunnel) string {
+		var out []string
+		for _, tun := range tunnels {
+			out = append(out, tun.Subdomain())
+		}
+		return strings.Join(out, ",")
+	}
+
+	for key, want := range map[string]string{
+		"":          "old,tie-a,tie-b,new",
+		"created":   "old,tie-a,tie-b,new",
+		"subdomain": "new,old,tie-a,tie-b",
+	} {
+		// Every starting order gives the same result
+		for _, start := range [][]string{{"new", "tie-b", "old", "tie-a"}, {"tie-a", "tie-b", "new", "old"}} {
+			ages := map[string]time.Duration{"old": time.Hour, "tie-a": time.Minute, "tie-b": time.Minute, "new": 0}
+			var tunnels []*tunnel.Tunnel
+			for _, name := range start {
+				tunnels = append(tunnels, newTunnel(name, ages[name]))
+			}
+			if err := sortTunnels(tunnels, key); err != nil {
+				t.Fatalf("sortTunnels(%q): %v", key, err)
+			}
+			if got := names(tunnels); got != want {
+				t.Errorf("sortTunnels(%v, %q) = %s, want %s", start, key, got, want)
+			}
+		}
+	}
+
+	if err := sortTunnels(nil, "size"); err == nil {
+		t.Fatal("sortTunnels accepted an unknown key")
+	}
+}
+
+func TestTunnelListingOrder(t *testing.T) {
+	h := newHarness(t, adminConfig())
+	for _, name := range []string{"bravo", "charlie", "alpha"} {
+		h.connect(nil).register(RegisterRequest{Subdomain: name})
+	}
+
+	for query, want := range map[string]string{
+		"":                "bravo,charlie,alpha",
+		"?sort=created":   "bravo,charlie,alpha",
+		"?sort=subdomain": "alpha,bravo,charlie",
+	} {
+		var tunnels []tunnelInfo
+		if status := h.admin(http.MethodGet, "/admin/tunnels"+query, nil, &tunnels); status != http.StatusOK {
+			t.Fatalf("GET /admin/tunnels%s = %d", query, status)
+		}
+		var got []string
+		for _, info := range tunnels {
+			got = append(got, info.Subdomain)
+		}
+		if strings.Join(got, ",") != want {
+			t.Errorf("GET /admin/tunnels%s listed %v, want %s", query, got, want)
+		}
+	}
+
+	if status := h.admin(http.MethodGet, "/admin/tunnels?sort=size", nil, nil); status != http.StatusBadRequest {
+		t.Fatalf("unknown sort key = %d, want 400", status)
+	}
+}
+
+func TestTunnelListingCountsTraffic(t *testing.T) {
+	h := newHarness(t, adminConfig())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+	client.serve(echoHandler, false)
+
+	body := testkit.ReadBody(t, h.get("myapp", "/hello"))
+
+	var tunnels []tunnelInfo
+	if status := h.admin(http.MethodGet, "/admin/tunnels", nil, &tunnels); status != http.StatusOK {
+		t.Fatalf("GET /admin/tunnels = %d", status)
+	}
+	if len(tunnels) != 1 {
+		t.Fatalf("listed %+v, want myapp", tunnels)
+	}
+	// The counters include the request and response heads
+	if info := tunnels[0]; info.BytesIn < int64(len("GET /hello HTTP/1.1\r\n")) || info.BytesOut <= int64(len(body)) {
+		t.Fatalf("myapp traffic = %d bytes in, %d bytes out after a %d byte response", info.BytesIn, info.BytesOut, len(body))
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	h := newHarness(t, adminConfig())
+	h.connect(nil).register(RegisterRequest{Subdomain: "one"})
+	h.connect(nil).register(RegisterRequest{Subdomain: "two"})
+	h.registry.SetMaintenance(true)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+testkit.Domain+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	client := &http.Client{Timeout: testkit.Timeout, Transport: &http.Transport{DialContext: h.control.DialContext}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("GET /metrics = %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		"# TYPE tunnel_tunnels_created_total counter",
+		"# TYPE tunnel_control_connections gauge",
+		"tunnel_tunnels_active 2",
+		"tunnel_maintenance 1",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("metrics are missing %q:\n%s", line, body)
+		}
+	}
+
+	if status := h.admin(http.MethodPost, "/metrics", nil, nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /metrics = %d, want 405", status)
+	}
+	if status := h.adminAs("wrong", http.MethodGet, "/metrics", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("GET /metrics with a wrong token = %d, want 401", status)
+	}
+}
+
+// stubCerts stands in for the certificate manager of a combined server
+type stubCerts struct{}
+
+func (stubCerts) GetTLSConfig() *tls.Config             { return &tls.Config{} }
+func (stubCerts) GetTLSConfigForHijacking() *tls.Config { return &tls.Config{} }
+func (stubCerts) HTTPHandler() func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler { return h }
+}
+
+// The combined server shares the admin routes, /metrics included
+func TestCombinedServerMetrics(t *testing.T) {
+	cs := NewCombinedServer(adminConfig(), tunnel.NewRegistry(0), stubCerts{})
+
+	req := httptest.NewRequest(http.MethodGet, "https://"+testkit.Domain+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	rec := httptest.NewRecorder()
+	cs.server.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "tunnel_tunnels_active 0\n") {
+		t.Fatalf("GET /metrics on the combined server = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	h := newHarness(t, adminConfig())
+	serving := h.connect(nil)
+	serving.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{CapabilityMux}})
+	serving.serve(echoHandler, true)
+	reconnecting := h.connect(nil)
+	prev := reconnecting.register(RegisterRequest{Subdomain: "other", Capabilities: []string{CapabilityReconnect}})
+
+	var state struct{ Enabled bool }
+	if status := h.admin(http.MethodPost, "/api/maintenance", strings.NewReader(`{"enabled": true}`), &state); status != http.StatusOK || !state.Enabled {
+		t.Fatalf("POST /api/maintenance = %d %+v, want enabled", status, state)
+	}
+	if status := h.admin(http.MethodGet, "/api/maintenance", nil, &state); status != http.StatusOK || !state.Enabled {
+		t.Fatalf("GET /api/maintenance = %d %+v, want enabled", status, state)
+	}
+	var health healthResponse
+	if h.admin(http.MethodGet, "/health", nil, &health); health.Status != "maintenance" {
+		t.Fatalf("health status = %q, want maintenance", health.Status)
+	}
+
+	// New registrations are refused
+	client := h.connect(nil)
+	client.send(MessageTypeRegister, RegisterRequest{Subdomain: "newapp", LocalPort: 3000})
+	if msg := client.expectError(); msg.Code != ErrorCodeMaintenance || msg.Error != tunnel.ErrMaintenance.Error() {
+		t.Fatalf("register in maintenance = %q (%s), want %q", msg.Code, msg.Error, ErrorCodeMaintenance)
+	}
+
+	// Existing tunnels keep serving
+	for i := 0; i < 3; i++ {
+		if resp := h.get("myapp", "/"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d in maintenance: status = %d, want 200", i, resp.StatusCode)
+		}
+	}
+
+	// Reconnecting clients may still reclaim their tunnel
+	reconnecting.close()
+	testkit.WaitFor(t, "tunnel to be released", func() bool {
+		_, ok := h.registry.Get("other")
+		return !ok
+	})
+	if msg := h.connect(nil).reconnect(prev); msg.Type != MessageTypeSuccess {
+		t.Fatalf("reconnect in maintenance = %s (%s), want success", msg.Type, msg.Error)
+	}
+
+	if status := h.admin(http.MethodPost, "/api/maintenance", strings.NewReader(`{"enabled": false}`), &state); status != http.StatusOK || state.Enabled {
+		t.Fatalf("POST /api/maintenance = %d %+v, want disabled", status, state)
+	}
+	h.connect(nil).register(RegisterRequest{Subdomain: "newapp"})
+}
+
+func TestMaintenanceRejectsInvalidBody(t *testing.T) {
+	h := newHarness(t, adminConfig())
+	for _, body := range []string{"", "{}", `{"enabled": "yes"}`} {
+		if status := h.admin(http.MethodPost, "/api/maintenance", strings.NewReader(body), nil); status != http.StatusBadRequest {
+			t.Errorf("POST /api/maintenance with %q = %d, want 400", body, status)
+		}
+	}
+	if h.registry.InMaintenance() {
+		t.Fatal("invalid request turned maintenance mode on")
+	}
+}
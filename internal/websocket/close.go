@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// CertFailureHandler returns a callback for cert.Manager.OnPersistentFailure.
+// A tunnel whose host can't get a certificate is unreachable over HTTPS, so
+// its client is told why and the tunnel is closed.
+func CertFailureHandler(cfg *config.Config, registry *tunnel.Registry) func(host string, err error) {
+	return func(host string, err error) {
+		name := strings.TrimSuffix(strings.ToLower(host), "."+cfg.Domain)
+		if name == strings.ToLower(host) {
+			return
+		}
+
+		tun, killed := registry.Kill(name)
+		if !killed {
+			return
+		}
+		closeTunnel(tun, cfg.CloseDrainTimeout, ErrorCodeCertFailure,
+			fmt.Sprintf("tunnel closed: a certificate for %s could not be issued (%v)", host, err))
+	}
+}
+
+// IdleEvictionHandler returns a callback for tunnel.Registry.StartReaper
+// that tells the client its idle tunnel was closed
+func IdleEvictionHandler(cfg *config.Config) func(tun *tunnel.Tunnel) {
+	return func(tun *tunnel.Tunnel) {
+		closeTunnel(tun, cfg.CloseDrainTimeout, ErrorCodeIdle,
+			fmt.Sprintf("tunnel closed: no traffic for %v", cfg.IdleTimeout))
+	}
+}
+
+// closeTunnel sends the client an error explaining why its tunnel is being
+// closed, then closes the connection. The tunnel must already be
+// unregistered. With a positive drain, requests already in flight get up
+// to drain to complete first; the wait happens in the background.
+func closeTunnel(tun *tunnel.Tunnel, drain time.Duration, code, reason string) {
+	slog.Info("Closing tunnel", "subdomain", tun.Subdomain(), "conn", tun.ConnID, "code", code, "reason", reason)
+	tun.MarkClosing()
+
+	if drain <= 0 || tun.InFlight() == 0 {
+		finishClose(tun, code, reason)
+		return
+	}
+
+	go func() {
+		timer := time.NewTimer(drain)
+		defer timer.Stop()
+
+		select {
+		case <-tun.Idle():
+		case <-timer.C:
+			slog.Warn("Closing tunnel with requests still in flight", "subdomain", tun.Subdomain(), "conn", tun.ConnID, "in_flight", tun.InFlight())
+		}
+		finishClose(tun, code, reason)
+	}()
+}
+
+// finishClose notifies the client and closes its connection
+func finishClose(tun *tunnel.Tunnel, code, reason string) {
+	if conn, ok := tun.WSConn.(*Connection); ok {
+		if err := conn.WriteMessage(&Message{
+			Type:      MessageTypeError,
+			Error:     reason,
+			Code:      code,
+			Timestamp: time.Now(),
+		}); err != nil {
+			slog.Info("Failed to notify client of closed tunnel", "subdomain", tun.Subdomain(), "conn", tun.ConnID, "error", err)
+		}
+	}
+
+	if tun.WSConn != nil {
+		tun.WSConn.Close()
+	}
+}
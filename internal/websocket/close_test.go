@@ -0,0 +1,185 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+)
+
+func TestCertFailureClosesTunnel(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+	other := h.connect(nil)
+	other.register(RegisterRequest{Subdomain: "other"})
+
+	onFailure := CertFailureHandler(h.config, h.registry)
+	onFailure("MyApp."+testkit.Domain, errors.New("CAA record forbids issuance"))
+
+	msg := client.expectError()
+	if msg.Code != ErrorCodeCertFailure || !strings.Contains(msg.Error, "CAA record") {
+		t.Fatalf("error = %s %q, want code %s with the cause", msg.Code, msg.Error, ErrorCodeCertFailure)
+	}
+	if _, ok := h.registry.Get("myapp"); ok {
+		t.Fatal("tunnel is still registered after its certificate failed")
+	}
+	if _, ok := h.registry.Get("other"); !ok {
+		t.Fatal("an unrelated tunnel was closed")
+	}
+
+	// Hosts outside the domain and unknown subdomains are ignored
+	onFailure("other.example.com", errors.New("failed"))
+	onFailure("missing."+testkit.Domain, errors.New("failed"))
+	if _, ok := h.registry.Get("other"); !ok {
+		t.Fatal("a tunnel was closed for a failure on another host")
+	}
+}
+
+func TestIdleEvictionClosesTunnel(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.IdleTimeout = time.Minute
+	h := newHarness(t, cfg)
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+
+	onEvict := IdleEvictionHandler(cfg)
+	for _, tun := range h.registry.ReapIdle(0) {
+		onEvict(tun)
+	}
+
+	msg := client.expectError()
+	if msg.Code != ErrorCodeIdle || !strings.Contains(msg.Error, "1m0s") {
+		t.Fatalf("error = %s %q, want code %s with the timeout", msg.Code, msg.Error, ErrorCodeIdle)
+	}
+	if _, ok := h.registry.Get("myapp"); ok {
+		t.Fatal("tunnel is still registered after it was reaped")
+	}
+}
+
+// Every line about a tunnel carries the ID of its client connection, from
+// registration to the server closing it
+func TestTunnelLogsCarryConnID(t *testing.T) {
+	logs := testkit.CaptureLogs(t)
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+	tun, _ := h.registry.Get("myapp")
+
+	CertFailureHandler(h.config, h.registry)("myapp."+testkit.Domain, errors.New("failed"))
+	client.expectError()
+
+	var tagged []string
+	for _, record := range logs.Records(t) {
+		msg, _ := record["msg"].(string)
+		if record["subdomain"] != "myapp" && !strings.Contains(msg, "myapp") {
+			continue
+		}
+		if record["conn"] != tun.ConnID {
+			t.Errorf("log line %q has conn %v, want %s", msg, record["conn"], tun.ConnID)
+		}
+		tagged = append(tagged, msg)
+	}
+	if len(tagged) < 2 {
+		t.Fatalf("got log lines %q, want registration and close", tagged)
+	}
+}
+
+// visitInBackground sends a visitor request for the tunnel's root and
+// delivers the status, or 0 if the request failed
+func (h *harness) visitInBackground(subdomain string) <-chan int {
+	status := make(chan int, 1)
+	go func() {
+		client := &http.Client{
+			Timeout:   testkit.Timeout,
+			Transport: &http.Transport{DialContext: h.visitors.DialContext, DisableKeepAlives: true},
+		}
+		resp, err := client.Get("http://" + subdomain + "." + testkit.Domain + "/")
+		if err != nil {
+			status <- 0
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	return status
+}
+
+func TestCloseDrainsInFlightRequests(t *testing.T) {
+	closers := map[string]func(h *harness){
+		"cert failure": func(h *harness) {
+			CertFailureHandler(h.config, h.registry)("myapp."+testkit.Domain, errors.New("failed"))
+		},
+		"admin kill": func(h *harness) {
+			if status := h.admin(http.MethodDelete, "/api/tunnels/myapp", nil, nil); status != http.StatusOK {
+				h.t.Fatalf("DELETE /api/tunnels/myapp = %d", status)
+			}
+		},
+	}
+	for _, tt := range []struct {
+		name    string
+		drain   time.Duration
+		release bool // the backend answers while the tunnel drains
+		status  int  // what the in-flight visitor gets
+	}{
+		{"completes within drain", 5 * time.Second, true, http.StatusOK},
+		{"drain times out", 100 * time.Millisecond, false, 0},
+		{"no drain", 0, false, 0},
+	} {
+		for closer, trigger := range closers {
+			t.Run(closer+"/"+tt.name, func(t *testing.T) {
+				cfg := adminConfig()
+				cfg.CloseDrainTimeout = tt.drain
+				h := newHarness(t, cfg)
+				client := h.connect(nil)
+				client.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{CapabilityMux}})
+
+				started := make(chan struct{})
+				release := make(chan struct{})
+				defer close(release)
+				client.serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					close(started)
+					<-release
+				}), true)
+				tun, _ := h.registry.Get("myapp")
+
+				status := h.visitInBackground("myapp")
+				<-started
+				testkit.WaitFor(t, "the request to be in flight", func() bool { return tun.InFlight() == 1 })
+
+				closed := time.Now()
+				trigger(h)
+				if _, exists := h.registry.Get("myapp"); exists {
+					t.Fatal("a draining tunnel is still registered")
+				}
+				if tt.release {
+					// The client is not told, nor cut off, while the request runs
+					select {
+					case msg := <-client.control:
+						t.Fatalf("got %s message (%s) while a request was in flight", msg.Type, msg.Error)
+					case <-time.After(100 * time.Millisecond):
+					}
+					release <- struct{}{}
+				}
+
+				client.expectError()
+				if elapsed := time.Since(closed); tt.drain > 0 && !tt.release && elapsed < tt.drain {
+					t.Fatalf("connection closed after %v, before the %v drain ran out", elapsed, tt.drain)
+				}
+				select {
+				case got := <-status:
+					if got != tt.status {
+						t.Fatalf("in-flight request status = %d, want %d", got, tt.status)
+					}
+				case <-time.After(testkit.Timeout):
+					t.Fatal("in-flight request did not finish")
+				}
+			})
+		}
+	}
+}
@@ -5,13 +5,17 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"strings"
 	"time"
 
+	"github.com/ahmadrosid/tunnel/internal/audit"
 	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/ipfilter"
+	"github.com/ahmadrosid/tunnel/internal/metrics"
 	"github.com/ahmadrosid/tunnel/internal/proxy"
 	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // CombinedServer handles both WebSocket and HTTPS proxy on the same port
@@ -23,9 +27,10 @@ type CombinedServer struct {
 		GetTLSConfigForHijacking() *tls.Config
 		HTTPHandler() func(http.Handler) http.Handler
 	}
-	server      *http.Server
-	httpServer  *http.Server
-	wsHandler   *Server
+	server     *http.Server
+	httpServer *http.Server
+	wsHandler  *Server
+	proxy      *proxy.Handler
 }
 
 // NewCombinedServer creates a combined server for WebSocket and HTTPS proxy
@@ -38,24 +43,38 @@ func NewCombinedServer(cfg *config.Config, registry *tunnel.Registry, certManage
 		config:      cfg,
 		registry:    registry,
 		certManager: certManager,
+		proxy:       proxy.NewHandler(cfg, registry),
 	}
 
 	// Create WebSocket handler (but don't start its server)
 	cs.wsHandler = &Server{
 		config:      cfg,
 		registry:    registry,
+		audit:       audit.NewLog(cfg.AuditLogSize),
 		certManager: certManager,
+		metrics:     promhttp.HandlerFor(metrics.NewRegistry(registry), promhttp.HandlerOpts{}),
+		started:     time.Now(),
+		pongWait:    defaultPongWait,
 	}
 
 	// Create combined mux
 	mux := http.NewServeMux()
 
-	// WebSocket endpoints
-	mux.HandleFunc("/tunnel", cs.wsHandler.handleWebSocket)
-	mux.HandleFunc("/health", cs.wsHandler.handleHealth)
+	// WebSocket and API endpoints
+	cs.wsHandler.registerRoutes(mux)
 
-	// All other requests go to the proxy
-	mux.HandleFunc("/", cs.handleProxyOrWebSocket)
+	// All other requests go to the proxy, including WebSocket upgrades:
+	// tunnel clients connect on /tunnel, so anything else, such as an app's
+	// socket under PathRoutingPrefix, belongs to a tunneled app
+	mux.Handle("/", cs.proxy)
+
+	// Control subdomains serve only the control endpoints
+	controlMux := http.NewServeMux()
+	cs.wsHandler.registerRoutes(controlMux)
+
+	for _, name := range cfg.ControlHosts {
+		cs.proxy.HandleReserved(name, controlMux)
+	}
 
 	// Get TLS config with HTTP/2 disabled (required for connection hijacking)
 	tlsConfig := certManager.GetTLSConfigForHijacking()
@@ -63,7 +82,7 @@ func NewCombinedServer(cfg *config.Config, registry *tunnel.Registry, certManage
 	// HTTPS server on 443
 	cs.server = &http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.HTTPSPort),
-		Handler:      mux,
+		Handler:      cs.route(mux),
 		TLSConfig:    tlsConfig,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
@@ -83,24 +102,39 @@ func NewCombinedServer(cfg *config.Config, registry *tunnel.Registry, certManage
 	return cs
 }
 
+// SetDenylist refuses tunnel clients connecting from the ranges in d
+func (cs *CombinedServer) SetDenylist(d *ipfilter.Denylist) {
+	cs.wsHandler.SetDenylist(d)
+}
+
 // Start starts the combined server
 func (cs *CombinedServer) Start() error {
 	// Start HTTP server (for redirects and ACME)
+	httpListener, err := net.Listen("tcp", cs.httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", cs.config.HTTPPort, err)
+	}
 	go func() {
 		log.Printf("HTTP server listening on port %d (redirects to HTTPS)", cs.config.HTTPPort)
-		if err := cs.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := cs.httpServer.Serve(proxy.LimitListener(httpListener, cs.config.MaxVisitorConns)); err != nil && err != http.ErrServerClosed {
 			log.Printf("HTTP server error: %v", err)
 		}
 	}()
 
-	// Start HTTPS server (WebSocket + Proxy)
+	// Start HTTPS server (WebSocket + Proxy). Tunnel clients are counted as
+	// visitors until their upgrade succeeds.
+	listener, err := net.Listen("tcp", cs.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", cs.config.HTTPSPort, err)
+	}
 	log.Printf("Combined server (HTTPS + WSS) listening on port %d", cs.config.HTTPSPort)
-	return cs.server.ListenAndServeTLS("", "")
+	return cs.server.ServeTLS(proxy.LimitListener(listener, cs.config.MaxVisitorConns), "", "")
 }
 
 // Shutdown gracefully shuts down the combined server
 func (cs *CombinedServer) Shutdown(ctx context.Context) error {
 	log.Println("Shutting down combined server...")
+	cs.wsHandler.BeginShutdown()
 
 	var err error
 	if shutdownErr := cs.httpServer.Shutdown(ctx); shutdownErr != nil {
@@ -114,85 +148,18 @@ func (cs *CombinedServer) Shutdown(ctx context.Context) error {
 	return err
 }
 
-// handleProxyOrWebSocket routes requests to either WebSocket or proxy
-func (cs *CombinedServer) handleProxyOrWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Check if it's a WebSocket upgrade request (RFC 6455 compliant)
-	// Headers are case-insensitive per HTTP spec
-	upgrade := r.Header.Get("Upgrade")
-	connection := r.Header.Get("Connection")
-
-	if strings.EqualFold(upgrade, "websocket") &&
-	   strings.Contains(strings.ToLower(connection), "upgrade") {
-		cs.wsHandler.handleWebSocket(w, r)
-		return
-	}
-
-	// Otherwise, handle as proxy request
-	cs.handleProxy(w, r)
-}
-
-// handleProxy handles HTTP proxy requests
-func (cs *CombinedServer) handleProxy(w http.ResponseWriter, r *http.Request) {
-	// Extract subdomain from Host header
-	host := r.Host
-	subdomain := cs.extractSubdomain(host)
-
-	if subdomain == "" {
-		http.Error(w, "Invalid hostname", http.StatusNotFound)
-		return
-	}
-
-	// Look up tunnel by subdomain
-	tun, exists := cs.registry.Get(subdomain)
-	if !exists {
-		log.Printf("Subdomain not found: %s", subdomain)
-		http.Error(w, fmt.Sprintf("Tunnel not found for subdomain: %s", subdomain), http.StatusNotFound)
-		return
-	}
-
-	// Hijack the connection for raw TCP forwarding
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		log.Printf("Response writer does not support hijacking")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	clientConn, _, err := hijacker.Hijack()
-	if err != nil {
-		log.Printf("Failed to hijack connection: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	// Forward the request to the tunnel
-	go func() {
-		defer clientConn.Close()
-
-		// Dial through the tunnel to the local server
-		tunnelConn, err := proxy.DialThroughTunnel(tun)
-		if err != nil {
-			log.Printf("Failed to dial through tunnel for %s: %v", subdomain, err)
-			response := "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain\r\nContent-Length: 15\r\n\r\nBad Gateway\r\n"
-			clientConn.Write([]byte(response))
-			return
-		}
-		defer tunnelConn.Close()
-
-		// Write the original HTTP request to the tunnel
-		if err := r.Write(tunnelConn); err != nil {
-			log.Printf("Failed to write request to tunnel: %v", err)
+// route sends requests for tunnel hosts straight to the proxy and everything
+// else to mux. Tunnel requests bypass the mux so their paths reach the
+// backend verbatim rather than being cleaned and redirected, and so paths
+// like /health belong to the tunneled app.
+func (cs *CombinedServer) route(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cs.proxy.IsTunnelHost(r.Host) {
+			cs.proxy.ServeHTTP(w, r)
 			return
 		}
-
-		// Set timeout on client connection
-		if cs.config.RequestTimeout > 0 {
-			clientConn.SetDeadline(time.Now().Add(cs.config.RequestTimeout))
-		}
-
-		// Bidirectional copy
-		proxy.CopyBidirectional(clientConn, tunnelConn)
-	}()
+		mux.ServeHTTP(w, r)
+	})
 }
 
 // handleHTTPRedirect redirects HTTP to HTTPS
@@ -203,26 +170,3 @@ func (cs *CombinedServer) handleHTTPRedirect(w http.ResponseWriter, r *http.Requ
 	}
 	http.Redirect(w, r, target, http.StatusMovedPermanently)
 }
-
-// extractSubdomain extracts the subdomain from a host header
-func (cs *CombinedServer) extractSubdomain(host string) string {
-	// Remove port if present
-	if colonIndex := strings.Index(host, ":"); colonIndex != -1 {
-		host = host[:colonIndex]
-	}
-
-	// Check if host ends with our domain
-	domain := "." + cs.config.Domain
-	if !strings.HasSuffix(host, domain) && host != cs.config.Domain {
-		if host == cs.config.Domain {
-			return ""
-		}
-		return ""
-	}
-
-	// Extract subdomain
-	subdomain := strings.TrimSuffix(host, domain)
-	subdomain = strings.TrimSpace(subdomain)
-
-	return subdomain
-}
@@ -0,0 +1,63 @@
+package websocket
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// A tunnel registered over WebSocket on the combined server serves visitor
+// requests arriving on the same port
+func TestCombinedServerForwardsOverWebSocket(t *testing.T) {
+	cs := NewCombinedServer(testkit.Config(), tunnel.NewRegistry(0), stubCerts{})
+	l := testkit.ServeInMemory(t, cs.server.Handler)
+
+	client := newTestClient(t, testkit.DialInMemory(t, l, "/tunnel", nil))
+	client.register(RegisterRequest{Subdomain: "myapp"})
+	client.serve(echoHandler, false)
+
+	req, err := http.NewRequest(http.MethodGet, "http://myapp."+testkit.Domain+"/hello", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	httpClient := &http.Client{
+		Timeout:   testkit.Timeout,
+		Transport: &http.Transport{DialContext: l.DialContext, DisableKeepAlives: true},
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", req.URL, err)
+	}
+	defer resp.Body.Close()
+	if got, want := testkit.ReadBody(t, resp), "GET /hello myapp."+testkit.Domain; resp.StatusCode != http.StatusOK || got != want {
+		t.Fatalf("response = %d %q, want 200 %q", resp.StatusCode, got, want)
+	}
+}
+
+// WebSocket upgrades on the base domain are only tunnel clients when they
+// ask for /tunnel; under PathRoutingPrefix they belong to the tunneled app
+func TestCombinedServerRoutesUpgradesByPath(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.PathRoutingPrefix = "/t/"
+	cs := NewCombinedServer(cfg, tunnel.NewRegistry(0), stubCerts{})
+	l := testkit.ServeInMemory(t, cs.server.Handler)
+
+	conn, _, err := testkit.DialWebSocket(l, "/tunnel", nil)
+	if err != nil {
+		t.Fatalf("dial /tunnel: %v", err)
+	}
+	conn.Close()
+
+	for _, path := range []string{"/t/myapp/socket", "/socket"} {
+		conn, resp, err := testkit.DialWebSocket(l, path, nil)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("upgrade on %s reached the tunnel client endpoint", path)
+		}
+		if resp == nil || resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("upgrade on %s: %v, want the proxy's 404 for a missing tunnel", path, err)
+		}
+	}
+}
@@ -2,65 +2,133 @@ package websocket
 
 import (
 	"encoding/json"
-	"io"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Connection wraps a WebSocket connection and provides helper methods
+const (
+	// Writes at least this large are sent as their own frame even when
+	// coalescing is enabled
+	coalesceThreshold = 4 * 1024
+
+	// Coalesced data is flushed once it reaches this size
+	coalesceMaxSize = 32 * 1024
+)
+
+// Connection wraps a WebSocket connection and provides helper methods.
+// A single reader goroutine, started by the first read, owns the
+// underlying connection's reads and sorts frames by type: text frames go
+// to ReadMessage for the control plane, binary frames to Read and
+// ReadBinary for the data plane. Neither side can block the other, and no
+// lock is held while waiting on the network.
 type Connection struct {
-	conn         *websocket.Conn
-	mu           sync.Mutex
-	writeMu      sync.Mutex
-	closeOnce    sync.Once
-	readBuffer   []byte   // Buffer for partial reads from binary messages
-	readOffset   int      // Current offset in readBuffer
-	binaryQueue  [][]byte // Queue of binary messages read by ReadMessage()
+	conn       *websocket.Conn
+	writeMu    sync.Mutex
+	closeOnce  sync.Once
+	readerOnce sync.Once
+
+	// Read state, guarded by mu. cond is signalled whenever a frame is
+	// queued or the reader stops.
+	mu          sync.Mutex
+	cond        *sync.Cond
+	textQueue   [][]byte // control messages waiting for ReadMessage()
+	binaryQueue [][]byte // binary messages waiting for Read() or ReadBinary()
+	readErr     error    // why the reader stopped, returned once the queues are drained
+	readBuffer  []byte   // Buffer for partial reads from binary messages
+	readOffset  int      // Current offset in readBuffer
+
+	// Write coalescing, guarded by writeMu
+	coalesceWindow time.Duration // 0 disables coalescing
+	pending        []byte        // small writes waiting to be sent as one frame
+	flushTimer     *time.Timer
+	flushErr       error // error from a timer-driven flush, returned by the next Write
 }
 
-// NewConnection creates a new WebSocket connection wrapper
+// NewConnection creates a new WebSocket connection wrapper. Read limits,
+// deadlines and handlers should be set on conn before the first read.
 func NewConnection(conn *websocket.Conn) *Connection {
-	return &Connection{
+	c := &Connection{
 		conn: conn,
 	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
 }
 
-// ReadMessage reads a message from the WebSocket connection for control plane.
-// This method is used by HandleMessages() loop to read JSON control messages.
-// Binary messages are queued for Read() to consume, avoiding race conditions.
-func (c *Connection) ReadMessage() (*Message, error) {
+// startReader starts the reader goroutine if it isn't running yet
+func (c *Connection) startReader() {
+	c.readerOnce.Do(func() {
+		go c.readLoop()
+	})
+}
+
+// readLoop reads frames from the network and queues them by type until
+// the connection fails
+func (c *Connection) readLoop() {
 	for {
-		c.mu.Lock()
 		messageType, data, err := c.conn.ReadMessage()
 
-		if err != nil {
-			c.mu.Unlock()
-			return nil, err
+		c.mu.Lock()
+		switch {
+		case err != nil:
+			c.readErr = err
+		case messageType == websocket.TextMessage:
+			c.textQueue = append(c.textQueue, data)
+		case messageType == websocket.BinaryMessage:
+			c.binaryQueue = append(c.binaryQueue, data)
 		}
+		c.mu.Unlock()
+		c.cond.Broadcast()
 
-		// If it's a binary message, queue it for Read() and continue reading
-		if messageType == websocket.BinaryMessage {
-			c.binaryQueue = append(c.binaryQueue, data)
-			c.mu.Unlock()
-			continue
+		if err != nil {
+			return
 		}
+	}
+}
+
+// ReadMessage returns the next control message. It is used by the
+// HandleMessages() loop; binary messages are left for Read() and
+// ReadBinary(), so data arriving in between never delays control messages.
+func (c *Connection) ReadMessage() (*Message, error) {
+	c.startReader()
 
+	c.mu.Lock()
+	for len(c.textQueue) == 0 && c.readErr == nil {
+		c.cond.Wait()
+	}
+	if len(c.textQueue) == 0 {
+		err := c.readErr
 		c.mu.Unlock()
+		return nil, err
+	}
+	data := c.textQueue[0]
+	c.textQueue = c.textQueue[1:]
+	c.mu.Unlock()
 
-		// Only handle text messages for control plane
-		if messageType != websocket.TextMessage {
-			continue
-		}
+	return decodeMessage(data)
+}
 
-		var msg Message
-		if err := json.Unmarshal(data, &msg); err != nil {
-			return nil, err
-		}
+// nextBinaryLocked waits for the next binary message. c.mu must be held.
+func (c *Connection) nextBinaryLocked() ([]byte, error) {
+	for len(c.binaryQueue) == 0 && c.readErr == nil {
+		c.cond.Wait()
+	}
+	if len(c.binaryQueue) == 0 {
+		return nil, c.readErr
+	}
+	data := c.binaryQueue[0]
+	c.binaryQueue = c.binaryQueue[1:]
+	return data, nil
+}
 
-		return &msg, nil
+// decodeMessage parses a JSON control message
+func decodeMessage(data []byte) (*Message, error) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
 	}
+	return &msg, nil
 }
 
 // WriteMessage writes a message to the WebSocket connection
@@ -82,25 +150,23 @@ func (c *Connection) WriteBinary(data []byte) error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 
+	if err := c.flushLocked(); err != nil {
+		return err
+	}
+
 	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 	return c.conn.WriteMessage(websocket.BinaryMessage, data)
 }
 
-// ReadBinary reads binary data from the WebSocket connection
+// ReadBinary returns the next binary message. Control messages arriving
+// in between are left for ReadMessage().
 func (c *Connection) ReadBinary() ([]byte, error) {
+	c.startReader()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	messageType, data, err := c.conn.ReadMessage()
-	if err != nil {
-		return nil, err
-	}
-
-	if messageType != websocket.BinaryMessage {
-		return nil, io.EOF
-	}
-
-	return data, nil
+	return c.nextBinaryLocked()
 }
 
 // WritePing writes a ping message to the WebSocket connection
@@ -112,15 +178,30 @@ func (c *Connection) WritePing() error {
 	return c.conn.WriteMessage(websocket.PingMessage, nil)
 }
 
-// Close closes the WebSocket connection
+// Close closes the WebSocket connection, flushing any coalesced data first
 func (c *Connection) Close() error {
 	var err error
 	c.closeOnce.Do(func() {
+		c.writeMu.Lock()
+		c.flushLocked()
+		c.writeMu.Unlock()
+
 		err = c.conn.Close()
 	})
 	return err
 }
 
+// SetWriteCoalescing batches small Write calls made within window into a
+// single binary frame, trading up to window of latency for fewer frames.
+// A window of 0 disables coalescing.
+func (c *Connection) SetWriteCoalescing(window time.Duration) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.flushLocked()
+	c.coalesceWindow = window
+}
+
 // RemoteAddr returns the remote address of the connection
 func (c *Connection) RemoteAddr() string {
 	return c.conn.RemoteAddr().String()
@@ -134,60 +215,26 @@ func (c *Connection) Conn() *websocket.Conn {
 // Read implements io.Reader interface for bidirectional copying
 // Reads binary WebSocket messages and buffers them for io.Copy operations
 func (c *Connection) Read(p []byte) (n int, err error) {
+	c.startReader()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// If we have buffered data, return it first
-	if c.readOffset < len(c.readBuffer) {
-		n = copy(p, c.readBuffer[c.readOffset:])
-		c.readOffset += n
-
-		// If we've consumed the entire buffer, clear it
-		if c.readOffset >= len(c.readBuffer) {
-			c.readBuffer = nil
-			c.readOffset = 0
+	// No buffered data, wait for the next binary WebSocket message
+	if c.readOffset >= len(c.readBuffer) {
+		data, err := c.nextBinaryLocked()
+		if err != nil {
+			return 0, err
 		}
-
-		return n, nil
-	}
-
-	// Check if there are queued binary messages from ReadMessage()
-	if len(c.binaryQueue) > 0 {
-		c.readBuffer = c.binaryQueue[0]
-		c.binaryQueue = c.binaryQueue[1:]
+		c.readBuffer = data
 		c.readOffset = 0
-
-		// Copy as much as we can to the caller's buffer
-		n = copy(p, c.readBuffer)
-		c.readOffset = n
-
-		// If we didn't consume everything, keep the buffer for next Read()
-		if c.readOffset >= len(c.readBuffer) {
-			c.readBuffer = nil
-			c.readOffset = 0
-		}
-
-		return n, nil
-	}
-
-	// No buffered or queued data, read next WebSocket message
-	var messageType int
-	messageType, c.readBuffer, err = c.conn.ReadMessage()
-	if err != nil {
-		return 0, err
-	}
-
-	// Only handle binary messages for data transfer
-	if messageType != websocket.BinaryMessage {
-		c.readBuffer = nil
-		return 0, io.EOF
 	}
 
 	// Copy as much as we can to the caller's buffer
-	n = copy(p, c.readBuffer)
-	c.readOffset = n
+	n = copy(p, c.readBuffer[c.readOffset:])
+	c.readOffset += n
 
-	// If we didn't consume everything, keep the buffer for next Read()
+	// If we've consumed the entire buffer, clear it
 	if c.readOffset >= len(c.readBuffer) {
 		c.readBuffer = nil
 		c.readOffset = 0
@@ -196,11 +243,35 @@ func (c *Connection) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
-// Write implements io.Writer interface for bidirectional copying
+// Write implements io.Writer interface for bidirectional copying.
+// With coalescing enabled, small writes are buffered and sent together
+// once the window passes or enough data has accumulated; ordering is
+// preserved because every other binary write flushes the buffer first.
 func (c *Connection) Write(p []byte) (n int, err error) {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 
+	if c.flushErr != nil {
+		err, c.flushErr = c.flushErr, nil
+		return 0, err
+	}
+
+	if c.coalesceWindow > 0 && len(p) < coalesceThreshold {
+		c.pending = append(c.pending, p...)
+		if len(c.pending) >= coalesceMaxSize {
+			if err := c.flushLocked(); err != nil {
+				return 0, err
+			}
+		} else if c.flushTimer == nil {
+			c.flushTimer = time.AfterFunc(c.coalesceWindow, c.flush)
+		}
+		return len(p), nil
+	}
+
+	if err := c.flushLocked(); err != nil {
+		return 0, err
+	}
+
 	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 	err = c.conn.WriteMessage(websocket.BinaryMessage, p)
 	if err != nil {
@@ -209,3 +280,31 @@ func (c *Connection) Write(p []byte) (n int, err error) {
 
 	return len(p), nil
 }
+
+// flush sends coalesced data when the coalescing window expires
+func (c *Connection) flush() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.flushLocked(); err != nil {
+		c.flushErr = err
+	}
+}
+
+// flushLocked sends any coalesced data as one binary frame. c.writeMu must be held.
+func (c *Connection) flushLocked() error {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	data := c.pending
+	c.pending = nil
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+}
@@ -0,0 +1,298 @@
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/gorilla/websocket"
+)
+
+// newConnPair returns a server-side Connection and the client end of it
+func newConnPair(t testing.TB) (*Connection, *websocket.Conn) {
+	t.Helper()
+
+	accepted := make(chan *websocket.Conn, 1)
+	l := testkit.ServeInMemory(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}))
+	client := testkit.DialInMemory(t, l, "/tunnel", nil)
+
+	select {
+	case conn := <-accepted:
+		server := NewConnection(conn)
+		t.Cleanup(func() { server.Close() })
+		return server, client
+	case <-time.After(testkit.Timeout):
+		t.Fatal("server never accepted the connection")
+		return nil, nil
+	}
+}
+
+// await runs fn in the background and returns its results, failing the
+// test if it doesn't finish in time
+func await[T any](t *testing.T, what string, fn func() (T, error)) (T, error) {
+	t.Helper()
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		done <- result{value, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-time.After(testkit.Timeout):
+		t.Fatalf("%s did not return", what)
+		var zero T
+		return zero, nil
+	}
+}
+
+// writeFrames sends text (control) and binary frames in order
+func writeFrames(t *testing.T, conn *websocket.Conn, frames ...interface{}) {
+	t.Helper()
+
+	for _, frame := range frames {
+		var err error
+		switch f := frame.(type) {
+		case MessageType:
+			err = conn.WriteJSON(Message{Type: f})
+		case []byte:
+			err = conn.WriteMessage(websocket.BinaryMessage, f)
+		}
+		if err != nil {
+			t.Fatalf("write frame: %v", err)
+		}
+	}
+}
+
+func TestReadBinaryLeavesControlMessages(t *testing.T) {
+	server, client := newConnPair(t)
+	writeFrames(t, client, MessageTypePing, []byte("data"), MessageTypePause)
+
+	data, err := await(t, "ReadBinary", server.ReadBinary)
+	if err != nil || string(data) != "data" {
+		t.Fatalf("ReadBinary = %q, %v; want %q", data, err, "data")
+	}
+
+	for _, want := range []MessageType{MessageTypePing, MessageTypePause} {
+		msg, err := await(t, "ReadMessage", server.ReadMessage)
+		if err != nil || msg.Type != want {
+			t.Fatalf("ReadMessage = %+v, %v; want %s", msg, err, want)
+		}
+	}
+}
+
+func TestReadMessageLeavesBinaryMessages(t *testing.T) {
+	server, client := newConnPair(t)
+	writeFrames(t, client, []byte("first"), MessageTypePing, []byte("second"))
+
+	msg, err := await(t, "ReadMessage", server.ReadMessage)
+	if err != nil || msg.Type != MessageTypePing {
+		t.Fatalf("ReadMessage = %+v, %v; want ping", msg, err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		buf := make([]byte, 64)
+		n, err := await(t, "Read", func() (int, error) { return server.Read(buf) })
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("Read = %q, %v; want %q", buf[:n], err, want)
+		}
+	}
+}
+
+// A control message must reach ReadMessage while another goroutine is
+// blocked in Read waiting for data, without any binary frame following it
+func TestControlMessageDuringBlockedRead(t *testing.T) {
+	server, client := newConnPair(t)
+
+	readDone := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := server.Read(buf)
+		readDone <- string(buf[:n])
+	}()
+
+	// Give Read time to block before the control message arrives
+	time.Sleep(50 * time.Millisecond)
+	writeFrames(t, client, MessageTypePause)
+
+	msg, err := await(t, "ReadMessage", server.ReadMessage)
+	if err != nil || msg.Type != MessageTypePause {
+		t.Fatalf("ReadMessage = %+v, %v; want pause", msg, err)
+	}
+
+	writeFrames(t, client, []byte("data"))
+	select {
+	case got := <-readDone:
+		if got != "data" {
+			t.Fatalf("Read = %q, want %q", got, "data")
+		}
+	case <-time.After(testkit.Timeout):
+		t.Fatal("Read did not return")
+	}
+}
+
+func TestReadSplitsLargeMessages(t *testing.T) {
+	server, client := newConnPair(t)
+	writeFrames(t, client, []byte("abcdef"))
+
+	var got []byte
+	for len(got) < 6 {
+		buf := make([]byte, 4)
+		n, err := await(t, "Read", func() (int, error) { return server.Read(buf) })
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "abcdef" {
+		t.Fatalf("Read = %q, want %q", got, "abcdef")
+	}
+}
+
+func TestReadsFailAfterClose(t *testing.T) {
+	server, client := newConnPair(t)
+	writeFrames(t, client, []byte("queued"))
+	if _, err := await(t, "ReadBinary", server.ReadBinary); err != nil {
+		t.Fatalf("ReadBinary: %v", err)
+	}
+	client.Close()
+
+	if _, err := await(t, "ReadMessage", server.ReadMessage); err == nil {
+		t.Fatal("ReadMessage succeeded after the peer closed")
+	}
+	_, err := await(t, "Read", func() (int, error) { return server.Read(make([]byte, 8)) })
+	if err == nil {
+		t.Fatal("Read succeeded after the peer closed")
+	}
+}
+
+// readFrames reads binary frames from conn until they add up to n bytes
+func readFrames(t *testing.T, conn *websocket.Conn, n int) [][]byte {
+	t.Helper()
+
+	var frames [][]byte
+	for total := 0; total < n; {
+		conn.SetReadDeadline(time.Now().Add(testkit.Timeout))
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read frame after %d of %d bytes: %v", total, n, err)
+		}
+		if msgType != websocket.BinaryMessage {
+			t.Fatalf("got message type %d, want binary", msgType)
+		}
+		frames = append(frames, data)
+		total += len(data)
+	}
+	return frames
+}
+
+func TestCoalescedWritesKeepOrder(t *testing.T) {
+	server, client := newConnPair(t)
+	server.SetWriteCoalescing(20 * time.Millisecond)
+
+	var want bytes.Buffer
+	for i := 0; i < 100; i++ {
+		chunk := fmt.Sprintf("chunk %03d;", i)
+		want.WriteString(chunk)
+		if _, err := server.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	// A large write goes out directly, after what was buffered before it
+	large := bytes.Repeat([]byte("x"), coalesceThreshold)
+	want.Write(large)
+	server.Write(large)
+	want.WriteString("tail")
+	server.Write([]byte("tail"))
+
+	frames := readFrames(t, client, want.Len())
+	if got := bytes.Join(frames, nil); !bytes.Equal(got, want.Bytes()) {
+		t.Fatal("coalesced data arrived out of order")
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3 (the small writes, the large one, the tail)", len(frames))
+	}
+}
+
+// Small writes are flushed once enough has accumulated, without waiting
+// for the window
+func TestCoalescingFlushesAtMaxSize(t *testing.T) {
+	server, client := newConnPair(t)
+	server.SetWriteCoalescing(time.Hour)
+
+	chunk := bytes.Repeat([]byte("y"), coalesceThreshold-1)
+	n := 0
+	for n < coalesceMaxSize {
+		server.Write(chunk)
+		n += len(chunk)
+	}
+
+	frames := readFrames(t, client, n)
+	if len(frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(frames))
+	}
+}
+
+func TestCloseFlushesCoalescedWrites(t *testing.T) {
+	server, client := newConnPair(t)
+	server.SetWriteCoalescing(time.Hour)
+	server.Write([]byte("last words"))
+	server.Close()
+
+	if frames := readFrames(t, client, len("last words")); string(frames[0]) != "last words" {
+		t.Fatalf("frame = %q, want the buffered data", frames[0])
+	}
+}
+
+func TestWritesWithoutCoalescing(t *testing.T) {
+	server, client := newConnPair(t)
+	for _, s := range []string{"a", "b", "c"} {
+		server.Write([]byte(s))
+	}
+	if frames := readFrames(t, client, 3); len(frames) != 3 {
+		t.Fatalf("got %d frames, want one per write", len(frames))
+	}
+}
+
+// BenchmarkSmallWrites compares sending 64-byte writes frame by frame and
+// with coalescing
+func BenchmarkSmallWrites(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprintf("window=%s", window), func(b *testing.B) {
+			server, client := newConnPair(b)
+			server.SetWriteCoalescing(window)
+
+			go func() {
+				for {
+					if _, _, err := client.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+
+			chunk := make([]byte, 64)
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := server.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
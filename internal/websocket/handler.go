@@ -1,15 +1,25 @@
 package websocket
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"strconv"
 	"time"
 
+	"github.com/ahmadrosid/tunnel/internal/audit"
 	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/metrics"
+	"github.com/ahmadrosid/tunnel/internal/proxy"
+	"github.com/ahmadrosid/tunnel/internal/qrcode"
 	"github.com/ahmadrosid/tunnel/internal/subdomain"
 	"github.com/ahmadrosid/tunnel/internal/tunnel"
 	"github.com/google/uuid"
+	"golang.org/x/net/http/httpguts"
 )
 
 // MessageType represents the type of WebSocket message
@@ -23,21 +33,73 @@ const (
 	MessageTypeData       MessageType = "data"
 	MessageTypePing       MessageType = "ping"
 	MessageTypePong       MessageType = "pong"
+	MessageTypePause      MessageType = "pause"
+	MessageTypeResume     MessageType = "resume"
+	MessageTypeRename     MessageType = "rename"
+	MessageTypeReconnect  MessageType = "reconnect"
 )
 
+// Capabilities are optional protocol features a client can ask for when
+// registering. The server answers with the subset it supports, so new
+// features don't break older clients.
+const (
+	// CapabilityReconnect issues a reconnect token and reserves the
+	// subdomain for the client after a disconnect
+	CapabilityReconnect = "reconnect"
+	// CapabilityPause allows pause and resume control messages
+	CapabilityPause = "pause"
+	// CapabilityMux frames binary messages with a stream ID so concurrent
+	// requests share the connection without corrupting each other
+	CapabilityMux = "mux"
+	// CapabilityFlow adds window updates to mux so a stream whose reader
+	// falls behind holds up neither memory nor the other streams
+	CapabilityFlow = "flow"
+)
+
+// supportedCapabilities lists the capabilities this server implements
+var supportedCapabilities = []string{CapabilityReconnect, CapabilityPause, CapabilityMux, CapabilityFlow}
+
+// Error codes sent alongside error messages so clients can react to
+// specific failures without parsing the text
+const (
+	ErrorCodeAtCapacity  = "at_capacity"
+	ErrorCodeCertFailure = "cert_failure"
+	ErrorCodeKilled      = "killed"
+	ErrorCodePortDenied  = "port_not_allowed"
+	ErrorCodeIdle        = "idle_timeout"
+	ErrorCodeMaintenance = "maintenance"
+	ErrorCodeRegistered  = "already_registered"
+)
+
+// ErrPortNotAllowed is returned when a client registers a local port the
+// server's policy doesn't allow
+var ErrPortNotAllowed = errors.New("local port is not allowed on this server")
+
+// ErrAlreadyRegistered is returned when a connection that still has a
+// tunnel sends another register message
+var ErrAlreadyRegistered = errors.New("this connection already has a tunnel")
+
 // Message represents a WebSocket message
 type Message struct {
 	Type      MessageType     `json:"type"`
 	Data      json.RawMessage `json:"data,omitempty"`
 	Error     string          `json:"error,omitempty"`
+	Code      string          `json:"code,omitempty"`
 	Timestamp time.Time       `json:"timestamp"`
 }
 
 // RegisterRequest represents a tunnel registration request
 type RegisterRequest struct {
-	Subdomain string `json:"subdomain,omitempty"` // Empty for random subdomain
-	LocalAddr string `json:"local_addr"`          // e.g., "localhost:3000"
-	LocalPort int    `json:"local_port"`          // e.g., 3000
+	Subdomain      string   `json:"subdomain,omitempty"`            // Empty for random subdomain
+	LocalAddr      string   `json:"local_addr"`                     // e.g., "localhost:3000"
+	LocalPort      int      `json:"local_port"`                     // e.g., 3000
+	ReconnectToken string   `json:"reconnect_token,omitempty"`      // Reclaims Subdomain after a disconnect
+	TunnelID       string   `json:"tunnel_id,omitempty"`            // Must match the reclaimed tunnel when set
+	Capabilities   []string `json:"capabilities,omitempty"`         // Optional features the client supports
+	NormalizePaths bool     `json:"normalize_paths,omitempty"`      // Clean request paths before forwarding
+	HostHeader     string   `json:"host_header_override,omitempty"` // Host sent to the backend instead of the public one
+	ForwardTLSInfo bool     `json:"forward_tls_info,omitempty"`     // Add the visitor's TLS details as headers
+	BufferResponse bool     `json:"buffer_response,omitempty"`      // Read whole responses before sending them to visitors
 }
 
 // RegisterResponse represents a tunnel registration response
@@ -47,6 +109,25 @@ type RegisterResponse struct {
 	FullDomain string `json:"full_domain"`
 	LocalAddr  string `json:"local_addr"`
 	Message    string `json:"message"`
+
+	// ReconnectToken lets the client reclaim this subdomain and tunnel ID
+	// if it reconnects within the grace period
+	ReconnectToken string `json:"reconnect_token,omitempty"`
+
+	// Capabilities is the subset of the requested capabilities the server supports
+	Capabilities []string `json:"capabilities"`
+
+	// Capacity shows how many tunnels the server holds, including this one
+	Capacity *tunnel.Capacity `json:"capacity,omitempty"`
+
+	// QRCode is the public URL as a QR code drawn with Unicode blocks, for
+	// opening the tunnel on a phone; only sent with REGISTER_QR_CODE
+	QRCode string `json:"qr_code,omitempty"`
+}
+
+// RenameRequest represents a request to move a tunnel to a new subdomain
+type RenameRequest struct {
+	Subdomain string `json:"subdomain"`
 }
 
 // Handler handles WebSocket messages
@@ -54,47 +135,94 @@ type Handler struct {
 	config    *config.Config
 	registry  *tunnel.Registry
 	conn      *Connection
+	audit     *audit.Log
+	connID    string // correlation ID included in every log line for this connection
+	client    string // label of the auth token the client presented, if any
 	tunnelID  string
 	subdomain string
+	streams   tunnel.StreamDialer // created on the first registration that negotiates mux
 }
 
 // NewHandler creates a new WebSocket handler
-func NewHandler(cfg *config.Config, registry *tunnel.Registry, conn *Connection) *Handler {
+func NewHandler(cfg *config.Config, registry *tunnel.Registry, conn *Connection, auditLog *audit.Log, connID, client string) *Handler {
 	return &Handler{
 		config:   cfg,
 		registry: registry,
 		conn:     conn,
+		audit:    auditLog,
+		connID:   connID,
+		client:   client,
 	}
 }
 
+// logf logs a message at info level, tagged with the connection's correlation ID
+func (h *Handler) logf(format string, args ...interface{}) {
+	slog.Info(fmt.Sprintf(format, args...), "conn", h.connID)
+}
+
+// debugf logs a per-connection detail that is only wanted at debug level
+func (h *Handler) debugf(format string, args ...interface{}) {
+	slog.Debug(fmt.Sprintf(format, args...), "conn", h.connID)
+}
+
 // HandleMessages processes incoming WebSocket messages
 func (h *Handler) HandleMessages() error {
 	for {
 		msg, err := h.conn.ReadMessage()
 		if err != nil {
-			log.Printf("Failed to read message: %v", err)
-			// Cleanup tunnel on disconnect
+			h.debugf("Failed to read message: %v", err)
+			// Cleanup tunnel on disconnect, keeping the subdomain
+			// reserved for a reconnecting client
 			if h.subdomain != "" {
-				h.registry.Unregister(h.subdomain)
-				log.Printf("Tunnel unregistered on disconnect: %s", h.subdomain)
+				// A reconnected client may already have taken the tunnel over
+				if tun, exists := h.registry.Get(h.subdomain); exists && tun.WSConn == tunnel.Connection(h.conn) {
+					tun.MarkClosing()
+					h.registry.Release(tun, h.config.ReconnectGrace)
+					h.logf("Tunnel unregistered on disconnect: %s", h.subdomain)
+				}
 			}
 			return err
 		}
 
 		if err := h.handleMessage(msg); err != nil {
-			log.Printf("Error handling message: %v", err)
-			h.sendError(err.Error())
+			h.logf("Error handling message: %v", err)
+			h.sendError(err)
 		}
 	}
 }
 
+// actor identifies the client in audit entries, by token label when known
+func (h *Handler) actor() string {
+	if h.client != "" {
+		return fmt.Sprintf("%s (%s)", h.client, h.conn.RemoteAddr())
+	}
+	return h.conn.RemoteAddr()
+}
+
 // handleMessage processes a single message
 func (h *Handler) handleMessage(msg *Message) error {
 	switch msg.Type {
-	case MessageTypeRegister:
-		return h.handleRegister(msg)
+	case MessageTypeRegister, MessageTypeReconnect:
+		err := h.handleRegister(msg)
+		h.audit.Record(h.actor(), string(msg.Type), h.subdomain, err)
+		return err
 	case MessageTypeUnregister:
-		return h.handleUnregister(msg)
+		target := h.subdomain
+		err := h.handleUnregister(msg)
+		h.audit.Record(h.actor(), string(msg.Type), target, err)
+		return err
+	case MessageTypePause, MessageTypeResume:
+		err := h.handlePause(msg.Type == MessageTypePause)
+		h.audit.Record(h.actor(), string(msg.Type), h.subdomain, err)
+		return err
+	case MessageTypeRename:
+		target := h.subdomain
+		err := h.handleRename(msg)
+		if err == nil {
+			target = fmt.Sprintf("%s -> %s", target, h.subdomain)
+		}
+		h.audit.Record(h.actor(), string(msg.Type), target, err)
+		return err
 	case MessageTypePing:
 		return h.handlePing()
 	case MessageTypeData:
@@ -109,15 +237,39 @@ func (h *Handler) handleMessage(msg *Message) error {
 func (h *Handler) handleRegister(msg *Message) error {
 	var req RegisterRequest
 	if err := json.Unmarshal(msg.Data, &req); err != nil {
-		return fmt.Errorf("invalid register request: %w", err)
+		return fmt.Errorf("invalid %s request: %w", msg.Type, err)
+	}
+
+	// reconnect is register with the identity of the previous tunnel
+	if msg.Type == MessageTypeReconnect && (req.TunnelID == "" || req.Subdomain == "" || req.ReconnectToken == "") {
+		return fmt.Errorf("reconnect requires tunnel_id, subdomain and reconnect_token")
+	}
+
+	// A connection carries one tunnel; registering again would orphan it
+	if h.subdomain != "" {
+		if tun, exists := h.registry.Get(h.subdomain); exists && tun.ID == h.tunnelID {
+			return fmt.Errorf("%w (%s); unregister it first or use rename", ErrAlreadyRegistered, h.subdomain)
+		}
+	}
+
+	// Only reconnecting clients are let in during maintenance
+	if req.ReconnectToken == "" && h.registry.InMaintenance() {
+		return tunnel.ErrMaintenance
 	}
 
 	// Determine subdomain
 	var selectedSubdomain string
-	if req.Subdomain != "" {
+	if req.ReconnectToken != "" {
+		// Reclaiming a reserved subdomain; availability is checked by the registry
+		normalized := subdomain.Normalize(req.Subdomain)
+		if normalized == "" {
+			return fmt.Errorf("subdomain is required with a reconnect token")
+		}
+		selectedSubdomain = normalized
+	} else if req.Subdomain != "" {
 		// Custom subdomain requested
 		normalized := subdomain.Normalize(req.Subdomain)
-		if err := subdomain.Validate(normalized); err != nil {
+		if err := subdomain.Validate(normalized, h.config.MaxSubdomainLen); err != nil {
 			return fmt.Errorf("invalid subdomain: %w", err)
 		}
 
@@ -129,68 +281,280 @@ func (h *Handler) handleRegister(msg *Message) error {
 	} else {
 		// Generate random subdomain
 		var err error
-		selectedSubdomain, err = subdomain.Generate()
+		selectedSubdomain, err = h.generateSubdomain()
 		if err != nil {
-			return fmt.Errorf("failed to generate subdomain: %w", err)
+			return err
+		}
+	}
+
+	// local_port may be left out when local_addr is given
+	if req.LocalPort != 0 || req.LocalAddr == "" {
+		if req.LocalPort < 1 || req.LocalPort > 65535 {
+			return fmt.Errorf("invalid local_port %d: must be between 1 and 65535", req.LocalPort)
 		}
 	}
 
-	// Create tunnel
-	tunnelID := uuid.New().String()
 	localAddr := req.LocalAddr
 	if localAddr == "" {
 		localAddr = fmt.Sprintf("localhost:%d", req.LocalPort)
 	}
 
+	// The port comes from LocalAddr when set
+	port, err := localPort(localAddr)
+	if err != nil {
+		return fmt.Errorf("invalid local_addr %q: must be host:port: %w", localAddr, err)
+	}
+
+	// Enforce the local port policy, if any
+	if !h.config.LocalPortAllowed(port) {
+		return fmt.Errorf("%w: %d", ErrPortNotAllowed, port)
+	}
+
+	if req.HostHeader != "" && !httpguts.ValidHostHeader(req.HostHeader) {
+		return fmt.Errorf("invalid host_header_override: %q", req.HostHeader)
+	}
+
+	// Create tunnel. A reclaimed tunnel keeps its previous ID, which the
+	// client may name to make sure it gets the same tunnel back.
+	tunnelID := uuid.New().String()
+	if req.ReconnectToken != "" {
+		tunnelID = req.TunnelID
+	}
+
 	tun := &tunnel.Tunnel{
 		ID:         tunnelID,
-		Subdomain:  selectedSubdomain,
 		WSConn:     h.conn,
 		LocalAddr:  localAddr,
 		RemotePort: req.LocalPort,
 		CreatedAt:  time.Now(),
+		Caps:       negotiateCapabilities(req.Capabilities),
+		ConnID:     h.connID,
+
+		NormalizePaths: req.NormalizePaths,
+		HostHeader:     req.HostHeader,
+		ForwardTLSInfo: req.ForwardTLSInfo,
+		BufferResponse: req.BufferResponse,
+	}
+	tun.SetSubdomain(selectedSubdomain)
+	// The connection has a single reader, so re-registrations share the mux
+	if tun.HasCapability(CapabilityMux) {
+		if h.streams == nil {
+			h.streams = proxy.NewStreamMux(h.conn, tun.HasCapability(CapabilityFlow))
+		}
+		tun.Streams = h.streams
+	}
+	if h.config.BreakerThreshold > 0 {
+		tun.Breaker = tunnel.NewBreaker(h.config.BreakerThreshold, h.config.BreakerWindow, h.config.BreakerCooldown)
+	}
+	if h.config.RequestsPerSecond > 0 {
+		tun.Limiter = tunnel.NewRateLimiter(h.config.RequestsPerSecond, h.config.BurstSize)
 	}
 
-	// Register tunnel
-	if err := h.registry.Register(tun); err != nil {
+	// Only clients that can reconnect get a token and a reservation
+	var reconnectToken string
+	if tun.HasCapability(CapabilityReconnect) {
+		var err error
+		if reconnectToken, err = generateReconnectToken(); err != nil {
+			return err
+		}
+		tun.TokenHash = tunnel.HashToken(reconnectToken)
+	}
+
+	// Register tunnel, or take over the reservation left by a previous connection
+	if req.ReconnectToken != "" {
+		replaced, err := h.registry.Reclaim(tun, req.ReconnectToken)
+		if err != nil {
+			return fmt.Errorf("failed to reclaim tunnel: %w", err)
+		}
+		tunnelID = tun.ID
+		h.logf("Tunnel reclaimed after reconnect: %s", selectedSubdomain)
+
+		// The old connection hasn't noticed it dropped; it no longer
+		// carries the tunnel, so close it
+		if replaced != nil {
+			h.logf("Closing previous connection %s of tunnel %s", replaced.ConnID, selectedSubdomain)
+			replaced.MarkClosing()
+			replaced.WSConn.Close()
+		}
+	} else if err := h.registry.Register(tun); err != nil {
+		if errors.Is(err, tunnel.ErrAtCapacity) || errors.Is(err, tunnel.ErrMaintenance) {
+			return err
+		}
 		return fmt.Errorf("failed to register tunnel: %w", err)
 	}
 
 	h.tunnelID = tunnelID
 	h.subdomain = selectedSubdomain
+	metrics.TunnelsCreated.Inc()
 
 	// Send success response
 	fullDomain := fmt.Sprintf("%s.%s", selectedSubdomain, h.config.Domain)
 	response := RegisterResponse{
-		TunnelID:   tunnelID,
-		Subdomain:  selectedSubdomain,
-		FullDomain: fullDomain,
-		LocalAddr:  localAddr,
-		Message:    fmt.Sprintf("Tunnel created: https://%s -> %s", fullDomain, localAddr),
+		TunnelID:       tunnelID,
+		Subdomain:      selectedSubdomain,
+		FullDomain:     fullDomain,
+		LocalAddr:      localAddr,
+		Message:        fmt.Sprintf("Tunnel created: https://%s -> %s", fullDomain, localAddr),
+		ReconnectToken: reconnectToken,
+		Capabilities:   tun.Caps,
 	}
+	capacity := h.registry.Capacity()
+	response.Capacity = &capacity
+	response.QRCode = h.qrCode(fullDomain)
 
-	log.Printf("Tunnel registered: %s -> %s", fullDomain, localAddr)
+	if h.client != "" {
+		h.logf("Tunnel registered by %s: %s -> %s", h.client, fullDomain, localAddr)
+	} else {
+		h.logf("Tunnel registered: %s -> %s", fullDomain, localAddr)
+	}
 
 	return h.sendSuccess(response)
 }
 
+// generateSubdomain picks a random subdomain in the configured style that
+// is valid and not in use, retrying on collisions up to SubdomainAttempts times
+func (h *Handler) generateSubdomain() (string, error) {
+	attempts := max(h.config.SubdomainAttempts, 1)
+	for attempt := 0; attempt < attempts; attempt++ {
+		var name string
+		var err error
+		if h.config.SubdomainStyle == config.SubdomainStyleReadable {
+			name, err = subdomain.GenerateReadable()
+		} else {
+			name, err = subdomain.Generate(h.config.SubdomainLength)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to generate subdomain: %w", err)
+		}
+
+		if subdomain.Validate(name, h.config.MaxSubdomainLen) == nil && h.registry.IsSubdomainAvailable(name) {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("failed to find a free random subdomain after %d attempts, please try again", attempts)
+}
+
 // handleUnregister handles tunnel unregistration
 func (h *Handler) handleUnregister(msg *Message) error {
 	if h.subdomain == "" {
 		return fmt.Errorf("no tunnel registered")
 	}
 
-	h.registry.Unregister(h.subdomain)
-	log.Printf("Tunnel unregistered: %s", h.subdomain)
-
+	removed := h.registry.Unregister(h.subdomain)
+	name := h.subdomain
 	h.tunnelID = ""
 	h.subdomain = ""
 
+	// The server may already have closed the tunnel, e.g. after
+	// certificate failures
+	if !removed {
+		return fmt.Errorf("tunnel %s was already unregistered", name)
+	}
+	h.logf("Tunnel unregistered: %s", name)
+
 	return h.sendSuccess(map[string]string{
 		"message": "Tunnel unregistered successfully",
 	})
 }
 
+// handlePause pauses or resumes traffic to the registered tunnel.
+// The tunnel stays registered, so the subdomain is kept while paused.
+func (h *Handler) handlePause(pause bool) error {
+	if h.subdomain == "" {
+		return fmt.Errorf("no tunnel registered")
+	}
+
+	tun, exists := h.registry.Get(h.subdomain)
+	if !exists {
+		return fmt.Errorf("tunnel not found: %s", h.subdomain)
+	}
+
+	if !tun.HasCapability(CapabilityPause) {
+		return fmt.Errorf("capability '%s' was not negotiated", CapabilityPause)
+	}
+
+	state := "resumed"
+	if pause {
+		tun.Pause()
+		state = "paused"
+	} else {
+		tun.Resume()
+	}
+	h.logf("Tunnel %s: %s", state, h.subdomain)
+
+	return h.sendSuccess(map[string]string{
+		"message": fmt.Sprintf("Tunnel %s", state),
+	})
+}
+
+// handleRename moves the registered tunnel to a new subdomain without
+// dropping it. The tunnel keeps its ID and reconnect token.
+func (h *Handler) handleRename(msg *Message) error {
+	if h.subdomain == "" {
+		return fmt.Errorf("no tunnel registered")
+	}
+
+	var req RenameRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		return fmt.Errorf("invalid rename request: %w", err)
+	}
+
+	normalized := subdomain.Normalize(req.Subdomain)
+	if err := subdomain.Validate(normalized, h.config.MaxSubdomainLen); err != nil {
+		return fmt.Errorf("invalid subdomain: %w", err)
+	}
+	if normalized == h.subdomain {
+		return fmt.Errorf("tunnel already uses subdomain '%s'", normalized)
+	}
+
+	if err := h.registry.Rename(h.subdomain, normalized); err != nil {
+		return fmt.Errorf("failed to rename tunnel: %w", err)
+	}
+
+	tun, _ := h.registry.Get(normalized)
+	oldSubdomain := h.subdomain
+	h.subdomain = normalized
+
+	// The certificate for the new host is issued on its first TLS
+	// handshake, just as it is for a newly registered tunnel
+	fullDomain := fmt.Sprintf("%s.%s", normalized, h.config.Domain)
+	h.logf("Tunnel renamed: %s -> %s", oldSubdomain, normalized)
+
+	response := RegisterResponse{
+		TunnelID:   h.tunnelID,
+		Subdomain:  normalized,
+		FullDomain: fullDomain,
+		Message:    fmt.Sprintf("Tunnel renamed: https://%s", fullDomain),
+	}
+	if tun != nil {
+		response.LocalAddr = tun.LocalAddr
+		response.Capabilities = tun.Caps
+	}
+	response.QRCode = h.qrCode(fullDomain)
+
+	return h.sendSuccess(response)
+}
+
+// qrCode returns the QR code for the tunnel at fullDomain, or "" when
+// REGISTER_QR_CODE is off
+func (h *Handler) qrCode(fullDomain string) string {
+	if !h.config.RegisterQRCode {
+		return ""
+	}
+
+	scheme := "http"
+	if h.config.EnableHTTPS {
+		scheme = "https"
+	}
+	code, err := qrcode.Encode(scheme + "://" + fullDomain)
+	if err != nil {
+		h.logf("Failed to encode QR code: %v", err)
+		return ""
+	}
+	return code.Terminal()
+}
+
 // handlePing handles ping messages
 func (h *Handler) handlePing() error {
 	return h.send(&Message{
@@ -213,15 +577,69 @@ func (h *Handler) sendSuccess(data interface{}) error {
 	})
 }
 
-// sendError sends an error message
-func (h *Handler) sendError(errMsg string) error {
+// sendError sends an error message, tagged with a code for known failures
+func (h *Handler) sendError(err error) error {
 	return h.send(&Message{
 		Type:      MessageTypeError,
-		Error:     errMsg,
+		Error:     err.Error(),
+		Code:      errorCode(err),
 		Timestamp: time.Now(),
 	})
 }
 
+// errorCode maps an error to the code sent to the client, if any
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, tunnel.ErrAtCapacity):
+		return ErrorCodeAtCapacity
+	case errors.Is(err, tunnel.ErrMaintenance):
+		return ErrorCodeMaintenance
+	case errors.Is(err, ErrPortNotAllowed):
+		return ErrorCodePortDenied
+	case errors.Is(err, ErrAlreadyRegistered):
+		return ErrorCodeRegistered
+	default:
+		return ""
+	}
+}
+
+// localPort extracts the port from a host:port address
+func localPort(addr string) (int, error) {
+	_, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", portText)
+	}
+	return port, nil
+}
+
+// negotiateCapabilities returns the requested capabilities the server
+// supports, ignoring unknown and duplicate entries
+func negotiateCapabilities(requested []string) []string {
+	negotiated := []string{}
+	for _, supported := range supportedCapabilities {
+		for _, c := range requested {
+			if c == supported {
+				negotiated = append(negotiated, supported)
+				break
+			}
+		}
+	}
+	return negotiated
+}
+
+// generateReconnectToken creates a random token for reclaiming a tunnel
+func generateReconnectToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate reconnect token: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
 // send sends a message to the client
 func (h *Handler) send(msg *Message) error {
 	return h.conn.WriteMessage(msg)
@@ -0,0 +1,534 @@
+package websocket
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/qrcode"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+)
+
+// reconnect registers again with the token of a previous registration
+func (c *testClient) reconnect(prev RegisterResponse) *Message {
+	c.t.Helper()
+
+	c.send(MessageTypeReconnect, RegisterRequest{
+		Subdomain:      prev.Subdomain,
+		TunnelID:       prev.TunnelID,
+		ReconnectToken: prev.ReconnectToken,
+		LocalPort:      3000,
+		Capabilities:   []string{CapabilityReconnect},
+	})
+	return c.next()
+}
+
+func TestReconnectReclaimsTunnel(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	first := h.connect(nil)
+	prev := first.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{CapabilityReconnect}})
+	if prev.ReconnectToken == "" {
+		t.Fatal("no reconnect token issued to a client with the reconnect capability")
+	}
+
+	first.close()
+	testkit.WaitFor(t, "tunnel to be released", func() bool {
+		_, ok := h.registry.Get("myapp")
+		return !ok
+	})
+
+	// The reservation holds the subdomain against other clients
+	other := h.connect(nil)
+	other.send(MessageTypeRegister, RegisterRequest{Subdomain: "myapp", LocalPort: 3000})
+	other.expectError()
+
+	second := h.connect(nil)
+	msg := second.reconnect(prev)
+	if msg.Type != MessageTypeSuccess {
+		t.Fatalf("reconnect = %s (%s), want success", msg.Type, msg.Error)
+	}
+	res := second.decodeResponse(msg)
+	if res.Subdomain != "myapp" || res.TunnelID != prev.TunnelID {
+		t.Fatalf("reclaimed %s/%s, want %s/%s", res.Subdomain, res.TunnelID, "myapp", prev.TunnelID)
+	}
+	if res.ReconnectToken == "" || res.ReconnectToken == prev.ReconnectToken {
+		t.Fatal("reconnect did not issue a fresh token")
+	}
+}
+
+func TestReconnectAfterGraceFails(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.ReconnectGrace = 20 * time.Millisecond
+	h := newHarness(t, cfg)
+	first := h.connect(nil)
+	prev := first.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{CapabilityReconnect}})
+
+	first.close()
+	testkit.WaitFor(t, "tunnel to be released", func() bool {
+		_, ok := h.registry.Get("myapp")
+		return !ok
+	})
+	time.Sleep(2 * cfg.ReconnectGrace)
+
+	second := h.connect(nil)
+	if msg := second.reconnect(prev); msg.Type != MessageTypeError {
+		t.Fatalf("reconnect after the grace period = %s, want error", msg.Type)
+	}
+
+	// The subdomain is free again
+	third := h.connect(nil)
+	third.register(RegisterRequest{Subdomain: "myapp"})
+}
+
+func TestReconnectWithWrongTokenFails(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	first := h.connect(nil)
+	prev := first.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{CapabilityReconnect}})
+	first.close()
+	testkit.WaitFor(t, "tunnel to be released", func() bool {
+		_, ok := h.registry.Get("myapp")
+		return !ok
+	})
+
+	prev.ReconnectToken = "not-the-token"
+	second := h.connect(nil)
+	if msg := second.reconnect(prev); msg.Type != MessageTypeError {
+		t.Fatalf("reconnect with a wrong token = %s, want error", msg.Type)
+	}
+}
+
+func TestNoReconnectTokenWithoutCapability(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	if res := client.register(RegisterRequest{Subdomain: "myapp"}); res.ReconnectToken != "" {
+		t.Fatal("reconnect token issued to a client without the reconnect capability")
+	}
+}
+
+func TestRegisterAtCapacity(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.MaxTunnels = 1
+	h := newHarness(t, cfg)
+	h.connect(nil).register(RegisterRequest{Subdomain: "first"})
+
+	late := h.connect(nil)
+	late.send(MessageTypeRegister, RegisterRequest{Subdomain: "second", LocalPort: 3000})
+	msg := late.expectError()
+	if msg.Code != ErrorCodeAtCapacity {
+		t.Fatalf("error code = %q, want %q", msg.Code, ErrorCodeAtCapacity)
+	}
+	if msg.Error != tunnel.ErrAtCapacity.Error() {
+		t.Fatalf("error = %q, want the capacity message", msg.Error)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.PausedMessage = "back soon"
+	h := newHarness(t, cfg)
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{CapabilityPause, CapabilityMux}})
+	client.serve(echoHandler, true)
+
+	if resp := h.get("myapp", "/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status before pausing = %d, want 200", resp.StatusCode)
+	}
+
+	client.send(MessageTypePause, nil)
+	client.expect(MessageTypeSuccess)
+	resp := h.get("myapp", "/")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status while paused = %d, want 503", resp.StatusCode)
+	}
+	if body := testkit.ReadBody(t, resp); !strings.Contains(body, "back soon") {
+		t.Fatalf("paused body = %q, want the paused message", body)
+	}
+	tun, ok := h.registry.Get("myapp")
+	if !ok || !tun.IsPaused() {
+		t.Fatal("paused tunnel lost its registration")
+	}
+
+	// Pausing twice is harmless
+	client.send(MessageTypePause, nil)
+	client.expect(MessageTypeSuccess)
+
+	client.send(MessageTypeResume, nil)
+	client.expect(MessageTypeSuccess)
+	if resp := h.get("myapp", "/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status after resuming = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestPauseRequiresCapability(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+
+	unregistered := h.connect(nil)
+	unregistered.send(MessageTypePause, nil)
+	unregistered.expectError()
+
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+	client.send(MessageTypePause, nil)
+	client.expectError()
+	if tun, _ := h.registry.Get("myapp"); tun.IsPaused() {
+		t.Fatal("tunnel paused without the pause capability")
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	for _, tt := range []struct {
+		requested, want []string
+	}{
+		{nil, []string{}},
+		{[]string{"compression", "ip-forwarding"}, []string{}},
+		{[]string{CapabilityMux, "compression"}, []string{CapabilityMux}},
+		{[]string{CapabilityMux, CapabilityReconnect, CapabilityReconnect}, []string{CapabilityReconnect, CapabilityMux}},
+		{supportedCapabilities, supportedCapabilities},
+	} {
+		got := negotiateCapabilities(tt.requested)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("negotiateCapabilities(%v) = %v, want %v", tt.requested, got, tt.want)
+		}
+	}
+}
+
+// A client offering features this server lacks gets the shared subset,
+// and only that subset is enabled on its tunnel
+func TestRegisterNegotiatesCapabilities(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+
+	client := h.connect(nil)
+	res := client.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{"compression", CapabilityPause}})
+	if fmt.Sprint(res.Capabilities) != fmt.Sprint([]string{CapabilityPause}) {
+		t.Fatalf("negotiated %v, want [%s]", res.Capabilities, CapabilityPause)
+	}
+	tun, _ := h.registry.Get("myapp")
+	if !tun.HasCapability(CapabilityPause) || tun.HasCapability("compression") || tun.HasCapability(CapabilityMux) {
+		t.Fatalf("tunnel capabilities = %v", tun.Caps)
+	}
+
+	// Older clients send no capabilities and get none
+	old := h.connect(nil)
+	old.send(MessageTypeRegister, RegisterRequest{Subdomain: "legacy", LocalPort: 3000})
+	msg := old.expect(MessageTypeSuccess)
+	if !strings.Contains(string(msg.Data), `"capabilities":[]`) {
+		t.Fatalf("response to a client without capabilities = %s, want an empty list", msg.Data)
+	}
+}
+
+func TestBreakerOffByDefault(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+
+	tun, ok := h.registry.Get("myapp")
+	if !ok {
+		t.Fatal("tunnel is not registered")
+	}
+	if tun.Breaker != nil {
+		t.Fatal("tunnel has a circuit breaker although BREAKER_THRESHOLD is unset")
+	}
+}
+
+func TestRegisterRespectsMaxSubdomainLength(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.MaxSubdomainLen = 10
+	cfg.SubdomainLength = 8
+	h := newHarness(t, cfg)
+
+	h.connect(nil).register(RegisterRequest{Subdomain: "tenletters"})
+
+	long := h.connect(nil)
+	long.send(MessageTypeRegister, RegisterRequest{Subdomain: "elevenchars", LocalPort: 3000})
+	if msg := long.expectError(); !strings.Contains(msg.Error, "10 characters") {
+		t.Fatalf("error = %q, want the configured limit", msg.Error)
+	}
+
+	// Generated names stay within the limit too
+	if res := h.connect(nil).register(RegisterRequest{}); len(res.Subdomain) > cfg.MaxSubdomainLen {
+		t.Fatalf("generated subdomain %q is longer than %d", res.Subdomain, cfg.MaxSubdomainLen)
+	}
+}
+
+func TestRegisterGivesUpAfterSubdomainAttempts(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.SubdomainAttempts = 3
+	cfg.MaxSubdomainLen = 4 // shorter than any generated name, so every attempt is rejected
+	h := newHarness(t, cfg)
+
+	client := h.connect(nil)
+	client.send(MessageTypeRegister, RegisterRequest{LocalPort: 3000})
+	if msg := client.expectError(); !strings.Contains(msg.Error, "after 3 attempts") {
+		t.Fatalf("error = %q, want the configured attempt count", msg.Error)
+	}
+}
+
+func TestRenameMovesTunnel(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	h.connect(nil).register(RegisterRequest{Subdomain: "taken"})
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+
+	client.send(MessageTypeRename, RenameRequest{Subdomain: "taken"})
+	client.expectError()
+
+	client.send(MessageTypeRename, RenameRequest{Subdomain: "renamed"})
+	if res := client.decodeResponse(client.expect(MessageTypeSuccess)); res.Subdomain != "renamed" {
+		t.Fatalf("rename response subdomain = %q, want %q", res.Subdomain, "renamed")
+	}
+	client.serve(echoHandler, false)
+
+	resp := h.get("renamed", "/")
+	if got, want := testkit.ReadBody(t, resp), "GET / renamed."+testkit.Domain; resp.StatusCode != http.StatusOK || got != want {
+		t.Fatalf("response = %d %q, want 200 %q", resp.StatusCode, got, want)
+	}
+	if resp := h.get("myapp", "/"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("old name status = %d, want 404", resp.StatusCode)
+	}
+
+	// The tunnel is released under its new name when the client leaves
+	client.close()
+	testkit.WaitFor(t, "renamed tunnel to be unregistered", func() bool {
+		return h.registry.Count() == 1
+	})
+	if _, ok := h.registry.Get("renamed"); ok {
+		t.Fatal("renamed tunnel is still registered after its client left")
+	}
+}
+
+func TestRegisterPathNormalization(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	h.connect(nil).register(RegisterRequest{Subdomain: "clean", NormalizePaths: true})
+	h.connect(nil).register(RegisterRequest{Subdomain: "verbatim"})
+
+	for name, want := range map[string]bool{"clean": true, "verbatim": false} {
+		if tun, _ := h.registry.Get(name); tun.NormalizePaths != want {
+			t.Errorf("%s: NormalizePaths = %t, want %t", name, tun.NormalizePaths, want)
+		}
+	}
+}
+
+func TestHostHeaderOverride(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "saas", HostHeader: "localhost:3000", Capabilities: []string{CapabilityMux}})
+	client.serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.Header.Get("X-Forwarded-Host"))
+	}), true)
+
+	// The backend sees the override; the public host stays available
+	if body := testkit.ReadBody(t, h.get("saas", "/")); body != "localhost:3000 saas."+testkit.Domain {
+		t.Fatalf("backend saw Host and X-Forwarded-Host %q", body)
+	}
+
+	plain := h.connect(nil)
+	plain.register(RegisterRequest{Subdomain: "plain", Capabilities: []string{CapabilityMux}})
+	plain.serve(echoHandler, true)
+	if body := testkit.ReadBody(t, h.get("plain", "/")); !strings.HasSuffix(body, " plain."+testkit.Domain) {
+		t.Fatalf("tunnel without an override forwarded %q", body)
+	}
+
+	bad := h.connect(nil)
+	bad.send(MessageTypeRegister, RegisterRequest{Subdomain: "bad", LocalPort: 3000, HostHeader: "evil\r\nX-Injected: 1"})
+	bad.expectError()
+}
+
+func TestUnregisterTwice(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+
+	client.send(MessageTypeUnregister, nil)
+	client.expect(MessageTypeSuccess)
+	client.send(MessageTypeUnregister, nil)
+	client.expectError()
+
+	if h.registry.Count() != 0 {
+		t.Fatalf("Count() = %d after unregistering", h.registry.Count())
+	}
+}
+
+// A tunnel the server already closed isn't reported as unregistered by
+// the client
+func TestUnregisterAfterServerClosedTunnel(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+	h.registry.Unregister("myapp")
+
+	client.send(MessageTypeUnregister, nil)
+	if msg := client.expectError(); !strings.Contains(msg.Error, "already unregistered") {
+		t.Fatalf("error = %q, want already unregistered", msg.Error)
+	}
+}
+
+func TestRegisterEnforcesLocalPortPolicy(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.AllowedLocalPorts = []string{"3000", "8000-8999"}
+	h := newHarness(t, cfg)
+
+	h.connect(nil).register(RegisterRequest{Subdomain: "web", LocalPort: 3000})
+	h.connect(nil).register(RegisterRequest{Subdomain: "backend", LocalAddr: "127.0.0.1:8080"})
+
+	for name, req := range map[string]RegisterRequest{
+		"ssh":   {Subdomain: "ssh", LocalPort: 22},
+		"db":    {Subdomain: "db", LocalAddr: "db.internal:5432"},
+		"above": {Subdomain: "above", LocalPort: 9000},
+	} {
+		client := h.connect(nil)
+		client.send(MessageTypeRegister, req)
+		if msg := client.expectError(); msg.Code != ErrorCodePortDenied {
+			t.Errorf("%s: error code = %q (%s), want %q", name, msg.Code, msg.Error, ErrorCodePortDenied)
+		}
+	}
+}
+
+// Control messages must keep being answered once mux is negotiated, even
+// though the stream mux is waiting for data on the same connection
+func TestMuxKeepsControlChannelResponsive(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{CapabilityMux, CapabilityPause}})
+
+	for i := 0; i < 20; i++ {
+		client.send(MessageTypePause, nil)
+		client.expect(MessageTypeSuccess)
+		client.send(MessageTypeResume, nil)
+		client.expect(MessageTypeSuccess)
+	}
+
+	client.send(MessageTypeUnregister, nil)
+	client.expect(MessageTypeSuccess)
+	if _, ok := h.registry.Get("myapp"); ok {
+		t.Fatal("tunnel is still registered after unregister")
+	}
+}
+
+func TestMuxConcurrentRequests(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	res := client.register(RegisterRequest{Subdomain: "myapp", Capabilities: []string{CapabilityMux}})
+	if len(res.Capabilities) != 1 || res.Capabilities[0] != CapabilityMux {
+		t.Fatalf("negotiated capabilities = %v, want [mux]", res.Capabilities)
+	}
+	client.serve(echoHandler, true)
+
+	const requests = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/req/%d", i)
+			resp := h.get("myapp", path)
+			body := testkit.ReadBody(t, resp)
+			if want := "GET " + path + " myapp." + testkit.Domain; resp.StatusCode != http.StatusOK || body != want {
+				errs <- fmt.Errorf("request %d: %d %q, want 200 %q", i, resp.StatusCode, body, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Control messages still work after streams were opened and closed
+	client.send(MessageTypePing, nil)
+	client.expect(MessageTypePong)
+}
+
+func TestSecondRegisterIsRejected(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "first"})
+
+	client.send(MessageTypeRegister, RegisterRequest{Subdomain: "second", LocalPort: 3000})
+	if msg := client.expectError(); msg.Code != ErrorCodeRegistered {
+		t.Fatalf("second register = %q (%s), want %q", msg.Code, msg.Error, ErrorCodeRegistered)
+	}
+	if _, ok := h.registry.Get("second"); ok {
+		t.Fatal("second register created a tunnel")
+	}
+	if _, ok := h.registry.Get("first"); !ok || h.registry.Count() != 1 {
+		t.Fatalf("registry holds %d tunnels after the rejected register, want only first", h.registry.Count())
+	}
+
+	// Once unregistered, the connection may register again
+	client.send(MessageTypeUnregister, nil)
+	client.expect(MessageTypeSuccess)
+	client.register(RegisterRequest{Subdomain: "second"})
+
+	// Disconnecting leaves nothing behind
+	client.close()
+	testkit.WaitFor(t, "tunnels to be unregistered", func() bool {
+		return h.registry.Count() == 0
+	})
+}
+
+func TestRegisterValidatesLocalAddress(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+
+	for name, tt := range map[string]struct {
+		req RegisterRequest
+		ok  bool
+	}{
+		"port 0":             {RegisterRequest{LocalPort: 0}, false},
+		"negative port":      {RegisterRequest{LocalPort: -1}, false},
+		"port 70000":         {RegisterRequest{LocalPort: 70000}, false},
+		"port 65535":         {RegisterRequest{LocalPort: 65535}, true},
+		"addr without port":  {RegisterRequest{LocalAddr: "localhost"}, false},
+		"addr with bad port": {RegisterRequest{LocalAddr: "localhost:http"}, false},
+		"addr port 0":        {RegisterRequest{LocalAddr: "localhost:0"}, false},
+		"addr port 70000":    {RegisterRequest{LocalAddr: "127.0.0.1:70000"}, false},
+		"malformed addr":     {RegisterRequest{LocalAddr: "[::1:3000"}, false},
+		"addr only":          {RegisterRequest{LocalAddr: "127.0.0.1:3000"}, true},
+		"ipv6 addr":          {RegisterRequest{LocalAddr: "[::1]:3000"}, true},
+		"addr overrides 0":   {RegisterRequest{LocalAddr: "localhost:8080", LocalPort: 0}, true},
+	} {
+		client := h.connect(nil)
+		client.send(MessageTypeRegister, tt.req)
+		msg := client.next()
+		if ok := msg.Type == MessageTypeSuccess; ok != tt.ok {
+			t.Errorf("%s: register = %s (%s), want success %t", name, msg.Type, msg.Error, tt.ok)
+		}
+		if !tt.ok && !strings.Contains(msg.Error, "local_") {
+			t.Errorf("%s: error %q does not name the invalid field", name, msg.Error)
+		}
+		client.close()
+	}
+}
+
+func TestRegisterQRCode(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	if res := h.connect(nil).register(RegisterRequest{Subdomain: "plain"}); res.QRCode != "" {
+		t.Fatal("QR code sent without REGISTER_QR_CODE")
+	}
+
+	cfg := testkit.Config()
+	cfg.RegisterQRCode = true
+	h = newHarness(t, cfg)
+	client := h.connect(nil)
+	res := client.register(RegisterRequest{Subdomain: "myapp"})
+	want, err := qrcode.Encode("http://myapp." + testkit.Domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.QRCode != want.Terminal() {
+		t.Fatalf("QR code =\n%s\nwant the code of the public URL", res.QRCode)
+	}
+
+	// A renamed tunnel gets the code of its new URL
+	client.send(MessageTypeRename, RenameRequest{Subdomain: "renamed"})
+	renamed := client.decodeResponse(client.expect(MessageTypeSuccess))
+	want, _ = qrcode.Encode("http://renamed." + testkit.Domain)
+	if renamed.QRCode != want.Terminal() {
+		t.Fatal("rename response does not carry the code of the new URL")
+	}
+}
@@ -0,0 +1,437 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/proxy"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"github.com/gorilla/websocket"
+)
+
+// harness runs the control server and the proxy in memory. Tunnel clients
+// connect to control and visitors to visitors; both share one registry.
+type harness struct {
+	t        *testing.T
+	config   *config.Config
+	registry *tunnel.Registry
+	server   *Server
+	proxy    *proxy.Handler
+	control  *testkit.MemListener
+	visitors *testkit.MemListener
+}
+
+// newHarness starts a control server and proxy for cfg
+func newHarness(t *testing.T, cfg *config.Config) *harness {
+	t.Helper()
+
+	registry := tunnel.NewRegistry(cfg.MaxTunnels)
+	h := &harness{
+		t:        t,
+		config:   cfg,
+		registry: registry,
+		server:   NewServer(cfg, registry, nil),
+		proxy:    proxy.NewHandler(cfg, registry),
+	}
+	h.control = testkit.ServeInMemory(t, h.server.Handler())
+	h.visitors = testkit.ServeInMemory(t, h.proxy)
+	return h
+}
+
+// connect opens a tunnel client connection
+func (h *harness) connect(header http.Header) *testClient {
+	h.t.Helper()
+	return newTestClient(h.t, testkit.DialInMemory(h.t, h.control, "/tunnel", header))
+}
+
+// get sends a visitor request for path on the tunnel's host
+func (h *harness) get(subdomain, path string) *http.Response {
+	h.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+subdomain+"."+testkit.Domain+path, nil)
+	if err != nil {
+		h.t.Fatalf("new request: %v", err)
+	}
+	return h.do(req)
+}
+
+// do sends a visitor request through the proxy
+func (h *harness) do(req *http.Request) *http.Response {
+	h.t.Helper()
+
+	client := &http.Client{
+		Timeout: testkit.Timeout,
+		Transport: &http.Transport{
+			DialContext:       h.visitors.DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		h.t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+	}
+	h.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// testAdminToken is the admin API token of harnesses that enable it
+const testAdminToken = "admin-secret"
+
+// admin sends an admin API request with testAdminToken to the control
+// server and decodes the JSON answer into out, if given. It returns the
+// response status.
+func (h *harness) admin(method, path string, body io.Reader, out interface{}) int {
+	h.t.Helper()
+	return h.adminAs(testAdminToken, method, path, body, out)
+}
+
+// adminAs is admin with an explicit bearer token
+func (h *harness) adminAs(token, method, path string, body io.Reader, out interface{}) int {
+	h.t.Helper()
+
+	req, err := http.NewRequest(method, "http://"+testkit.Domain+path, body)
+	if err != nil {
+		h.t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return h.adminDo(req, out)
+}
+
+// adminDo sends req to the control server as is and decodes the JSON
+// answer into out, if given. It returns the response status.
+func (h *harness) adminDo(req *http.Request, out interface{}) int {
+	h.t.Helper()
+
+	client := &http.Client{Timeout: testkit.Timeout, Transport: &http.Transport{DialContext: h.control.DialContext}}
+	resp, err := client.Do(req)
+	if err != nil {
+		h.t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			h.t.Fatalf("decode %s %s: %v", req.Method, req.URL.Path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// testClient is a scripted tunnel client. Like the real clients it reads
+// the connection on one goroutine: control messages are handed to expect,
+// binary data to the local handler set with serve.
+type testClient struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	control chan *Message
+
+	mu      sync.Mutex
+	handler http.Handler
+	mux     bool
+	data    chan<- []byte            // request bytes for the unframed handler
+	streams map[uint32]chan<- []byte // request bytes per stream when multiplexing
+	pending []byte                   // partial mux frame
+}
+
+func newTestClient(t *testing.T, conn *websocket.Conn) *testClient {
+	c := &testClient{
+		t:       t,
+		conn:    conn,
+		control: make(chan *Message, 16),
+		streams: make(map[uint32]chan<- []byte),
+	}
+	go c.readLoop()
+	return c
+}
+
+// readLoop dispatches frames from the server until the connection closes
+func (c *testClient) readLoop() {
+	defer close(c.control)
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.mu.Lock()
+			if c.data != nil {
+				close(c.data)
+			}
+			for _, in := range c.streams {
+				close(in)
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		if messageType == websocket.TextMessage {
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				c.t.Errorf("invalid control message %q: %v", data, err)
+				continue
+			}
+			c.control <- &msg
+			continue
+		}
+
+		c.mu.Lock()
+		if c.mux {
+			c.handleFramesLocked(data)
+		} else if c.data != nil {
+			c.data <- data
+		}
+		c.mu.Unlock()
+	}
+}
+
+// send writes a control message
+func (c *testClient) send(msgType MessageType, data interface{}) {
+	c.t.Helper()
+
+	msg := Message{Type: msgType, Timestamp: time.Now()}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			c.t.Fatalf("marshal %s: %v", msgType, err)
+		}
+		msg.Data = raw
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatalf("send %s: %v", msgType, err)
+	}
+}
+
+// next returns the next control message from the server
+func (c *testClient) next() *Message {
+	c.t.Helper()
+
+	select {
+	case msg, ok := <-c.control:
+		if !ok {
+			c.t.Fatal("connection closed while waiting for a control message")
+		}
+		return msg
+	case <-time.After(testkit.Timeout):
+		c.t.Fatal("timed out waiting for a control message")
+		return nil
+	}
+}
+
+// expect returns the next control message, failing unless it has type want
+func (c *testClient) expect(want MessageType) *Message {
+	c.t.Helper()
+
+	msg := c.next()
+	if msg.Type != want {
+		c.t.Fatalf("got %s message (%s), want %s", msg.Type, msg.Error, want)
+	}
+	return msg
+}
+
+// expectError returns the next control message, failing unless it is an error
+func (c *testClient) expectError() *Message {
+	c.t.Helper()
+	return c.expect(MessageTypeError)
+}
+
+// register registers a tunnel and returns the server's response
+func (c *testClient) register(req RegisterRequest) RegisterResponse {
+	c.t.Helper()
+
+	if req.LocalPort == 0 && req.LocalAddr == "" {
+		req.LocalPort = 3000
+	}
+	c.send(MessageTypeRegister, req)
+	return c.decodeResponse(c.expect(MessageTypeSuccess))
+}
+
+// decodeResponse decodes the RegisterResponse in a success message
+func (c *testClient) decodeResponse(msg *Message) RegisterResponse {
+	c.t.Helper()
+
+	var res RegisterResponse
+	if err := json.Unmarshal(msg.Data, &res); err != nil {
+		c.t.Fatalf("decode register response: %v", err)
+	}
+	return res
+}
+
+// serve answers proxied requests with handler. With mux set, requests
+// arrive as framed streams, as negotiated with CapabilityMux.
+func (c *testClient) serve(handler http.Handler, mux bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.handler = handler
+	c.mux = mux
+	if !mux {
+		c.data = c.startConn(c.writeBinary, nil)
+	}
+}
+
+// startConn starts answering the requests in the bytes sent to the
+// returned channel, writing responses with write. The channel is
+// buffered, so the read loop never waits for the handler.
+func (c *testClient) startConn(write func([]byte) error, done func()) chan<- []byte {
+	in := make(chan []byte, 256)
+	r, w := io.Pipe()
+	go func() {
+		for data := range in {
+			w.Write(data)
+		}
+		w.Close()
+	}()
+
+	go func() {
+		if done != nil {
+			defer done()
+		}
+
+		br := bufio.NewReader(r)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+
+			rec := httptest.NewRecorder()
+			c.handler.ServeHTTP(rec, req)
+			io.Copy(io.Discard, req.Body)
+
+			resp := rec.Result()
+			resp.ContentLength = int64(rec.Body.Len())
+			var out strings.Builder
+			resp.Write(&out)
+			if write([]byte(out.String())) != nil {
+				return
+			}
+		}
+	}()
+	return in
+}
+
+// handleFramesLocked splits mux frames out of data. c.mu must be held.
+func (c *testClient) handleFramesLocked(data []byte) {
+	c.pending = append(c.pending, data...)
+	for len(c.pending) >= 8 {
+		id := binary.BigEndian.Uint32(c.pending[:4])
+		length := int(binary.BigEndian.Uint32(c.pending[4:8]))
+		if len(c.pending) < 8+length {
+			return
+		}
+		payload := append([]byte(nil), c.pending[8:8+length]...)
+		c.pending = c.pending[8+length:]
+
+		in, open := c.streams[id]
+		switch {
+		case length == 0 && open:
+			close(in)
+			delete(c.streams, id)
+		case length == 0:
+		default:
+			if !open {
+				in = c.startConn(func(p []byte) error {
+					return c.writeFrame(id, p)
+				}, func() {
+					c.writeFrame(id, nil)
+				})
+				c.streams[id] = in
+			}
+			in <- payload
+		}
+	}
+}
+
+// writeFrame sends one mux frame
+func (c *testClient) writeFrame(id uint32, payload []byte) error {
+	frame := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], id)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	copy(frame[8:], payload)
+	return c.writeBinary(frame)
+}
+
+// writeBinary sends a binary message
+func (c *testClient) writeBinary(p []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(websocket.BinaryMessage, p)
+}
+
+// close closes the client's connection
+func (c *testClient) close() {
+	c.conn.Close()
+}
+
+// echoHandler answers every request with its method, path and Host
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Backend", "echo")
+	io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+r.Host)
+})
+
+func TestRegisterAndProxyRequest(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+
+	res := client.register(RegisterRequest{Subdomain: "myapp"})
+	if res.Subdomain != "myapp" || res.FullDomain != "myapp."+testkit.Domain {
+		t.Fatalf("register response = %+v", res)
+	}
+	if res.TunnelID == "" {
+		t.Fatal("register response has no tunnel ID")
+	}
+	client.serve(echoHandler, false)
+
+	resp := h.get("myapp", "/hello?x=1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got, want := testkit.ReadBody(t, resp), "GET /hello?x=1 myapp."+testkit.Domain; got != want {
+		t.Fatalf("body = %q, want %q", got, want)
+	}
+	if resp.Header.Get("X-Backend") != "echo" {
+		t.Fatal("backend response header was not passed through")
+	}
+
+	tun, ok := h.registry.Get("myapp")
+	if !ok {
+		t.Fatal("tunnel is not registered")
+	}
+	requests, in, out := atomic.LoadInt64(&tun.Requests), atomic.LoadInt64(&tun.BytesIn), atomic.LoadInt64(&tun.BytesOut)
+	if requests != 1 || in == 0 || out == 0 {
+		t.Fatalf("tunnel counters = %d requests, %d bytes in, %d bytes out", requests, in, out)
+	}
+}
+
+func TestRequestForUnknownTunnel(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+
+	resp := h.get("missing", "/")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestDisconnectUnregistersTunnel(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+
+	client.close()
+	testkit.WaitFor(t, "tunnel to be unregistered", func() bool {
+		_, ok := h.registry.Get("myapp")
+		return !ok
+	})
+}
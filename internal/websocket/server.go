@@ -1,26 +1,37 @@
 package websocket
 
 import (
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/ahmadrosid/tunnel/internal/audit"
 	"github.com/ahmadrosid/tunnel/internal/config"
+	"github.com/ahmadrosid/tunnel/internal/ipfilter"
+	"github.com/ahmadrosid/tunnel/internal/metrics"
+	"github.com/ahmadrosid/tunnel/internal/proxy"
 	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
 	// Time allowed to write a message to the peer
 	writeWait = 10 * time.Second
 
-	// Time allowed to read the next pong message from the peer
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period (must be less than pongWait)
-	pingPeriod = (pongWait * 9) / 10
+	// Time allowed to read the next pong message from the peer. Pings are
+	// sent every 9/10 of it.
+	defaultPongWait = 60 * time.Second
 
 	// Maximum message size allowed from peer
 	maxMessageSize = 512 * 1024 // 512KB
@@ -30,17 +41,28 @@ var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for now - can be restricted in production
+		// Origins are checked against ALLOWED_ORIGINS before upgrading,
+		// see originAllowed
 		return true
 	},
 }
 
+// Version is the server version reported by /health. main sets it from
+// build flags.
+var Version = "dev"
+
 // Server represents the WebSocket server
 type Server struct {
-	config      *config.Config
-	registry    *tunnel.Registry
-	server      *http.Server
-	certManager interface {
+	config       *config.Config
+	registry     *tunnel.Registry
+	audit        *audit.Log
+	server       *http.Server
+	metrics      http.Handler // serves /metrics from a registry of this server's collectors
+	started      time.Time
+	shuttingDown atomic.Bool        // /ready fails once shutdown has begun
+	denylist     *ipfilter.Denylist // source ranges refused before the upgrade; nil allows all
+	pongWait     time.Duration      // how long a client may leave a ping unanswered
+	certManager  interface {
 		GetTLSConfig() *tls.Config
 		GetTLSConfigForHijacking() *tls.Config
 	}
@@ -54,12 +76,15 @@ func NewServer(cfg *config.Config, registry *tunnel.Registry, certManager interf
 	s := &Server{
 		config:      cfg,
 		registry:    registry,
+		audit:       audit.NewLog(cfg.AuditLogSize),
 		certManager: certManager,
+		metrics:     promhttp.HandlerFor(metrics.NewRegistry(registry), promhttp.HandlerOpts{}),
+		started:     time.Now(),
+		pongWait:    defaultPongWait,
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/tunnel", s.handleWebSocket)
-	mux.HandleFunc("/health", s.handleHealth)
+	s.registerRoutes(mux)
 
 	s.server = &http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.WebSocketPort),
@@ -77,6 +102,24 @@ func NewServer(cfg *config.Config, registry *tunnel.Registry, certManager interf
 	return s
 }
 
+// registerRoutes adds the control endpoints to mux
+func (s *Server) registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/tunnel", s.handleWebSocket)
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/api/audit", s.requireAdmin(s.handleAudit))
+	mux.HandleFunc("/api/capacity", s.requireAdmin(s.handleCapacity))
+	mux.HandleFunc("/admin/tunnels", s.requireAdmin(s.handleTunnels))
+	mux.HandleFunc("/metrics", s.requireAdmin(s.handleMetrics))
+	mux.HandleFunc("/api/maintenance", s.requireAdmin(s.handleMaintenance))
+	mux.HandleFunc(tunnel.ExportPath, s.requireAdmin(s.handleRegistryExport))
+	mux.HandleFunc("/api/registry/import", s.requireAdmin(s.handleRegistryImport))
+	mux.HandleFunc("/api/sd", s.requireAdmin(s.handleServiceDiscovery))
+	mux.HandleFunc("/api/tunnels/{subdomain}", s.requireAdmin(s.handleKill))
+	mux.HandleFunc("/api/reservations", s.requireAdmin(s.handleReserve))
+	mux.HandleFunc("/api/reservations/{subdomain}", s.requireAdmin(s.handleDeleteReservation))
+}
+
 // Start starts the WebSocket server
 func (s *Server) Start() error {
 	// If WebSocket is on HTTPS port and HTTPS is enabled, use TLS
@@ -89,63 +132,221 @@ func (s *Server) Start() error {
 	return s.server.ListenAndServe()
 }
 
-// Shutdown gracefully shuts down the WebSocket server
-func (s *Server) Shutdown() error {
+// Handler returns the HTTP handler serving the control endpoints
+func (s *Server) Handler() http.Handler {
+	return s.server.Handler
+}
+
+// BeginShutdown makes /ready fail so load balancers stop sending traffic
+// while the servers drain
+func (s *Server) BeginShutdown() {
+	s.shuttingDown.Store(true)
+}
+
+// Shutdown gracefully shuts down the WebSocket server, waiting for control
+// API requests to finish until ctx is done. Tunnel connections have been
+// hijacked from the server and are not waited for.
+func (s *Server) Shutdown(ctx context.Context) error {
 	log.Println("Shutting down WebSocket server...")
-	return s.server.Close()
+	s.BeginShutdown()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.server.Close()
+		return err
+	}
+	return nil
+}
+
+// healthResponse is the body of /health
+type healthResponse struct {
+	Status        string `json:"status"` // "ok", or "maintenance" while registrations are refused
+	Version       string `json:"version"`
+	Uptime        string `json:"uptime"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+	Tunnels       int    `json:"tunnels"`
 }
 
 // handleHealth handles health check requests
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	uptime := time.Since(s.started)
+	response := healthResponse{
+		Status:        "ok",
+		Version:       Version,
+		Uptime:        uptime.Truncate(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+		Tunnels:       s.registry.Count(),
+	}
+
+	// Still healthy in maintenance: existing tunnels keep serving
+	if s.registry.InMaintenance() {
+		response.Status = "maintenance"
+	}
+
+	writeJSON(w, response)
+}
+
+// handleReady reports whether the server can take traffic. It answers 503
+// while the initial certificate is still being obtained and once shutdown
+// has begun.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if s.shuttingDown.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "shutting down\n")
+		return
+	}
+
+	if rc, ok := s.certManager.(interface{ Ready() error }); ok {
+		if err := rc.Ready(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%v\n", err)
+			return
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "OK\n")
 }
 
+// originAllowed reports whether r's Origin header is in AllowedOrigins.
+// Requests without one come from non-browser clients, which can't be
+// used for cross-site requests, and are allowed.
+func (s *Server) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(s.config.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range s.config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetDenylist refuses tunnel clients connecting from the ranges in d
+func (s *Server) SetDenylist(d *ipfilter.Denylist) {
+	s.denylist = d
+}
+
 // handleWebSocket handles WebSocket upgrade and connection
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Known-bad sources are refused before anything else is done for them
+	if ip := proxy.RealClientIP(r, s.config.TrustedHops); s.denylist.Contains(ip) {
+		metrics.ControlDenied.Inc()
+		slog.Warn("Rejected WebSocket connection: source IP is denied", "remote_addr", r.RemoteAddr, "ip", ip)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Browsers on other sites must not be able to open tunnels
+	if !s.originAllowed(r) {
+		slog.Warn("Rejected WebSocket connection: origin not allowed", "remote_addr", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Reject unauthenticated clients before upgrading
+	client, ok := s.authenticate(r)
+	if !ok {
+		slog.Warn("Rejected WebSocket connection: invalid or missing token", "remote_addr", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Tunnel clients are limited separately from visitors
+	if !metrics.ControlConnections.TryInc(int64(s.config.MaxControlConns)) {
+		metrics.ControlRejected.Inc()
+		slog.Warn("Rejected WebSocket connection: control connection limit reached", "remote_addr", r.RemoteAddr)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Too many tunnel connections, please try again later", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Failed to upgrade connection: %v", err)
+		metrics.ControlConnections.Dec()
+		slog.Warn("Failed to upgrade connection", "remote_addr", r.RemoteAddr, "error", err)
 		return
 	}
 
-	log.Printf("New WebSocket connection from %s", r.RemoteAddr)
+	// On a shared port the connection was accepted as a visitor
+	proxy.ReleaseVisitorSlot(conn.NetConn())
+
+	// Short ID that ties together the log lines for this connection
+	connID := uuid.New().String()[:8]
+	slog.Debug("New WebSocket connection", "conn", connID, "remote_addr", r.RemoteAddr, "client", client)
 
 	// Handle the WebSocket connection
-	go s.handleConnection(conn)
+	go s.handleConnection(conn, connID, client)
+}
+
+// authenticate checks the request's bearer token against AuthTokens and
+// returns the matching token's label. When no tokens are configured every
+// client is accepted with an empty label.
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	if len(s.config.AuthTokens) == 0 {
+		return "", true
+	}
+
+	presented, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || presented == "" {
+		return "", false
+	}
+
+	// Compare against every token so timing doesn't reveal which matched
+	var client string
+	matched := false
+	for token, label := range s.config.AuthTokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1 {
+			client, matched = label, true
+		}
+	}
+	return client, matched
 }
 
 // handleConnection manages a WebSocket connection
-func (s *Server) handleConnection(conn *websocket.Conn) {
+func (s *Server) handleConnection(conn *websocket.Conn, connID, client string) {
 	defer func() {
 		conn.Close()
-		log.Printf("WebSocket connection closed: %s", conn.RemoteAddr())
+		metrics.ControlConnections.Dec()
+		slog.Debug("WebSocket connection closed", "conn", connID, "remote_addr", conn.RemoteAddr().String())
 	}()
 
 	// Configure connection
+	// A client that stops answering pings, e.g. behind a half-open TCP
+	// connection, lets the read deadline pass. The read fails, which ends
+	// HandleMessages and unregisters the tunnel.
 	conn.SetReadLimit(maxMessageSize)
-	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetReadDeadline(time.Now().Add(s.pongWait))
 	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
+		return conn.SetReadDeadline(time.Now().Add(s.pongWait))
 	})
 
 	// Start ping ticker to keep connection alive
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(s.pongWait * 9 / 10)
 	defer ticker.Stop()
+	done := make(chan struct{})
+	defer close(done)
 
 	// Create connection wrapper
 	wsConn := NewConnection(conn)
+	wsConn.SetWriteCoalescing(s.config.WriteCoalesce)
 
 	// Handle messages from client
-	handler := NewHandler(s.config, s.registry, wsConn)
+	handler := NewHandler(s.config, s.registry, wsConn, s.audit, connID, client)
 
 	// Start ping routine
 	go func() {
-		for range ticker.C {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
 			if err := wsConn.WritePing(); err != nil {
-				log.Printf("Failed to send ping: %v", err)
+				slog.Debug("Failed to send ping", "conn", connID, "error", err)
+				wsConn.Close()
 				return
 			}
 		}
@@ -153,6 +354,11 @@ func (s *Server) handleConnection(conn *websocket.Conn) {
 
 	// Process incoming messages
 	if err := handler.HandleMessages(); err != nil {
-		log.Printf("Handler error: %v", err)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			slog.Info("Closed unresponsive tunnel connection", "conn", connID, "silent_for", s.pongWait)
+			return
+		}
+		slog.Debug("Handler error", "conn", connID, "error", err)
 	}
 }
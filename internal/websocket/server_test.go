@@ -0,0 +1,369 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ahmadrosid/tunnel/internal/ipfilter"
+	"github.com/ahmadrosid/tunnel/internal/metrics"
+	"github.com/ahmadrosid/tunnel/internal/testkit"
+	"github.com/ahmadrosid/tunnel/internal/tunnel"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTokenAuthentication(t *testing.T) {
+	cfg := testkit.Config()
+	// An entry like ":secret" has an empty label but is still a valid token
+	cfg.AuthTokens = map[string]string{"secret": "", "ci-token": "ci"}
+	h := newHarness(t, cfg)
+
+	for _, tt := range []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"unlabelled token", "Bearer secret", http.StatusSwitchingProtocols},
+		{"labelled token", "Bearer ci-token", http.StatusSwitchingProtocols},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+		{"not a bearer token", "Basic c2VjcmV0", http.StatusUnauthorized},
+		{"no header", "", http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.authorization != "" {
+				header.Set("Authorization", tt.authorization)
+			}
+			conn, resp, err := testkit.DialWebSocket(h.control, "/tunnel", header)
+			if conn != nil {
+				conn.Close()
+			}
+			if resp == nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "Bearer" {
+				t.Fatal("401 response has no WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	cfg := testkit.Config()
+	cfg.AllowedOrigins = []string{"https://dashboard.example.com/"}
+	h := newHarness(t, cfg)
+
+	for origin, status := range map[string]int{
+		"":                              http.StatusSwitchingProtocols,
+		"https://dashboard.example.com": http.StatusSwitchingProtocols,
+		"HTTPS://Dashboard.Example.com": http.StatusSwitchingProtocols,
+		"https://evil.example.com":      http.StatusForbidden,
+		"http://dashboard.example.com":  http.StatusForbidden,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := testkit.DialWebSocket(h.control, "/tunnel", header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("dial with origin %q: %v", origin, err)
+		}
+		if resp.StatusCode != status {
+			t.Errorf("origin %q: status = %d, want %d", origin, resp.StatusCode, status)
+		}
+	}
+}
+
+func TestNoTokensAllowsAnyClient(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+}
+
+func TestControlConnectionLimit(t *testing.T) {
+	// Connections of earlier tests may still be closing
+	testkit.WaitFor(t, "control connections to close", func() bool {
+		return metrics.ControlConnections.Value() == 0
+	})
+	rejected := testutil.ToFloat64(metrics.ControlRejected)
+
+	cfg := testkit.Config()
+	cfg.MaxControlConns = 2
+	h := newHarness(t, cfg)
+	serving := h.connect(nil)
+	serving.register(RegisterRequest{Subdomain: "myapp"})
+	serving.serve(echoHandler, false)
+	idle := h.connect(nil)
+
+	conn, resp, err := testkit.DialWebSocket(h.control, "/tunnel", nil)
+	if conn != nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("status over the limit = %d, want 503 with Retry-After", resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(metrics.ControlRejected) - rejected; got != 1 {
+		t.Fatalf("rejected counter grew by %v, want 1", got)
+	}
+
+	// Visitors are limited separately and still get through
+	if resp := h.get("myapp", "/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("visitor status with control connections full = %d, want 200", resp.StatusCode)
+	}
+
+	// A closed connection frees its slot
+	idle.close()
+	testkit.WaitFor(t, "control connection to be released", func() bool {
+		return metrics.ControlConnections.Value() == 1
+	})
+	h.connect(nil).register(RegisterRequest{Subdomain: "other"})
+}
+
+// Connection chatter is logged at debug so LOG_LEVEL=info keeps only
+// tunnel lifecycle events
+func TestConnectionDetailsLogAtDebug(t *testing.T) {
+	logs := testkit.CaptureLogs(t)
+	h := newHarness(t, testkit.Config())
+	client := h.connect(nil)
+	client.register(RegisterRequest{Subdomain: "myapp"})
+
+	levels := map[string]interface{}{}
+	for _, record := range logs.Records(t) {
+		msg, _ := record["msg"].(string)
+		levels[msg] = record["level"]
+	}
+	if level := levels["New WebSocket connection"]; level != "DEBUG" {
+		t.Errorf("new connection logged at %v, want DEBUG", level)
+	}
+	if level := levels["Tunnel registered: myapp."+testkit.Domain+" -> localhost:3000"]; level != "INFO" {
+		t.Errorf("registration logged at %v, want INFO (records %v)", level, levels)
+	}
+}
+
+func TestHealthReportsServerState(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	h.connect(nil).register(RegisterRequest{Subdomain: "one"})
+	h.connect(nil).register(RegisterRequest{Subdomain: "two"})
+
+	var health healthResponse
+	if status := h.admin(http.MethodGet, "/health", nil, &health); status != http.StatusOK {
+		t.Fatalf("GET /health = %d, want 200", status)
+	}
+	if health.Status != "ok" || health.Version != Version || health.Tunnels != 2 {
+		t.Fatalf("health = %+v, want ok, version %s and 2 tunnels", health, Version)
+	}
+	if health.Uptime == "" || health.UptimeSeconds < 0 {
+		t.Fatalf("health uptime = %q (%d seconds)", health.Uptime, health.UptimeSeconds)
+	}
+}
+
+func TestReadyFailsOnShutdown(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	if status := h.admin(http.MethodGet, "/ready", nil, nil); status != http.StatusOK {
+		t.Fatalf("GET /ready = %d, want 200", status)
+	}
+
+	h.server.BeginShutdown()
+	if status := h.admin(http.MethodGet, "/ready", nil, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("GET /ready during shutdown = %d, want 503", status)
+	}
+	// The process is still alive, only draining
+	if status := h.admin(http.MethodGet, "/health", nil, nil); status != http.StatusOK {
+		t.Fatalf("GET /health during shutdown = %d, want 200", status)
+	}
+}
+
+// readyCertManager is a certificate manager whose readiness is set by the test
+type readyCertManager struct{ err error }
+
+func (m *readyCertManager) GetTLSConfig() *tls.Config             { return &tls.Config{} }
+func (m *readyCertManager) GetTLSConfigForHijacking() *tls.Config { return &tls.Config{} }
+func (m *readyCertManager) Ready() error                          { return m.err }
+
+// Until the initial certificate is obtained the server is not ready
+func TestReadyWaitsForCertificate(t *testing.T) {
+	certs := &readyCertManager{err: errors.New("waiting for the certificate")}
+	s := NewServer(testkit.Config(), tunnel.NewRegistry(0), certs)
+	l := testkit.ServeInMemory(t, s.Handler())
+	client := &http.Client{Timeout: testkit.Timeout, Transport: &http.Transport{DialContext: l.DialContext}}
+
+	for _, want := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		resp, err := client.Get("http://" + testkit.Domain + "/ready")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("GET /ready with certificate error %v = %d, want %d", certs.err, resp.StatusCode, want)
+		}
+		certs.err = nil
+	}
+}
+
+func TestDenylistRefusesClients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist")
+	if err := os.WriteFile(path, []byte("203.0.113.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	denylist, err := ipfilter.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testkit.Config()
+	// Sources are taken from X-Forwarded-For, set by the test
+	cfg.TrustedHops = 1
+	h := newHarness(t, cfg)
+	h.server.SetDenylist(denylist)
+	denied := testutil.ToFloat64(metrics.ControlDenied)
+
+	for ip, status := range map[string]int{
+		"203.0.113.7":  http.StatusForbidden,
+		"198.51.100.7": http.StatusSwitchingProtocols,
+	} {
+		conn, resp, err := testkit.DialWebSocket(h.control, "/tunnel", http.Header{"X-Forwarded-For": {ip}})
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("%s: dial: %v", ip, err)
+		}
+		if resp.StatusCode != status {
+			t.Errorf("%s: status = %d, want %d", ip, resp.StatusCode, status)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.ControlDenied) - denied; got != 1 {
+		t.Fatalf("denied counter grew by %v, want 1", got)
+	}
+
+	// Reloading applies to new connections
+	if err := os.WriteFile(path, []byte("198.51.100.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := denylist.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, resp, _ := testkit.DialWebSocket(h.control, "/tunnel", http.Header{"X-Forwarded-For": {"198.51.100.7"}}); resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("a source added by reload was let in")
+	}
+}
+
+// Shutdown waits for in-flight requests only as long as its context allows
+func TestShutdownRespectsDeadline(t *testing.T) {
+	const budget = 200 * time.Millisecond
+
+	for _, tt := range []struct {
+		name   string
+		finish bool // whether the request completes within the budget
+	}{
+		{"request completes", true},
+		{"request outlives the budget", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testkit.Config()
+			cfg.AdminToken = testAdminToken
+			s := NewServer(cfg, tunnel.NewRegistry(0), nil)
+			active := make(chan struct{}, 1)
+			s.server.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateActive {
+					active <- struct{}{}
+				}
+			}
+			l := testkit.NewMemListener()
+			go s.server.Serve(l)
+			t.Cleanup(func() { s.server.Close() })
+
+			// An import whose body hasn't fully arrived keeps the request in flight
+			conn, err := l.DialContext(context.Background(), "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			body := `{"tunnels":[]}`
+			fmt.Fprintf(conn, "POST /api/registry/import HTTP/1.1\r\nHost: %s\r\nAuthorization: Bearer %s\r\nContent-Length: %d\r\n\r\n{",
+				testkit.Domain, testAdminToken, len(body))
+			select {
+			case <-active:
+			case <-time.After(testkit.Timeout):
+				t.Fatal("request never became active")
+			}
+
+			if tt.finish {
+				time.AfterFunc(budget/4, func() { io.WriteString(conn, body[1:]) })
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), budget)
+			defer cancel()
+			start := time.Now()
+			err = s.Shutdown(ctx)
+			elapsed := time.Since(start)
+
+			if tt.finish {
+				if err != nil {
+					t.Fatalf("Shutdown = %v, want nil", err)
+				}
+				if elapsed >= budget {
+					t.Fatalf("Shutdown took %s, want less than the %s budget", elapsed, budget)
+				}
+				return
+			}
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+			}
+			if elapsed < budget || elapsed > budget+time.Second {
+				t.Fatalf("Shutdown took %s, want about the %s budget", elapsed, budget)
+			}
+			// The request still in flight is cut off
+			conn.SetReadDeadline(time.Now().Add(testkit.Timeout))
+			if _, err := io.ReadAll(conn); err != nil {
+				t.Fatalf("connection was not closed: %v", err)
+			}
+		})
+	}
+}
+
+// A client that stops answering pings, as behind a half-open TCP
+// connection, has its tunnel unregistered once the pong deadline passes
+func TestUnresponsiveClientIsDisconnected(t *testing.T) {
+	h := newHarness(t, testkit.Config())
+	h.server.pongWait = 200 * time.Millisecond
+
+	responsive := h.connect(nil)
+	responsive.register(RegisterRequest{Subdomain: "alive"})
+
+	// Register, then never read again, so pings go unanswered
+	stalled := testkit.DialInMemory(t, h.control, "/tunnel", nil)
+	if err := stalled.WriteJSON(Message{Type: MessageTypeRegister, Data: []byte(`{"subdomain":"stalled","local_port":3000}`)}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	testkit.WaitFor(t, "stalled tunnel to register", func() bool {
+		_, ok := h.registry.Get("stalled")
+		return ok
+	})
+
+	testkit.WaitFor(t, "stalled tunnel to be unregistered", func() bool {
+		_, ok := h.registry.Get("stalled")
+		return !ok
+	})
+	time.Sleep(3 * h.server.pongWait)
+	if _, ok := h.registry.Get("alive"); !ok {
+		t.Fatal("a client answering pings was disconnected")
+	}
+}